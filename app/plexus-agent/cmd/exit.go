@@ -0,0 +1,57 @@
+/*
+Copyright © 2024 Matthew R Kasun <mkasun@nusak.ca>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/devilcove/plexus"
+	"github.com/devilcove/plexus/internal/agent"
+	"github.com/spf13/cobra"
+)
+
+// exitCmd represents the exit command.
+var exitCmd = &cobra.Command{
+	Use:   "exit network [exit node]",
+	Args:  cobra.RangeArgs(1, 2),
+	Short: "route internet traffic through an exit node",
+	Long: `route all internet traffic of the device through an exit node
+(by name or public key) of the network. Without an exit node, stop
+using the exit node of the network. Only one exit node is used at a time.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		request := plexus.ExitNodeRequest{Network: args[0]}
+		if len(args) > 1 {
+			request.ExitNode = args[1]
+		}
+		resp := plexus.MessageResponse{}
+		ec, err := agent.ConnectToAgentBroker()
+		cobra.CheckErr(err)
+		defer ec.Close()
+		cobra.CheckErr(
+			agent.Request(ec, agent.Agent+plexus.SetExitNode, request, &resp, agent.NatsTimeout),
+		)
+		fmt.Println(resp.Message)
+		if resp.IncludesError {
+			fmt.Println("error:", resp.Error)
+			os.Exit(1)
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(exitCmd)
+}
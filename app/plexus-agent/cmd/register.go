@@ -29,7 +29,8 @@ var registerCmd = &cobra.Command{
 	Use:   "register token",
 	Args:  cobra.ExactArgs(1),
 	Short: "register with a plexus server",
-	Long:  `register with a plexus server using token`,
+	Long: `register with a plexus server using token
+if the token requires approval, waits for an admin to approve the device`,
 	Run: func(cmd *cobra.Command, args []string) {
 		request := plexus.RegisterRequest{
 			Token: args[0],
@@ -39,7 +40,8 @@ var registerCmd = &cobra.Command{
 		defer ec.Close()
 		resp := plexus.MessageResponse{}
 		cobra.CheckErr(
-			agent.Request(ec, agent.Agent+plexus.Register, request, &resp, agent.NatsTimeout),
+			agent.Request(ec, agent.Agent+plexus.Register, request, &resp,
+				agent.ApprovalTimeout+agent.NatsLongTimeout),
 		)
 		fmt.Println(resp.Message)
 		if resp.IncludesError {
@@ -55,6 +55,8 @@ func init() {
 	// will be global for your application.
 
 	agent.Config.NatsPort = *rootCmd.PersistentFlags().IntP("natsport", "p", 4223, "nats port for cli <-> agent comms")
+	rootCmd.PersistentFlags().StringSliceVar(&agent.Config.StunServers, "stun", agent.DefaultStunServers,
+		"stun servers (host:port) used when the server's stun server is not available")
 	// Cobra also supports local flags, which will only run
 	// when this action is called directly.
 	// rootCmd.Flags().BoolP("toggle", "t", false, "Help message for toggle")
@@ -0,0 +1,53 @@
+/*
+Copyright © 2024 Matthew R Kasun <mkasun@nusak.ca>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/devilcove/plexus"
+	"github.com/devilcove/plexus/internal/agent"
+	"github.com/spf13/cobra"
+)
+
+// rotateCmd represents the rotate command.
+var rotateCmd = &cobra.Command{
+	Use:   "rotate",
+	Args:  cobra.NoArgs,
+	Short: "rotate device keys",
+	Long: `generates new wireguard and nats keys for the device and
+replaces the old keys on the server and in all networks`,
+
+	Run: func(cmd *cobra.Command, args []string) {
+		fmt.Println("rotating keys")
+		ec, err := agent.ConnectToAgentBroker()
+		cobra.CheckErr(err)
+		resp := plexus.MessageResponse{}
+		cobra.CheckErr(
+			agent.Request(ec, agent.Agent+plexus.RotateKeys, nil, &resp, agent.NatsTimeout*2),
+		)
+		fmt.Println(resp.Message)
+		if resp.IncludesError {
+			fmt.Println("error:", resp.Error)
+			os.Exit(1)
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(rotateCmd)
+}
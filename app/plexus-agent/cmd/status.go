@@ -109,10 +109,20 @@ var statusCmd = &cobra.Command{
 					relayed = "(relayed)"
 				}
 				color.Yellow("peer: %s %s %s %s", peer.WGPublicKey, peer.HostName, peer.Address.IP, relayed)
+				if peer.Address6.IP != nil {
+					fmt.Println("\tipv6:", peer.Address6.IP)
+				}
 				if peer.IsRelay {
 					fmt.Println("\trelay: true")
 					showRelayedPeers(peer.RelayedPeers, network)
 				}
+				if peer.IsExitNode {
+					inUse := ""
+					if self.ExitNode == peer.WGPublicKey {
+						inUse = "(in use)"
+					}
+					fmt.Println("\texit node: true", inUse)
+				}
 				fmt.Println(
 					"\tprivate-endpoint:",
 					peer.PrivateEndpoint.String()+":",
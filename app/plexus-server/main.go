@@ -1,7 +1,66 @@
 package main
 
-import "github.com/devilcove/plexus/internal/server"
+import (
+	"fmt"
+	"os"
+
+	"github.com/devilcove/plexus/internal/server"
+)
+
+const usage = `usage:
+  plexus-server                   run the server
+  plexus-server backup <file>     save a backup of the running server (api token in PLEXUS_TOKEN)
+  plexus-server restore <file>    restore a backup and run the server
+  plexus-server export <file>     save the topology of the running server as yaml or json
+  plexus-server plan <file>       show the changes applying a topology would make
+  plexus-server apply <file>      apply a topology to the running server`
 
 func main() {
+	if len(os.Args) > 1 {
+		if len(os.Args) != 3 {
+			fmt.Println(usage)
+			os.Exit(1)
+		}
+		switch os.Args[1] {
+		case "backup":
+			if err := server.Backup(os.Args[2]); err != nil {
+				fmt.Println("backup:", err)
+				os.Exit(1)
+			}
+			fmt.Println("backup saved to", os.Args[2])
+			return
+		case "restore":
+			if err := server.Restore(os.Args[2]); err != nil {
+				fmt.Println("restore:", err)
+				os.Exit(1)
+			}
+			fmt.Println("restored", os.Args[2])
+			// run the server with the restored database.
+			os.Args = os.Args[:1]
+		case "export":
+			if err := server.Export(os.Args[2]); err != nil {
+				fmt.Println("export:", err)
+				os.Exit(1)
+			}
+			fmt.Println("topology saved to", os.Args[2])
+			return
+		case "plan", "apply":
+			changes, err := server.Apply(os.Args[2], os.Args[1] == "plan")
+			for _, change := range changes {
+				fmt.Println(change.Action, change.Target)
+			}
+			if err != nil {
+				fmt.Println(os.Args[1]+":", err)
+				os.Exit(1)
+			}
+			if len(changes) == 0 {
+				fmt.Println("no changes")
+			}
+			return
+		default:
+			fmt.Println(usage)
+			os.Exit(1)
+		}
+	}
 	server.Run()
 }
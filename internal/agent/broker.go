@@ -6,6 +6,7 @@ import (
 	"log/slog"
 	"net"
 	"runtime/debug"
+	"slices"
 	"strings"
 	"time"
 
@@ -101,6 +102,12 @@ func subcribe(agentConn *nats.Conn) {
 	_, _ = agentConn.Subscribe(Agent+plexus.SetPrivateEndpoint, func(msg *nats.Msg) {
 		setPrivateEndpoint(msg, agentConn)
 	})
+	_, _ = agentConn.Subscribe(Agent+plexus.RotateKeys, func(msg *nats.Msg) {
+		sendRotateKeys(msg, agentConn)
+	})
+	_, _ = agentConn.Subscribe(Agent+plexus.SetExitNode, func(msg *nats.Msg) {
+		setExitNode(msg, agentConn)
+	})
 }
 
 func ConnectToAgentBroker() (*nats.Conn, error) {
@@ -137,6 +144,7 @@ func subcribeToServerTopics(self Device) {
 			closeServerConnections()
 			deleteAllInterfaces()
 			deleteAllNetworks()
+			refreshDNS()
 		},
 	)
 	if err != nil {
@@ -175,6 +183,19 @@ func subcribeToServerTopics(self Device) {
 		slog.Error("delete router subscription", "error", err)
 	}
 	subscriptions = append(subscriptions, delRouter)
+	rotate, err := serverConn.Subscribe(plexus.Update+id+plexus.RotateKeys,
+		func(msg *nats.Msg) {
+			serverRotateKeys(msg, serverConn)
+		})
+	if err != nil {
+		slog.Error("rotate keys subscription", "error", err)
+	}
+	subscriptions = append(subscriptions, rotate)
+	psk, err := serverConn.Subscribe(plexus.Update+id+plexus.PresharedKeys, presharedKeysUpdate)
+	if err != nil {
+		slog.Error("preshared keys subscription", "error", err)
+	}
+	subscriptions = append(subscriptions, psk)
 }
 
 func createRegistationConnection(key plexus.KeyValue) (*nats.Conn, error) {
@@ -190,13 +211,44 @@ func createRegistationConnection(key plexus.KeyValue) (*nats.Conn, error) {
 		return loginKeyPair.Sign(nonce)
 	}
 	opts := nats.Options{
-		Url:         "nats://" + key.URL + ":4222",
+		Url:         serverURL(key.URL),
+		Servers:     clusterURLs(key),
 		Nkey:        loginPublicKey,
 		SignatureCB: sign,
 	}
 	return opts.Connect()
 }
 
+// serverURL returns the url of the broker of the server with fqdn.
+func serverURL(fqdn string) string {
+	return "nats://" + net.JoinHostPort(fqdn, "4222")
+}
+
+// clusterURLs returns the urls of all the servers of the cluster of the
+// server of a registration key, or none when it is not clustered.
+func clusterURLs(key plexus.KeyValue) []string {
+	if len(key.Servers) == 0 {
+		return nil
+	}
+	urls := []string{serverURL(key.URL)}
+	for _, fqdn := range key.Servers {
+		urls = append(urls, serverURL(fqdn))
+	}
+	return urls
+}
+
+// serverURLs returns the urls the device connects to: its server first, then
+// the other servers of its cluster so the connection fails over to them.
+func serverURLs(self Device) string {
+	urls := []string{self.Server}
+	for _, url := range self.Servers {
+		if !slices.Contains(urls, url) {
+			urls = append(urls, url)
+		}
+	}
+	return strings.Join(urls, ",")
+}
+
 func Request(conn *nats.Conn, subj string, request any, response any, timeout time.Duration) error {
 	data, err := json.Marshal(request)
 	if err != nil {
@@ -325,6 +377,7 @@ func sendReset(msg *nats.Msg, agentConn *nats.Conn) {
 		publish.ErrorMessage(agentConn, msg.Reply, "start interface "+network.Interface, err)
 		return
 	}
+	refreshDNS()
 	publish.Message(agentConn, msg.Reply, plexus.MessageResponse{Message: "interfaces reset"})
 }
 
@@ -355,5 +408,7 @@ func sendRelaad(msg *nats.Msg, agentConn *nats.Conn) {
 		slog.Error("save networks", "error", err)
 	}
 	startAllInterfaces(self)
+	requestPresharedKeys()
+	refreshDNS()
 	// addNewNetworks(self, resp.Networks).
 }
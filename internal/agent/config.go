@@ -16,23 +16,30 @@ const (
 	NatsLongTimeout       = time.Second * 15
 	checkinTime           = time.Minute * 1
 	serverCheckTime       = time.Minute * 3
+	natCheckTime          = time.Minute * 15
 	connectivityTimeout   = time.Minute * 3
 	endpointServerTimeout = time.Second * 30
+	ApprovalTimeout       = time.Minute * 10
+	approvalInterval      = time.Second * 5
 	// networkNotMapped      = "network not mapped to server".
 	networkTable = "networks"
 	deviceTable  = "devices"
 )
 
 var (
-	Config        Configuration
-	serverConn    atomic.Pointer[nats.Conn]
-	subscriptions []*nats.Subscription
+	// DefaultStunServers are the public STUN servers used when the server's
+	// STUN server is not available.
+	DefaultStunServers = []string{"stun1.l.google.com:19302", "stun.cloudflare.com:3478"}
+	Config             Configuration
+	serverConn         atomic.Pointer[nats.Conn]
+	subscriptions      []*nats.Subscription
 	// errors.
 	ErrNetNotMapped = errors.New("network not mapped to server")
 	ErrNotConnected = errors.New("not connected to server")
 )
 
 type Configuration struct {
-	NatsPort int
-	DataDir  string
+	NatsPort    int
+	DataDir     string
+	StunServers []string
 }
@@ -34,16 +34,18 @@ func Run() {
 		slog.Error("new device", "error", err)
 	}
 	ns, ec := startBroker()
-	if err := connectToServer(self); err != nil {
+	if self, err = reconnect(self); err != nil {
 		slog.Error("connect to server", "error", err)
 	}
 	startAllInterfaces(self)
+	refreshDNS()
 	checkinTicker := time.NewTicker(checkinTime)
 	serverTicker := time.NewTicker(serverCheckTime)
 	wg := &sync.WaitGroup{}
-	wg.Add(1)
+	wg.Add(2)
 	ctx, cancel := context.WithCancel(context.Background())
 	go privateEndpointServer(ctx, wg)
+	go startDNS(ctx, wg)
 	for {
 		select {
 		case <-quit:
@@ -51,6 +53,8 @@ func Run() {
 			cancel()
 			slog.Info("deleting wg interfaces")
 			deleteAllInterfaces()
+			slog.Info("stopping dns")
+			restoreDNS()
 			slog.Info("stopping tickers")
 			checkinTicker.Stop()
 			// serverTicker.Stop().
@@ -71,7 +75,11 @@ func Run() {
 			slog.Debug("check server connection")
 			if serverConn.Load() == nil {
 				slog.Info("not connected to server.... retrying")
-				if err := connectToServer(self); err != nil {
+				// keys may have been rotated since startup.
+				if current, err := boltdb.Get[Device]("self", deviceTable); err == nil {
+					self = current
+				}
+				if self, err = reconnect(self); err != nil {
 					slog.Error("server connection", "error", err)
 				} else {
 					slog.Info("connected to server")
@@ -80,9 +88,10 @@ func Run() {
 		case <-restartEndpointServer:
 			cancel()
 			wg.Wait()
-			wg.Add(1)
+			wg.Add(2)
 			ctx, cancel = context.WithCancel(context.Background())
 			go privateEndpointServer(ctx, wg)
+			go startDNS(ctx, wg)
 		}
 	}
 }
@@ -120,13 +129,14 @@ func connectToServer(self Device) error {
 		}),
 		nats.Nkey(publicKey, sign),
 	}...)
-	slog.Debug("connecting to server", "url", self.Server)
-	nc, err := nats.Connect(self.Server, opts...)
+	slog.Debug("connecting to server", "url", self.Server, "cluster", self.Servers)
+	nc, err := nats.Connect(serverURLs(self), opts...)
 	if err != nil {
 		return err
 	}
 	serverConn.Store(nc)
 	subcribeToServerTopics(self)
+	requestPresharedKeys()
 	return nil
 }
 
@@ -136,6 +146,7 @@ func closeServerConnections() {
 			slog.Error("drain subscription", "sub", sub.Subject, "error", err)
 		}
 	}
+	subscriptions = nil
 	ec := serverConn.Load()
 	if ec != nil {
 		ec.Close()
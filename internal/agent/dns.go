@@ -0,0 +1,304 @@
+package agent
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+
+	"github.com/devilcove/boltdb"
+	"github.com/miekg/dns"
+)
+
+const (
+	dnsDomain   = "plexus."
+	dnsAddress  = "127.0.0.153"
+	dnsTTL      = 60
+	resolvedRun = "/run/systemd/resolve"
+)
+
+// resolvConf is the resolver configuration rewritten when systemd-resolved is not running.
+var resolvConf = "/etc/resolv.conf"
+
+// resolver answers <host>.<network>.plexus queries from the cached network peers.
+// Other queries are forwarded to upstreams, the name servers of the original
+// resolv.conf, when the agent manages resolv.conf; and refused otherwise.
+type resolver struct {
+	mu        sync.RWMutex
+	records   map[string][]net.IP
+	upstreams []string
+}
+
+var dnsResolver = &resolver{}
+
+// dnsLabel converts a host or network name to a dns label.
+func dnsLabel(name string) string {
+	label := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9', r == '-':
+			return r
+		case r >= 'A' && r <= 'Z':
+			return r + 'a' - 'A'
+		default:
+			return '-'
+		}
+	}, name)
+	return strings.Trim(label, "-")
+}
+
+// networkDomain returns the dns domain of a network.
+func networkDomain(network string) string {
+	return dnsLabel(network) + "." + dnsDomain
+}
+
+// update replaces the records with those of the network peers.
+func (r *resolver) update(networks []Network) {
+	records := make(map[string][]net.IP)
+	for _, network := range networks {
+		for _, peer := range network.Peers {
+			host := dnsLabel(peer.HostName)
+			if host == "" {
+				continue
+			}
+			name := host + "." + networkDomain(network.Name)
+			for _, address := range peer.Addresses() {
+				records[name] = append(records[name], address.IP)
+			}
+		}
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.records = records
+}
+
+func (r *resolver) setUpstreams(upstreams []string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.upstreams = upstreams
+}
+
+// answer returns the records of a name for a query type and whether the name exists.
+func (r *resolver) answer(question dns.Question) ([]dns.RR, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	addresses, ok := r.records[strings.ToLower(question.Name)]
+	if !ok {
+		return nil, false
+	}
+	answers := []dns.RR{}
+	header := dns.RR_Header{Name: question.Name, Class: dns.ClassINET, Ttl: dnsTTL}
+	for _, address := range addresses {
+		if ip4 := address.To4(); ip4 != nil && question.Qtype == dns.TypeA {
+			header.Rrtype = dns.TypeA
+			answers = append(answers, &dns.A{Hdr: header, A: ip4})
+		} else if ip4 == nil && question.Qtype == dns.TypeAAAA {
+			header.Rrtype = dns.TypeAAAA
+			answers = append(answers, &dns.AAAA{Hdr: header, AAAA: address})
+		}
+	}
+	return answers, true
+}
+
+func (r *resolver) ServeDNS(w dns.ResponseWriter, request *dns.Msg) {
+	response := new(dns.Msg)
+	if len(request.Question) != 1 {
+		response.SetRcode(request, dns.RcodeFormatError)
+		r.reply(w, response)
+		return
+	}
+	question := request.Question[0]
+	if !dns.IsSubDomain(dnsDomain, strings.ToLower(question.Name)) {
+		r.forward(w, request)
+		return
+	}
+	response.SetReply(request)
+	response.Authoritative = true
+	answers, ok := r.answer(question)
+	if !ok {
+		response.SetRcode(request, dns.RcodeNameError)
+	}
+	response.Answer = answers
+	r.reply(w, response)
+}
+
+func (r *resolver) forward(w dns.ResponseWriter, request *dns.Msg) {
+	r.mu.RLock()
+	upstreams := r.upstreams
+	r.mu.RUnlock()
+	for _, upstream := range upstreams {
+		response, err := dns.Exchange(request, net.JoinHostPort(upstream, "53"))
+		if err != nil {
+			slog.Debug("forward dns query", "upstream", upstream, "error", err)
+			continue
+		}
+		r.reply(w, response)
+		return
+	}
+	response := new(dns.Msg)
+	response.SetRcode(request, dns.RcodeRefused)
+	r.reply(w, response)
+}
+
+func (r *resolver) reply(w dns.ResponseWriter, response *dns.Msg) {
+	if err := w.WriteMsg(response); err != nil {
+		slog.Debug("dns reply", "error", err)
+	}
+}
+
+// startDNS runs the agent resolver until ctx is cancelled. The sockets are
+// bound before serving so that they are released on cancel even when the
+// servers did not start yet.
+func startDNS(ctx context.Context, wg *sync.WaitGroup) {
+	defer wg.Done()
+	address := net.JoinHostPort(dnsAddress, "53")
+	conn, err := net.ListenPacket("udp", address)
+	if err != nil {
+		slog.Error("dns server", "proto", "udp", "error", err)
+		return
+	}
+	defer conn.Close()
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		slog.Error("dns server", "proto", "tcp", "error", err)
+		return
+	}
+	defer listener.Close()
+	servers := []*dns.Server{
+		{PacketConn: conn, Handler: dnsResolver},
+		{Listener: listener, Handler: dnsResolver},
+	}
+	for _, server := range servers {
+		go func() {
+			if err := server.ActivateAndServe(); err != nil && ctx.Err() == nil {
+				slog.Error("dns server", "error", err)
+			}
+		}()
+	}
+	<-ctx.Done()
+	for _, server := range servers {
+		if err := server.Shutdown(); err != nil {
+			slog.Debug("dns server shutdown", "error", err)
+		}
+	}
+}
+
+// refreshDNS reloads the dns records from the saved networks and configures the
+// host to send queries for the network domains to the agent resolver.
+func refreshDNS() {
+	networks, err := boltdb.GetAll[Network](networkTable)
+	if err != nil {
+		slog.Error("get networks for dns", "error", err)
+		return
+	}
+	dnsResolver.update(networks)
+	if useResolved() {
+		for _, network := range networks {
+			if err := resolvectl("dns", network.Interface, dnsAddress); err != nil {
+				slog.Error("set link dns", "interface", network.Interface, "error", err)
+				continue
+			}
+			if err := resolvectl("domain", network.Interface, "~"+strings.TrimSuffix(
+				networkDomain(network.Name), ".")); err != nil {
+				slog.Error("set link dns domain", "interface", network.Interface, "error", err)
+			}
+		}
+		return
+	}
+	if len(networks) == 0 {
+		restoreDNS()
+		return
+	}
+	upstreams, err := setResolvConf(resolvConf, backupResolvConf())
+	if err != nil {
+		slog.Error("configure resolv.conf", "error", err)
+		return
+	}
+	dnsResolver.setUpstreams(upstreams)
+}
+
+// restoreDNS restores the original resolv.conf, if the agent replaced it. Link
+// settings of systemd-resolved are removed with the interfaces.
+func restoreDNS() {
+	if err := restoreResolvConf(resolvConf, backupResolvConf()); err != nil {
+		slog.Error("restore resolv.conf", "error", err)
+	}
+	dnsResolver.setUpstreams(nil)
+}
+
+func useResolved() bool {
+	if _, err := exec.LookPath("resolvectl"); err != nil {
+		return false
+	}
+	_, err := os.Stat(resolvedRun)
+	return err == nil
+}
+
+func resolvectl(args ...string) error {
+	out, err := exec.Command("resolvectl", args...).CombinedOutput()
+	if err != nil {
+		return errors.New(strings.TrimSpace(string(out)) + " " + err.Error())
+	}
+	return nil
+}
+
+func backupResolvConf() string {
+	return Config.DataDir + "resolv.conf"
+}
+
+// setResolvConf saves the original resolv.conf to backup, once, and rewrites it
+// with the agent resolver as first name server. It returns the original name servers.
+func setResolvConf(path, backup string) ([]string, error) {
+	if _, err := os.Stat(backup); errors.Is(err, os.ErrNotExist) {
+		original, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		if err := os.WriteFile(backup, original, 0o644); err != nil {
+			return nil, err
+		}
+	}
+	original, err := os.ReadFile(backup)
+	if err != nil {
+		return nil, err
+	}
+	content := "# generated by plexus-agent; the original is saved in " + backup + "\n" +
+		"nameserver " + dnsAddress + "\n" + string(original)
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		return nil, err
+	}
+	return nameServers(string(original)), nil
+}
+
+// restoreResolvConf restores the original resolv.conf saved in backup.
+func restoreResolvConf(path, backup string) error {
+	original, err := os.ReadFile(backup)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(path, original, 0o644); err != nil {
+		return err
+	}
+	return os.Remove(backup)
+}
+
+// nameServers returns the name servers of a resolv.conf, other than the agent resolver.
+func nameServers(content string) []string {
+	servers := []string{}
+	scanner := bufio.NewScanner(strings.NewReader(content))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 || fields[0] != "nameserver" || fields[1] == dnsAddress {
+			continue
+		}
+		servers = append(servers, fields[1])
+	}
+	return servers
+}
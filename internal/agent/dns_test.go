@@ -0,0 +1,146 @@
+package agent
+
+import (
+	"context"
+	"net"
+	"os"
+	"os/user"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Kairum-Labs/should"
+	"github.com/devilcove/plexus"
+	"github.com/miekg/dns"
+)
+
+func TestDNSLabel(t *testing.T) {
+	for name, label := range map[string]string{
+		"laptop":       "laptop",
+		"My Laptop":    "my-laptop",
+		"host.example": "host-example",
+		"_build_":      "build",
+	} {
+		should.BeEqual(t, dnsLabel(name), label)
+	}
+}
+
+func TestResolver(t *testing.T) {
+	_, v4, _ := net.ParseCIDR("10.100.0.0/24")
+	_, v6, _ := net.ParseCIDR("fd00:100::/64")
+	r := &resolver{}
+	r.update([]Network{{Network: plexus.Network{
+		Name: "office",
+		Peers: []plexus.NetworkPeer{
+			{
+				HostName: "Laptop",
+				Address:  net.IPNet{IP: net.ParseIP("10.100.0.2"), Mask: v4.Mask},
+				Address6: net.IPNet{IP: net.ParseIP("fd00:100::2"), Mask: v6.Mask},
+			},
+			{
+				HostName: "server",
+				Address:  net.IPNet{IP: net.ParseIP("10.100.0.3"), Mask: v4.Mask},
+			},
+		},
+	}}})
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	should.NotBeError(t, err)
+	server := &dns.Server{PacketConn: conn, Handler: r}
+	started := make(chan struct{})
+	server.NotifyStartedFunc = func() { close(started) }
+	go func() {
+		_ = server.ActivateAndServe()
+	}()
+	defer func() {
+		_ = server.Shutdown()
+	}()
+	<-started
+	query := func(name string, qtype uint16) *dns.Msg {
+		t.Helper()
+		request := new(dns.Msg)
+		request.SetQuestion(name, qtype)
+		response, err := dns.Exchange(request, conn.LocalAddr().String())
+		should.NotBeError(t, err)
+		return response
+	}
+
+	t.Run("a", func(t *testing.T) {
+		response := query("laptop.office.plexus.", dns.TypeA)
+		should.BeEqual(t, response.Rcode, dns.RcodeSuccess)
+		should.BeEqual(t, len(response.Answer), 1)
+		should.BeEqual(t, response.Answer[0].(*dns.A).A.String(), "10.100.0.2")
+	})
+	t.Run("aaaa", func(t *testing.T) {
+		response := query("LAPTOP.office.plexus.", dns.TypeAAAA)
+		should.BeEqual(t, len(response.Answer), 1)
+		should.BeEqual(t, response.Answer[0].(*dns.AAAA).AAAA.String(), "fd00:100::2")
+		response = query("server.office.plexus.", dns.TypeAAAA)
+		should.BeEqual(t, response.Rcode, dns.RcodeSuccess)
+		should.BeEqual(t, len(response.Answer), 0)
+	})
+	t.Run("unknown", func(t *testing.T) {
+		response := query("printer.office.plexus.", dns.TypeA)
+		should.BeEqual(t, response.Rcode, dns.RcodeNameError)
+	})
+	t.Run("other", func(t *testing.T) {
+		// without upstreams, queries outside the plexus domain are refused.
+		response := query("example.com.", dns.TypeA)
+		should.BeEqual(t, response.Rcode, dns.RcodeRefused)
+	})
+}
+
+func TestResolvConf(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "resolv.conf")
+	backup := filepath.Join(dir, "resolv.conf.orig")
+	original := "search example.com\nnameserver 192.168.1.1\nnameserver 1.1.1.1\n"
+	should.NotBeError(t, os.WriteFile(path, []byte(original), 0o644))
+
+	upstreams, err := setResolvConf(path, backup)
+	should.NotBeError(t, err)
+	should.BeEqual(t, upstreams, []string{"192.168.1.1", "1.1.1.1"})
+	// a second call keeps the saved original.
+	upstreams, err = setResolvConf(path, backup)
+	should.NotBeError(t, err)
+	should.BeEqual(t, upstreams, []string{"192.168.1.1", "1.1.1.1"})
+	content, err := os.ReadFile(path)
+	should.NotBeError(t, err)
+	should.BeEqual(t, nameServers(string(content)), []string{"192.168.1.1", "1.1.1.1"})
+	should.ContainSubstring(t, string(content), "nameserver "+dnsAddress+"\n")
+
+	should.NotBeError(t, restoreResolvConf(path, backup))
+	content, err = os.ReadFile(path)
+	should.NotBeError(t, err)
+	should.BeEqual(t, string(content), original)
+	_, err = os.Stat(backup)
+	should.BeTrue(t, os.IsNotExist(err))
+	should.NotBeError(t, restoreResolvConf(path, backup))
+}
+
+func TestStartDNS(t *testing.T) {
+	user, err := user.Current()
+	should.NotBeError(t, err)
+	if user.Uid != "0" {
+		t.Log("this test must be run as root")
+		t.Skip()
+	}
+	address := net.JoinHostPort(dnsAddress, "53")
+	// a resolver stopped right after it is started releases its sockets.
+	for range 5 {
+		ctx, cancel := context.WithCancel(context.Background())
+		wg := &sync.WaitGroup{}
+		wg.Add(1)
+		go startDNS(ctx, wg)
+		cancel()
+		wg.Wait()
+	}
+	// servers left running would have bound their sockets by now.
+	time.Sleep(time.Millisecond * 100)
+	conn, err := net.ListenPacket("udp", address)
+	should.NotBeError(t, err)
+	should.NotBeError(t, conn.Close())
+	listener, err := net.Listen("tcp", address)
+	should.NotBeError(t, err)
+	should.NotBeError(t, listener.Close())
+}
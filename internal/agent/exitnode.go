@@ -0,0 +1,102 @@
+package agent
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+
+	"github.com/devilcove/boltdb"
+	"github.com/devilcove/plexus"
+	"github.com/devilcove/plexus/internal/publish"
+	"github.com/nats-io/nats.go"
+)
+
+// setExitNode handles the choice of an exit node made with the cli.
+func setExitNode(msg *nats.Msg, agentConn *nats.Conn) {
+	request := plexus.ExitNodeRequest{}
+	if err := json.Unmarshal(msg.Data, &request); err != nil {
+		slog.Error("invalid exit node request", "error", err, "data", string(msg.Data))
+		publish.ErrorMessage(agentConn, msg.Reply, "invalid request", err)
+		return
+	}
+	response, err := chooseExitNode(request)
+	if err != nil {
+		slog.Error("set exit node", "error", err)
+		publish.ErrorMessage(agentConn, msg.Reply, "set exit node", err)
+		return
+	}
+	publish.Message(agentConn, msg.Reply, response)
+}
+
+// chooseExitNode sets the exit node of the device in a network. A device uses
+// one exit node at a time so the exit node chosen in any other network is
+// cleared. The choice is saved on the server.
+func chooseExitNode(request plexus.ExitNodeRequest) (plexus.MessageResponse, error) {
+	response := plexus.MessageResponse{}
+	self, err := boltdb.Get[Device]("self", deviceTable)
+	if err != nil {
+		return response, err
+	}
+	network, err := boltdb.Get[Network](request.Network, networkTable)
+	if err != nil {
+		return response, errors.New("no such network " + request.Network)
+	}
+	exitNode := ""
+	if request.ExitNode != "" {
+		exitNode, err = findExitNode(network, self, request.ExitNode)
+		if err != nil {
+			return response, err
+		}
+	}
+	if serverConn.Load() == nil {
+		return response, ErrNotConnected
+	}
+	networks, err := boltdb.GetAll[Network](networkTable)
+	if err != nil {
+		return response, err
+	}
+	for _, network := range networks {
+		choice := ""
+		if network.Name == request.Network {
+			choice = exitNode
+		}
+		for i, peer := range network.Peers {
+			if peer.WGPublicKey != self.WGPublicKey || peer.ExitNode == choice {
+				continue
+			}
+			network.Peers[i].ExitNode = choice
+			if err := publishNetworkPeerUpdate(self, &network.Peers[i]); err != nil {
+				return response, err
+			}
+			if err := boltdb.Save(network, network.Name, networkTable); err != nil {
+				return response, err
+			}
+			if err := resetPeersOnNetworkInterface(self, network); err != nil {
+				slog.Error("reset peers", "network", network.Name, "error", err)
+			}
+		}
+	}
+	response.Message = "exit node cleared"
+	if exitNode != "" {
+		response.Message = "using exit node " + request.ExitNode
+	}
+	return response, nil
+}
+
+// findExitNode returns the WGPublicKey of the exit node with the given name or
+// key in network.
+func findExitNode(network Network, self Device, name string) (string, error) {
+	for _, peer := range network.Peers {
+		if peer.WGPublicKey == self.WGPublicKey {
+			continue
+		}
+		if peer.HostName != name && peer.WGPublicKey != name {
+			continue
+		}
+		if !peer.IsExitNode {
+			return "", errors.New(name + " is not an exit node")
+		}
+		return peer.WGPublicKey, nil
+	}
+	return "", errors.New("no peer " + name + " in network " + network.Name)
+}
@@ -0,0 +1,60 @@
+package agent
+
+import (
+	"net"
+	"testing"
+
+	"github.com/Kairum-Labs/should"
+	"github.com/devilcove/plexus"
+)
+
+func TestExitNode(t *testing.T) {
+	_, self, err := generateKeys()
+	should.NotBeError(t, err)
+	_, exit, err := generateKeys()
+	should.NotBeError(t, err)
+	_, other, err := generateKeys()
+	should.NotBeError(t, err)
+	network := Network{}
+	network.Name = "exit"
+	network.Peers = []plexus.NetworkPeer{
+		{WGPublicKey: self.String(), HostName: "self", ExitNode: exit.String()},
+		{
+			WGPublicKey: exit.String(), HostName: "exit", IsExitNode: true,
+			Address: net.IPNet{IP: net.ParseIP("10.10.10.2").To4(), Mask: net.CIDRMask(32, 32)},
+		},
+		{
+			WGPublicKey: other.String(), HostName: "other",
+			Address: net.IPNet{IP: net.ParseIP("10.10.10.3").To4(), Mask: net.CIDRMask(32, 32)},
+		},
+	}
+	device := Device{}
+	device.WGPublicKey = self.String()
+
+	t.Run("allowedIPs", func(t *testing.T) {
+		peers := getWGPeers(device, network)
+		should.BeEqual(t, len(peers), 2)
+		should.BeEqual(t, len(peers[0].AllowedIPs), 2)
+		should.BeEqual(t, peers[0].AllowedIPs[1].String(), "0.0.0.0/0")
+		should.BeEqual(t, len(peers[1].AllowedIPs), 1)
+	})
+	t.Run("notChosen", func(t *testing.T) {
+		network.Peers[0].ExitNode = ""
+		defer func() { network.Peers[0].ExitNode = exit.String() }()
+		peers := getWGPeers(device, network)
+		should.BeEqual(t, len(peers[0].AllowedIPs), 1)
+	})
+	t.Run("find", func(t *testing.T) {
+		id, err := findExitNode(network, device, "exit")
+		should.NotBeError(t, err)
+		should.BeEqual(t, id, exit.String())
+		id, err = findExitNode(network, device, exit.String())
+		should.NotBeError(t, err)
+		should.BeEqual(t, id, exit.String())
+		_, err = findExitNode(network, device, "other")
+		should.BeError(t, err)
+		should.ContainSubstring(t, err.Error(), "not an exit node")
+		_, err = findExitNode(network, device, "self")
+		should.BeError(t, err)
+	})
+}
@@ -47,11 +47,19 @@ func networkUpdates(msg *nats.Msg) {
 	}
 	switch update.Action {
 	case plexus.AddPeer:
-		processAddPeer(network, update, wg)
+		processAddPeer(network, update, self, wg)
+		refreshPolicies(self, network.Name)
 	case plexus.DeletePeer:
 		processDeletePeer(network, update, self, wg)
+		refreshPolicies(self, network.Name)
 	case plexus.UpdatePeer:
-		processUpdatePeer(network, update, wg)
+		processUpdatePeer(network, update, self, wg)
+		refreshPolicies(self, network.Name)
+	case plexus.UpdatePeerKey:
+		processUpdatePeerKey(network, update, self, wg)
+		refreshPolicies(self, network.Name)
+	case plexus.UpdatePolicies:
+		processUpdatePolicies(network, update, self)
 	case plexus.AddRelay:
 		processAddRelay(network, update, self)
 	case plexus.DeleteRelay:
@@ -62,6 +70,7 @@ func networkUpdates(msg *nats.Msg) {
 	default:
 		slog.Info("invalid network update type")
 	}
+	refreshDNS()
 }
 
 func processStatus() []byte {
@@ -69,6 +78,10 @@ func processStatus() []byte {
 	if err != nil {
 		slog.Error("get networks", "error", err)
 	}
+	for i := range networks {
+		// the cli may be run by any user.
+		networks[i].PresharedKeys = nil
+	}
 	response := StatusResponse{Networks: networks}
 	self, err := boltdb.Get[Device]("self", deviceTable)
 	if err != nil {
@@ -195,6 +208,7 @@ func processLeaveServer() plexus.MessageResponse {
 	}
 	serverConn.Store(nil)
 	self.Server = ""
+	self.Servers = nil
 	if err := boltdb.Save(self, "self", deviceTable); err != nil {
 		slog.Error("save device", "error", err)
 	}
@@ -218,7 +232,7 @@ func processReload() (plexus.NetworkResponse, error) {
 	return response, nil
 }
 
-func processAddPeer(network Network, update *plexus.NetworkUpdate, wg *plexus.Wireguard) {
+func processAddPeer(network Network, update *plexus.NetworkUpdate, self Device, wg *plexus.Wireguard) {
 	slog.Debug("add peer")
 	for _, peer := range network.Peers {
 		if peer.WGPublicKey == update.Peer.WGPublicKey {
@@ -240,11 +254,13 @@ func processAddPeer(network Network, update *plexus.NetworkUpdate, wg *plexus.Wi
 	if err := boltdb.Save(network, network.Name, networkTable); err != nil {
 		slog.Error("update network -- add peer", "error", err)
 	}
-	wgPeer, err := convertPeerToWG(update.Peer, network.Peers)
+	wgPeer, err := convertPeerToWG(update.Peer, network.Peers, network.exitNode(self.WGPublicKey))
 	if err != nil {
 		slog.Error("convert peer", "peer", update.Peer.HostName, "error", err)
 		return
 	}
+	wgPeer.PresharedKey = network.presharedKey(update.Peer.WGPublicKey)
+	useServerRelay(self, network, update.Peer, &wgPeer)
 	slog.Debug("adding wg peer", "key", wgPeer.PublicKey, "allowedIPs", wgPeer.AllowedIPs)
 	wg.AddPeer(wgPeer)
 	if err := wg.Apply(); err != nil {
@@ -293,11 +309,13 @@ func processDeletePeer(
 	}
 }
 
-func processUpdatePeer(network Network, update *plexus.NetworkUpdate, wg *plexus.Wireguard) {
+func processUpdatePeer(network Network, update *plexus.NetworkUpdate, self Device, wg *plexus.Wireguard) {
 	slog.Debug("update peer")
 	found := false
+	previous := plexus.NetworkPeer{}
 	for i, oldpeer := range network.Peers {
 		if oldpeer.WGPublicKey == update.Peer.WGPublicKey {
+			previous = oldpeer
 			if update.Peer.PrivateEndpoint != nil {
 				if connectToPublicEndpoint(update.Peer) {
 					update.Peer.UsePrivateEndpoint = true
@@ -313,11 +331,35 @@ func processUpdatePeer(network Network, update *plexus.NetworkUpdate, wg *plexus
 			"id", update.Peer.WGPublicKey)
 		return
 	}
-	wgPeer, err := convertPeerToWG(update.Peer, network.Peers)
+	if previous.ServerRelayed != update.Peer.ServerRelayed {
+		// the peer, or every peer when it is self, changes endpoints.
+		slog.Info("server relay changed", "network", network.Name, "peer", update.Peer.HostName,
+			"relayed", update.Peer.ServerRelayed)
+		if err := boltdb.Save(network, network.Name, networkTable); err != nil {
+			slog.Error("update network -- update peer", "error", err)
+		}
+		if err := resetPeersOnNetworkInterface(self, network); err != nil {
+			slog.Error("reset peers", "network", network.Name, "error", err)
+		}
+		return
+	}
+	if update.Peer.WGPublicKey == self.WGPublicKey && previous.ExitNode != update.Peer.ExitNode {
+		slog.Info("exit node changed", "network", network.Name, "exit node", update.Peer.ExitNode)
+		if err := boltdb.Save(network, network.Name, networkTable); err != nil {
+			slog.Error("update network -- update peer", "error", err)
+		}
+		if err := resetPeersOnNetworkInterface(self, network); err != nil {
+			slog.Error("reset peers", "network", network.Name, "error", err)
+		}
+		return
+	}
+	wgPeer, err := convertPeerToWG(update.Peer, network.Peers, network.exitNode(self.WGPublicKey))
 	if err != nil {
 		slog.Error("convert to WG peer", "error", err)
 		return
 	}
+	wgPeer.PresharedKey = network.presharedKey(update.Peer.WGPublicKey)
+	useServerRelay(self, network, update.Peer, &wgPeer)
 	wg.ReplacePeer(wgPeer)
 	if err := boltdb.Save(network, network.Name, networkTable); err != nil {
 		slog.Error("update network -- update peer", "error", err)
@@ -327,6 +369,54 @@ func processUpdatePeer(network Network, update *plexus.NetworkUpdate, wg *plexus
 	}
 }
 
+// processUpdatePeerKey replaces the key of a peer that rotated its keys. The
+// wireguard peer with the old key is removed and the one with the new key added
+// in a single change so sessions with the other peers are kept.
+func processUpdatePeerKey(
+	network Network,
+	update *plexus.NetworkUpdate,
+	self Device,
+	wg *plexus.Wireguard,
+) {
+	slog.Debug("update peer key", "old", update.OldKey, "new", update.Peer.WGPublicKey)
+	if !network.ReplacePeerKey(update.OldKey, update.Peer.WGPublicKey) {
+		slog.Debug("peer key already replaced", "network", network.Name, "peer", update.Peer.HostName)
+		return
+	}
+	if psk, ok := network.PresharedKeys[update.OldKey]; ok {
+		// the server keeps the preshared key of a peer that rotated its keys.
+		delete(network.PresharedKeys, update.OldKey)
+		network.PresharedKeys[update.Peer.WGPublicKey] = psk
+	}
+	if err := boltdb.Save(network, network.Name, networkTable); err != nil {
+		slog.Error("update network -- update peer key", "error", err)
+	}
+	if update.OldKey == self.WGPublicKey || update.Peer.WGPublicKey == self.WGPublicKey {
+		// own keys are applied by rotateKeys.
+		return
+	}
+	wg.DeletePeer(update.OldKey)
+	for _, peer := range getWGPeers(self, network) {
+		if peer.PublicKey.String() == update.Peer.WGPublicKey {
+			wg.AddPeer(peer)
+		}
+	}
+	if err := wg.Apply(); err != nil {
+		slog.Error("apply wg config", "error", err)
+	}
+}
+
+func processUpdatePolicies(network Network, update *plexus.NetworkUpdate, self Device) {
+	slog.Debug("update policies", "network", network.Name, "policies", len(update.Policies))
+	network.Policies = update.Policies
+	if err := boltdb.Save(network, network.Name, networkTable); err != nil {
+		slog.Error("update network -- policies", "error", err)
+	}
+	if err := applyPolicies(self, network); err != nil {
+		slog.Error("apply policies", "network", network.Name, "error", err)
+	}
+}
+
 func processAddRelay(network Network, update *plexus.NetworkUpdate, self Device) {
 	slog.Debug("add relay")
 	newPeers := []plexus.NetworkPeer{}
@@ -393,12 +483,7 @@ func deleteRouter(msg *nats.Msg, id string) {
 		slog.Error("add router wrong id", "me", id, "router", data.WGPublicKey)
 		return
 	}
-	if err := delNat(); err != nil {
-		slog.Error("delete nat", "error", err)
-	}
-	if err := delVirtualSubnet(); err != nil {
-		slog.Error("delete virtual subnet", "error", err)
-	}
+	configureRouter(data)
 }
 
 func addRouter(msg *nats.Msg, id string) {
@@ -410,19 +495,26 @@ func addRouter(msg *nats.Msg, id string) {
 		slog.Error("add router wrong id", "me", id, "router", data.WGPublicKey)
 		return
 	}
-	if !data.IsSubnetRouter {
-		return
-	}
-	slog.Debug("adding subnet router")
-	if data.UseNat {
+	slog.Debug("adding subnet router or exit node")
+	configureRouter(data)
+}
+
+// configureRouter sets up nat and virtual subnets for the subnets routed by
+// data and its exit node role, removing what is no longer required.
+func configureRouter(data *plexus.NetworkPeer) {
+	if data.UsesNat() || data.IsExitNode {
 		if err := addNat(); err != nil {
 			slog.Error("add nat", "error", err)
 		}
+	} else if err := delNat(); err != nil {
+		slog.Error("delete nat", "error", err)
 	}
-	if data.UseVirtSubnet {
-		if err := addVirtualSubnet(data.VirtSubnet, data.Subnet); err != nil {
+	if virt := data.VirtSubnets(); len(virt) > 0 {
+		if err := addVirtualSubnets(virt); err != nil {
 			slog.Error("add virtual subnet", "error", err)
 		}
+	} else if err := delVirtualSubnet(); err != nil {
+		slog.Error("delete virtual subnet", "error", err)
 	}
 }
 
@@ -471,4 +563,8 @@ func joinNetwork(msg *nats.Msg, self Device) {
 		)
 		return
 	}
+	if network.UsePSK {
+		requestPresharedKeys()
+	}
+	refreshDNS()
 }
@@ -27,6 +27,9 @@ func deleteInterface(name string) error {
 		return fmt.Errorf("interface does not exist %w", err)
 	}
 	log.Println(link.Attrs().Name, link.Attrs().Index)
+	if err := delPolicies(name); err != nil {
+		slog.Error("delete policies", "interface", name, "error", err)
+	}
 	return netlink.LinkDel(link)
 }
 
@@ -40,6 +43,9 @@ func deleteAllInterfaces() {
 	for _, iface := range ifaces {
 		if strings.Contains(iface.Attrs().Name, "plexus") {
 			slog.Debug("deleting interface", "name", iface.Attrs().Name)
+			if err := delPolicies(iface.Attrs().Name); err != nil {
+				slog.Error("delete policies", "interface", iface.Attrs().Name, "error", err)
+			}
 			if err := netlink.LinkDel(iface); err != nil {
 				slog.Error("deleting link", "name", iface.Attrs().Name, "error", err)
 			}
@@ -74,18 +80,23 @@ func startAllInterfaces(self Device) {
 
 func startInterface(self Device, network Network) error {
 	slog.Info("starting interface", "interface", network.Interface, "network", network.Name)
-	address := netlink.Addr{}
+	addresses := []netlink.Addr{}
 	for _, peer := range network.Peers {
 		if peer.WGPublicKey == self.WGPublicKey {
-			add := net.IPNet{
+			addresses = append(addresses, netlink.Addr{IPNet: &net.IPNet{
 				IP:   peer.Address.IP,
 				Mask: network.Net.Mask,
+			}})
+			if peer.Address6.IP != nil {
+				addresses = append(addresses, netlink.Addr{IPNet: &net.IPNet{
+					IP:   peer.Address6.IP,
+					Mask: network.Net6.Mask,
+				}})
 			}
-			address.IPNet = &add
 			break
 		}
 	}
-	if address.IPNet == nil {
+	if len(addresses) == 0 {
 		return errors.New("no address for network " + network.Name)
 	}
 	privKey, err := wgtypes.ParseKey(self.WGPrivateKey)
@@ -102,6 +113,9 @@ func startInterface(self Device, network Network) error {
 		if err := checkForNat(self, network); err != nil {
 			slog.Error("nat error", "network", network.Name, "error", err)
 		}
+		if err := applyPolicies(self, network); err != nil {
+			slog.Error("policy error", "network", network.Name, "error", err)
+		}
 		return err
 	}
 	mtu := 1420
@@ -142,9 +156,9 @@ func startInterface(self Device, network Network) error {
 		ReplacePeers: true,
 		Peers:        peers,
 	}
-	slog.Debug("creating new wireguard interface", "name", network.Interface, "address", address,
+	slog.Debug("creating new wireguard interface", "name", network.Interface, "addresses", addresses,
 		"key", config.PrivateKey, "port", config.ListenPort)
-	wg := plexus.New(network.Interface, mtu, address, config)
+	wg := plexus.New(network.Interface, mtu, addresses, config)
 	if err := wg.Up(); err != nil {
 		slog.Error("failed initializition interface", "interface", network.Interface, "error", err)
 		return err
@@ -153,6 +167,9 @@ func startInterface(self Device, network Network) error {
 	if err := checkForNat(self, network); err != nil {
 		slog.Error("nat error", "network", network.Name, "error", err)
 	}
+	if err := applyPolicies(self, network); err != nil {
+		slog.Error("policy error", "network", network.Name, "error", err)
+	}
 	return nil
 }
 
@@ -228,30 +245,31 @@ func getConnectivity() []plexus.ConnectivityData {
 	return results
 }
 
-func getAllowedIPs(node plexus.NetworkPeer, peers []plexus.NetworkPeer) []net.IPNet {
+// getAllowedIPs returns the allowed ips of node; exitNode is the exit node
+// chosen by self, whose allowed ips include the ipv4 default route.
+func getAllowedIPs(node plexus.NetworkPeer, peers []plexus.NetworkPeer, exitNode string) []net.IPNet {
 	allowed := []net.IPNet{}
-	allowed = append(allowed, net.IPNet{
-		IP:   node.Address.IP,
-		Mask: net.CIDRMask(32, 32),
-	})
+	for _, address := range node.Addresses() {
+		allowed = append(allowed, hostPrefix(address.IP))
+	}
+	if node.IsExitNode && node.WGPublicKey == exitNode {
+		allowed = append(allowed, net.IPNet{IP: net.IPv4zero.To4(), Mask: net.CIDRMask(0, 32)})
+	}
 	if node.IsSubnetRouter {
-		if node.UseVirtSubnet {
-			allowed = append(allowed, node.VirtSubnet)
-		} else {
-			allowed = append(allowed, node.Subnet)
+		for _, subnet := range node.Subnets {
+			if !subnet.Standby {
+				allowed = append(allowed, subnet.Advertised())
+			}
 		}
-		slog.Debug(
-			"new allowed ips",
-			"allowed", allowed,
-			"virt", node.VirtSubnet,
-			"subnet", node.Subnet,
-		)
+		slog.Debug("new allowed ips", "allowed", allowed, "subnets", node.Subnets)
 	}
 	if node.IsRelay {
 		for _, peer := range peers {
 			if peer.IsRelayed {
 				if slices.Contains(node.RelayedPeers, peer.WGPublicKey) {
-					allowed = append(allowed, peer.Address)
+					for _, address := range peer.Addresses() {
+						allowed = append(allowed, hostPrefix(address.IP))
+					}
 				}
 			}
 		}
@@ -259,9 +277,28 @@ func getAllowedIPs(node plexus.NetworkPeer, peers []plexus.NetworkPeer) []net.IP
 	return allowed
 }
 
+// exitNode returns the exit node chosen by self in the network.
+func (n Network) exitNode(self string) string {
+	for _, peer := range n.Peers {
+		if peer.WGPublicKey == self {
+			return peer.ExitNode
+		}
+	}
+	return ""
+}
+
+// hostPrefix returns a /32 (ipv4) or /128 (ipv6) network containing only ip.
+func hostPrefix(ip net.IP) net.IPNet {
+	if ip4 := ip.To4(); ip4 != nil {
+		return net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}
+	}
+	return net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}
+}
+
 func getWGPeers(self Device, network Network) []wgtypes.PeerConfig {
 	keepalive := defaultKeepalive
 	peers := []wgtypes.PeerConfig{}
+	relayed := []string{}
 	for _, peer := range network.Peers {
 		slog.Debug(
 			"checking peer",
@@ -302,8 +339,9 @@ func getWGPeers(self Device, network Network) []wgtypes.PeerConfig {
 		}
 		wgPeer := wgtypes.PeerConfig{
 			PublicKey:         pubKey,
+			PresharedKey:      network.presharedKey(peer.WGPublicKey),
 			ReplaceAllowedIPs: true,
-			AllowedIPs:        getAllowedIPs(peer, network.Peers),
+			AllowedIPs:        getAllowedIPs(peer, network.Peers, network.exitNode(self.WGPublicKey)),
 			Endpoint: &net.UDPAddr{
 				IP:   peer.Endpoint,
 				Port: peer.PublicListenPort,
@@ -319,8 +357,17 @@ func getWGPeers(self Device, network Network) []wgtypes.PeerConfig {
 				}
 			}
 		}
+		if usesServerRelay(self, network, peer) {
+			relayed = append(relayed, peer.WGPublicKey)
+		}
 		peers = append(peers, wgPeer)
 	}
+	endpoints := serverRelay.endpoints(self, network.Name, network.ListenPort, relayed)
+	for i := range peers {
+		if endpoint, ok := endpoints[peers[i].PublicKey.String()]; ok {
+			peers[i].Endpoint = endpoint
+		}
+	}
 	return peers
 }
 
@@ -335,8 +382,9 @@ func selfRelayedPeers(self Device, network Network) []wgtypes.PeerConfig {
 			}
 			wgPeer := wgtypes.PeerConfig{
 				PublicKey:         pubKey,
+				PresharedKey:      network.presharedKey(peer.WGPublicKey),
 				ReplaceAllowedIPs: true,
-				AllowedIPs:        []net.IPNet{network.Net},
+				AllowedIPs:        network.Nets(),
 				Endpoint: &net.UDPAddr{
 					IP:   peer.Endpoint,
 					Port: peer.PublicListenPort,
@@ -353,7 +401,7 @@ func selfRelayedPeers(self Device, network Network) []wgtypes.PeerConfig {
 func stunCheck(self *Device, network *Network, port int) (bool, bool, error) {
 	endpointChanged := false
 	portChanged := false
-	stunAddr, err := getPublicAddPort(port)
+	stunAddr, err := getPublicAddPort(port, stunServers(*self))
 	if err != nil {
 		return endpointChanged, portChanged, err
 	}
@@ -402,6 +450,7 @@ func getNewListenPorts(name string) (plexus.NetworkPeer, error) {
 func convertPeerToWG(
 	netPeer plexus.NetworkPeer,
 	peers []plexus.NetworkPeer,
+	exitNode string,
 ) (wgtypes.PeerConfig, error) {
 	var addr *net.UDPAddr
 	keepalive := defaultKeepalive
@@ -428,7 +477,7 @@ func convertPeerToWG(
 		Endpoint:                    addr,
 		PersistentKeepaliveInterval: &keepalive,
 		ReplaceAllowedIPs:           true,
-		AllowedIPs:                  getAllowedIPs(netPeer, peers),
+		AllowedIPs:                  getAllowedIPs(netPeer, peers, exitNode),
 	}, nil
 }
 
@@ -1,10 +1,12 @@
 package agent
 
 import (
+	"net"
 	"os/user"
 	"testing"
 
 	"github.com/Kairum-Labs/should"
+	"github.com/devilcove/plexus"
 	"github.com/vishvananda/netlink"
 )
 
@@ -34,3 +36,18 @@ func TestInterface(t *testing.T) {
 		should.BeEqual(t, len(ifaces), number+2)
 	})
 }
+
+func TestStandbyRouter(t *testing.T) {
+	_, lan, _ := net.ParseCIDR("192.168.10.0/24")
+	_, other, _ := net.ParseCIDR("192.168.20.0/24")
+	router := plexus.NetworkPeer{
+		WGPublicKey:    "router",
+		Address:        net.IPNet{IP: net.ParseIP("10.10.10.2").To4(), Mask: net.CIDRMask(32, 32)},
+		IsSubnetRouter: true,
+		Subnets:        []plexus.RouterSubnet{{Subnet: *lan, Standby: true}, {Subnet: *other}},
+	}
+	// standby routers do not advertise the subnet.
+	allowed := getAllowedIPs(router, nil, "")
+	should.BeEqual(t, len(allowed), 2)
+	should.BeEqual(t, allowed[1].String(), "192.168.20.0/24")
+}
@@ -8,6 +8,7 @@ import (
 
 	"github.com/Kairum-Labs/should"
 	"github.com/devilcove/boltdb"
+	"github.com/devilcove/plexus"
 )
 
 func TestCheckPort(t *testing.T) {
@@ -70,3 +71,21 @@ func TestNewDevice(t *testing.T) {
 		should.BeEqual(t, new.Seed, device.Seed)
 	})
 }
+
+func TestStunServers(t *testing.T) {
+	defer func() { Config.StunServers = nil }()
+	should.BeEqual(t, stunServers(Device{}), DefaultStunServers)
+	Config.StunServers = []string{"stun.example.org:3478", "plexus.example.org:3478"}
+	should.BeEqual(t, stunServers(Device{StunServer: "plexus.example.org:3478"}),
+		[]string{"plexus.example.org:3478", "stun.example.org:3478"})
+}
+
+func TestServerURLs(t *testing.T) {
+	key := plexus.KeyValue{URL: "one.example.com"}
+	should.BeEqual(t, len(clusterURLs(key)), 0)
+	key.Servers = []string{"two.example.com"}
+	should.BeEqual(t, clusterURLs(key), []string{"nats://one.example.com:4222", "nats://two.example.com:4222"})
+	self := Device{Server: "nats://two.example.com:4222", Servers: clusterURLs(key)}
+	should.BeEqual(t, serverURLs(self), "nats://two.example.com:4222,nats://one.example.com:4222")
+	should.BeEqual(t, serverURLs(Device{Server: "nats://one.example.com:4222"}), "nats://one.example.com:4222")
+}
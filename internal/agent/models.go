@@ -11,14 +11,21 @@ type Network struct {
 	PublicListenPort int
 	Interface        string
 	InterfaceSuffix  int
+	PresharedKeys    map[string]string
 }
 
+// Device is the peer of this agent. StunServer is the STUN server and
+// RelayServer the packet relay of the server the device is registered with.
+// Servers are the urls of all the servers of its cluster, if any.
 type Device struct {
 	plexus.Peer
 
 	WGPrivateKey string
 	Seed         string
 	Server       string
+	Servers      []string
+	StunServer   string
+	RelayServer  string
 }
 
 type StatusResponse struct {
@@ -0,0 +1,137 @@
+package agent
+
+import (
+	"log/slog"
+	"net"
+	"time"
+
+	"github.com/devilcove/boltdb"
+	"github.com/devilcove/plexus"
+	"github.com/pion/stun/v3"
+)
+
+// natChecked is when the nat type of the device was last discovered.
+var natChecked time.Time
+
+// bindingResult is the outcome of a stun binding request: the local address
+// the request was sent from, the address the server saw it from and, for
+// servers supporting RFC 5780, the alternate address of the server.
+type bindingResult struct {
+	local  *net.UDPAddr
+	mapped *net.UDPAddr
+	other  *net.UDPAddr
+}
+
+// stunBinding sends a binding request from the local port to server.
+func stunBinding(port int, server *net.UDPAddr) (bindingResult, error) {
+	result := bindingResult{}
+	c, err := net.DialUDP("udp4", &net.UDPAddr{Port: port}, server)
+	if err != nil {
+		return result, err
+	}
+	result.local, _ = c.LocalAddr().(*net.UDPAddr)
+	client, err := stun.NewClient(c)
+	if err != nil {
+		c.Close()
+		return result, err
+	}
+	defer client.Close()
+	var responseErr error
+	msg := stun.MustBuild(stun.TransactionID, stun.BindingRequest)
+	if err := client.Do(msg, func(res stun.Event) {
+		if res.Error != nil {
+			responseErr = res.Error
+			return
+		}
+		mapped := stun.XORMappedAddress{}
+		if err := mapped.GetFrom(res.Message); err != nil {
+			responseErr = err
+			return
+		}
+		result.mapped = &net.UDPAddr{IP: mapped.IP, Port: mapped.Port}
+		other := stun.OtherAddress{}
+		if err := other.GetFrom(res.Message); err == nil {
+			result.other = &net.UDPAddr{IP: other.IP, Port: other.Port}
+		}
+	}); err != nil {
+		return result, err
+	}
+	return result, responseErr
+}
+
+// discoverNatType discovers the mapping behaviour of the nat in front of the
+// device as in RFC 5780. A binding request is sent to the first of servers
+// that answers and, from the same local port, to the alternate address of
+// that server or else to a server with another address. The nat is endpoint
+// independent when both servers see the same public address and port, and
+// symmetric otherwise.
+func discoverNatType(servers []string) string {
+	addrs := []*net.UDPAddr{}
+	for _, server := range servers {
+		addr, err := net.ResolveUDPAddr("udp4", server)
+		if err != nil {
+			slog.Debug("resolve stun server", "server", server, "error", err)
+			continue
+		}
+		addrs = append(addrs, addr)
+	}
+	var primary *net.UDPAddr
+	first := bindingResult{}
+	for len(addrs) > 0 && primary == nil {
+		result, err := stunBinding(0, addrs[0])
+		if err != nil {
+			slog.Debug("stun binding", "server", addrs[0], "error", err)
+		} else {
+			primary = addrs[0]
+			first = result
+		}
+		addrs = addrs[1:]
+	}
+	if primary == nil {
+		return plexus.NatUnknown
+	}
+	if first.mapped.IP.Equal(first.local.IP) && first.mapped.Port == first.local.Port {
+		return plexus.NatNone
+	}
+	alternates := []*net.UDPAddr{}
+	if first.other != nil && !first.other.IP.Equal(primary.IP) {
+		alternates = append(alternates, &net.UDPAddr{IP: first.other.IP, Port: primary.Port})
+	}
+	for _, addr := range addrs {
+		if !addr.IP.Equal(primary.IP) {
+			alternates = append(alternates, addr)
+		}
+	}
+	for _, addr := range alternates {
+		result, err := stunBinding(first.local.Port, addr)
+		if err != nil {
+			slog.Debug("stun binding", "server", addr, "error", err)
+			continue
+		}
+		if result.mapped.IP.Equal(first.mapped.IP) && result.mapped.Port == first.mapped.Port {
+			return plexus.NatEndpointIndependent
+		}
+		return plexus.NatSymmetric
+	}
+	return plexus.NatUnknown
+}
+
+// checkNatType returns the nat type of the device, discovering it again once
+// natCheckTime has passed since the last discovery. A changed nat type is
+// saved to the device record.
+func checkNatType(self *Device) string {
+	if self.NatType != "" && time.Since(natChecked) < natCheckTime {
+		return self.NatType
+	}
+	natChecked = time.Now()
+	natType := discoverNatType(stunServers(*self))
+	if natType == self.NatType {
+		return natType
+	}
+	slog.Info("nat type changed", "old", self.NatType, "new", natType)
+	self.NatType = natType
+	if err := boltdb.Save(*self, "self", deviceTable); err != nil {
+		slog.Error("save device", "error", err)
+	}
+	return natType
+}
@@ -0,0 +1,89 @@
+package agent
+
+import (
+	"net"
+	"testing"
+
+	"github.com/Kairum-Labs/should"
+	"github.com/devilcove/plexus"
+	"github.com/pion/stun/v3"
+)
+
+// fakeStunServer answers binding requests on addr with the mapped address
+// returned by mapped for the source of the request, and other as the
+// alternate address when set.
+func fakeStunServer(t *testing.T, addr string, mapped func(*net.UDPAddr) *net.UDPAddr,
+	other *net.UDPAddr,
+) string {
+	t.Helper()
+	conn, err := net.ListenPacket("udp4", addr)
+	should.NotBeError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, from, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			request := &stun.Message{Raw: append([]byte{}, buf[:n]...)}
+			if err := request.Decode(); err != nil {
+				continue
+			}
+			public := mapped(from.(*net.UDPAddr))
+			setters := []stun.Setter{
+				stun.NewTransactionIDSetter(request.TransactionID),
+				stun.BindingSuccess,
+				&stun.XORMappedAddress{IP: public.IP.To4(), Port: public.Port},
+			}
+			if other != nil {
+				setters = append(setters, &stun.OtherAddress{IP: other.IP.To4(), Port: other.Port})
+			}
+			response := stun.MustBuild(setters...)
+			_, _ = conn.WriteTo(response.Raw, from)
+		}
+	}()
+	return conn.LocalAddr().String()
+}
+
+func TestDiscoverNatType(t *testing.T) {
+	public := &net.UDPAddr{IP: net.ParseIP("203.0.113.1"), Port: 40000}
+	fixed := func(*net.UDPAddr) *net.UDPAddr { return public }
+	t.Run("none", func(t *testing.T) {
+		server := fakeStunServer(t, "127.0.0.1:0", func(from *net.UDPAddr) *net.UDPAddr { return from }, nil)
+		should.BeEqual(t, discoverNatType([]string{server}), plexus.NatNone)
+	})
+	t.Run("endpointIndependent", func(t *testing.T) {
+		server1 := fakeStunServer(t, "127.0.0.1:0", fixed, nil)
+		server2 := fakeStunServer(t, "127.0.0.2:0", fixed, nil)
+		should.BeEqual(t, discoverNatType([]string{server1, server2}), plexus.NatEndpointIndependent)
+	})
+	t.Run("symmetric", func(t *testing.T) {
+		server1 := fakeStunServer(t, "127.0.0.1:0", fixed, nil)
+		server2 := fakeStunServer(t, "127.0.0.2:0", func(*net.UDPAddr) *net.UDPAddr {
+			return &net.UDPAddr{IP: public.IP, Port: public.Port + 1}
+		}, nil)
+		should.BeEqual(t, discoverNatType([]string{server1, server2}), plexus.NatSymmetric)
+	})
+	t.Run("alternateAddress", func(t *testing.T) {
+		// the second request goes to the alternate address of the server, at
+		// the port of the server.
+		server := fakeStunServer(t, "127.0.0.1:0", fixed, &net.UDPAddr{IP: net.ParseIP("127.0.0.2"), Port: 1})
+		_, port, err := net.SplitHostPort(server)
+		should.NotBeError(t, err)
+		fakeStunServer(t, "127.0.0.2:"+port, fixed, nil)
+		should.BeEqual(t, discoverNatType([]string{server}), plexus.NatEndpointIndependent)
+	})
+	t.Run("singleServer", func(t *testing.T) {
+		server := fakeStunServer(t, "127.0.0.1:0", fixed, nil)
+		should.BeEqual(t, discoverNatType([]string{server}), plexus.NatUnknown)
+	})
+	t.Run("sameAddress", func(t *testing.T) {
+		server1 := fakeStunServer(t, "127.0.0.1:0", fixed, nil)
+		server2 := fakeStunServer(t, "127.0.0.1:0", fixed, nil)
+		should.BeEqual(t, discoverNatType([]string{server1, server2}), plexus.NatUnknown)
+	})
+	t.Run("noServers", func(t *testing.T) {
+		should.BeEqual(t, discoverNatType([]string{"invalid"}), plexus.NatUnknown)
+	})
+}
@@ -1,10 +1,13 @@
 package agent
 
 import (
+	"net"
 	"testing"
 
 	"github.com/Kairum-Labs/should"
 	"github.com/devilcove/boltdb"
+	"github.com/devilcove/plexus"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
 )
 
 func TestSaveServerNetwork(t *testing.T) {
@@ -27,3 +30,38 @@ func TestSaveServerNetworks(t *testing.T) {
 	should.NotBeError(t, err)
 	should.BeEqual(t, len(networks), 2)
 }
+
+func TestPresharedKeys(t *testing.T) {
+	_, self, err := generateKeys()
+	should.NotBeError(t, err)
+	_, other, err := generateKeys()
+	should.NotBeError(t, err)
+	_, third, err := generateKeys()
+	should.NotBeError(t, err)
+	psk, err := wgtypes.GenerateKey()
+	should.NotBeError(t, err)
+	network := Network{Interface: "plexus-psk-test"}
+	network.Name = "psk"
+	network.Peers = []plexus.NetworkPeer{
+		{WGPublicKey: self.String()},
+		{WGPublicKey: other.String(), Endpoint: net.ParseIP("192.0.2.1"), PublicListenPort: 51820},
+		{WGPublicKey: third.String(), Endpoint: net.ParseIP("192.0.2.2"), PublicListenPort: 51820},
+	}
+	should.NotBeError(t, boltdb.Save(network, network.Name, networkTable))
+	defer func() {
+		_ = boltdb.Delete[Network](network.Name, networkTable)
+	}()
+
+	updatePresharedKeys(plexus.PresharedKeyUpdate{
+		Network: network.Name,
+		Keys:    map[string]string{other.String(): psk.String()},
+	})
+	network, err = boltdb.Get[Network](network.Name, networkTable)
+	should.NotBeError(t, err)
+	device := Device{}
+	device.WGPublicKey = self.String()
+	peers := getWGPeers(device, network)
+	should.BeEqual(t, len(peers), 2)
+	should.BeEqual(t, *peers[0].PresharedKey, psk)
+	should.BeEqual(t, *peers[1].PresharedKey, wgtypes.Key{})
+}
@@ -27,7 +27,11 @@ func toAgentNetwork(in plexus.Network) Network {
 	out := Network{}
 	out.Name = in.Name
 	out.Net = in.Net
+	out.AddressString = in.AddressString
+	out.Net6 = in.Net6
+	out.Address6String = in.Address6String
 	out.Peers = in.Peers
+	out.Policies = in.Policies
 	return out
 }
 
@@ -3,9 +3,13 @@ package agent
 import (
 	"log/slog"
 	"net"
+	"syscall"
 
 	"github.com/c-robinson/iplib"
+	"github.com/devilcove/boltdb"
+	"github.com/devilcove/plexus"
 	"github.com/google/nftables"
+	"github.com/google/nftables/binaryutil"
 	"github.com/google/nftables/expr"
 )
 
@@ -63,32 +67,37 @@ func checkForNat(self Device, network Network) error {
 	slog.Debug("checking if NAT required")
 	for _, peer := range network.Peers {
 		if peer.WGPublicKey == self.WGPublicKey {
-			slog.Debug("Nat check", "subnet-router", peer.IsSubnetRouter)
+			slog.Debug("Nat check", "subnet-router", peer.IsSubnetRouter, "exit-node", peer.IsExitNode)
+			if peer.IsExitNode {
+				// internet traffic of the peers using the exit node is masqueraded.
+				slog.Debug("adding NAT for exit node", "network", network.Name)
+				if err := addNat(); err != nil {
+					return err
+				}
+			}
 			if !peer.IsSubnetRouter {
 				slog.Debug("nat check -- not subnetrouter")
 				return nil
 			}
-			slog.Debug("Nat check --- subnet", "useNat", peer.UseNat)
-			if peer.UseNat {
+			slog.Debug("Nat check --- subnet", "useNat", peer.UsesNat())
+			if peer.UsesNat() {
 				slog.Debug("adding NAT", "network", network.Name)
-				return addNat()
+				if err := addNat(); err != nil {
+					return err
+				}
 			}
-			if peer.UseVirtSubnet {
-				slog.Debug(
-					"adding virtual subnet",
-					"peer", peer.HostName,
-					"virtual subnet", peer.VirtSubnet,
-					"subnet", peer.Subnet,
-				)
-				return addVirtualSubnet(peer.VirtSubnet, peer.Subnet)
+			if virt := peer.VirtSubnets(); len(virt) > 0 {
+				slog.Debug("adding virtual subnets", "peer", peer.HostName, "subnets", len(virt))
+				return addVirtualSubnets(virt)
 			}
 		}
 	}
 	return nil
 }
 
-func addVirtualSubnet(virtual, subnet net.IPNet) error {
-	slog.Debug("add virtual subnet", "virtual", virtual, "subnet", subnet)
+// addVirtualSubnets replaces the rules translating virtual subnet addresses to
+// the addresses of the routed subnets.
+func addVirtualSubnets(subnets []plexus.RouterSubnet) error {
 	c := &nftables.Conn{}
 	table := c.AddTable(&nftables.Table{
 		Name:   "plexus",
@@ -105,6 +114,20 @@ func addVirtualSubnet(virtual, subnet net.IPNet) error {
 		Hooknum:  nftables.ChainHookPrerouting,
 		Priority: nftables.ChainPriorityFilter,
 	})
+	for _, subnet := range subnets {
+		if err := addVirtualSubnet(c, table, chain, subnet.VirtSubnet, subnet.Subnet); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addVirtualSubnet adds a rule to chain for each address of virtual, translating
+// it to the address at the same offset in subnet.
+func addVirtualSubnet(
+	c *nftables.Conn, table *nftables.Table, chain *nftables.Chain, virtual, subnet net.IPNet,
+) error {
+	slog.Debug("add virtual subnet", "virtual", virtual, "subnet", subnet)
 	ones, _ := virtual.Mask.Size()
 	virtNet := iplib.NewNet4(virtual.IP, ones)
 	virt := virtNet.FirstAddress()
@@ -183,3 +206,421 @@ func delVirtualSubnet() error {
 	}
 	return nil
 }
+
+const plexusFilter string = "plexus-filter"
+
+// aclRule is a compiled policy. Nil source or destination match any address;
+// a zero family matches ipv4 and ipv6 and a zero protocol every protocol.
+type aclRule struct {
+	family      nftables.TableFamily
+	source      *net.IPNet
+	destination *net.IPNet
+	protocol    byte
+	ports       plexus.PortRange
+}
+
+// compilePolicies converts the policies of a network into the rules filtering
+// traffic arriving on the network interface of self: input rules for traffic
+// to self and forward rules for traffic to the subnet routed by self and, on
+// exit nodes, for internet traffic of the peers using self as exit node.
+func compilePolicies(self Device, network Network) ([]aclRule, []aclRule) {
+	input := []aclRule{}
+	forward := []aclRule{}
+	var me *plexus.NetworkPeer
+	for i := range network.Peers {
+		if network.Peers[i].WGPublicKey == self.WGPublicKey {
+			me = &network.Peers[i]
+		}
+	}
+	if me == nil {
+		return input, forward
+	}
+	for _, policy := range network.Policies {
+		sources := policyPeers(policy.Source, network)
+		if me.Selects(policy.Destination) {
+			input = append(input, expandPolicy(policy, sources, []*net.IPNet{nil})...)
+		}
+		if subnets := routedSubnets(*me, policy.Destination); len(subnets) > 0 {
+			forward = append(forward, expandPolicy(policy, sources, subnets)...)
+		}
+		if destinations := exitDestinations(*me, network, policy.Destination); len(destinations) > 0 {
+			forward = append(forward, expandPolicy(policy, exitClients(policy.Source, *me, network), destinations)...)
+		}
+	}
+	return input, forward
+}
+
+// exitDestinations returns the internet destinations selected by a policy
+// destination when peer is an exit node; nil matches any address.
+func exitDestinations(peer plexus.NetworkPeer, network Network, destination string) []*net.IPNet {
+	if !peer.IsExitNode {
+		return nil
+	}
+	if destination == plexus.PolicyAny {
+		return []*net.IPNet{nil}
+	}
+	_, cidr, err := net.ParseCIDR(destination)
+	if err != nil {
+		return nil
+	}
+	for _, subnet := range []net.IPNet{network.Net, network.Net6} {
+		if subnet.IP != nil && overlaps(*cidr, subnet) {
+			return nil
+		}
+	}
+	return []*net.IPNet{cidr}
+}
+
+// exitClients returns the host addresses of the peers selected by a policy
+// source that use exitNode as their exit node.
+func exitClients(selector string, exitNode plexus.NetworkPeer, network Network) []*net.IPNet {
+	addresses := []*net.IPNet{}
+	for _, peer := range network.Peers {
+		if peer.ExitNode != exitNode.WGPublicKey || !peer.Selects(selector) {
+			continue
+		}
+		for _, address := range peer.Addresses() {
+			host := hostPrefix(address.IP)
+			addresses = append(addresses, &host)
+		}
+	}
+	return addresses
+}
+
+// policyPeers returns the host addresses of the peers selected by a policy source;
+// nil matches any address.
+func policyPeers(selector string, network Network) []*net.IPNet {
+	if selector == plexus.PolicyAny {
+		return []*net.IPNet{nil}
+	}
+	addresses := []*net.IPNet{}
+	for _, peer := range network.Peers {
+		if !peer.Selects(selector) {
+			continue
+		}
+		for _, address := range peer.Addresses() {
+			host := hostPrefix(address.IP)
+			addresses = append(addresses, &host)
+		}
+	}
+	return addresses
+}
+
+// routedSubnets returns the parts of the subnets routed by peer selected by a
+// policy destination. Destinations in a virtual subnet are mapped to the real
+// subnet as forwarded traffic has already been translated.
+func routedSubnets(peer plexus.NetworkPeer, destination string) []*net.IPNet {
+	routed := []*net.IPNet{}
+	if !peer.IsSubnetRouter {
+		return routed
+	}
+	for _, routerSubnet := range peer.Subnets {
+		if subnet := routedSubnet(routerSubnet, destination); subnet != nil {
+			routed = append(routed, subnet)
+		}
+	}
+	return routed
+}
+
+// routedSubnet returns the part of a routed subnet selected by a policy
+// destination, or nil.
+func routedSubnet(routerSubnet plexus.RouterSubnet, destination string) *net.IPNet {
+	subnet := routerSubnet.Subnet
+	if destination == plexus.PolicyAny {
+		return &subnet
+	}
+	_, cidr, err := net.ParseCIDR(destination)
+	if err != nil {
+		return nil
+	}
+	if routerSubnet.UseVirtSubnet && overlaps(*cidr, routerSubnet.VirtSubnet) {
+		cidr = translate(narrowest(*cidr, routerSubnet.VirtSubnet), subnet)
+	}
+	if !overlaps(*cidr, subnet) {
+		return nil
+	}
+	return narrowest(*cidr, subnet)
+}
+
+func overlaps(a, b net.IPNet) bool {
+	return a.Contains(b.IP) || b.Contains(a.IP)
+}
+
+func narrowest(a, b net.IPNet) *net.IPNet {
+	onesA, _ := a.Mask.Size()
+	onesB, _ := b.Mask.Size()
+	if onesA >= onesB {
+		return &a
+	}
+	return &b
+}
+
+// translate maps cidr, within a virtual subnet, to the same offset in subnet.
+func translate(cidr *net.IPNet, subnet net.IPNet) *net.IPNet {
+	ip := cidr.IP.To4()
+	base := subnet.IP.To4()
+	if ip == nil || base == nil {
+		return cidr
+	}
+	translated := make(net.IP, net.IPv4len)
+	for i := range translated {
+		translated[i] = base[i]&subnet.Mask[i] | ip[i]&^subnet.Mask[i]
+	}
+	return &net.IPNet{IP: translated, Mask: cidr.Mask}
+}
+
+func ipFamily(n *net.IPNet) nftables.TableFamily {
+	switch {
+	case n == nil:
+		return 0
+	case n.IP.To4() != nil:
+		return nftables.TableFamilyIPv4
+	default:
+		return nftables.TableFamilyIPv6
+	}
+}
+
+// expandPolicy returns a rule for each combination of source, destination,
+// address family (for icmp) and port range of a policy.
+func expandPolicy(policy plexus.Policy, sources, destinations []*net.IPNet) []aclRule {
+	rules := []aclRule{}
+	ports, err := plexus.ParsePorts(policy.Ports)
+	if err != nil {
+		slog.Error("invalid policy ports", "policy", policy.Name, "ports", policy.Ports, "error", err)
+		return rules
+	}
+	if len(ports) == 0 {
+		ports = []plexus.PortRange{{}}
+	}
+	for _, source := range sources {
+		for _, destination := range destinations {
+			family := ipFamily(source)
+			if destFamily := ipFamily(destination); destFamily != 0 {
+				if family != 0 && family != destFamily {
+					continue
+				}
+				family = destFamily
+			}
+			families := []nftables.TableFamily{family}
+			if policy.Protocol == plexus.ProtoICMP && family == 0 {
+				families = []nftables.TableFamily{nftables.TableFamilyIPv4, nftables.TableFamilyIPv6}
+			}
+			for _, family := range families {
+				for _, portRange := range ports {
+					rules = append(rules, aclRule{
+						family:      family,
+						source:      source,
+						destination: destination,
+						protocol:    protocolNumber(policy.Protocol, family),
+						ports:       portRange,
+					})
+				}
+			}
+		}
+	}
+	return rules
+}
+
+func protocolNumber(protocol string, family nftables.TableFamily) byte {
+	switch protocol {
+	case plexus.ProtoTCP:
+		return syscall.IPPROTO_TCP
+	case plexus.ProtoUDP:
+		return syscall.IPPROTO_UDP
+	case plexus.ProtoICMP:
+		if family == nftables.TableFamilyIPv6 {
+			return syscall.IPPROTO_ICMPV6
+		}
+		return syscall.IPPROTO_ICMP
+	default:
+		return 0
+	}
+}
+
+// ifname returns an interface name as compared by nftables.
+func ifname(name string) []byte {
+	b := make([]byte, 16)
+	copy(b, name+"\x00")
+	return b
+}
+
+func matchIIF(iface string) []expr.Any {
+	return []expr.Any{
+		&expr.Meta{Key: expr.MetaKeyIIFNAME, Register: 1},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: ifname(iface)},
+	}
+}
+
+func matchAddress(address *net.IPNet, source bool) []expr.Any {
+	offset, length := uint32(16), uint32(net.IPv4len)
+	if source {
+		offset = 12
+	}
+	ip := address.IP.To4()
+	if ip == nil {
+		ip = address.IP.To16()
+		offset, length = 24, net.IPv6len
+		if source {
+			offset = 8
+		}
+	}
+	mask := address.Mask
+	if len(mask) != int(length) {
+		ones, _ := mask.Size()
+		mask = net.CIDRMask(ones, int(length)*8)
+	}
+	return []expr.Any{
+		&expr.Payload{
+			DestRegister: 1,
+			Base:         expr.PayloadBaseNetworkHeader,
+			Offset:       offset,
+			Len:          length,
+		},
+		&expr.Bitwise{
+			SourceRegister: 1,
+			DestRegister:   1,
+			Len:            length,
+			Mask:           mask,
+			Xor:            make([]byte, length),
+		},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: ip.Mask(mask)},
+	}
+}
+
+// ruleExprs returns the nftables expressions accepting traffic matching rule on iface.
+func ruleExprs(iface string, rule aclRule) []expr.Any {
+	exprs := matchIIF(iface)
+	if rule.family != 0 {
+		exprs = append(exprs,
+			&expr.Meta{Key: expr.MetaKeyNFPROTO, Register: 1},
+			&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{byte(rule.family)}},
+		)
+	}
+	if rule.source != nil {
+		exprs = append(exprs, matchAddress(rule.source, true)...)
+	}
+	if rule.destination != nil {
+		exprs = append(exprs, matchAddress(rule.destination, false)...)
+	}
+	if rule.protocol != 0 {
+		exprs = append(exprs,
+			&expr.Meta{Key: expr.MetaKeyL4PROTO, Register: 1},
+			&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{rule.protocol}},
+		)
+	}
+	if rule.ports.First != 0 {
+		exprs = append(exprs,
+			&expr.Payload{
+				DestRegister: 1,
+				Base:         expr.PayloadBaseTransportHeader,
+				Offset:       2,
+				Len:          2,
+			},
+			&expr.Range{
+				Op:       expr.CmpOpEq,
+				Register: 1,
+				FromData: binaryutil.BigEndian.PutUint16(rule.ports.First),
+				ToData:   binaryutil.BigEndian.PutUint16(rule.ports.Last),
+			},
+		)
+	}
+	return append(exprs, &expr.Verdict{Kind: expr.VerdictAccept})
+}
+
+// applyPolicies replaces the filter chains of a network interface with the
+// compiled network policies. A network without policies is not filtered.
+func applyPolicies(self Device, network Network) error {
+	if err := delPolicies(network.Interface); err != nil {
+		return err
+	}
+	if len(network.Policies) == 0 {
+		return nil
+	}
+	slog.Debug("applying policies", "network", network.Name, "policies", len(network.Policies))
+	input, forward := compilePolicies(self, network)
+	c := &nftables.Conn{}
+	table := c.AddTable(&nftables.Table{
+		Name:   plexusFilter,
+		Family: nftables.TableFamilyINet,
+	})
+	established := append(matchIIF(network.Interface),
+		&expr.Ct{Register: 1, Key: expr.CtKeySTATE},
+		&expr.Bitwise{
+			SourceRegister: 1,
+			DestRegister:   1,
+			Len:            4,
+			Mask:           binaryutil.NativeEndian.PutUint32(expr.CtStateBitESTABLISHED | expr.CtStateBitRELATED),
+			Xor:            binaryutil.NativeEndian.PutUint32(0),
+		},
+		&expr.Cmp{Op: expr.CmpOpNeq, Register: 1, Data: binaryutil.NativeEndian.PutUint32(0)},
+		&expr.Verdict{Kind: expr.VerdictAccept},
+	)
+	drop := append(matchIIF(network.Interface), &expr.Verdict{Kind: expr.VerdictDrop})
+	// traffic relayed between peers is filtered by the destination peer.
+	relayed := append(matchIIF(network.Interface),
+		&expr.Meta{Key: expr.MetaKeyOIFNAME, Register: 1},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: ifname(network.Interface)},
+		&expr.Verdict{Kind: expr.VerdictAccept},
+	)
+	for _, hook := range []struct {
+		name  string
+		hook  *nftables.ChainHook
+		rules []aclRule
+		extra [][]expr.Any
+	}{
+		{name: "-input", hook: nftables.ChainHookInput, rules: input},
+		{name: "-forward", hook: nftables.ChainHookForward, rules: forward, extra: [][]expr.Any{relayed}},
+	} {
+		chain := c.AddChain(&nftables.Chain{
+			Name:     network.Interface + hook.name,
+			Table:    table,
+			Type:     nftables.ChainTypeFilter,
+			Hooknum:  hook.hook,
+			Priority: nftables.ChainPriorityFilter,
+		})
+		exprs := append([][]expr.Any{established}, hook.extra...)
+		for _, rule := range hook.rules {
+			exprs = append(exprs, ruleExprs(network.Interface, rule))
+		}
+		exprs = append(exprs, drop)
+		for _, e := range exprs {
+			c.AddRule(&nftables.Rule{Table: table, Chain: chain, Exprs: e})
+		}
+	}
+	return c.Flush()
+}
+
+// delPolicies deletes the filter chains of a network interface.
+func delPolicies(iface string) error {
+	c := &nftables.Conn{}
+	chains, err := c.ListChainsOfTableFamily(nftables.TableFamilyINet)
+	if err != nil {
+		return err
+	}
+	found := false
+	for _, chain := range chains {
+		if chain.Table.Name != plexusFilter {
+			continue
+		}
+		if chain.Name == iface+"-input" || chain.Name == iface+"-forward" {
+			slog.Debug("deleting filter chain", "chain", chain.Name)
+			c.DelChain(chain)
+			found = true
+		}
+	}
+	if !found {
+		return nil
+	}
+	return c.Flush()
+}
+
+// refreshPolicies re-applies the policies of a network after its peers change.
+func refreshPolicies(self Device, name string) {
+	network, err := boltdb.Get[Network](name, networkTable)
+	if err != nil {
+		return
+	}
+	if err := applyPolicies(self, network); err != nil {
+		slog.Error("apply policies", "network", network.Name, "error", err)
+	}
+}
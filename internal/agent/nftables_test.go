@@ -3,6 +3,7 @@ package agent
 import (
 	"net"
 	"os/user"
+	"slices"
 	"testing"
 
 	"github.com/Kairum-Labs/should"
@@ -146,10 +147,10 @@ func TestCheckForNat(t *testing.T) {
 	})
 	t.Run("subnetWithoutNat", func(t *testing.T) {
 		peer.IsSubnetRouter = true
-		peer.Subnet = net.IPNet{
+		peer.Subnets = []plexus.RouterSubnet{{Subnet: net.IPNet{
 			IP:   net.ParseIP("192.168.0.0"),
 			Mask: net.CIDRMask(24, 32),
-		}
+		}}}
 		network.Peers = []plexus.NetworkPeer{peer}
 		err = checkForNat(self, network)
 		should.NotBeError(t, err)
@@ -164,7 +165,7 @@ func TestCheckForNat(t *testing.T) {
 	t.Run("subnetWithNat", func(t *testing.T) {
 		table := &nftables.Table{}
 		chain := &nftables.Chain{}
-		peer.UseNat = true
+		peer.Subnets[0].UseNat = true
 		network.Peers = []plexus.NetworkPeer{peer}
 		err = checkForNat(self, network)
 		should.NotBeError(t, err)
@@ -203,9 +204,9 @@ func TestCheckForNat(t *testing.T) {
 	t.Run("virtual subnet", func(t *testing.T) {
 		table := &nftables.Table{}
 		chain := &nftables.Chain{}
-		peer.UseNat = false
-		peer.UseVirtSubnet = true
-		peer.VirtSubnet = net.IPNet{
+		peer.Subnets[0].UseNat = false
+		peer.Subnets[0].UseVirtSubnet = true
+		peer.Subnets[0].VirtSubnet = net.IPNet{
 			IP:   net.ParseIP("10.100.0.0").To4(),
 			Mask: net.CIDRMask(24, 32),
 		}
@@ -253,3 +254,155 @@ func cleanNat(t *testing.T, c *nftables.Conn) {
 		}
 	}
 }
+
+func TestCompilePolicies(t *testing.T) {
+	_, v4, _ := net.ParseCIDR("10.100.0.0/24")
+	_, v6, _ := net.ParseCIDR("fd00:100::/64")
+	_, lan, _ := net.ParseCIDR("192.168.1.0/24")
+	self := Device{Peer: plexus.Peer{WGPublicKey: "router"}}
+	network := Network{Network: plexus.Network{
+		Net:  *v4,
+		Net6: *v6,
+		Peers: []plexus.NetworkPeer{
+			{
+				WGPublicKey:    "router",
+				Address:        net.IPNet{IP: net.ParseIP("10.100.0.1"), Mask: v4.Mask},
+				IsSubnetRouter: true,
+				Subnets:        []plexus.RouterSubnet{{Subnet: *lan}},
+				Groups:         []string{"servers"},
+			},
+			{
+				WGPublicKey: "laptop",
+				Address:     net.IPNet{IP: net.ParseIP("10.100.0.2"), Mask: v4.Mask},
+				Address6:    net.IPNet{IP: net.ParseIP("fd00:100::2"), Mask: v6.Mask},
+				Tags:        []string{"admin"},
+			},
+		},
+	}}
+	t.Run("none", func(t *testing.T) {
+		input, forward := compilePolicies(self, network)
+		should.BeEqual(t, len(input), 0)
+		should.BeEqual(t, len(forward), 0)
+	})
+	t.Run("ssh", func(t *testing.T) {
+		network.Policies = []plexus.Policy{{
+			Name: "ssh", Source: "laptop", Destination: "router", Protocol: plexus.ProtoTCP, Ports: "22,2222",
+		}}
+		input, forward := compilePolicies(self, network)
+		should.BeEqual(t, len(forward), 0)
+		// two source addresses and two port ranges.
+		should.BeEqual(t, len(input), 4)
+		should.BeEqual(t, input[0].family, nftables.TableFamilyIPv4)
+		should.BeEqual(t, input[0].source.String(), "10.100.0.2/32")
+		should.BeNil(t, input[0].destination)
+		should.BeEqual(t, input[0].protocol, byte(6))
+		should.BeEqual(t, input[1].ports, plexus.PortRange{First: 2222, Last: 2222})
+		should.BeEqual(t, input[2].source.String(), "fd00:100::2/128")
+	})
+	t.Run("subnet", func(t *testing.T) {
+		network.Policies = []plexus.Policy{{
+			Name: "printer", Source: plexus.PolicyAny, Destination: "192.168.1.10/32", Protocol: plexus.ProtoICMP,
+		}}
+		input, forward := compilePolicies(self, network)
+		should.BeEqual(t, len(input), 0)
+		should.BeEqual(t, len(forward), 1)
+		should.BeEqual(t, forward[0].destination.String(), "192.168.1.10/32")
+		should.BeEqual(t, forward[0].protocol, byte(1))
+	})
+	t.Run("any", func(t *testing.T) {
+		network.Policies = []plexus.Policy{{
+			Name: "icmp", Source: plexus.PolicyAny, Destination: plexus.PolicyAny, Protocol: plexus.ProtoICMP,
+		}}
+		input, forward := compilePolicies(self, network)
+		should.BeEqual(t, len(input), 2)
+		should.BeEqual(t, input[1].protocol, byte(58))
+		should.BeEqual(t, forward[0].destination.String(), "192.168.1.0/24")
+	})
+	t.Run("selectors", func(t *testing.T) {
+		network.Policies = []plexus.Policy{
+			{Name: "admin", Source: "tag:admin", Destination: "group:servers", Protocol: plexus.ProtoTCP},
+			{Name: "laptops", Source: plexus.PolicyAny, Destination: "group:laptops"},
+		}
+		input, forward := compilePolicies(self, network)
+		should.BeEqual(t, len(forward), 0)
+		should.BeEqual(t, len(input), 2)
+		should.BeEqual(t, input[0].source.String(), "10.100.0.2/32")
+		should.BeEqual(t, input[1].source.String(), "fd00:100::2/128")
+	})
+	t.Run("exitNode", func(t *testing.T) {
+		exit := network
+		exit.Peers = slices.Clone(network.Peers)
+		exit.Peers[0].IsExitNode = true
+		exit.Peers[0].IsSubnetRouter = false
+		exit.Peers = append(exit.Peers, plexus.NetworkPeer{
+			WGPublicKey: "phone",
+			Address:     net.IPNet{IP: net.ParseIP("10.100.0.3"), Mask: v4.Mask},
+			ExitNode:    "router",
+			Tags:        []string{"admin"},
+		})
+		exit.Policies = []plexus.Policy{
+			{Name: "web", Source: "tag:admin", Destination: plexus.PolicyAny, Protocol: plexus.ProtoTCP},
+			{Name: "dns", Source: plexus.PolicyAny, Destination: "8.8.8.8/32", Protocol: plexus.ProtoUDP},
+			{Name: "inside", Source: plexus.PolicyAny, Destination: "10.100.0.0/25"},
+		}
+		_, forward := compilePolicies(self, exit)
+		// only the phone uses the exit node; the laptop is not forwarded to the internet.
+		should.BeEqual(t, len(forward), 2)
+		should.BeEqual(t, forward[0].source.String(), "10.100.0.3/32")
+		should.BeNil(t, forward[0].destination)
+		should.BeEqual(t, forward[0].protocol, byte(6))
+		should.BeEqual(t, forward[1].source.String(), "10.100.0.3/32")
+		should.BeEqual(t, forward[1].destination.String(), "8.8.8.8/32")
+		should.BeEqual(t, forward[1].protocol, byte(17))
+		should.BeEqual(t, len(exitDestinations(exit.Peers[0], exit, "10.100.0.0/25")), 0)
+		should.BeEqual(t, len(exitDestinations(exit.Peers[1], exit, plexus.PolicyAny)), 0)
+	})
+	t.Run("virtual", func(t *testing.T) {
+		_, virt, _ := net.ParseCIDR("10.50.1.0/24")
+		subnet := network.Peers[0].Subnets[0]
+		subnet.UseVirtSubnet = true
+		subnet.VirtSubnet = *virt
+		should.BeEqual(t, routedSubnet(subnet, "10.50.1.10/32").String(), "192.168.1.10/32")
+		should.BeNil(t, routedSubnet(subnet, "10.60.0.0/16"))
+	})
+}
+
+func TestApplyPolicies(t *testing.T) {
+	user, err := user.Current()
+	should.NotBeError(t, err)
+	if user.Uid != "0" {
+		t.Log("this test must be run as root")
+		t.Skip()
+	}
+	self := Device{Peer: plexus.Peer{WGPublicKey: "self"}}
+	network := Network{Interface: "plexus-acl0"}
+	network.Peers = []plexus.NetworkPeer{
+		{WGPublicKey: "self", Address: net.IPNet{IP: net.ParseIP("10.100.0.1"), Mask: net.CIDRMask(24, 32)}},
+		{WGPublicKey: "other", Address: net.IPNet{IP: net.ParseIP("10.100.0.2"), Mask: net.CIDRMask(24, 32)}},
+	}
+	network.Policies = []plexus.Policy{{
+		Name: "ssh", Source: "other", Destination: plexus.PolicyAny, Protocol: plexus.ProtoTCP, Ports: "22",
+	}}
+	should.NotBeError(t, applyPolicies(self, network))
+	c := &nftables.Conn{}
+	chains, err := c.ListChainsOfTableFamily(nftables.TableFamilyINet)
+	should.NotBeError(t, err)
+	found := false
+	for _, chain := range chains {
+		if chain.Name == "plexus-acl0-input" {
+			found = true
+			rules, err := c.GetRules(chain.Table, chain)
+			should.NotBeError(t, err)
+			// established, ssh and drop.
+			should.BeEqual(t, len(rules), 3)
+		}
+	}
+	should.BeTrue(t, found)
+	network.Policies = nil
+	should.NotBeError(t, applyPolicies(self, network))
+	chains, err = c.ListChainsOfTableFamily(nftables.TableFamilyINet)
+	should.NotBeError(t, err)
+	for _, chain := range chains {
+		should.BeFalse(t, chain.Name == "plexus-acl0-input")
+	}
+}
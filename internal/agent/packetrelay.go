@@ -0,0 +1,345 @@
+package agent
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/devilcove/plexus"
+	"github.com/devilcove/plexus/internal/packetrelay"
+	"github.com/nats-io/nkeys"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+const (
+	defaultRelayPort = 4223
+	relayRetryTime   = time.Second * 5
+	relayDialTimeout = time.Second * 10
+)
+
+var errRelayRejected = errors.New("packet relay rejected the device")
+
+// relayClient tunnels the wireguard packets exchanged with the peers that use
+// the packet relay of the server. Wireguard sends the packets of each of these
+// peers to a local udp proxy, the endpoint of the peer, and receives the
+// packets of the peer from it.
+type relayClient struct {
+	mu      sync.Mutex
+	writeMu sync.Mutex
+	conn    net.Conn
+	cancel  context.CancelFunc
+	key     string
+	proxies map[string]*relayProxy
+}
+
+// relayProxy is the local endpoint of a peer of a network reached through the
+// packet relay.
+type relayProxy struct {
+	network string
+	peer    string
+	wgPort  int
+	conn    *net.UDPConn
+}
+
+var serverRelay = newRelayClient()
+
+func newRelayClient() *relayClient {
+	return &relayClient{proxies: map[string]*relayProxy{}}
+}
+
+// usesServerRelay reports whether self and peer exchange their packets through
+// the packet relay of the server.
+func usesServerRelay(self Device, network Network, peer plexus.NetworkPeer) bool {
+	if peer.ServerRelayed {
+		return true
+	}
+	me := getSelfFromPeers(&self, network.Peers)
+	return me != nil && me.ServerRelayed
+}
+
+// useServerRelay points wgPeer at the local proxy of the packet relay when
+// self and peer exchange their packets through it.
+func useServerRelay(self Device, network Network, peer plexus.NetworkPeer, wgPeer *wgtypes.PeerConfig) {
+	if !usesServerRelay(self, network, peer) {
+		return
+	}
+	if endpoint := serverRelay.endpoint(self, network.Name, network.ListenPort, peer.WGPublicKey); endpoint != nil {
+		wgPeer.Endpoint = endpoint
+	}
+}
+
+// relayServers returns the urls of the packet relay: the one from the
+// registration token or else the address of the server, over tls then tcp.
+func relayServers(self Device) []string {
+	if self.RelayServer != "" {
+		return []string{self.RelayServer}
+	}
+	server, err := url.Parse(self.Server)
+	if err != nil || server.Hostname() == "" {
+		return []string{}
+	}
+	addr := net.JoinHostPort(server.Hostname(), strconv.Itoa(defaultRelayPort))
+	return []string{"tls://" + addr, "tcp://" + addr}
+}
+
+// endpoints keeps the proxies of the peers of network reached through the
+// packet relay and returns their addresses, indexed by peer. wgPort is the
+// listen port of the wireguard interface of the network. The connection to
+// the packet relay is kept while there are proxies.
+func (c *relayClient) endpoints(self Device, network string, wgPort int, peers []string) map[string]*net.UDPAddr {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	endpoints := map[string]*net.UDPAddr{}
+	keep := map[string]bool{}
+	for _, peer := range peers {
+		keep[network+"/"+peer] = true
+	}
+	for key, proxy := range c.proxies {
+		if proxy.network == network && !keep[key] {
+			proxy.conn.Close()
+			delete(c.proxies, key)
+		}
+	}
+	for _, peer := range peers {
+		proxy, err := c.proxy(network, wgPort, peer)
+		if err != nil {
+			slog.Error("packet relay proxy", "network", network, "peer", peer, "error", err)
+			continue
+		}
+		endpoints[peer], _ = proxy.conn.LocalAddr().(*net.UDPAddr)
+	}
+	c.connection(self)
+	return endpoints
+}
+
+// endpoint returns the address of the proxy of a peer of network reached
+// through the packet relay.
+func (c *relayClient) endpoint(self Device, network string, wgPort int, peer string) *net.UDPAddr {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	proxy, err := c.proxy(network, wgPort, peer)
+	if err != nil {
+		slog.Error("packet relay proxy", "network", network, "peer", peer, "error", err)
+		return nil
+	}
+	c.connection(self)
+	addr, _ := proxy.conn.LocalAddr().(*net.UDPAddr)
+	return addr
+}
+
+// proxy returns the proxy of peer, creating it if needed. c.mu is held.
+func (c *relayClient) proxy(network string, wgPort int, peer string) (*relayProxy, error) {
+	if proxy, ok := c.proxies[network+"/"+peer]; ok {
+		proxy.wgPort = wgPort
+		return proxy, nil
+	}
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		return nil, err
+	}
+	proxy := &relayProxy{network: network, peer: peer, wgPort: wgPort, conn: conn}
+	c.proxies[network+"/"+peer] = proxy
+	go c.forward(proxy)
+	return proxy, nil
+}
+
+// connection starts the connection to the packet relay when there are proxies
+// and stops it when there are none, or when the device changed keys. c.mu is
+// held.
+func (c *relayClient) connection(self Device) {
+	if c.cancel != nil && (len(c.proxies) == 0 || c.key != self.WGPublicKey) {
+		c.cancel()
+		c.cancel = nil
+		if c.conn != nil {
+			c.conn.Close()
+		}
+	}
+	if len(c.proxies) > 0 && c.cancel == nil {
+		ctx, cancel := context.WithCancel(context.Background())
+		c.cancel = cancel
+		c.key = self.WGPublicKey
+		go c.run(ctx, self)
+	}
+}
+
+// run keeps a connection to the packet relay until ctx is done.
+func (c *relayClient) run(ctx context.Context, self Device) {
+	for ctx.Err() == nil {
+		conn, err := connectRelay(self)
+		if err != nil {
+			slog.Warn("packet relay", "error", err)
+			select {
+			case <-ctx.Done():
+			case <-time.After(relayRetryTime):
+			}
+			continue
+		}
+		c.mu.Lock()
+		if ctx.Err() != nil {
+			c.mu.Unlock()
+			conn.Close()
+			return
+		}
+		c.conn = conn
+		c.mu.Unlock()
+		slog.Info("connected to packet relay", "server", conn.RemoteAddr())
+		c.receive(conn)
+		c.mu.Lock()
+		if c.conn == conn {
+			c.conn = nil
+		}
+		c.mu.Unlock()
+		conn.Close()
+	}
+}
+
+// connectRelay connects to the first of the packet relays of the server that
+// accepts the device.
+func connectRelay(self Device) (net.Conn, error) {
+	errs := []error{}
+	for _, server := range relayServers(self) {
+		conn, err := dialRelay(server, self)
+		if err == nil {
+			return conn, nil
+		}
+		errs = append(errs, fmt.Errorf("%s: %w", server, err))
+	}
+	if len(errs) == 0 {
+		return nil, errors.New("no packet relay")
+	}
+	return nil, errors.Join(errs...)
+}
+
+// dialRelay connects to the packet relay at server (tcp:// or tls:// url) and
+// authenticates with the nkey of the device.
+func dialRelay(server string, self Device) (net.Conn, error) {
+	relay, err := url.Parse(server)
+	if err != nil {
+		return nil, err
+	}
+	dialer := &net.Dialer{Timeout: relayDialTimeout}
+	var conn net.Conn
+	switch relay.Scheme {
+	case "tls":
+		conn, err = tls.DialWithDialer(dialer, "tcp", relay.Host, &tls.Config{ServerName: relay.Hostname()})
+	case "tcp":
+		conn, err = dialer.Dial("tcp", relay.Host)
+	default:
+		return nil, fmt.Errorf("invalid packet relay scheme %q", relay.Scheme)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := authenticateRelay(conn, self); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// authenticateRelay signs the challenge of the packet relay with the nkey of
+// the device.
+func authenticateRelay(conn net.Conn, self Device) error {
+	if err := conn.SetDeadline(time.Now().Add(relayDialTimeout)); err != nil {
+		return err
+	}
+	kind, nonce, err := packetrelay.ReadFrame(conn)
+	if err != nil {
+		return err
+	}
+	if kind != packetrelay.FrameChallenge {
+		return errRelayRejected
+	}
+	kp, err := nkeys.FromSeed([]byte(self.Seed))
+	if err != nil {
+		return err
+	}
+	signature, err := kp.Sign(nonce)
+	if err != nil {
+		return err
+	}
+	hello, err := json.Marshal(packetrelay.Hello{WGPublicKey: self.WGPublicKey, Signature: signature})
+	if err != nil {
+		return err
+	}
+	if err := packetrelay.WriteFrame(conn, packetrelay.FrameHello, hello); err != nil {
+		return err
+	}
+	kind, _, err = packetrelay.ReadFrame(conn)
+	if err != nil {
+		return fmt.Errorf("%w: %w", errRelayRejected, err)
+	}
+	if kind != packetrelay.FrameAccept {
+		return errRelayRejected
+	}
+	return conn.SetDeadline(time.Time{})
+}
+
+// receive hands the packets received from the packet relay to wireguard
+// through the proxy of their source until the connection fails.
+func (c *relayClient) receive(conn net.Conn) {
+	for {
+		kind, payload, err := packetrelay.ReadFrame(conn)
+		if err != nil {
+			slog.Debug("packet relay read", "error", err)
+			return
+		}
+		if kind != packetrelay.FramePacket {
+			continue
+		}
+		packet, err := packetrelay.UnmarshalPacket(payload)
+		if err != nil {
+			slog.Debug("packet relay", "error", err)
+			continue
+		}
+		c.mu.Lock()
+		proxy := c.proxies[packet.Network+"/"+packet.Peer]
+		c.mu.Unlock()
+		if proxy == nil {
+			continue
+		}
+		wireguard := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: proxy.wgPort}
+		if _, err := proxy.conn.WriteToUDP(packet.Data, wireguard); err != nil {
+			slog.Debug("packet relay proxy write", "peer", packet.Peer, "error", err)
+		}
+	}
+}
+
+// forward sends the packets wireguard sends to proxy to the packet relay until
+// the proxy is closed. Packets are dropped while the relay is not connected.
+func (c *relayClient) forward(proxy *relayProxy) {
+	buf := make([]byte, packetrelay.MaxPayload)
+	for {
+		n, err := proxy.conn.Read(buf)
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				slog.Debug("packet relay proxy read", "peer", proxy.peer, "error", err)
+			}
+			return
+		}
+		payload, err := packetrelay.Packet{Network: proxy.network, Peer: proxy.peer, Data: buf[:n]}.Marshal()
+		if err != nil {
+			continue
+		}
+		c.mu.Lock()
+		conn := c.conn
+		c.mu.Unlock()
+		if conn == nil {
+			continue
+		}
+		c.writeMu.Lock()
+		err = packetrelay.WriteFrame(conn, packetrelay.FramePacket, payload)
+		c.writeMu.Unlock()
+		if err != nil {
+			slog.Debug("packet relay write", "error", err)
+		}
+	}
+}
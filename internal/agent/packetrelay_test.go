@@ -0,0 +1,151 @@
+package agent
+
+import (
+	"encoding/json"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Kairum-Labs/should"
+	"github.com/devilcove/plexus"
+	"github.com/devilcove/plexus/internal/packetrelay"
+	"github.com/nats-io/nkeys"
+)
+
+// fakePacketRelay forwards packets between the devices connected to it,
+// accepting any device, and returns its url.
+func fakePacketRelay(t *testing.T) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	should.NotBeError(t, err)
+	t.Cleanup(func() { listener.Close() })
+	mu := sync.Mutex{}
+	clients := map[string]net.Conn{}
+	handle := func(conn net.Conn) {
+		defer conn.Close()
+		if err := packetrelay.WriteFrame(conn, packetrelay.FrameChallenge, []byte("nonce")); err != nil {
+			return
+		}
+		_, payload, err := packetrelay.ReadFrame(conn)
+		if err != nil {
+			return
+		}
+		hello := packetrelay.Hello{}
+		if err := json.Unmarshal(payload, &hello); err != nil {
+			return
+		}
+		if err := packetrelay.WriteFrame(conn, packetrelay.FrameAccept, nil); err != nil {
+			return
+		}
+		mu.Lock()
+		clients[hello.WGPublicKey] = conn
+		mu.Unlock()
+		for {
+			_, payload, err := packetrelay.ReadFrame(conn)
+			if err != nil {
+				return
+			}
+			packet, err := packetrelay.UnmarshalPacket(payload)
+			if err != nil {
+				continue
+			}
+			mu.Lock()
+			to := clients[packet.Peer]
+			mu.Unlock()
+			if to == nil {
+				continue
+			}
+			packet.Peer = hello.WGPublicKey
+			payload, _ = packet.Marshal()
+			_ = packetrelay.WriteFrame(to, packetrelay.FramePacket, payload)
+		}
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go handle(conn)
+		}
+	}()
+	return "tcp://" + listener.Addr().String()
+}
+
+func TestPacketRelay(t *testing.T) {
+	relay := fakePacketRelay(t)
+	device := func(t *testing.T, key string) Device {
+		t.Helper()
+		kp, err := nkeys.CreateUser()
+		should.NotBeError(t, err)
+		seed, err := kp.Seed()
+		should.NotBeError(t, err)
+		self := Device{Seed: string(seed), RelayServer: relay}
+		self.WGPublicKey = key
+		return self
+	}
+	// the wireguard interfaces of two loopback peers.
+	alphaWG, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	should.NotBeError(t, err)
+	defer alphaWG.Close()
+	betaWG, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	should.NotBeError(t, err)
+	defer betaWG.Close()
+	alpha := newRelayClient()
+	beta := newRelayClient()
+	alphaSelf := device(t, "alpha")
+	betaSelf := device(t, "beta")
+	toBeta := alpha.endpoints(alphaSelf, "plexus", alphaWG.LocalAddr().(*net.UDPAddr).Port, []string{"beta"})["beta"]
+	toAlpha := beta.endpoints(betaSelf, "plexus", betaWG.LocalAddr().(*net.UDPAddr).Port, []string{"alpha"})["alpha"]
+	should.NotBeNil(t, toBeta)
+	should.NotBeNil(t, toAlpha)
+
+	// exchange sends data from one interface to the proxy of the other peer
+	// until it is received, as packets are dropped until both are connected.
+	exchange := func(t *testing.T, from, to *net.UDPConn, proxy *net.UDPAddr, data string) *net.UDPAddr {
+		t.Helper()
+		buf := make([]byte, 1500)
+		for range 50 {
+			_, err := from.WriteToUDP([]byte(data), proxy)
+			should.NotBeError(t, err)
+			should.NotBeError(t, to.SetReadDeadline(time.Now().Add(time.Millisecond*100)))
+			n, source, err := to.ReadFromUDP(buf)
+			if err == nil {
+				should.BeEqual(t, string(buf[:n]), data)
+				return source
+			}
+		}
+		t.Fatal("packet not relayed")
+		return nil
+	}
+	t.Run("loopback", func(t *testing.T) {
+		// packets arrive from the proxy of the sender, so wireguard answers
+		// through the relay.
+		source := exchange(t, alphaWG, betaWG, toBeta, "handshake initiation")
+		should.BeEqual(t, source.String(), toAlpha.String())
+		source = exchange(t, betaWG, alphaWG, toAlpha, "handshake response")
+		should.BeEqual(t, source.String(), toBeta.String())
+	})
+	t.Run("stop", func(t *testing.T) {
+		should.BeEqual(t, len(alpha.endpoints(alphaSelf, "plexus", 0, nil)), 0)
+		alpha.mu.Lock()
+		defer alpha.mu.Unlock()
+		should.BeEqual(t, len(alpha.proxies), 0)
+		should.BeNil(t, alpha.cancel)
+	})
+	beta.endpoints(betaSelf, "plexus", 0, nil)
+}
+
+func TestUsesServerRelay(t *testing.T) {
+	self := Device{}
+	self.WGPublicKey = "self"
+	network := Network{}
+	network.Peers = []plexus.NetworkPeer{{WGPublicKey: "self"}, {WGPublicKey: "peer"}}
+	should.BeFalse(t, usesServerRelay(self, network, network.Peers[1]))
+	should.BeTrue(t, usesServerRelay(self, network, plexus.NetworkPeer{WGPublicKey: "peer", ServerRelayed: true}))
+	network.Peers[0].ServerRelayed = true
+	should.BeTrue(t, usesServerRelay(self, network, network.Peers[1]))
+	should.BeEqual(t, relayServers(Device{Server: "nats://plexus.example.com:4222"}),
+		[]string{"tls://plexus.example.com:4223", "tcp://plexus.example.com:4223"})
+}
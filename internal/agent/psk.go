@@ -0,0 +1,122 @@
+package agent
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+
+	"github.com/devilcove/boltdb"
+	"github.com/devilcove/plexus"
+	"github.com/nats-io/nats.go"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// presharedKey returns the preshared key shared with a peer. Without one, the
+// zero key is returned, which removes the preshared key of a wireguard peer.
+func (n Network) presharedKey(peer string) *wgtypes.Key {
+	key := wgtypes.Key{}
+	if psk, ok := n.PresharedKeys[peer]; ok {
+		parsed, err := wgtypes.ParseKey(psk)
+		if err != nil {
+			slog.Error("invalid preshared key", "network", n.Name, "peer", peer, "error", err)
+		} else {
+			key = parsed
+		}
+	}
+	return &key
+}
+
+// updatePresharedKeys saves the preshared keys of a network and sets them on
+// the wireguard peers of the network interface, if it is up. Pending keys are
+// acknowledged; the server sends them again as keys once the other peers of
+// the pairs hold them too.
+func updatePresharedKeys(update plexus.PresharedKeyUpdate) {
+	network, err := boltdb.Get[Network](update.Network, networkTable)
+	if err != nil {
+		if errors.Is(err, boltdb.ErrNoResults) {
+			slog.Debug("preshared keys for unknown network", "network", update.Network)
+			return
+		}
+		slog.Error("get network", "network", update.Network, "error", err)
+		return
+	}
+	network.PresharedKeys = update.Keys
+	if err := boltdb.Save(network, network.Name, networkTable); err != nil {
+		slog.Error("save network -- preshared keys", "error", err)
+		return
+	}
+	if len(update.Pending) > 0 {
+		ackPresharedKeys(update)
+	}
+	wg, err := plexus.Get(network.Interface)
+	if err != nil {
+		slog.Debug("interface not up", "interface", network.Interface, "error", err)
+		return
+	}
+	for i, peer := range wg.Config.Peers {
+		wg.Config.Peers[i].PresharedKey = network.presharedKey(peer.PublicKey.String())
+	}
+	if err := wg.Apply(); err != nil {
+		slog.Error("apply wg config", "error", err)
+	}
+}
+
+// ackPresharedKeys tells the server that the pending preshared keys of update
+// were received.
+func ackPresharedKeys(update plexus.PresharedKeyUpdate) {
+	conn := serverConn.Load()
+	if conn == nil {
+		return
+	}
+	self, err := boltdb.Get[Device]("self", deviceTable)
+	if err != nil {
+		slog.Error("get device", "error", err)
+		return
+	}
+	ack := plexus.PresharedKeyUpdate{Network: update.Network, Pending: update.Pending}
+	response := plexus.MessageResponse{}
+	if err := Request(conn, self.WGPublicKey+plexus.PresharedKeysAck, ack, &response, NatsTimeout); err != nil {
+		slog.Error("acknowledge preshared keys", "error", err)
+		return
+	}
+	if response.IncludesError {
+		slog.Error("acknowledge preshared keys", "error", response.Error)
+	}
+}
+
+// presharedKeysUpdate handles preshared keys sent by the server.
+func presharedKeysUpdate(msg *nats.Msg) {
+	update := plexus.PresharedKeyUpdate{}
+	if err := json.Unmarshal(msg.Data, &update); err != nil {
+		slog.Error("invalid preshared keys", "error", err)
+		return
+	}
+	slog.Info("preshared keys update", "network", update.Network, "peers", len(update.Keys),
+		"pending", len(update.Pending))
+	updatePresharedKeys(update)
+}
+
+// requestPresharedKeys fetches the preshared keys of all networks from the server.
+func requestPresharedKeys() {
+	conn := serverConn.Load()
+	if conn == nil {
+		return
+	}
+	self, err := boltdb.Get[Device]("self", deviceTable)
+	if err != nil {
+		slog.Error("get device", "error", err)
+		return
+	}
+	response := plexus.PresharedKeyResponse{}
+	if err := Request(conn, self.WGPublicKey+plexus.PresharedKeys, nil, &response, NatsTimeout); err != nil {
+		slog.Error("request preshared keys", "error", err)
+		return
+	}
+	if response.Message != "" {
+		slog.Error("request preshared keys", "error", response.Message)
+		return
+	}
+	for _, update := range response.Networks {
+		updatePresharedKeys(update)
+	}
+}
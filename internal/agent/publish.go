@@ -24,6 +24,7 @@ func publishDeviceUpdate(self *Device) {
 		OS:            self.OS,
 		Endpoint:      self.Endpoint,
 		NatsConnected: true,
+		NatType:       self.NatType,
 	})
 	if err != nil {
 		slog.Error("publish device update endcoding error", "error", err)
@@ -94,6 +95,7 @@ func checkin() {
 	checkinData.Name = self.Name
 	checkinData.Version = self.Version
 	checkinData.Endpoint = self.Endpoint
+	checkinData.NatType = checkNatType(&self)
 	networks, err := boltdb.GetAll[Network](networkTable)
 	if err != nil {
 		slog.Error("get networks", "error", err)
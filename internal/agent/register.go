@@ -3,16 +3,19 @@ package agent
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
 	"log"
 	"log/slog"
 	"net"
 	"os"
 	"runtime"
+	"slices"
 	"strings"
 	"time"
 
 	"github.com/devilcove/boltdb"
 	"github.com/devilcove/plexus"
+	"github.com/nats-io/nats.go"
 	"github.com/nats-io/nkeys"
 	"github.com/pion/stun/v3"
 	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
@@ -46,6 +49,18 @@ func handleRegistration(request *plexus.RegisterRequest) plexus.MessageResponse
 		log.Println(err)
 		return plexus.MessageResponse{Message: "invalid registration key: " + err.Error()}
 	}
+	if loginKey.Stun != "" {
+		// the public endpoint is discovered again with the server's stun server.
+		self.StunServer = loginKey.Stun
+		stunAddr, err := getPublicAddPort(checkPort(defaultWGPort), stunServers(self))
+		if err != nil {
+			slog.Warn("public address", "error", err)
+		} else {
+			self.Endpoint = stunAddr.IP
+		}
+	}
+	self.RelayServer = loginKey.Relay
+	self.Servers = clusterURLs(loginKey)
 	conn, err := createRegistationConnection(loginKey)
 	if err != nil {
 		return plexus.MessageResponse{Message: "invalid registration key: " + err.Error()}
@@ -55,10 +70,16 @@ func handleRegistration(request *plexus.RegisterRequest) plexus.MessageResponse
 		KeyName: loginKey.KeyName,
 		Peer:    self.Peer,
 	}
-	if err := Request(conn, "register", serverRequest, &resp, NatsTimeout); err != nil {
+	if err := Request(conn, plexus.RegisterKey+loginKey.KeyName, serverRequest, &resp, NatsTimeout); err != nil {
 		log.Println(err)
 		return plexus.MessageResponse{Message: "error: " + err.Error()}
 	}
+	if resp.Message == plexus.RegistrationPending {
+		resp = waitForApproval(conn, self.WGPublicKey)
+		if resp.Message == plexus.RegistrationRejected || resp.IncludesError {
+			return resp
+		}
+	}
 	self.Server = conn.ConnectedUrl()
 	if err := boltdb.Save(self, "self", deviceTable); err != nil {
 		slog.Error("save device", "error", err)
@@ -71,6 +92,29 @@ func handleRegistration(request *plexus.RegisterRequest) plexus.MessageResponse
 	return resp
 }
 
+// waitForApproval waits for an admin to approve or reject a registration
+// that requires approval. A registration still pending when the wait ends
+// completes when the agent is able to connect to the server.
+func waitForApproval(conn *nats.Conn, id string) plexus.MessageResponse {
+	slog.Info("registration pending approval")
+	request := plexus.RegistrationStatusRequest{WGPublicKey: id}
+	deadline := time.Now().Add(ApprovalTimeout)
+	for time.Now().Before(deadline) {
+		time.Sleep(approvalInterval)
+		resp := plexus.MessageResponse{}
+		if err := Request(conn, plexus.RegistrationStatus, request, &resp, NatsTimeout); err != nil {
+			// the registration connection is closed when the key is used up.
+			slog.Debug("registration status", "error", err)
+			break
+		}
+		if resp.Message != plexus.RegistrationPending {
+			slog.Info(resp.Message)
+			return resp
+		}
+	}
+	return plexus.MessageResponse{Message: plexus.RegistrationPending}
+}
+
 func newDevice() (Device, error) {
 	device, err := boltdb.Get[Device]("self", deviceTable)
 	version := Version()
@@ -127,20 +171,21 @@ func createPeer() (*plexus.Peer, *wgtypes.Key, string, error) {
 	if strings.Contains(pubKey.String(), "/") {
 		return nil, nil, empty, errors.New("invalid public key")
 	}
-	port := checkPort(51820)
-	stunAddr, err := getPublicAddPort(port)
-	if err != nil {
-		return nil, nil, empty, err
-	}
 	peer := &plexus.Peer{
 		WGPublicKey: pubKey.String(),
 		PubNkey:     nkey,
 		Name:        name,
 		Version:     Version(),
-		Endpoint:    stunAddr.IP,
 		OS:          runtime.GOOS,
 		Updated:     time.Now(),
 	}
+	// the endpoint is discovered on registration when no stun server is reachable.
+	stunAddr, err := getPublicAddPort(checkPort(defaultWGPort), stunServers(Device{}))
+	if err != nil {
+		slog.Warn("public address", "error", err)
+	} else {
+		peer.Endpoint = stunAddr.IP
+	}
 	return peer, privKey, string(seed), nil
 }
 
@@ -172,32 +217,51 @@ func checkPort(rangestart int) int {
 	return 0
 }
 
-func getPublicAddPort(port int) (*stun.XORMappedAddress, error) {
-	add := &stun.XORMappedAddress{}
-	stunServer, err := net.ResolveUDPAddr("udp4", "stun1.l.google.com:19302")
-	if err != nil {
-		return nil, err
+// stunServers returns the STUN servers to use: the STUN server of the server
+// self is registered with, then the configured STUN servers.
+func stunServers(self Device) []string {
+	servers := []string{}
+	if self.StunServer != "" {
+		servers = append(servers, self.StunServer)
 	}
-	local := &net.UDPAddr{
-		IP:   net.ParseIP(""),
-		Port: port,
+	configured := Config.StunServers
+	if len(configured) == 0 {
+		configured = DefaultStunServers
 	}
-	c, err := net.DialUDP("udp4", local, stunServer)
-	if err != nil {
-		return nil, err
+	for _, server := range configured {
+		if !slices.Contains(servers, server) {
+			servers = append(servers, server)
+		}
+	}
+	return servers
+}
+
+// getPublicAddPort returns the public address and port of the local port as
+// seen by the first of servers that answers.
+func getPublicAddPort(port int, servers []string) (*stun.XORMappedAddress, error) {
+	errs := []error{}
+	for _, server := range servers {
+		add, err := stunRequest(port, server)
+		if err == nil {
+			return add, nil
+		}
+		slog.Debug("stun request", "server", server, "error", err)
+		errs = append(errs, fmt.Errorf("%s: %w", server, err))
 	}
-	conn, err := stun.NewClient(c)
+	if len(errs) == 0 {
+		return nil, errors.New("no stun servers")
+	}
+	return nil, errors.Join(errs...)
+}
+
+func stunRequest(port int, server string) (*stun.XORMappedAddress, error) {
+	stunServer, err := net.ResolveUDPAddr("udp4", server)
 	if err != nil {
 		return nil, err
 	}
-	defer conn.Close()
-	msg := stun.MustBuild(stun.TransactionID, stun.BindingRequest)
-	if err := conn.Do(msg, func(res stun.Event) {
-		if err := add.GetFrom(res.Message); err != nil {
-			slog.Error("get address", "error", err)
-		}
-	}); err != nil {
+	result, err := stunBinding(port, stunServer)
+	if err != nil {
 		return nil, err
 	}
-	return add, nil
+	return &stun.XORMappedAddress{IP: result.mapped.IP, Port: result.mapped.Port}, nil
 }
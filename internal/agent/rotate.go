@@ -0,0 +1,203 @@
+package agent
+
+import (
+	"errors"
+	"log/slog"
+	"os"
+	"sync"
+
+	"github.com/devilcove/boltdb"
+	"github.com/devilcove/plexus"
+	"github.com/devilcove/plexus/internal/publish"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nkeys"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+var rotateLock sync.Mutex
+
+// rotationKey is the device table key of new keys that the device has not yet
+// confirmed to the server.
+const rotationKey = "rotation"
+
+// rotateKeys replaces the WireGuard and nkey keys of the device. The new keys
+// are saved before the server is asked to re-key the device, so a rotation
+// interrupted by a restart is completed by reconnect. Once the server has
+// re-keyed the device, the new private key is set on the interfaces, without
+// replacing their peers, the server connection is re-established with the new
+// nkey and the rotation is confirmed; only then does the server notify the
+// other peers.
+func rotateKeys() (plexus.MessageResponse, error) {
+	rotateLock.Lock()
+	defer rotateLock.Unlock()
+	response := plexus.MessageResponse{}
+	self, err := boltdb.Get[Device]("self", deviceTable)
+	if err != nil {
+		return response, err
+	}
+	conn := serverConn.Load()
+	if conn == nil {
+		return response, errors.New("not connected to server")
+	}
+	kp, err := nkeys.CreateUser()
+	if err != nil {
+		return response, err
+	}
+	seed, err := kp.Seed()
+	if err != nil {
+		return response, err
+	}
+	nkey, err := kp.PublicKey()
+	if err != nil {
+		return response, err
+	}
+	privKey, pubKey, err := generateKeys()
+	if err != nil {
+		return response, err
+	}
+	next := self
+	next.WGPublicKey = pubKey.String()
+	next.WGPrivateKey = privKey.String()
+	next.PubNkey = nkey
+	next.Seed = string(seed)
+	if err := boltdb.Save(next, rotationKey, deviceTable); err != nil {
+		return response, err
+	}
+	request := plexus.RotateKeysRequest{
+		WGPublicKey: next.WGPublicKey,
+		PubNkey:     next.PubNkey,
+	}
+	if err := Request(conn, self.WGPublicKey+plexus.RotateKeys, request, &response, NatsTimeout); err != nil {
+		// the server may have re-keyed the device; reconnect finds out.
+		return response, err
+	}
+	if response.IncludesError {
+		if err := boltdb.Delete[Device](rotationKey, deviceTable); err != nil {
+			slog.Error("delete rotation", "error", err)
+		}
+		return response, errors.New(response.Error)
+	}
+	closeServerConnections()
+	if err := applyKeys(self, next); err != nil {
+		return response, err
+	}
+	if err := connectToServer(next); err != nil {
+		slog.Error("connect to server", "error", err)
+		return response, nil
+	}
+	confirmRotation(next)
+	return response, nil
+}
+
+// reconnect connects to the server. A key rotation that was not confirmed is
+// completed when the server accepts the new nkey, and discarded when it
+// rejects it as the server did not re-key the device.
+func reconnect(self Device) (Device, error) {
+	rotateLock.Lock()
+	defer rotateLock.Unlock()
+	next, err := boltdb.Get[Device](rotationKey, deviceTable)
+	if err != nil {
+		return self, connectToServer(self)
+	}
+	err = connectToServer(next)
+	if errors.Is(err, nats.ErrAuthorization) {
+		slog.Info("server did not rotate keys, discarding new keys")
+		if err := boltdb.Delete[Device](rotationKey, deviceTable); err != nil {
+			slog.Error("delete rotation", "error", err)
+		}
+		return self, connectToServer(self)
+	}
+	if err != nil {
+		return self, err
+	}
+	if err := applyKeys(self, next); err != nil {
+		slog.Error("apply rotated keys", "error", err)
+	}
+	confirmRotation(next)
+	return next, nil
+}
+
+// applyKeys switches the device and its interfaces from the keys of self to
+// the keys of next.
+func applyKeys(self, next Device) error {
+	privKey, err := wgtypes.ParseKey(next.WGPrivateKey)
+	if err != nil {
+		return err
+	}
+	if err := boltdb.Save(next, "self", deviceTable); err != nil {
+		return err
+	}
+	if err := os.WriteFile(Config.DataDir+"agent.seed", []byte(next.Seed), os.ModePerm); err != nil {
+		slog.Error("save seed", "error", err)
+	}
+	slog.Info("keys rotated", "old", self.WGPublicKey, "new", next.WGPublicKey)
+	networks, err := boltdb.GetAll[Network](networkTable)
+	if err != nil {
+		return err
+	}
+	for _, network := range networks {
+		network.ReplacePeerKey(self.WGPublicKey, next.WGPublicKey)
+		if err := boltdb.Save(network, network.Name, networkTable); err != nil {
+			slog.Error("save network", "network", network.Name, "error", err)
+		}
+		if err := setPrivateKey(network.Interface, privKey); err != nil {
+			slog.Error("set private key", "interface", network.Interface, "error", err)
+		}
+		refreshPolicies(next, network.Name)
+	}
+	return nil
+}
+
+// confirmRotation tells the server that the device uses its new keys. The new
+// keys are kept as unconfirmed until the server has replied.
+func confirmRotation(self Device) {
+	conn := serverConn.Load()
+	if conn == nil {
+		return
+	}
+	response := plexus.MessageResponse{}
+	if err := Request(conn, self.WGPublicKey+plexus.ConfirmRotation, nil, &response, NatsTimeout); err != nil {
+		slog.Error("confirm rotation", "error", err)
+		return
+	}
+	if response.IncludesError {
+		slog.Error("confirm rotation", "error", response.Error)
+	}
+	if err := boltdb.Delete[Device](rotationKey, deviceTable); err != nil {
+		slog.Error("delete rotation", "error", err)
+	}
+}
+
+// setPrivateKey changes the private key of an interface, keeping its peers.
+func setPrivateKey(iface string, key wgtypes.Key) error {
+	wg, err := plexus.Get(iface)
+	if err != nil {
+		return err
+	}
+	wg.Config.PrivateKey = &key
+	return wg.Apply()
+}
+
+// serverRotateKeys handles a key rotation requested by the server. The reply
+// is sent before rotating as the rotation replaces the server connection.
+func serverRotateKeys(msg *nats.Msg, serverConn *nats.Conn) {
+	slog.Info("key rotation requested by server")
+	publish.Message(serverConn, msg.Reply, plexus.MessageResponse{Message: "rotating keys"})
+	go func() {
+		if _, err := rotateKeys(); err != nil {
+			slog.Error("rotate keys", "error", err)
+		}
+	}()
+}
+
+// sendRotateKeys handles a key rotation requested with the cli.
+func sendRotateKeys(msg *nats.Msg, agentConn *nats.Conn) {
+	slog.Debug("rotate keys request")
+	response, err := rotateKeys()
+	if err != nil {
+		slog.Error("rotate keys", "error", err)
+		publish.ErrorMessage(agentConn, msg.Reply, "rotate keys", err)
+		return
+	}
+	publish.Message(agentConn, msg.Reply, response)
+}
@@ -0,0 +1,104 @@
+// Package packetrelay implements the framing of the packet relay hosted by the
+// server: wireguard packets tunnelled between agents over an authenticated tcp
+// or tls stream, for peers that cannot reach each other directly.
+//
+// The server opens a connection with a challenge frame holding a nonce. The
+// agent answers with a hello frame holding its wireguard public key and the
+// nonce signed with its nkey, and the server accepts it with an accept frame.
+// Packet frames follow in both directions.
+package packetrelay
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// frame types.
+const (
+	FrameChallenge byte = iota + 1
+	FrameHello
+	FrameAccept
+	FramePacket
+)
+
+// MaxPayload is the largest payload of a frame.
+const MaxPayload = 65535
+
+var (
+	ErrFrameTooLarge = errors.New("frame too large")
+	ErrInvalidPacket = errors.New("invalid packet")
+)
+
+// Hello is the payload of a hello frame.
+type Hello struct {
+	WGPublicKey string
+	Signature   []byte
+}
+
+// Packet is a wireguard packet of a network. Peer is the destination of the
+// packets sent by agents and the source of the packets sent by the server.
+type Packet struct {
+	Network string
+	Peer    string
+	Data    []byte
+}
+
+// WriteFrame writes a frame: its type, the length of the payload and the
+// payload.
+func WriteFrame(w io.Writer, kind byte, payload []byte) error {
+	if len(payload) > MaxPayload {
+		return ErrFrameTooLarge
+	}
+	frame := make([]byte, 3, 3+len(payload))
+	frame[0] = kind
+	binary.BigEndian.PutUint16(frame[1:], uint16(len(payload)))
+	_, err := w.Write(append(frame, payload...))
+	return err
+}
+
+// ReadFrame reads a frame and returns its type and payload.
+func ReadFrame(r io.Reader) (byte, []byte, error) {
+	header := make([]byte, 3)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return 0, nil, err
+	}
+	payload := make([]byte, binary.BigEndian.Uint16(header[1:]))
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return 0, nil, err
+	}
+	return header[0], payload, nil
+}
+
+// Marshal encodes the packet as the payload of a packet frame: the network and
+// the peer, each preceded by its length, then the data.
+func (p Packet) Marshal() ([]byte, error) {
+	if len(p.Network) > 255 || len(p.Peer) > 255 {
+		return nil, ErrInvalidPacket
+	}
+	payload := make([]byte, 0, 2+len(p.Network)+len(p.Peer)+len(p.Data))
+	payload = append(payload, byte(len(p.Network)))
+	payload = append(payload, p.Network...)
+	payload = append(payload, byte(len(p.Peer)))
+	payload = append(payload, p.Peer...)
+	payload = append(payload, p.Data...)
+	if len(payload) > MaxPayload {
+		return nil, ErrFrameTooLarge
+	}
+	return payload, nil
+}
+
+// UnmarshalPacket decodes the payload of a packet frame.
+func UnmarshalPacket(payload []byte) (Packet, error) {
+	packet := Packet{}
+	fields := []*string{&packet.Network, &packet.Peer}
+	for _, field := range fields {
+		if len(payload) == 0 || len(payload) < 1+int(payload[0]) {
+			return packet, ErrInvalidPacket
+		}
+		*field = string(payload[1 : 1+payload[0]])
+		payload = payload[1+payload[0]:]
+	}
+	packet.Data = payload
+	return packet, nil
+}
@@ -0,0 +1,42 @@
+package packetrelay
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	"github.com/Kairum-Labs/should"
+)
+
+func TestFrames(t *testing.T) {
+	buf := &bytes.Buffer{}
+	should.NotBeError(t, WriteFrame(buf, FrameChallenge, []byte("nonce")))
+	should.NotBeError(t, WriteFrame(buf, FrameAccept, nil))
+	kind, payload, err := ReadFrame(buf)
+	should.NotBeError(t, err)
+	should.BeEqual(t, kind, FrameChallenge)
+	should.BeEqual(t, string(payload), "nonce")
+	kind, payload, err = ReadFrame(buf)
+	should.NotBeError(t, err)
+	should.BeEqual(t, kind, FrameAccept)
+	should.BeEqual(t, len(payload), 0)
+	_, _, err = ReadFrame(buf)
+	should.BeError(t, err)
+	should.BeTrue(t, err == io.EOF)
+	should.BeError(t, WriteFrame(buf, FramePacket, make([]byte, MaxPayload+1)))
+}
+
+func TestPacket(t *testing.T) {
+	packet := Packet{Network: "plexus", Peer: "key", Data: []byte{1, 2, 3}}
+	payload, err := packet.Marshal()
+	should.NotBeError(t, err)
+	decoded, err := UnmarshalPacket(payload)
+	should.NotBeError(t, err)
+	should.BeEqual(t, decoded, packet)
+	_, err = UnmarshalPacket(payload[:3])
+	should.BeError(t, err)
+	_, err = UnmarshalPacket(nil)
+	should.BeError(t, err)
+	_, err = Packet{Network: "plexus", Peer: "key", Data: make([]byte, MaxPayload)}.Marshal()
+	should.BeError(t, err)
+}
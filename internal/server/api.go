@@ -0,0 +1,809 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"log/slog"
+	"net/http"
+
+	"github.com/devilcove/boltdb"
+	"github.com/devilcove/mux"
+	"github.com/devilcove/plexus"
+)
+
+// APIError is the json body returned by the api for failed requests.
+type APIError struct {
+	Error string
+}
+
+// RelayRequest is the json body for creating a relay via the api. The peers
+// of Group in the network are relayed as well as the Relayed peers.
+type RelayRequest struct {
+	Relayed []string
+	Group   string
+}
+
+// RouterRequest is the json body for adding a subnet to a subnet router via the
+// api. Nat is one of "", "nat" or "virt"; VirtSubnet is only used with "virt".
+type RouterRequest struct {
+	Subnet     string
+	Nat        string
+	VirtSubnet string
+}
+
+// LabelsRequest is the json body for setting the tags and groups of a peer via the api.
+type LabelsRequest struct {
+	Tags   []string
+	Groups []string
+}
+
+// PresharedKeysRequest is the json body for enabling or disabling the
+// preshared keys of a network via the api.
+type PresharedKeysRequest struct {
+	Enabled bool
+}
+
+// PasswordRequest is the json body for changing a user password via the api.
+type PasswordRequest struct {
+	Password string
+}
+
+// SSORequest is the json body for linking a user to a single sign-on subject via the api.
+type SSORequest struct {
+	Subject string
+}
+
+func setupAPI(router *mux.Router) {
+	api := router.Group("/api/v1", apiAuth)
+	api.Get("/networks", apiGetNetworks)
+	api.Post("/networks", anyNetworkRole(roleOwner, apiError, apiAddNetwork))
+	api.Get("/networks/{id}", networkRole(roleViewer, apiError, apiGetNetwork))
+	api.Delete("/networks/{id}", networkRole(roleOwner, apiError, apiDeleteNetwork))
+	api.Get("/networks/{id}/peers/{peer}", networkRole(roleViewer, apiError, apiGetNetworkPeer))
+	api.Post("/networks/{id}/peers/{peer}", networkRole(roleOperator, apiError, apiNetworkAddPeer))
+	api.Delete("/networks/{id}/peers/{peer}", networkRole(roleOperator, apiError, apiNetworkDeletePeer))
+	api.Post("/networks/{id}/groups/{group}", networkRole(roleOperator, apiError, apiNetworkAddGroup))
+	api.Post("/networks/{id}/relay/{peer}", networkRole(roleOperator, apiError, apiAddRelay))
+	api.Delete("/networks/{id}/relay/{peer}", networkRole(roleOperator, apiError, apiDeleteRelay))
+	api.Post("/networks/{id}/router/{peer}", networkRole(roleOperator, apiError, apiAddRouter))
+	api.Delete("/networks/{id}/router/{peer}", networkRole(roleOperator, apiError, apiDeleteRouter))
+	api.Post("/networks/{id}/exit/{peer}", networkRole(roleOperator, apiError, apiAddExitNode))
+	api.Delete("/networks/{id}/exit/{peer}", networkRole(roleOperator, apiError, apiDeleteExitNode))
+	api.Get("/networks/{id}/ipam", networkRole(roleViewer, apiError, apiGetIPAM))
+	api.Post("/networks/{id}/reservations", networkRole(roleOperator, apiError, apiAddReservation))
+	api.Delete("/networks/{id}/reservations/{address}", networkRole(roleOperator, apiError, apiDeleteReservation))
+	api.Post("/networks/{id}/excluded", networkRole(roleOperator, apiError, apiAddExclusion))
+	api.Delete("/networks/{id}/excluded/{start}", networkRole(roleOperator, apiError, apiDeleteExclusion))
+	api.Get("/networks/{id}/policies", networkRole(roleViewer, apiError, apiGetPolicies))
+	api.Post("/networks/{id}/policies", networkRole(roleOwner, apiError, apiAddPolicy))
+	api.Delete("/networks/{id}/policies/{name}", networkRole(roleOwner, apiError, apiDeletePolicy))
+	api.Put("/networks/{id}/psk", networkRole(roleOwner, apiError, apiSetPresharedKeys))
+	api.Get("/networks/{id}/roles", networkRole(roleOwner, apiError, apiGetNetworkRoles))
+	api.Put("/networks/{id}/roles/{user}", networkRole(roleOwner, apiError, apiSetNetworkRole))
+	api.Delete("/networks/{id}/roles/{user}", networkRole(roleOwner, apiError, apiDeleteNetworkRole))
+
+	api.Get("/peers", apiGetPeers)
+	api.Get("/peers/{id}", peerRole(roleViewer, apiError, apiGetPeer))
+	api.Put("/peers/{id}/labels", peerRole(roleOperator, apiError, apiSetPeerLabels))
+	api.Delete("/peers/{id}", peerRole(roleOperator, apiError, apiDeletePeer))
+	api.Post("/peers/{id}/rotate", peerRole(roleOperator, apiError, apiRotatePeerKeys))
+
+	api.Get("/pending", apiGetPending)
+	api.Post("/pending/{id}", apiApprovePending)
+	api.Delete("/pending/{id}", apiRejectPending)
+
+	api.Get("/groups", apiGetGroups)
+	api.Post("/groups", anyNetworkRole(roleOperator, apiError, apiAddGroup))
+	api.Delete("/groups/{name}", anyNetworkRole(roleOperator, apiError, apiDeleteGroup))
+
+	api.Get("/keys", anyNetworkRole(roleOperator, apiError, apiGetKeys))
+	api.Post("/keys", anyNetworkRole(roleOperator, apiError, apiAddKey))
+	api.Delete("/keys/{id}", anyNetworkRole(roleOperator, apiError, apiDeleteKey))
+
+	api.Get("/users", apiGetUsers)
+	api.Post("/users", apiAddUser)
+	api.Get("/users/{name}", apiGetUser)
+	api.Put("/users/{name}", apiEditUser)
+	api.Put("/users/{name}/sso", apiLinkUser)
+	api.Delete("/users/{name}", apiDeleteUser)
+
+	api.Get("/audit", exportAudit)
+	api.Get("/backup", apiBackup)
+	api.Get("/topology", apiExportTopology)
+	api.Post("/topology", apiApplyTopology)
+}
+
+func apiAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if value, ok := bearerToken(r); ok {
+			request, status, err := tokenRequest(r, value)
+			if err != nil {
+				apiError(w, status, err.Error())
+				return
+			}
+			next.ServeHTTP(w, request)
+			return
+		}
+		session := GetSession(r)
+		if session.IsNew {
+			apiError(w, http.StatusUnauthorized, "authentication required")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func apiResponse(w http.ResponseWriter, status int, data any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if data == nil {
+		return
+	}
+	if err := json.NewEncoder(w).Encode(data); err != nil {
+		slog.Error("encode api response", "error", err)
+	}
+}
+
+func apiError(w http.ResponseWriter, status int, message string) {
+	buf := bytes.Buffer{}
+	l := log.New(&buf, "", log.Lshortfile)
+	_ = l.Output(2, message)
+	slog.Error(buf.String())
+	apiResponse(w, status, APIError{Error: message})
+}
+
+func decodeRequest(w http.ResponseWriter, r *http.Request, request any) bool {
+	if err := json.NewDecoder(r.Body).Decode(request); err != nil {
+		apiError(w, http.StatusBadRequest, "invalid request body "+err.Error())
+		return false
+	}
+	return true
+}
+
+func apiGetNetwork(w http.ResponseWriter, r *http.Request) {
+	network, err := boltdb.Get[plexus.Network](r.PathValue("id"), networkTable)
+	if err != nil {
+		apiError(w, errorStatus(err), err.Error())
+		return
+	}
+	apiResponse(w, http.StatusOK, network)
+}
+
+func apiGetNetworks(w http.ResponseWriter, r *http.Request) {
+	networks, err := boltdb.GetAll[plexus.Network](networkTable)
+	if err != nil {
+		apiError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	apiResponse(w, http.StatusOK, visibleNetworks(GetSessionData(r), networks))
+}
+
+func apiAddNetwork(w http.ResponseWriter, r *http.Request) {
+	request := plexus.Network{}
+	if !decodeRequest(w, r, &request) {
+		return
+	}
+	network, err := createNetwork(userActor(r), plexus.Network{
+		Name:           request.Name,
+		AddressString:  request.AddressString,
+		Address6String: request.Address6String,
+	})
+	if err != nil {
+		apiError(w, errorStatus(err), err.Error())
+		return
+	}
+	if err := setRole(userActor(r), GetSessionData(r).Username, network.Name, roleOwner); err != nil {
+		slog.Error("set network owner", "network", network.Name, "error", err)
+	}
+	apiResponse(w, http.StatusCreated, network)
+}
+
+func apiDeleteNetwork(w http.ResponseWriter, r *http.Request) {
+	if err := removeNetwork(userActor(r), r.PathValue("id")); err != nil {
+		apiError(w, errorStatus(err), err.Error())
+		return
+	}
+	apiResponse(w, http.StatusNoContent, nil)
+}
+
+func apiGetNetworkPeer(w http.ResponseWriter, r *http.Request) {
+	network, err := boltdb.Get[plexus.Network](r.PathValue("id"), networkTable)
+	if err != nil {
+		apiError(w, errorStatus(err), err.Error())
+		return
+	}
+	for _, peer := range network.Peers {
+		if peer.WGPublicKey == r.PathValue("peer") {
+			apiResponse(w, http.StatusOK, peer)
+			return
+		}
+	}
+	apiError(w, http.StatusNotFound, ErrPeerNotFound.Error())
+}
+
+func apiNetworkAddPeer(w http.ResponseWriter, r *http.Request) {
+	networkName := r.PathValue("id")
+	peerID := r.PathValue("peer")
+	if _, err := boltdb.Get[plexus.Network](networkName, networkTable); err != nil {
+		apiError(w, errorStatus(err), err.Error())
+		return
+	}
+	if _, err := boltdb.Get[plexus.Peer](peerID, peerTable); err != nil {
+		apiError(w, errorStatus(err), err.Error())
+		return
+	}
+	priv, pub, err := getListenPorts(peerID, networkName)
+	if err != nil {
+		apiError(w, http.StatusBadGateway, err.Error())
+		return
+	}
+	network, err := addPeerToNetwork(userActor(r), peerID, networkName, priv, pub)
+	if err != nil {
+		apiError(w, http.StatusConflict, err.Error())
+		return
+	}
+	apiResponse(w, http.StatusOK, network)
+}
+
+func apiNetworkDeletePeer(w http.ResponseWriter, r *http.Request) {
+	network, err := boltdb.Get[plexus.Network](r.PathValue("id"), networkTable)
+	if err != nil {
+		apiError(w, errorStatus(err), err.Error())
+		return
+	}
+	network, err = deletePeerFromNetwork(userActor(r), network, r.PathValue("peer"))
+	if err != nil {
+		apiError(w, errorStatus(err), err.Error())
+		return
+	}
+	apiResponse(w, http.StatusOK, network)
+}
+
+func apiNetworkAddGroup(w http.ResponseWriter, r *http.Request) {
+	network, err := addGroupToNetwork(userActor(r), r.PathValue("id"), r.PathValue("group"))
+	if err != nil {
+		status := errorStatus(err)
+		if status == http.StatusInternalServerError {
+			status = http.StatusBadGateway
+		}
+		apiError(w, status, err.Error())
+		return
+	}
+	apiResponse(w, http.StatusOK, network)
+}
+
+func apiAddRelay(w http.ResponseWriter, r *http.Request) {
+	request := RelayRequest{}
+	if !decodeRequest(w, r, &request) {
+		return
+	}
+	network, err := boltdb.Get[plexus.Network](r.PathValue("id"), networkTable)
+	if err != nil {
+		apiError(w, errorStatus(err), err.Error())
+		return
+	}
+	for _, relayed := range request.Relayed {
+		if !peerInNetwork(network, relayed) {
+			apiError(w, http.StatusBadRequest, "relayed peer not in network "+relayed)
+			return
+		}
+	}
+	if request.Group != "" {
+		request.Relayed = append(request.Relayed, groupRelayed(network, r.PathValue("peer"), request.Group)...)
+	}
+	network, err = createRelay(userActor(r), network, r.PathValue("peer"), request.Relayed)
+	if err != nil {
+		apiError(w, errorStatus(err), err.Error())
+		return
+	}
+	apiResponse(w, http.StatusOK, network)
+}
+
+func apiDeleteRelay(w http.ResponseWriter, r *http.Request) {
+	network, err := boltdb.Get[plexus.Network](r.PathValue("id"), networkTable)
+	if err != nil {
+		apiError(w, errorStatus(err), err.Error())
+		return
+	}
+	network, err = removeRelay(userActor(r), network, r.PathValue("peer"))
+	if err != nil {
+		apiError(w, errorStatus(err), err.Error())
+		return
+	}
+	apiResponse(w, http.StatusOK, network)
+}
+
+func apiAddRouter(w http.ResponseWriter, r *http.Request) {
+	request := RouterRequest{}
+	if !decodeRequest(w, r, &request) {
+		return
+	}
+	network, err := boltdb.Get[plexus.Network](r.PathValue("id"), networkTable)
+	if err != nil {
+		apiError(w, errorStatus(err), err.Error())
+		return
+	}
+	subnet, err := parseRouterSubnet(network, r.PathValue("peer"), request.Subnet, request.Nat, request.VirtSubnet)
+	if err != nil {
+		apiError(w, errorStatus(err), err.Error())
+		return
+	}
+	network, err = createRouter(userActor(r), network, r.PathValue("peer"), subnet)
+	if err != nil {
+		apiError(w, errorStatus(err), err.Error())
+		return
+	}
+	apiResponse(w, http.StatusOK, network)
+}
+
+func apiDeleteRouter(w http.ResponseWriter, r *http.Request) {
+	network, err := boltdb.Get[plexus.Network](r.PathValue("id"), networkTable)
+	if err != nil {
+		apiError(w, errorStatus(err), err.Error())
+		return
+	}
+	network, err = removeRouter(userActor(r), network, r.PathValue("peer"), r.URL.Query().Get("subnet"))
+	if err != nil {
+		apiError(w, errorStatus(err), err.Error())
+		return
+	}
+	apiResponse(w, http.StatusOK, network)
+}
+
+func apiAddExitNode(w http.ResponseWriter, r *http.Request) {
+	network, err := boltdb.Get[plexus.Network](r.PathValue("id"), networkTable)
+	if err != nil {
+		apiError(w, errorStatus(err), err.Error())
+		return
+	}
+	network, err = createExitNode(userActor(r), network, r.PathValue("peer"))
+	if err != nil {
+		apiError(w, errorStatus(err), err.Error())
+		return
+	}
+	apiResponse(w, http.StatusOK, network)
+}
+
+func apiDeleteExitNode(w http.ResponseWriter, r *http.Request) {
+	network, err := boltdb.Get[plexus.Network](r.PathValue("id"), networkTable)
+	if err != nil {
+		apiError(w, errorStatus(err), err.Error())
+		return
+	}
+	network, err = removeExitNode(userActor(r), network, r.PathValue("peer"))
+	if err != nil {
+		apiError(w, errorStatus(err), err.Error())
+		return
+	}
+	apiResponse(w, http.StatusOK, network)
+}
+
+func apiGetIPAM(w http.ResponseWriter, r *http.Request) {
+	network, err := boltdb.Get[plexus.Network](r.PathValue("id"), networkTable)
+	if err != nil {
+		apiError(w, errorStatus(err), err.Error())
+		return
+	}
+	apiResponse(w, http.StatusOK, networkIPAM(network))
+}
+
+func apiAddReservation(w http.ResponseWriter, r *http.Request) {
+	request := plexus.Reservation{}
+	if !decodeRequest(w, r, &request) {
+		return
+	}
+	network, err := createReservation(userActor(r), r.PathValue("id"), request)
+	if err != nil {
+		apiError(w, errorStatus(err), err.Error())
+		return
+	}
+	apiResponse(w, http.StatusCreated, networkIPAM(network))
+}
+
+func apiDeleteReservation(w http.ResponseWriter, r *http.Request) {
+	address, err := parseAddress(r.PathValue("address"))
+	if err != nil {
+		apiError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if _, err := removeReservation(userActor(r), r.PathValue("id"), address); err != nil {
+		apiError(w, errorStatus(err), err.Error())
+		return
+	}
+	apiResponse(w, http.StatusNoContent, nil)
+}
+
+func apiAddExclusion(w http.ResponseWriter, r *http.Request) {
+	request := plexus.AddressRange{}
+	if !decodeRequest(w, r, &request) {
+		return
+	}
+	if request.End == nil {
+		request.End = request.Start
+	}
+	network, err := createExclusion(userActor(r), r.PathValue("id"), request)
+	if err != nil {
+		apiError(w, errorStatus(err), err.Error())
+		return
+	}
+	apiResponse(w, http.StatusCreated, networkIPAM(network))
+}
+
+func apiDeleteExclusion(w http.ResponseWriter, r *http.Request) {
+	start, err := parseAddress(r.PathValue("start"))
+	if err != nil {
+		apiError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if _, err := removeExclusion(userActor(r), r.PathValue("id"), start); err != nil {
+		apiError(w, errorStatus(err), err.Error())
+		return
+	}
+	apiResponse(w, http.StatusNoContent, nil)
+}
+
+func apiGetPolicies(w http.ResponseWriter, r *http.Request) {
+	network, err := boltdb.Get[plexus.Network](r.PathValue("id"), networkTable)
+	if err != nil {
+		apiError(w, errorStatus(err), err.Error())
+		return
+	}
+	if network.Policies == nil {
+		network.Policies = []plexus.Policy{}
+	}
+	apiResponse(w, http.StatusOK, network.Policies)
+}
+
+func apiAddPolicy(w http.ResponseWriter, r *http.Request) {
+	request := plexus.Policy{}
+	if !decodeRequest(w, r, &request) {
+		return
+	}
+	network, err := createPolicy(userActor(r), r.PathValue("id"), request)
+	if err != nil {
+		apiError(w, errorStatus(err), err.Error())
+		return
+	}
+	apiResponse(w, http.StatusCreated, network.Policies)
+}
+
+func apiDeletePolicy(w http.ResponseWriter, r *http.Request) {
+	if _, err := removePolicy(userActor(r), r.PathValue("id"), r.PathValue("name")); err != nil {
+		apiError(w, errorStatus(err), err.Error())
+		return
+	}
+	apiResponse(w, http.StatusNoContent, nil)
+}
+
+func apiGetNetworkRoles(w http.ResponseWriter, r *http.Request) {
+	apiResponse(w, http.StatusOK, networkMembers(r.PathValue("id")))
+}
+
+func apiSetNetworkRole(w http.ResponseWriter, r *http.Request) {
+	request := RoleRequest{}
+	if !decodeRequest(w, r, &request) {
+		return
+	}
+	if request.Role == "" {
+		apiError(w, http.StatusBadRequest, "role is required")
+		return
+	}
+	if err := setRole(userActor(r), r.PathValue("user"), r.PathValue("id"), request.Role); err != nil {
+		apiError(w, errorStatus(err), err.Error())
+		return
+	}
+	apiResponse(w, http.StatusOK, networkMembers(r.PathValue("id")))
+}
+
+func apiDeleteNetworkRole(w http.ResponseWriter, r *http.Request) {
+	if err := setRole(userActor(r), r.PathValue("user"), r.PathValue("id"), ""); err != nil {
+		apiError(w, errorStatus(err), err.Error())
+		return
+	}
+	apiResponse(w, http.StatusNoContent, nil)
+}
+
+func apiSetPresharedKeys(w http.ResponseWriter, r *http.Request) {
+	request := PresharedKeysRequest{}
+	if !decodeRequest(w, r, &request) {
+		return
+	}
+	network, err := setPresharedKeys(userActor(r), r.PathValue("id"), request.Enabled)
+	if err != nil {
+		apiError(w, errorStatus(err), err.Error())
+		return
+	}
+	apiResponse(w, http.StatusOK, network)
+}
+
+func apiGetPeers(w http.ResponseWriter, r *http.Request) {
+	peers, err := boltdb.GetAll[plexus.Peer](peerTable)
+	if err != nil {
+		apiError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if peers == nil {
+		peers = []plexus.Peer{}
+	}
+	apiResponse(w, http.StatusOK, visiblePeers(GetSessionData(r), peers))
+}
+
+func apiGetPeer(w http.ResponseWriter, r *http.Request) {
+	peer, err := boltdb.Get[plexus.Peer](r.PathValue("id"), peerTable)
+	if err != nil {
+		apiError(w, errorStatus(err), err.Error())
+		return
+	}
+	apiResponse(w, http.StatusOK, peer)
+}
+
+func apiDeletePeer(w http.ResponseWriter, r *http.Request) {
+	peer, err := discardPeer(userActor(r), r.PathValue("id"))
+	if err != nil {
+		apiError(w, errorStatus(err), err.Error())
+		return
+	}
+	deletePeerFromBroker(peer.PubNkey)
+	apiResponse(w, http.StatusNoContent, nil)
+}
+
+func apiRotatePeerKeys(w http.ResponseWriter, r *http.Request) {
+	if err := requestKeyRotation(userActor(r), r.PathValue("id")); err != nil {
+		status := errorStatus(err)
+		if status == http.StatusInternalServerError {
+			status = http.StatusBadGateway
+		}
+		apiError(w, status, err.Error())
+		return
+	}
+	apiResponse(w, http.StatusAccepted, plexus.MessageResponse{Message: "rotating keys"})
+}
+
+func apiGetPending(w http.ResponseWriter, r *http.Request) {
+	if !GetSessionData(r).IsAdmin {
+		apiError(w, http.StatusForbidden, "admin rights required")
+		return
+	}
+	pending, err := pendingPeers()
+	if err != nil {
+		apiError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	apiResponse(w, http.StatusOK, pending)
+}
+
+func apiApprovePending(w http.ResponseWriter, r *http.Request) {
+	if !GetSessionData(r).IsAdmin {
+		apiError(w, http.StatusForbidden, "admin rights required")
+		return
+	}
+	peer, err := approveRegistration(userActor(r), r.PathValue("id"))
+	if err != nil {
+		apiError(w, errorStatus(err), err.Error())
+		return
+	}
+	apiResponse(w, http.StatusOK, peer)
+}
+
+func apiRejectPending(w http.ResponseWriter, r *http.Request) {
+	if !GetSessionData(r).IsAdmin {
+		apiError(w, http.StatusForbidden, "admin rights required")
+		return
+	}
+	if err := rejectRegistration(userActor(r), r.PathValue("id")); err != nil {
+		apiError(w, errorStatus(err), err.Error())
+		return
+	}
+	apiResponse(w, http.StatusNoContent, nil)
+}
+
+func apiSetPeerLabels(w http.ResponseWriter, r *http.Request) {
+	request := LabelsRequest{}
+	if !decodeRequest(w, r, &request) {
+		return
+	}
+	peer, err := setPeerLabels(userActor(r), r.PathValue("id"), request.Tags, request.Groups)
+	if err != nil {
+		apiError(w, errorStatus(err), err.Error())
+		return
+	}
+	apiResponse(w, http.StatusOK, peer)
+}
+
+func apiGetGroups(w http.ResponseWriter, _ *http.Request) {
+	groups, err := boltdb.GetAll[plexus.Group](groupTable)
+	if err != nil {
+		apiError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if groups == nil {
+		groups = []plexus.Group{}
+	}
+	apiResponse(w, http.StatusOK, groups)
+}
+
+func apiAddGroup(w http.ResponseWriter, r *http.Request) {
+	request := plexus.Group{}
+	if !decodeRequest(w, r, &request) {
+		return
+	}
+	group, err := createGroup(userActor(r), request)
+	if err != nil {
+		apiError(w, errorStatus(err), err.Error())
+		return
+	}
+	apiResponse(w, http.StatusCreated, group)
+}
+
+func apiDeleteGroup(w http.ResponseWriter, r *http.Request) {
+	if err := removeGroup(userActor(r), r.PathValue("name")); err != nil {
+		apiError(w, errorStatus(err), err.Error())
+		return
+	}
+	apiResponse(w, http.StatusNoContent, nil)
+}
+
+func apiGetKeys(w http.ResponseWriter, r *http.Request) {
+	keys, err := boltdb.GetAll[plexus.Key](keyTable)
+	if err != nil {
+		apiError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	apiResponse(w, http.StatusOK, visibleKeys(GetSessionData(r), keys))
+}
+
+func apiAddKey(w http.ResponseWriter, r *http.Request) {
+	request := plexus.Key{}
+	if !decodeRequest(w, r, &request) {
+		return
+	}
+	if err := keyNetworksAllowed(GetSessionData(r), request); err != nil {
+		apiError(w, http.StatusForbidden, err.Error())
+		return
+	}
+	key, err := createKey(userActor(r), plexus.Key{
+		Name:      request.Name,
+		Usage:     request.Usage,
+		DispExp:   request.DispExp,
+		Tags:      request.Tags,
+		Groups:    request.Groups,
+		Networks:  request.Networks,
+		Relay:     request.Relay,
+		Router:    request.Router,
+		RouterNat: request.RouterNat,
+		Approval:  request.Approval,
+	})
+	if err != nil {
+		apiError(w, errorStatus(err), err.Error())
+		return
+	}
+	apiResponse(w, http.StatusCreated, key)
+}
+
+func apiDeleteKey(w http.ResponseWriter, r *http.Request) {
+	key, err := boltdb.Get[plexus.Key](r.PathValue("id"), keyTable)
+	if err != nil {
+		apiError(w, errorStatus(err), err.Error())
+		return
+	}
+	if err := keyNetworksAllowed(GetSessionData(r), key); err != nil {
+		apiError(w, http.StatusForbidden, err.Error())
+		return
+	}
+	if err := removeKey(userActor(r), key); err != nil {
+		apiError(w, http.StatusInternalServerError, "delete key "+err.Error())
+		return
+	}
+	apiResponse(w, http.StatusNoContent, nil)
+}
+
+func apiGetUsers(w http.ResponseWriter, r *http.Request) {
+	if !GetSessionData(r).IsAdmin {
+		apiError(w, http.StatusForbidden, "admin rights required")
+		return
+	}
+	users, err := boltdb.GetAll[plexus.User](userTable)
+	if err != nil {
+		apiError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	returnedUsers := []plexus.User{}
+	for _, user := range users {
+		user.Password = ""
+		returnedUsers = append(returnedUsers, user)
+	}
+	apiResponse(w, http.StatusOK, returnedUsers)
+}
+
+func apiGetUser(w http.ResponseWriter, r *http.Request) {
+	session := GetSessionData(r)
+	name := r.PathValue("name")
+	if !session.IsAdmin && session.Username != name {
+		apiError(w, http.StatusForbidden, "admin rights required")
+		return
+	}
+	user, err := boltdb.Get[plexus.User](name, userTable)
+	if err != nil {
+		apiError(w, errorStatus(err), err.Error())
+		return
+	}
+	user.Password = ""
+	apiResponse(w, http.StatusOK, user)
+}
+
+func apiAddUser(w http.ResponseWriter, r *http.Request) {
+	if !GetSessionData(r).IsAdmin {
+		apiError(w, http.StatusForbidden, "admin rights required")
+		return
+	}
+	request := plexus.User{}
+	if !decodeRequest(w, r, &request) {
+		return
+	}
+	if request.Username == "" || request.Password == "" {
+		apiError(w, http.StatusBadRequest, "username and password are required")
+		return
+	}
+	user, err := createUser(userActor(r), request)
+	if err != nil {
+		apiError(w, errorStatus(err), err.Error())
+		return
+	}
+	user.Password = ""
+	apiResponse(w, http.StatusCreated, user)
+}
+
+func apiEditUser(w http.ResponseWriter, r *http.Request) {
+	session := GetSessionData(r)
+	name := r.PathValue("name")
+	if !session.IsAdmin && session.Username != name {
+		apiError(w, http.StatusForbidden, "admin rights required to update other users")
+		return
+	}
+	request := PasswordRequest{}
+	if !decodeRequest(w, r, &request) {
+		return
+	}
+	if request.Password == "" {
+		apiError(w, http.StatusBadRequest, "blank password")
+		return
+	}
+	if _, err := boltdb.Get[plexus.User](name, userTable); err != nil {
+		apiError(w, errorStatus(err), err.Error())
+		return
+	}
+	if err := setPassword(userActor(r), name, request.Password); err != nil {
+		apiError(w, errorStatus(err), err.Error())
+		return
+	}
+	apiResponse(w, http.StatusNoContent, nil)
+}
+
+func apiLinkUser(w http.ResponseWriter, r *http.Request) {
+	if !GetSessionData(r).IsAdmin {
+		apiError(w, http.StatusForbidden, "admin rights required")
+		return
+	}
+	request := SSORequest{}
+	if !decodeRequest(w, r, &request) {
+		return
+	}
+	if err := linkOIDCUser(userActor(r), r.PathValue("name"), request.Subject); err != nil {
+		apiError(w, errorStatus(err), err.Error())
+		return
+	}
+	apiResponse(w, http.StatusNoContent, nil)
+}
+
+func apiDeleteUser(w http.ResponseWriter, r *http.Request) {
+	if !GetSessionData(r).IsAdmin {
+		apiError(w, http.StatusForbidden, "admin rights required")
+		return
+	}
+	if err := removeUser(userActor(r), r.PathValue("name")); err != nil {
+		apiError(w, errorStatus(err), err.Error())
+		return
+	}
+	apiResponse(w, http.StatusNoContent, nil)
+}
@@ -0,0 +1,267 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Kairum-Labs/should"
+	"github.com/devilcove/boltdb"
+	"github.com/devilcove/plexus"
+)
+
+func apiRequest(t *testing.T, cookie *http.Cookie, method, path, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	r := httptest.NewRequest(method, path, strings.NewReader(body))
+	r.Header.Set("Content-Type", "application/json")
+	if cookie != nil {
+		r.AddCookie(cookie)
+	}
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+	return w
+}
+
+func TestAPIAuth(t *testing.T) {
+	w := apiRequest(t, nil, http.MethodGet, "/api/v1/networks", "")
+	should.BeEqual(t, w.Code, http.StatusUnauthorized)
+	should.BeEqual(t, w.Header().Get("Content-Type"), "application/json")
+	apiErr := APIError{}
+	should.NotBeError(t, json.NewDecoder(w.Body).Decode(&apiErr))
+	should.BeEqual(t, apiErr.Error, "authentication required")
+}
+
+func TestAPINetworks(t *testing.T) {
+	setup(t)
+	defer shutdown(t)
+	deleteAllNetworks(t)
+	deleteAllPeers(t)
+	user := plexus.User{Username: "hello", Password: "world", IsAdmin: true}
+	createTestUser(t, user)
+	cookie := testLogin(t, user)
+
+	t.Run("empty", func(t *testing.T) {
+		w := apiRequest(t, cookie, http.MethodGet, "/api/v1/networks", "")
+		should.BeEqual(t, w.Code, http.StatusOK)
+		should.BeEqual(t, strings.TrimSpace(w.Body.String()), "[]")
+	})
+	t.Run("invalidBody", func(t *testing.T) {
+		w := apiRequest(t, cookie, http.MethodPost, "/api/v1/networks", "{")
+		should.BeEqual(t, w.Code, http.StatusBadRequest)
+		should.ContainSubstring(t, w.Body.String(), "invalid request body")
+	})
+	t.Run("invalidName", func(t *testing.T) {
+		w := apiRequest(t, cookie, http.MethodPost, "/api/v1/networks",
+			`{"Name":"Bad Name","AddressString":"10.10.10.0/24"}`)
+		should.BeEqual(t, w.Code, http.StatusBadRequest)
+		should.ContainSubstring(t, w.Body.String(), "invalid network name")
+	})
+	t.Run("add", func(t *testing.T) {
+		w := apiRequest(t, cookie, http.MethodPost, "/api/v1/networks",
+			`{"Name":"api","AddressString":"10.10.10.10/24"}`)
+		should.BeEqual(t, w.Code, http.StatusCreated)
+		network := plexus.Network{}
+		should.NotBeError(t, json.NewDecoder(w.Body).Decode(&network))
+		should.BeEqual(t, network.AddressString, "10.10.10.0/24")
+	})
+	t.Run("duplicate", func(t *testing.T) {
+		w := apiRequest(t, cookie, http.MethodPost, "/api/v1/networks",
+			`{"Name":"api","AddressString":"10.10.11.0/24"}`)
+		should.BeEqual(t, w.Code, http.StatusBadRequest)
+		should.ContainSubstring(t, w.Body.String(), "network name exists")
+	})
+	t.Run("get", func(t *testing.T) {
+		w := apiRequest(t, cookie, http.MethodGet, "/api/v1/networks/api", "")
+		should.BeEqual(t, w.Code, http.StatusOK)
+		network := plexus.Network{}
+		should.NotBeError(t, json.NewDecoder(w.Body).Decode(&network))
+		should.BeEqual(t, network.Name, "api")
+	})
+	t.Run("getMissing", func(t *testing.T) {
+		w := apiRequest(t, cookie, http.MethodGet, "/api/v1/networks/missing", "")
+		should.BeEqual(t, w.Code, http.StatusNotFound)
+	})
+	t.Run("peerMissing", func(t *testing.T) {
+		w := apiRequest(t, cookie, http.MethodGet, "/api/v1/networks/api/peers/missing", "")
+		should.BeEqual(t, w.Code, http.StatusNotFound)
+		should.ContainSubstring(t, w.Body.String(), "peer not found")
+	})
+	t.Run("relayMissingPeer", func(t *testing.T) {
+		w := apiRequest(t, cookie, http.MethodPost, "/api/v1/networks/api/relay/missing",
+			`{"Relayed":[]}`)
+		should.BeEqual(t, w.Code, http.StatusNotFound)
+	})
+	t.Run("routerBadSubnet", func(t *testing.T) {
+		w := apiRequest(t, cookie, http.MethodPost, "/api/v1/networks/api/router/missing",
+			`{"Subnet":"8.8.8.0/24"}`)
+		should.BeEqual(t, w.Code, http.StatusBadRequest)
+		should.ContainSubstring(t, w.Body.String(), "must be a private network")
+	})
+	t.Run("delete", func(t *testing.T) {
+		w := apiRequest(t, cookie, http.MethodDelete, "/api/v1/networks/api", "")
+		should.BeEqual(t, w.Code, http.StatusNoContent)
+		_, err := boltdb.Get[plexus.Network]("api", networkTable)
+		should.BeErrorIs(t, err, boltdb.ErrNoResults)
+	})
+	t.Run("deleteMissing", func(t *testing.T) {
+		w := apiRequest(t, cookie, http.MethodDelete, "/api/v1/networks/api", "")
+		should.BeEqual(t, w.Code, http.StatusNotFound)
+	})
+}
+
+func TestAPINetworkPeers(t *testing.T) {
+	setup(t)
+	defer shutdown(t)
+	deleteAllNetworks(t)
+	deleteAllPeers(t)
+	user := plexus.User{Username: "hello", Password: "world", IsAdmin: true}
+	createTestUser(t, user)
+	cookie := testLogin(t, user)
+	createTestNetwork(t)
+	defer deleteAllNetworks(t)
+	defer deleteAllPeers(t)
+	relay := createTestNetworkPeer(t)
+	relayed := createTestNetworkPeer(t)
+
+	t.Run("addRelay", func(t *testing.T) {
+		w := apiRequest(t, cookie, http.MethodPost, "/api/v1/networks/valid/relay/"+relay,
+			`{"Relayed":["`+relayed+`"]}`)
+		should.BeEqual(t, w.Code, http.StatusOK)
+		network := plexus.Network{}
+		should.NotBeError(t, json.NewDecoder(w.Body).Decode(&network))
+		for _, peer := range network.Peers {
+			if peer.WGPublicKey == relay {
+				should.BeTrue(t, peer.IsRelay)
+			}
+			if peer.WGPublicKey == relayed {
+				should.BeTrue(t, peer.IsRelayed)
+			}
+		}
+	})
+	t.Run("deleteRelay", func(t *testing.T) {
+		w := apiRequest(t, cookie, http.MethodDelete, "/api/v1/networks/valid/relay/"+relay, "")
+		should.BeEqual(t, w.Code, http.StatusOK)
+	})
+	t.Run("addRouter", func(t *testing.T) {
+		w := apiRequest(t, cookie, http.MethodPost, "/api/v1/networks/valid/router/"+relay,
+			`{"Subnet":"192.168.50.0/24","Nat":"nat"}`)
+		should.BeEqual(t, w.Code, http.StatusOK)
+		w = apiRequest(t, cookie, http.MethodGet, "/api/v1/networks/valid/peers/"+relay, "")
+		should.BeEqual(t, w.Code, http.StatusOK)
+		peer := plexus.NetworkPeer{}
+		should.NotBeError(t, json.NewDecoder(w.Body).Decode(&peer))
+		should.BeTrue(t, peer.IsSubnetRouter)
+		should.BeTrue(t, peer.UsesNat())
+	})
+	t.Run("deleteRouter", func(t *testing.T) {
+		w := apiRequest(t, cookie, http.MethodDelete, "/api/v1/networks/valid/router/"+relay, "")
+		should.BeEqual(t, w.Code, http.StatusOK)
+	})
+	t.Run("removePeer", func(t *testing.T) {
+		w := apiRequest(t, cookie, http.MethodDelete, "/api/v1/networks/valid/peers/"+relayed, "")
+		should.BeEqual(t, w.Code, http.StatusOK)
+		network := plexus.Network{}
+		should.NotBeError(t, json.NewDecoder(w.Body).Decode(&network))
+		should.BeEqual(t, len(network.Peers), 1)
+	})
+	t.Run("deletePeer", func(t *testing.T) {
+		w := apiRequest(t, cookie, http.MethodDelete, "/api/v1/peers/"+relayed, "")
+		should.BeEqual(t, w.Code, http.StatusNoContent)
+		w = apiRequest(t, cookie, http.MethodGet, "/api/v1/peers/"+relayed, "")
+		should.BeEqual(t, w.Code, http.StatusNotFound)
+	})
+}
+
+func TestAPIKeys(t *testing.T) {
+	setup(t)
+	defer shutdown(t)
+	deleteAllKeys(t)
+	defer deleteAllKeys(t)
+	user := plexus.User{Username: "hello", Password: "world", IsAdmin: true}
+	createTestUser(t, user)
+	cookie := testLogin(t, user)
+
+	t.Run("invalid", func(t *testing.T) {
+		w := apiRequest(t, cookie, http.MethodPost, "/api/v1/keys",
+			`{"Name":"Bad","DispExp":"`+time.Now().Format("2006-01-02")+`"}`)
+		should.BeEqual(t, w.Code, http.StatusBadRequest)
+		should.ContainSubstring(t, w.Body.String(), "invalid chars")
+	})
+	t.Run("add", func(t *testing.T) {
+		w := apiRequest(t, cookie, http.MethodPost, "/api/v1/keys",
+			`{"Name":"api","Usage":2,"DispExp":"`+time.Now().Format("2006-01-02")+`"}`)
+		should.BeEqual(t, w.Code, http.StatusCreated)
+		key := plexus.Key{}
+		should.NotBeError(t, json.NewDecoder(w.Body).Decode(&key))
+		should.BeEqual(t, key.Usage, 2)
+		should.NotBeEmpty(t, key.Value)
+	})
+	t.Run("list", func(t *testing.T) {
+		w := apiRequest(t, cookie, http.MethodGet, "/api/v1/keys", "")
+		should.BeEqual(t, w.Code, http.StatusOK)
+		keys := []plexus.Key{}
+		should.NotBeError(t, json.NewDecoder(w.Body).Decode(&keys))
+		should.BeEqual(t, len(keys), 1)
+	})
+	t.Run("delete", func(t *testing.T) {
+		w := apiRequest(t, cookie, http.MethodDelete, "/api/v1/keys/api", "")
+		should.BeEqual(t, w.Code, http.StatusNoContent)
+	})
+	t.Run("deleteMissing", func(t *testing.T) {
+		w := apiRequest(t, cookie, http.MethodDelete, "/api/v1/keys/api", "")
+		should.BeEqual(t, w.Code, http.StatusNotFound)
+	})
+}
+
+func TestAPIUsers(t *testing.T) {
+	deleteAllUsers(t)
+	admin := plexus.User{Username: "admin", Password: "pass", IsAdmin: true}
+	user := plexus.User{Username: "test", Password: "pass"}
+	createTestUser(t, admin)
+	createTestUser(t, user)
+	adminCookie := testLogin(t, admin)
+	userCookie := testLogin(t, user)
+
+	t.Run("listNotAdmin", func(t *testing.T) {
+		w := apiRequest(t, userCookie, http.MethodGet, "/api/v1/users", "")
+		should.BeEqual(t, w.Code, http.StatusForbidden)
+	})
+	t.Run("list", func(t *testing.T) {
+		w := apiRequest(t, adminCookie, http.MethodGet, "/api/v1/users", "")
+		should.BeEqual(t, w.Code, http.StatusOK)
+		users := []plexus.User{}
+		should.NotBeError(t, json.NewDecoder(w.Body).Decode(&users))
+		should.BeEqual(t, len(users), 2)
+		for _, user := range users {
+			should.BeEmpty(t, user.Password)
+		}
+	})
+	t.Run("add", func(t *testing.T) {
+		w := apiRequest(t, adminCookie, http.MethodPost, "/api/v1/users",
+			`{"username":"new","password":"secret"}`)
+		should.BeEqual(t, w.Code, http.StatusCreated)
+		w = apiRequest(t, adminCookie, http.MethodPost, "/api/v1/users",
+			`{"username":"new","password":"secret"}`)
+		should.BeEqual(t, w.Code, http.StatusBadRequest)
+		should.ContainSubstring(t, w.Body.String(), "user exists")
+	})
+	t.Run("editSelf", func(t *testing.T) {
+		w := apiRequest(t, userCookie, http.MethodPut, "/api/v1/users/test",
+			`{"Password":"newpass"}`)
+		should.BeEqual(t, w.Code, http.StatusNoContent)
+	})
+	t.Run("editOther", func(t *testing.T) {
+		w := apiRequest(t, userCookie, http.MethodPut, "/api/v1/users/admin",
+			`{"Password":"newpass"}`)
+		should.BeEqual(t, w.Code, http.StatusForbidden)
+	})
+	t.Run("delete", func(t *testing.T) {
+		w := apiRequest(t, adminCookie, http.MethodDelete, "/api/v1/users/new", "")
+		should.BeEqual(t, w.Code, http.StatusNoContent)
+		w = apiRequest(t, adminCookie, http.MethodGet, "/api/v1/users/new", "")
+		should.BeEqual(t, w.Code, http.StatusNotFound)
+	})
+}
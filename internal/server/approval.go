@@ -0,0 +1,194 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/devilcove/boltdb"
+	"github.com/devilcove/plexus"
+	"github.com/devilcove/plexus/internal/publish"
+	"github.com/nats-io/nats.go"
+)
+
+// queueRegistration holds a device registered with a key that requires
+// approval. The device is not given access to the broker until approved. A key
+// holds no more registrations awaiting a decision than it has uses left.
+func queueRegistration(peer plexus.Peer, key plexus.Key) plexus.MessageResponse {
+	if _, err := boltdb.Get[plexus.Peer](peer.WGPublicKey, peerTable); err == nil {
+		return plexus.MessageResponse{Message: "error: peer exists"}
+	}
+	queued, err := pendingPeers()
+	if err != nil {
+		slog.Error("get pending peers", "error", err)
+		return plexus.MessageResponse{Message: "error: " + err.Error()}
+	}
+	waiting := 0
+	for _, pending := range queued {
+		if pending.Key.Name == key.Name && pending.WGPublicKey != peer.WGPublicKey {
+			waiting++
+		}
+	}
+	if waiting >= key.Usage {
+		return plexus.MessageResponse{Message: "error: registration key has no uses left"}
+	}
+	pending := plexus.PendingPeer{
+		Peer:      peer,
+		Key:       auditKeyValue(key),
+		Requested: time.Now(),
+	}
+	if err := save(pending, peer.WGPublicKey, pendingTable); err != nil {
+		slog.Error("save pending peer", "error", err)
+		return plexus.MessageResponse{Message: "error: " + err.Error()}
+	}
+	slog.Info("registration pending approval", "peer", peer.Name, "key", key.Name)
+	audit("peer:"+peer.Name, "peer.pending", peer.Name, nil, pending)
+	return plexus.MessageResponse{Message: plexus.RegistrationPending}
+}
+
+// pendingPeers returns the registrations awaiting a decision.
+func pendingPeers() ([]plexus.PendingPeer, error) {
+	all, err := boltdb.GetAll[plexus.PendingPeer](pendingTable)
+	if err != nil {
+		return nil, err
+	}
+	pending := []plexus.PendingPeer{}
+	for _, peer := range all {
+		if !peer.Rejected {
+			pending = append(pending, peer)
+		}
+	}
+	return pending, nil
+}
+
+// getPending returns the registration of a device awaiting a decision.
+func getPending(id string) (plexus.PendingPeer, error) {
+	pending, err := boltdb.Get[plexus.PendingPeer](id, pendingTable)
+	if err != nil {
+		return pending, err
+	}
+	if pending.Rejected {
+		return pending, requestError("registration rejected")
+	}
+	return pending, nil
+}
+
+// approveRegistration completes the registration of a pending device.
+func approveRegistration(actor, id string) (plexus.Peer, error) {
+	pending, err := getPending(id)
+	if err != nil {
+		return pending.Peer, err
+	}
+	response := completeRegistration(pending.Peer, pending.Key)
+	if strings.HasPrefix(response.Message, "error") {
+		return pending.Peer, errors.New(response.Message)
+	}
+	if err := remove(id, pendingTable); err != nil {
+		return pending.Peer, fmt.Errorf("delete pending peer %w", err)
+	}
+	audit(actor, "peer.approve", pending.Name, pending, pending.Peer)
+	useApprovalKey(actor, pending.Key.Name)
+	return pending.Peer, nil
+}
+
+// rejectRegistration rejects a pending device. The rejection is kept until
+// reported to the device or it expires.
+func rejectRegistration(actor, id string) error {
+	pending, err := getPending(id)
+	if err != nil {
+		return err
+	}
+	before := pending
+	pending.Rejected = true
+	if err := save(pending, id, pendingTable); err != nil {
+		return fmt.Errorf("save pending peer %w", err)
+	}
+	audit(actor, "peer.reject", pending.Name, before, pending)
+	useApprovalKey(actor, pending.Key.Name)
+	return nil
+}
+
+// useApprovalKey decrements the usage of the key of a decided registration;
+// the key may have been deleted or expired in the meantime.
+func useApprovalKey(actor, name string) {
+	if err := decrementKeyUsage(actor, name); err != nil && !errors.Is(err, boltdb.ErrNoResults) {
+		slog.Error("decrement key usage", "key", name, "error", err)
+	}
+}
+
+// registrationStatus reports the approval decision for a device.
+func registrationStatus(id string) plexus.MessageResponse {
+	pending, err := boltdb.Get[plexus.PendingPeer](id, pendingTable)
+	if err == nil {
+		if !pending.Rejected {
+			return plexus.MessageResponse{Message: plexus.RegistrationPending}
+		}
+		if err := remove(id, pendingTable); err != nil {
+			slog.Error("delete rejected peer", "peer", pending.Name, "error", err)
+		}
+		return plexus.MessageResponse{Message: plexus.RegistrationRejected}
+	}
+	if _, err := boltdb.Get[plexus.Peer](id, peerTable); err == nil {
+		return plexus.MessageResponse{Message: plexus.RegistrationApproved}
+	}
+	return plexus.MessageResponse{
+		IncludesError: true,
+		Message:       "no registration",
+		Error:         "no registration for " + id,
+	}
+}
+
+func subscribeRegistrationStatus(msg *nats.Msg) {
+	request := plexus.RegistrationStatusRequest{}
+	if err := json.Unmarshal(msg.Data, &request); err != nil {
+		slog.Error("invalid registration status request", "error", err, "data", string(msg.Data))
+		publish.ErrorMessage(natsConn, msg.Reply, "invalid request", err)
+		return
+	}
+	publish.Message(natsConn, msg.Reply, registrationStatus(request.WGPublicKey))
+}
+
+// expirePending removes rejections that were never reported to the device.
+func expirePending() {
+	all, err := boltdb.GetAll[plexus.PendingPeer](pendingTable)
+	if err != nil {
+		slog.Error("get pending peers", "error", err)
+		return
+	}
+	for _, pending := range all {
+		if !pending.Rejected || time.Since(pending.Requested) < pendingExpiry {
+			continue
+		}
+		if err := remove(pending.WGPublicKey, pendingTable); err != nil {
+			slog.Error("delete rejected peer", "peer", pending.Name, "error", err)
+		}
+	}
+}
+
+func approvePeer(w http.ResponseWriter, r *http.Request) {
+	if !GetSessionData(r).IsAdmin {
+		processError(w, http.StatusUnauthorized, "admin rights required")
+		return
+	}
+	if _, err := approveRegistration(userActor(r), r.PathValue("id")); err != nil {
+		processError(w, errorStatus(err), err.Error())
+		return
+	}
+	displayPeers(w, r)
+}
+
+func rejectPeer(w http.ResponseWriter, r *http.Request) {
+	if !GetSessionData(r).IsAdmin {
+		processError(w, http.StatusUnauthorized, "admin rights required")
+		return
+	}
+	if err := rejectRegistration(userActor(r), r.PathValue("id")); err != nil {
+		processError(w, errorStatus(err), err.Error())
+		return
+	}
+	displayPeers(w, r)
+}
@@ -0,0 +1,138 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/Kairum-Labs/should"
+	"github.com/devilcove/boltdb"
+	"github.com/devilcove/plexus"
+	"github.com/nats-io/nkeys"
+)
+
+func TestApproval(t *testing.T) {
+	setup(t)
+	defer shutdown(t)
+	deleteAllUsers(t)
+	deleteAllPeers(t)
+	deleteAllKeys(t)
+	defer deleteAllPeers(t)
+	defer deleteAllKeys(t)
+	admin := plexus.User{Username: "admin", Password: "pass", IsAdmin: true}
+	createTestUser(t, admin)
+	cookie := testLogin(t, admin)
+	_, err := createKey("admin", plexus.Key{
+		Name:     "approval",
+		Usage:    2,
+		DispExp:  time.Now().Add(time.Hour).Format("2006-01-02"),
+		Approval: true,
+	})
+	should.NotBeError(t, err)
+	// register returns a pending device with a fresh nkey.
+	register := func(t *testing.T, name string) plexus.Peer {
+		t.Helper()
+		pub, err := generateKeys()
+		should.NotBeError(t, err)
+		kp, err := nkeys.CreateUser()
+		should.NotBeError(t, err)
+		nkey, err := kp.PublicKey()
+		should.NotBeError(t, err)
+		peer := plexus.Peer{WGPublicKey: pub.String(), PubNkey: nkey, Name: name, OS: "linux"}
+		response := registerHandler("approval", &plexus.ServerRegisterRequest{Peer: peer})
+		should.BeEqual(t, response.Message, plexus.RegistrationPending)
+		return peer
+	}
+	authorized := func(nkey string) bool {
+		for _, user := range natsOptions.Nkeys {
+			if user.Nkey == nkey {
+				return true
+			}
+		}
+		return false
+	}
+
+	t.Run("pending", func(t *testing.T) {
+		peer := register(t, "pending")
+		_, err := boltdb.Get[plexus.Peer](peer.WGPublicKey, peerTable)
+		should.BeError(t, err)
+		should.BeFalse(t, authorized(peer.PubNkey))
+		should.BeEqual(t, registrationStatus(peer.WGPublicKey).Message, plexus.RegistrationPending)
+		w := apiRequest(t, cookie, http.MethodGet, "/api/v1/pending", "")
+		should.BeEqual(t, w.Code, http.StatusOK)
+		pending := []plexus.PendingPeer{}
+		should.NotBeError(t, json.Unmarshal(w.Body.Bytes(), &pending))
+		should.BeEqual(t, len(pending), 1)
+		should.BeEqual(t, pending[0].Name, "pending")
+		should.BeEqual(t, pending[0].Key.Value, "")
+		r := httptest.NewRequest(http.MethodGet, "/peers/", nil)
+		r.AddCookie(cookie)
+		w = httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		should.ContainSubstring(t, w.Body.String(), "Pending Registrations")
+	})
+	t.Run("forbidden", func(t *testing.T) {
+		user := plexus.User{Username: "user", Password: "pass"}
+		createTestUser(t, user)
+		w := apiRequest(t, testLogin(t, user), http.MethodGet, "/api/v1/pending", "")
+		should.BeEqual(t, w.Code, http.StatusForbidden)
+	})
+	t.Run("approve", func(t *testing.T) {
+		pending, err := pendingPeers()
+		should.NotBeError(t, err)
+		should.BeEqual(t, len(pending), 1)
+		id := pending[0].WGPublicKey
+		w := apiRequest(t, cookie, http.MethodPost, "/api/v1/pending/"+id, "")
+		should.BeEqual(t, w.Code, http.StatusOK)
+		peer, err := boltdb.Get[plexus.Peer](id, peerTable)
+		should.NotBeError(t, err)
+		should.BeTrue(t, authorized(peer.PubNkey))
+		should.BeEqual(t, registrationStatus(id).Message, plexus.RegistrationApproved)
+		key, err := boltdb.Get[plexus.Key]("approval", keyTable)
+		should.NotBeError(t, err)
+		should.BeEqual(t, key.Usage, 1)
+		w = apiRequest(t, cookie, http.MethodPost, "/api/v1/pending/"+id, "")
+		should.BeEqual(t, w.Code, http.StatusNotFound)
+	})
+	t.Run("reject", func(t *testing.T) {
+		peer := register(t, "rejected")
+		r := httptest.NewRequest(http.MethodDelete, "/peers/pending/"+peer.WGPublicKey, nil)
+		r.AddCookie(cookie)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		should.BeEqual(t, w.Code, http.StatusOK)
+		pending, err := pendingPeers()
+		should.NotBeError(t, err)
+		should.BeEqual(t, len(pending), 0)
+		w = apiRequest(t, cookie, http.MethodPost, "/api/v1/pending/"+peer.WGPublicKey, "")
+		should.BeEqual(t, w.Code, http.StatusBadRequest)
+		should.BeFalse(t, authorized(peer.PubNkey))
+		// the key is used up by the decision.
+		_, err = boltdb.Get[plexus.Key]("approval", keyTable)
+		should.BeError(t, err)
+		should.BeEqual(t, registrationStatus(peer.WGPublicKey).Message, plexus.RegistrationRejected)
+		status := registrationStatus(peer.WGPublicKey)
+		should.BeTrue(t, status.IncludesError)
+	})
+	t.Run("queueLimit", func(t *testing.T) {
+		_, err := createKey("admin", plexus.Key{
+			Name:     "single",
+			DispExp:  time.Now().Add(time.Hour).Format("2006-01-02"),
+			Approval: true,
+		})
+		should.NotBeError(t, err)
+		for i, want := range []string{plexus.RegistrationPending, "error: registration key has no uses left"} {
+			pub, err := generateKeys()
+			should.NotBeError(t, err)
+			peer := plexus.Peer{WGPublicKey: pub.String(), Name: "queued" + strconv.Itoa(i)}
+			response := registerHandler("single", &plexus.ServerRegisterRequest{Peer: peer})
+			should.BeEqual(t, response.Message, want)
+		}
+		pending, err := pendingPeers()
+		should.NotBeError(t, err)
+		should.BeEqual(t, len(pending), 1)
+	})
+}
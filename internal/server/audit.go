@@ -0,0 +1,291 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/devilcove/boltdb"
+	"github.com/devilcove/plexus"
+	"go.etcd.io/bbolt"
+)
+
+const (
+	actorSystem = "system"
+	auditLimit  = 500
+)
+
+// AuditFilter selects audit events; blank fields match all events.
+type AuditFilter struct {
+	Actor  string
+	Action string
+	Target string
+	Since  time.Time
+	Until  time.Time
+	Limit  int
+}
+
+// AuditPage is the data used to display the audit page.
+type AuditPage struct {
+	Filter AuditFilter
+	Since  string
+	Until  string
+	Events []plexus.AuditEvent
+}
+
+// audit appends an event to the audit table, through the audit stream when the
+// server is clustered. Updates that do not change anything are not recorded.
+// Events can not be modified or deleted.
+func audit(actor, action, target string, before, after any) {
+	event := plexus.AuditEvent{
+		Time:   time.Now(),
+		Actor:  actor,
+		Action: action,
+		Target: target,
+		Before: auditValue(before),
+		After:  auditValue(after),
+	}
+	if event.Before != nil && event.After != nil && bytes.Equal(event.Before, event.After) {
+		return
+	}
+	if r := replica.Load(); r != nil && r.js != nil {
+		if err := r.publishAudit(event); err != nil {
+			slog.Error("audit", "action", action, "target", target, "error", err)
+		}
+		return
+	}
+	db := boltdb.Connection()
+	if db == nil {
+		slog.Error("audit: no database connection", "action", action)
+		return
+	}
+	if err := db.Update(func(tx *bbolt.Tx) error {
+		b := tx.Bucket([]byte(auditTable))
+		if b == nil {
+			return boltdb.ErrNoResults
+		}
+		seq, err := b.NextSequence()
+		if err != nil {
+			return err
+		}
+		event.ID = seq
+		value, err := json.Marshal(event)
+		if err != nil {
+			return err
+		}
+		return b.Put(auditKey(seq), value)
+	}); err != nil {
+		slog.Error("audit", "action", action, "target", target, "error", err)
+	}
+}
+
+// saveAuditEvent saves an event of the audit stream under its id. The sequence
+// of the table is kept past the id, so that events recorded once the server
+// is no longer clustered do not replace it.
+func saveAuditEvent(event plexus.AuditEvent) error {
+	value, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	return boltdb.Connection().Update(func(tx *bbolt.Tx) error {
+		b := tx.Bucket([]byte(auditTable))
+		if b == nil {
+			return boltdb.ErrNoResults
+		}
+		if err := b.SetSequence(max(b.Sequence(), event.ID)); err != nil {
+			return err
+		}
+		return b.Put(auditKey(event.ID), value)
+	})
+}
+
+// clearAudit deletes the events of the audit table, keeping its sequence.
+func clearAudit() error {
+	return boltdb.Connection().Update(func(tx *bbolt.Tx) error {
+		b := tx.Bucket([]byte(auditTable))
+		if b == nil {
+			return boltdb.ErrNoResults
+		}
+		keys := [][]byte{}
+		if err := b.ForEach(func(k, _ []byte) error {
+			keys = append(keys, slices.Clone(k))
+			return nil
+		}); err != nil {
+			return err
+		}
+		for _, k := range keys {
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// auditKey returns a key that sorts in sequence order.
+func auditKey(seq uint64) []byte {
+	return fmt.Appendf(nil, "%020d", seq)
+}
+
+func auditValue(value any) json.RawMessage {
+	if value == nil {
+		return nil
+	}
+	data, err := json.Marshal(value)
+	if err != nil {
+		slog.Error("audit value", "error", err)
+		return nil
+	}
+	return data
+}
+
+// peerActor returns the audit actor for an agent.
+func peerActor(id string) string {
+	peer, err := boltdb.Get[plexus.Peer](id, peerTable)
+	if err != nil || peer.Name == "" {
+		return "peer:" + id
+	}
+	return "peer:" + peer.Name
+}
+
+// userActor returns the audit actor for a web or api request.
+func userActor(r *http.Request) string {
+	return GetSessionData(r).Username
+}
+
+func (f AuditFilter) match(event plexus.AuditEvent) bool {
+	if f.Actor != "" && event.Actor != f.Actor {
+		return false
+	}
+	if f.Action != "" && !strings.HasPrefix(event.Action, f.Action) {
+		return false
+	}
+	if f.Target != "" && !strings.Contains(event.Target, f.Target) {
+		return false
+	}
+	if !f.Since.IsZero() && event.Time.Before(f.Since) {
+		return false
+	}
+	if !f.Until.IsZero() && event.Time.After(f.Until) {
+		return false
+	}
+	return true
+}
+
+// auditEvents returns the events matching filter, newest first.
+func auditEvents(filter AuditFilter) ([]plexus.AuditEvent, error) {
+	events := []plexus.AuditEvent{}
+	if filter.Limit <= 0 {
+		filter.Limit = auditLimit
+	}
+	db := boltdb.Connection()
+	err := db.View(func(tx *bbolt.Tx) error {
+		b := tx.Bucket([]byte(auditTable))
+		if b == nil {
+			return boltdb.ErrNoResults
+		}
+		c := b.Cursor()
+		for k, v := c.Last(); k != nil && len(events) < filter.Limit; k, v = c.Prev() {
+			event := plexus.AuditEvent{}
+			if err := json.Unmarshal(v, &event); err != nil {
+				return err
+			}
+			if filter.match(event) {
+				events = append(events, event)
+			}
+		}
+		return nil
+	})
+	return events, err
+}
+
+// parseAuditFilter reads an audit filter from the request query.
+// Dates are either RFC3339 or 2006-01-02; an until date includes the whole day.
+func parseAuditFilter(r *http.Request) (AuditFilter, error) {
+	query := r.URL.Query()
+	filter := AuditFilter{
+		Actor:  query.Get("actor"),
+		Action: query.Get("action"),
+		Target: query.Get("target"),
+	}
+	var err error
+	if filter.Since, err = parseAuditTime(query.Get("since"), false); err != nil {
+		return filter, requestError("invalid since " + err.Error())
+	}
+	if filter.Until, err = parseAuditTime(query.Get("until"), true); err != nil {
+		return filter, requestError("invalid until " + err.Error())
+	}
+	if limit := query.Get("limit"); limit != "" {
+		if filter.Limit, err = strconv.Atoi(limit); err != nil {
+			return filter, requestError("invalid limit " + err.Error())
+		}
+	}
+	return filter, nil
+}
+
+func parseAuditTime(value string, endOfDay bool) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	t, err := time.ParseInLocation("2006-01-02", value, time.Local)
+	if err != nil {
+		return t, err
+	}
+	if endOfDay {
+		t = t.Add(24*time.Hour - time.Nanosecond)
+	}
+	return t, nil
+}
+
+func displayAudit(w http.ResponseWriter, r *http.Request) {
+	if !GetSessionData(r).IsAdmin {
+		processError(w, http.StatusUnauthorized, "admin rights required")
+		return
+	}
+	filter, err := parseAuditFilter(r)
+	if err != nil {
+		processError(w, errorStatus(err), err.Error())
+		return
+	}
+	events, err := auditEvents(filter)
+	if err != nil {
+		processError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	render(w, "audit", AuditPage{
+		Filter: filter,
+		Since:  r.URL.Query().Get("since"),
+		Until:  r.URL.Query().Get("until"),
+		Events: events,
+	})
+}
+
+func exportAudit(w http.ResponseWriter, r *http.Request) {
+	if !GetSessionData(r).IsAdmin {
+		apiError(w, http.StatusForbidden, "admin rights required")
+		return
+	}
+	filter, err := parseAuditFilter(r)
+	if err != nil {
+		apiError(w, errorStatus(err), err.Error())
+		return
+	}
+	events, err := auditEvents(filter)
+	if err != nil {
+		apiError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if r.URL.Query().Has("download") {
+		w.Header().Set("Content-Disposition", `attachment; filename="plexus-audit.json"`)
+	}
+	apiResponse(w, http.StatusOK, events)
+}
@@ -0,0 +1,123 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Kairum-Labs/should"
+	"github.com/devilcove/plexus"
+)
+
+func TestAudit(t *testing.T) {
+	start := time.Now()
+	audit("tester", "test.create", "audit-one", nil, map[string]int{"a": 1})
+	audit("tester", "test.update", "audit-one", map[string]int{"a": 1}, map[string]int{"a": 2})
+	audit("tester", "test.update", "audit-one", map[string]int{"a": 2}, map[string]int{"a": 2})
+	audit("other", "test.delete", "audit-two", map[string]int{"a": 2}, nil)
+
+	t.Run("all", func(t *testing.T) {
+		events, err := auditEvents(AuditFilter{Action: "test.", Since: start})
+		should.NotBeError(t, err)
+		should.BeEqual(t, len(events), 3)
+		// newest first.
+		should.BeEqual(t, events[0].Action, "test.delete")
+		should.BeGreaterThan(t, events[0].ID, events[1].ID)
+		should.BeEqual(t, string(events[1].Before), `{"a":1}`)
+		should.BeEqual(t, string(events[1].After), `{"a":2}`)
+	})
+	t.Run("actor", func(t *testing.T) {
+		events, err := auditEvents(AuditFilter{Actor: "other", Since: start})
+		should.NotBeError(t, err)
+		should.BeEqual(t, len(events), 1)
+		should.BeEqual(t, events[0].Target, "audit-two")
+	})
+	t.Run("target", func(t *testing.T) {
+		events, err := auditEvents(AuditFilter{Target: "audit-one", Since: start, Limit: 1})
+		should.NotBeError(t, err)
+		should.BeEqual(t, len(events), 1)
+		should.BeEqual(t, events[0].Action, "test.update")
+	})
+	t.Run("until", func(t *testing.T) {
+		events, err := auditEvents(AuditFilter{Action: "test.", Until: start})
+		should.NotBeError(t, err)
+		for _, event := range events {
+			should.BeFalse(t, event.Time.After(start))
+		}
+	})
+}
+
+func TestParseAuditFilter(t *testing.T) {
+	r := httptest.NewRequest(http.MethodGet, "/audit/?actor=admin&since=2026-01-02&until=2026-01-02", nil)
+	filter, err := parseAuditFilter(r)
+	should.NotBeError(t, err)
+	should.BeEqual(t, filter.Actor, "admin")
+	should.BeEqual(t, filter.Until.Sub(filter.Since), 24*time.Hour-time.Nanosecond)
+	r = httptest.NewRequest(http.MethodGet, "/audit/?since=yesterday", nil)
+	_, err = parseAuditFilter(r)
+	should.BeError(t, err)
+	should.BeEqual(t, errorStatus(err), http.StatusBadRequest)
+}
+
+func TestAuditLog(t *testing.T) {
+	setup(t)
+	defer shutdown(t)
+	deleteAllUsers(t)
+	deleteAllNetworks(t)
+	defer deleteAllNetworks(t)
+	start := time.Now().Format(time.RFC3339)
+	admin := plexus.User{Username: "auditor", Password: "pass", IsAdmin: true}
+	user := plexus.User{Username: "regular", Password: "pass"}
+	createTestUser(t, admin)
+	createTestUser(t, user)
+	adminCookie := testLogin(t, admin)
+	userCookie := testLogin(t, user)
+
+	w := apiRequest(t, adminCookie, http.MethodPost, "/api/v1/networks",
+		`{"Name":"audited","AddressString":"10.210.0.0/24"}`)
+	should.BeEqual(t, w.Code, http.StatusCreated)
+	w = apiRequest(t, adminCookie, http.MethodDelete, "/api/v1/networks/audited", "")
+	should.BeEqual(t, w.Code, http.StatusNoContent)
+	w = apiRequest(t, adminCookie, http.MethodPost, "/api/v1/users",
+		`{"username":"audited","password":"secret"}`)
+	should.BeEqual(t, w.Code, http.StatusCreated)
+
+	t.Run("export", func(t *testing.T) {
+		w := apiRequest(t, adminCookie, http.MethodGet,
+			"/api/v1/audit?target=audited&since="+start, "")
+		should.BeEqual(t, w.Code, http.StatusOK)
+		events := []plexus.AuditEvent{}
+		should.NotBeError(t, json.NewDecoder(w.Body).Decode(&events))
+		actions := []string{}
+		for _, event := range events {
+			should.BeEqual(t, event.Actor, "auditor")
+			actions = append(actions, event.Action)
+		}
+		should.BeEqual(t, actions, []string{"user.create", "network.delete", "role.set", "network.create"})
+		// password hashes are not recorded.
+		should.ContainSubstring(t, string(events[0].After), `"password":""`)
+		should.BeNil(t, events[1].After)
+	})
+	t.Run("download", func(t *testing.T) {
+		w := apiRequest(t, adminCookie, http.MethodGet, "/audit/export?download&action=network.", "")
+		should.BeEqual(t, w.Code, http.StatusOK)
+		should.ContainSubstring(t, w.Header().Get("Content-Disposition"), "attachment")
+		should.ContainSubstring(t, w.Body.String(), "network.create")
+	})
+	t.Run("page", func(t *testing.T) {
+		w := apiRequest(t, adminCookie, http.MethodGet, "/audit/?action=network.", "")
+		should.BeEqual(t, w.Code, http.StatusOK)
+		should.ContainSubstring(t, w.Body.String(), "<h1>Audit Log</h1>")
+		should.ContainSubstring(t, w.Body.String(), "network.delete")
+		should.BeFalse(t, strings.Contains(w.Body.String(), "user.create"))
+	})
+	t.Run("notAdmin", func(t *testing.T) {
+		w := apiRequest(t, userCookie, http.MethodGet, "/api/v1/audit", "")
+		should.BeEqual(t, w.Code, http.StatusForbidden)
+		w = apiRequest(t, userCookie, http.MethodGet, "/audit/", "")
+		should.BeEqual(t, w.Code, http.StatusUnauthorized)
+	})
+}
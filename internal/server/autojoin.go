@@ -0,0 +1,126 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/devilcove/boltdb"
+	"github.com/devilcove/plexus"
+)
+
+// a newly registered device connects to the server after registration
+// completes, so its listen ports are requested until it answers.
+var (
+	autoJoinAttempts = 10
+	autoJoinInterval = time.Second * 3
+)
+
+// validateKeyNetworks checks the networks and roles a registration key
+// assigns to the devices registered with it.
+func validateKeyNetworks(key plexus.Key) (plexus.Key, error) {
+	key.Networks = normalizeLabels(key.Networks)
+	for _, name := range key.Networks {
+		if _, err := boltdb.Get[plexus.Network](name, networkTable); err != nil {
+			if errors.Is(err, boltdb.ErrNoResults) {
+				return key, requestError("no such network " + name)
+			}
+			return key, fmt.Errorf("retrieve network %w", err)
+		}
+	}
+	if (key.Relay != "" || key.Router != "") && len(key.Networks) == 0 {
+		return key, requestError("relay and router roles require networks")
+	}
+	if key.Relay != "" {
+		if _, err := boltdb.Get[plexus.Group](key.Relay, groupTable); err != nil {
+			if errors.Is(err, boltdb.ErrNoResults) {
+				return key, requestError("no such group " + key.Relay)
+			}
+			return key, fmt.Errorf("retrieve group %w", err)
+		}
+	}
+	if key.Router != "" {
+		// a subnet can only be routed in one network.
+		if len(key.Networks) > 1 {
+			return key, requestError("router keys can only join one network")
+		}
+		// the devices join the routers already routing the subnet.
+		network, err := boltdb.Get[plexus.Network](key.Networks[0], networkTable)
+		if err != nil {
+			return key, fmt.Errorf("retrieve network %w", err)
+		}
+		subnet, err := parseRouterSubnet(network, "", key.Router, keyRouterNat(key), "")
+		if err != nil {
+			return key, err
+		}
+		key.Router = subnet.Subnet.String()
+	} else {
+		key.RouterNat = false
+	}
+	return key, nil
+}
+
+// keyRouterNat returns the nat mode of subnet routers created by key.
+func keyRouterNat(key plexus.Key) string {
+	if key.RouterNat {
+		return "nat"
+	}
+	return "none"
+}
+
+// autoJoin adds a device registered with key to the key networks and assigns
+// the relay and router roles of the key. Failures are logged; the device can
+// still be added manually.
+func autoJoin(peer plexus.Peer, key plexus.Key) {
+	actor := "key:" + key.Name
+	for _, name := range key.Networks {
+		network, err := autoJoinNetwork(actor, peer.WGPublicKey, name)
+		if err != nil {
+			slog.Error("auto join network", "peer", peer.Name, "network", name, "error", err)
+			continue
+		}
+		slog.Info("peer joined network with key", "peer", peer.Name, "network", name, "key", key.Name)
+		if key.Relay != "" {
+			network, err = autoJoinRelay(actor, network, peer.WGPublicKey, key.Relay)
+			if err != nil {
+				slog.Error("auto join relay", "peer", peer.Name, "network", name, "error", err)
+			}
+		}
+		if key.Router != "" {
+			subnet, err := parseRouterSubnet(network, peer.WGPublicKey, key.Router, keyRouterNat(key), "")
+			if err != nil {
+				slog.Error("auto join router", "peer", peer.Name, "network", name, "error", err)
+				continue
+			}
+			if _, err := createRouter(actor, network, peer.WGPublicKey, subnet); err != nil {
+				slog.Error("auto join router", "peer", peer.Name, "network", name, "error", err)
+			}
+		}
+	}
+}
+
+// autoJoinNetwork adds a device to a network once it reports its listen ports.
+func autoJoinNetwork(actor, id, name string) (plexus.Network, error) {
+	var err error
+	for range autoJoinAttempts {
+		var priv, pub int
+		priv, pub, err = getListenPorts(id, name)
+		if err == nil {
+			return addPeerToNetwork(actor, id, name, priv, pub)
+		}
+		slog.Debug("waiting for peer listen ports", "peer", id, "network", name, "error", err)
+		time.Sleep(autoJoinInterval)
+	}
+	return plexus.Network{}, fmt.Errorf("get listen ports %w", err)
+}
+
+// autoJoinRelay makes a device the relay of the members of group in network.
+func autoJoinRelay(actor string, network plexus.Network, id, group string) (plexus.Network, error) {
+	relayed := groupRelayed(network, id, group)
+	if len(relayed) == 0 {
+		slog.Debug("no peers to relay", "network", network.Name, "group", group)
+		return network, nil
+	}
+	return createRelay(actor, network, id, relayed)
+}
@@ -0,0 +1,129 @@
+package server
+
+import (
+	"net/http"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/Kairum-Labs/should"
+	"github.com/devilcove/boltdb"
+	"github.com/devilcove/plexus"
+	"github.com/devilcove/plexus/internal/publish"
+	"github.com/nats-io/nats.go"
+)
+
+func TestAutoJoin(t *testing.T) {
+	setup(t)
+	defer shutdown(t)
+	deleteAllUsers(t)
+	deleteAllGroups(t)
+	deleteAllNetworks(t)
+	deleteAllPeers(t)
+	deleteAllKeys(t)
+	defer deleteAllGroups(t)
+	defer deleteAllNetworks(t)
+	defer deleteAllPeers(t)
+	defer deleteAllKeys(t)
+	interval := autoJoinInterval
+	autoJoinInterval = time.Millisecond * 100
+	defer func() { autoJoinInterval = interval }()
+	createTestNetwork(t)
+	member := createTestNetworkPeer(t)
+	_, err := createGroup("admin", plexus.Group{Name: "branch"})
+	should.NotBeError(t, err)
+	_, err = setPeerLabels("admin", member, nil, []string{"branch"})
+	should.NotBeError(t, err)
+	expires := time.Now().Add(time.Hour).Format("2006-01-02")
+
+	t.Run("invalid", func(t *testing.T) {
+		_, err := createKey("admin", plexus.Key{Name: "fleet", DispExp: expires, Networks: []string{"missing"}})
+		should.BeError(t, err)
+		should.ContainSubstring(t, err.Error(), "no such network missing")
+		_, err = createKey("admin", plexus.Key{Name: "fleet", DispExp: expires, Relay: "branch"})
+		should.BeError(t, err)
+		should.ContainSubstring(t, err.Error(), "require networks")
+		_, err = createKey("admin", plexus.Key{
+			Name: "fleet", DispExp: expires, Networks: []string{"valid"}, Relay: "missing",
+		})
+		should.BeError(t, err)
+		should.ContainSubstring(t, err.Error(), "no such group missing")
+		_, err = createKey("admin", plexus.Key{
+			Name: "fleet", DispExp: expires, Networks: []string{"valid"}, Router: "10.200.0.0/24",
+		})
+		should.BeError(t, err)
+		should.ContainSubstring(t, err.Error(), "subnet in use")
+	})
+	t.Run("forbidden", func(t *testing.T) {
+		operator := plexus.User{Username: "operator", Password: "pass", Roles: map[string]string{"other": roleOperator}}
+		createTestUser(t, operator)
+		w := apiRequest(t, testLogin(t, operator), http.MethodPost, "/api/v1/keys",
+			`{"Name":"fleet","DispExp":"`+expires+`","Networks":["valid"]}`)
+		should.BeEqual(t, w.Code, http.StatusForbidden)
+	})
+	t.Run("join", func(t *testing.T) {
+		key, err := createKey("admin", plexus.Key{
+			Name:      "fleet",
+			DispExp:   expires,
+			Networks:  []string{"valid", "valid"},
+			Relay:     "branch",
+			Router:    "192.168.50.0/24",
+			RouterNat: true,
+		})
+		should.NotBeError(t, err)
+		should.BeEqual(t, key.Networks, []string{"valid"})
+		pub, err := generateKeys()
+		should.NotBeError(t, err)
+		id := pub.String()
+		sub, err := natsConn.Subscribe(plexus.Update+id+plexus.SendListenPorts, func(msg *nats.Msg) {
+			publish.Message(natsConn, msg.Reply, plexus.ListenPortResponse{ListenPort: 51820, PublicListenPort: 51821})
+		})
+		should.NotBeError(t, err)
+		defer func() {
+			_ = sub.Unsubscribe()
+		}()
+		response := registerHandler("fleet", &plexus.ServerRegisterRequest{
+			Peer: plexus.Peer{WGPublicKey: id, Name: "fleet"},
+		})
+		should.BeEqual(t, response.Message, "registration successful")
+		var joined plexus.NetworkPeer
+		for range 50 {
+			network, err := boltdb.Get[plexus.Network]("valid", networkTable)
+			should.NotBeError(t, err)
+			for _, peer := range network.Peers {
+				if peer.WGPublicKey == id {
+					joined = peer
+				}
+			}
+			if joined.IsRelay && joined.IsSubnetRouter {
+				break
+			}
+			time.Sleep(time.Millisecond * 20)
+		}
+		should.BeEqual(t, joined.ListenPort, 51820)
+		should.BeEqual(t, joined.PublicListenPort, 51821)
+		should.BeTrue(t, joined.IsRelay)
+		should.BeEqual(t, joined.RelayedPeers, []string{member})
+		should.BeTrue(t, joined.IsSubnetRouter)
+		should.BeTrue(t, joined.UsesNat())
+		should.BeEqual(t, joined.Subnets[0].Subnet.String(), "192.168.50.0/24")
+	})
+	t.Run("otherKey", func(t *testing.T) {
+		_, err := createKey("admin", plexus.Key{Name: "plain", DispExp: expires})
+		should.NotBeError(t, err)
+		pub, err := generateKeys()
+		should.NotBeError(t, err)
+		// the networks of the key named in the request are not joined.
+		response := registerHandler("plain", &plexus.ServerRegisterRequest{
+			Peer:    plexus.Peer{WGPublicKey: pub.String(), Name: "intruder"},
+			KeyName: "fleet",
+		})
+		should.BeEqual(t, response.Message, "registration successful")
+		time.Sleep(time.Millisecond * 100)
+		network, err := boltdb.Get[plexus.Network]("valid", networkTable)
+		should.NotBeError(t, err)
+		should.BeFalse(t, slices.ContainsFunc(network.Peers, func(peer plexus.NetworkPeer) bool {
+			return peer.WGPublicKey == pub.String()
+		}))
+	})
+}
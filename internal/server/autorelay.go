@@ -0,0 +1,215 @@
+package server
+
+import (
+	"log/slog"
+	"slices"
+	"time"
+
+	"github.com/devilcove/boltdb"
+	"github.com/devilcove/plexus"
+	"github.com/devilcove/plexus/internal/publish"
+)
+
+// autoRelayThreshold is the connectivity (fraction of peers with recent
+// handshakes) under which a peer is considered unable to reach the other peers.
+const autoRelayThreshold = 0.5
+
+// A relayed peer only has handshakes with its relay, so whether it reaches the
+// other peers directly again is only known by undoing the relay: the server
+// retries direct connections once a peer has been relayed for autoRelayRetry
+// with a connectivity of at least autoRelayRecovery, and does not relay it
+// again for autoRelayHold so that the handshakes with the other peers can
+// complete.
+const (
+	autoRelayRecovery = 0.8
+	autoRelayRetry    = time.Minute * 15
+	autoRelayHold     = time.Minute * 2
+)
+
+// natReachable reports whether other peers can reach device directly.
+func natReachable(device plexus.Peer) bool {
+	return device.NatType == plexus.NatNone || device.NatType == plexus.NatEndpointIndependent
+}
+
+// needsAutoRelay reports whether peer, connected to the server, fails its
+// handshakes with most of the other peers of network and is not known to be
+// reachable.
+func needsAutoRelay(network plexus.Network, peer plexus.NetworkPeer, device plexus.Peer) bool {
+	if peer.IsRelay || peer.IsRelayed || peer.ServerRelayed || peer.IsSubnetRouter || peer.IsExitNode {
+		return false
+	}
+	return len(network.Peers) > 1 && peer.NatsConnected && peer.Connectivity < autoRelayThreshold &&
+		!natReachable(device) && time.Since(peer.AutoRelayChanged) >= autoRelayHold
+}
+
+// autoRelayRecovered reports whether direct connections should be retried for
+// peer, relayed by the server.
+func autoRelayRecovered(peer plexus.NetworkPeer) bool {
+	return peer.Connectivity >= autoRelayRecovery && time.Since(peer.AutoRelayChanged) >= autoRelayRetry
+}
+
+// relayCapable reports whether peer can relay other peers: it is reachable
+// and has handshakes with most of the peers of its network.
+func relayCapable(peer plexus.NetworkPeer, device plexus.Peer) bool {
+	return !peer.IsRelayed && !peer.ServerRelayed && peer.NatsConnected &&
+		peer.Connectivity >= autoRelayThreshold && natReachable(device)
+}
+
+// autoRelays relays the peers of network that cannot reach most of the other
+// peers through the best relay capable peer or, when there is none, serverRelay
+// is set and the peer is behind a symmetric nat, through the packet relay of
+// the server. It undoes the relays it made once the relayed peer is reachable
+// again, has recovered or its relay is no longer relay capable, and moves
+// peers from the packet relay to a peer when one becomes relay capable. devices
+// are the registered peers indexed by key. It returns the network updates to publish.
+func autoRelays(network *plexus.Network, devices map[string]plexus.Peer, serverRelay bool) []plexus.NetworkUpdate {
+	updates := []plexus.NetworkUpdate{}
+	for i, peer := range network.Peers {
+		switch {
+		case peer.AutoRelayed:
+			relay := relayIndex(*network, peer.WGPublicKey)
+			if relay >= 0 && autoRelayRecovered(peer) {
+				updates = append(updates, unrelayPeer(network, i, relay)...)
+				network.Peers[i].AutoRelayChanged = time.Now()
+				continue
+			}
+			if relay >= 0 && !natReachable(devices[peer.WGPublicKey]) &&
+				relayCapable(network.Peers[relay], devices[network.Peers[relay].WGPublicKey]) {
+				continue
+			}
+			updates = append(updates, unrelayPeer(network, i, relay)...)
+		case peer.ServerRelayed:
+			if !serverRelay || natReachable(devices[peer.WGPublicKey]) {
+				updates = append(updates, serverUnrelayPeer(network, i))
+				continue
+			}
+			if relay := bestRelay(*network, devices, i); relay >= 0 {
+				updates = append(updates, serverUnrelayPeer(network, i), relayPeer(network, i, relay))
+			}
+		}
+	}
+	for i, peer := range network.Peers {
+		if !needsAutoRelay(*network, peer, devices[peer.WGPublicKey]) {
+			continue
+		}
+		relay := bestRelay(*network, devices, i)
+		switch {
+		case relay >= 0:
+			updates = append(updates, relayPeer(network, i, relay))
+		case serverRelay && devices[peer.WGPublicKey].NeedsRelay():
+			updates = append(updates, serverRelayPeer(network, i))
+		default:
+			slog.Debug("no relay available", "network", network.Name, "peer", peer.HostName)
+		}
+	}
+	return updates
+}
+
+// relayIndex returns the index of the relay of the peer with key id, or -1.
+func relayIndex(network plexus.Network, id string) int {
+	return slices.IndexFunc(network.Peers, func(peer plexus.NetworkPeer) bool {
+		return peer.IsRelay && slices.Contains(peer.RelayedPeers, id)
+	})
+}
+
+// bestRelay returns the index of the relay capable peer of network that best
+// relays the peer at index peer, preferring peers with a public address, or -1.
+// The peers of a network of two reach each other directly or not at all.
+func bestRelay(network plexus.Network, devices map[string]plexus.Peer, peer int) int {
+	best := -1
+	if len(network.Peers) < 3 {
+		return best
+	}
+	better := func(candidate plexus.NetworkPeer) bool {
+		current := network.Peers[best]
+		candidatePublic := devices[candidate.WGPublicKey].NatType == plexus.NatNone
+		currentPublic := devices[current.WGPublicKey].NatType == plexus.NatNone
+		if candidatePublic != currentPublic {
+			return candidatePublic
+		}
+		return candidate.Connectivity > current.Connectivity
+	}
+	for i, candidate := range network.Peers {
+		if i == peer || !relayCapable(candidate, devices[candidate.WGPublicKey]) {
+			continue
+		}
+		if best < 0 || better(candidate) {
+			best = i
+		}
+	}
+	return best
+}
+
+// relayPeer relays the peer at index peer through the peer at index relay.
+func relayPeer(network *plexus.Network, peer, relay int) plexus.NetworkUpdate {
+	slog.Info("auto relay", "network", network.Name, "peer", network.Peers[peer].HostName,
+		"relay", network.Peers[relay].HostName)
+	network.Peers[peer].IsRelayed = true
+	network.Peers[peer].AutoRelayed = true
+	network.Peers[peer].AutoRelayChanged = time.Now()
+	network.Peers[relay].IsRelay = true
+	network.Peers[relay].RelayedPeers = slices.Sorted(slices.Values(
+		append(slices.Clone(network.Peers[relay].RelayedPeers), network.Peers[peer].WGPublicKey)))
+	return plexus.NetworkUpdate{Action: plexus.AddRelay, Peer: network.Peers[relay]}
+}
+
+// unrelayPeer undoes the relay of the peer at index peer through the peer at
+// index relay (-1 when the relay is gone). Agents drop the whole relay on a
+// delete relay update, so a relay keeping other relayed peers is added back.
+func unrelayPeer(network *plexus.Network, peer, relay int) []plexus.NetworkUpdate {
+	slog.Info("auto relay removed", "network", network.Name, "peer", network.Peers[peer].HostName)
+	network.Peers[peer].IsRelayed = false
+	network.Peers[peer].AutoRelayed = false
+	network.Peers[peer].AutoRelayChanged = time.Time{}
+	if relay < 0 {
+		return []plexus.NetworkUpdate{{Action: plexus.UpdatePeer, Peer: network.Peers[peer]}}
+	}
+	updates := []plexus.NetworkUpdate{{Action: plexus.DeleteRelay, Peer: network.Peers[relay]}}
+	id := network.Peers[peer].WGPublicKey
+	remaining := slices.DeleteFunc(slices.Clone(network.Peers[relay].RelayedPeers), func(relayed string) bool {
+		return relayed == id
+	})
+	if len(remaining) == 0 {
+		network.Peers[relay].IsRelay = false
+		network.Peers[relay].RelayedPeers = []string{}
+		return updates
+	}
+	network.Peers[relay].RelayedPeers = remaining
+	return append(updates, plexus.NetworkUpdate{Action: plexus.AddRelay, Peer: network.Peers[relay]})
+}
+
+// serverRelayPeer has the peer at index peer exchange its packets through the
+// packet relay of the server.
+func serverRelayPeer(network *plexus.Network, peer int) plexus.NetworkUpdate {
+	slog.Info("server relay", "network", network.Name, "peer", network.Peers[peer].HostName)
+	network.Peers[peer].ServerRelayed = true
+	return plexus.NetworkUpdate{Action: plexus.UpdatePeer, Peer: network.Peers[peer]}
+}
+
+// serverUnrelayPeer undoes serverRelayPeer.
+func serverUnrelayPeer(network *plexus.Network, peer int) plexus.NetworkUpdate {
+	slog.Info("server relay removed", "network", network.Name, "peer", network.Peers[peer].HostName)
+	network.Peers[peer].ServerRelayed = false
+	return plexus.NetworkUpdate{Action: plexus.UpdatePeer, Peer: network.Peers[peer]}
+}
+
+// registeredPeers returns the registered peers indexed by key.
+func registeredPeers() map[string]plexus.Peer {
+	devices := map[string]plexus.Peer{}
+	peers, err := boltdb.GetAll[plexus.Peer](peerTable)
+	if err != nil {
+		slog.Error("get peers", "error", err)
+		return devices
+	}
+	for _, peer := range peers {
+		devices[peer.WGPublicKey] = peer
+	}
+	return devices
+}
+
+// publishUpdates publishes network updates in order.
+func publishUpdates(network string, updates []plexus.NetworkUpdate) {
+	for _, update := range updates {
+		publish.Message(natsConn, plexus.Networks+network, update)
+	}
+}
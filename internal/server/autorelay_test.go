@@ -0,0 +1,165 @@
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/Kairum-Labs/should"
+	"github.com/devilcove/boltdb"
+	"github.com/devilcove/plexus"
+)
+
+func TestAutoRelays(t *testing.T) {
+	devices := map[string]plexus.Peer{
+		"a": {NatType: plexus.NatEndpointIndependent},
+		"b": {NatType: plexus.NatNone},
+		"c": {NatType: plexus.NatSymmetric},
+		"d": {NatType: plexus.NatEndpointIndependent},
+	}
+	network := plexus.Network{Name: "auto", Peers: []plexus.NetworkPeer{
+		{WGPublicKey: "a", NatsConnected: true, Connectivity: 1},
+		{WGPublicKey: "b", NatsConnected: true, Connectivity: 0.6},
+		{WGPublicKey: "c", NatsConnected: true, Connectivity: 0.3},
+		{WGPublicKey: "d", NatsConnected: true, Connectivity: 0.3},
+	}}
+	t.Run("relay", func(t *testing.T) {
+		updates := autoRelays(&network, devices, false)
+		should.BeEqual(t, len(updates), 1)
+		should.BeEqual(t, updates[0].Action, plexus.AddRelay)
+		// a peer with a public address is preferred as relay.
+		should.BeEqual(t, updates[0].Peer.WGPublicKey, "b")
+		should.BeEqual(t, updates[0].Peer.RelayedPeers, []string{"c"})
+		should.BeTrue(t, network.Peers[2].IsRelayed)
+		should.BeTrue(t, network.Peers[2].AutoRelayed)
+		// d is reachable, its failures are not its own.
+		should.BeFalse(t, network.Peers[3].IsRelayed)
+	})
+	t.Run("stable", func(t *testing.T) {
+		should.BeEqual(t, len(autoRelays(&network, devices, false)), 0)
+	})
+	t.Run("relayUnhealthy", func(t *testing.T) {
+		network.Peers[1].NatsConnected = false
+		updates := autoRelays(&network, devices, false)
+		should.BeEqual(t, len(updates), 2)
+		should.BeEqual(t, updates[0].Action, plexus.DeleteRelay)
+		should.BeEqual(t, updates[0].Peer.WGPublicKey, "b")
+		should.BeFalse(t, network.Peers[1].IsRelay)
+		should.BeEqual(t, updates[1].Action, plexus.AddRelay)
+		should.BeEqual(t, updates[1].Peer.WGPublicKey, "a")
+		should.BeTrue(t, network.Peers[2].AutoRelayed)
+	})
+	t.Run("reachable", func(t *testing.T) {
+		network.Peers[0].RelayedPeers = []string{"c", "manual"}
+		devices["c"] = plexus.Peer{NatType: plexus.NatEndpointIndependent}
+		updates := autoRelays(&network, devices, false)
+		should.BeEqual(t, len(updates), 2)
+		should.BeEqual(t, updates[0].Action, plexus.DeleteRelay)
+		// the relay keeps the peers it relays for other reasons.
+		should.BeEqual(t, updates[1].Action, plexus.AddRelay)
+		should.BeEqual(t, updates[1].Peer.RelayedPeers, []string{"manual"})
+		should.BeFalse(t, network.Peers[2].IsRelayed)
+		should.BeFalse(t, network.Peers[2].AutoRelayed)
+	})
+	t.Run("noRelay", func(t *testing.T) {
+		devices["c"] = plexus.Peer{NatType: plexus.NatSymmetric}
+		small := plexus.Network{Name: "small", Peers: []plexus.NetworkPeer{
+			{WGPublicKey: "a", NatsConnected: true, Connectivity: 1},
+			{WGPublicKey: "c", NatsConnected: true},
+		}}
+		should.BeEqual(t, len(autoRelays(&small, devices, false)), 0)
+	})
+	t.Run("serverRelay", func(t *testing.T) {
+		small := plexus.Network{Name: "small", Peers: []plexus.NetworkPeer{
+			{WGPublicKey: "a", NatsConnected: true, Connectivity: 1},
+			{WGPublicKey: "c", NatsConnected: true},
+		}}
+		updates := autoRelays(&small, devices, true)
+		should.BeEqual(t, len(updates), 1)
+		should.BeEqual(t, updates[0].Action, plexus.UpdatePeer)
+		should.BeTrue(t, updates[0].Peer.ServerRelayed)
+		should.BeEqual(t, len(autoRelays(&small, devices, true)), 0)
+		// the packet relay was disabled.
+		updates = autoRelays(&small, devices, false)
+		should.BeEqual(t, len(updates), 1)
+		should.BeFalse(t, small.Peers[1].ServerRelayed)
+	})
+	t.Run("serverRelayToPeer", func(t *testing.T) {
+		network.Peers[2].ServerRelayed = true
+		updates := autoRelays(&network, devices, true)
+		should.BeEqual(t, len(updates), 2)
+		should.BeEqual(t, updates[0].Action, plexus.UpdatePeer)
+		should.BeFalse(t, updates[0].Peer.ServerRelayed)
+		should.BeEqual(t, updates[1].Action, plexus.AddRelay)
+		should.BeTrue(t, network.Peers[2].AutoRelayed)
+	})
+	t.Run("recovered", func(t *testing.T) {
+		network.Peers[2].Connectivity = 1
+		should.BeEqual(t, len(autoRelays(&network, devices, false)), 0)
+		network.Peers[2].AutoRelayChanged = time.Now().Add(-autoRelayRetry)
+		updates := autoRelays(&network, devices, false)
+		should.BeEqual(t, len(updates), 2)
+		should.BeEqual(t, updates[0].Action, plexus.DeleteRelay)
+		should.BeEqual(t, updates[1].Peer.RelayedPeers, []string{"manual"})
+		should.BeFalse(t, network.Peers[2].IsRelayed)
+		should.BeFalse(t, network.Peers[2].AutoRelayed)
+		// direct handshakes get time to complete.
+		network.Peers[2].Connectivity = 0.3
+		should.BeEqual(t, len(autoRelays(&network, devices, false)), 0)
+		network.Peers[2].AutoRelayChanged = time.Now().Add(-autoRelayHold)
+		updates = autoRelays(&network, devices, false)
+		should.BeEqual(t, len(updates), 1)
+		should.BeEqual(t, updates[0].Action, plexus.AddRelay)
+		should.BeTrue(t, network.Peers[2].AutoRelayed)
+	})
+}
+
+func TestAutoRelayCheckin(t *testing.T) {
+	setup(t)
+	defer shutdown(t)
+	deleteAllPeers(t)
+	deleteAllNetworks(t)
+	defer deleteAllPeers(t)
+	defer deleteAllNetworks(t)
+	createTestNetwork(t)
+	relay := createTestNetworkPeer(t)
+	other := createTestNetworkPeer(t)
+	lonely := createTestNetworkPeer(t)
+	setNatType := func(t *testing.T, id, natType string) {
+		t.Helper()
+		peer, err := boltdb.Get[plexus.Peer](id, peerTable)
+		should.NotBeError(t, err)
+		peer.NatType = natType
+		should.NotBeError(t, boltdb.Save(peer, id, peerTable))
+	}
+	checkin := func(id string, connectivity float64) {
+		processConnectionData(&plexus.CheckinData{
+			ID:          id,
+			Connections: []plexus.ConnectivityData{{Network: "valid", Connectivity: connectivity}},
+		})
+	}
+	setNatType(t, relay, plexus.NatNone)
+	setNatType(t, other, plexus.NatEndpointIndependent)
+	setNatType(t, lonely, plexus.NatSymmetric)
+	checkin(relay, 1)
+	checkin(other, 1)
+
+	t.Run("relayed", func(t *testing.T) {
+		checkin(lonely, 0)
+		network, err := boltdb.Get[plexus.Network]("valid", networkTable)
+		should.NotBeError(t, err)
+		should.BeTrue(t, routerPeer(network, lonely).AutoRelayed)
+		should.BeEqual(t, routerPeer(network, relay).RelayedPeers, []string{lonely})
+		// relays made by the server are not exported.
+		topology, err := exportTopology()
+		should.NotBeError(t, err)
+		should.BeEqual(t, len(topology.Networks[0].Relays), 0)
+	})
+	t.Run("unrelayed", func(t *testing.T) {
+		setNatType(t, lonely, plexus.NatEndpointIndependent)
+		checkin(lonely, 1)
+		network, err := boltdb.Get[plexus.Network]("valid", networkTable)
+		should.NotBeError(t, err)
+		should.BeFalse(t, routerPeer(network, lonely).IsRelayed)
+		should.BeFalse(t, routerPeer(network, relay).IsRelay)
+	})
+}
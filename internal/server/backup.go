@@ -0,0 +1,295 @@
+package server
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/devilcove/boltdb"
+	"github.com/nats-io/nkeys"
+	"go.etcd.io/bbolt"
+)
+
+// names of the files in a backup archive.
+const (
+	backupDB   = "plexus-server.db"
+	backupSeed = "server.seed"
+)
+
+// backupLimits are the largest sizes of the files of a backup archive that
+// are extracted.
+var backupLimits = map[string]int64{
+	backupDB:   1 << 30,
+	backupSeed: 1 << 10,
+}
+
+// writeBackup writes a gzipped tar archive holding a consistent snapshot of
+// the database, taken in a read transaction, and the server seed.
+func writeBackup(w io.Writer, seed []byte) error {
+	gz := gzip.NewWriter(w)
+	archive := tar.NewWriter(gz)
+	now := time.Now()
+	if err := boltdb.Connection().View(func(tx *bbolt.Tx) error {
+		if err := archive.WriteHeader(&tar.Header{
+			Name: backupDB, Mode: 0o600, Size: tx.Size(), ModTime: now,
+		}); err != nil {
+			return err
+		}
+		_, err := tx.WriteTo(archive)
+		return err
+	}); err != nil {
+		return fmt.Errorf("write database %w", err)
+	}
+	if err := archive.WriteHeader(&tar.Header{
+		Name: backupSeed, Mode: 0o600, Size: int64(len(seed)), ModTime: now,
+	}); err != nil {
+		return err
+	}
+	if _, err := archive.Write(seed); err != nil {
+		return fmt.Errorf("write seed %w", err)
+	}
+	if err := archive.Close(); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+// extractBackup extracts a backup archive into dir and validates its
+// contents.
+func extractBackup(r io.Reader, dir string) error {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return fmt.Errorf("invalid archive %w", err)
+	}
+	archive := tar.NewReader(gz)
+	found := map[string]bool{}
+	for {
+		header, err := archive.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("invalid archive %w", err)
+		}
+		limit, ok := backupLimits[header.Name]
+		if !ok {
+			return fmt.Errorf("invalid archive: unexpected file %s", header.Name)
+		}
+		if found[header.Name] {
+			return fmt.Errorf("invalid archive: duplicate file %s", header.Name)
+		}
+		if header.Size < 0 || header.Size > limit {
+			return fmt.Errorf("invalid archive: %s is too large", header.Name)
+		}
+		file, err := os.OpenFile(filepath.Join(dir, header.Name), os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o600)
+		if err != nil {
+			return err
+		}
+		if _, err := io.CopyN(file, archive, header.Size); err != nil {
+			file.Close()
+			return fmt.Errorf("extract %s %w", header.Name, err)
+		}
+		if err := file.Close(); err != nil {
+			return err
+		}
+		found[header.Name] = true
+	}
+	for _, name := range []string{backupDB, backupSeed} {
+		if !found[name] {
+			return fmt.Errorf("invalid archive: missing %s", name)
+		}
+	}
+	seed, err := os.ReadFile(filepath.Join(dir, backupSeed))
+	if err != nil {
+		return err
+	}
+	if _, err := nkeys.FromSeed(seed); err != nil {
+		return fmt.Errorf("invalid seed %w", err)
+	}
+	return validateDatabase(filepath.Join(dir, backupDB))
+}
+
+// validateDatabase checks the consistency of a database file and that it
+// holds the server tables.
+func validateDatabase(file string) error {
+	db, err := bbolt.Open(file, 0o600, &bbolt.Options{ReadOnly: true, Timeout: time.Second})
+	if err != nil {
+		return fmt.Errorf("invalid database %w", err)
+	}
+	defer db.Close()
+	return db.View(func(tx *bbolt.Tx) error {
+		for _, table := range []string{userTable, keyTable, networkTable, peerTable, settingTable} {
+			if tx.Bucket([]byte(table)) == nil {
+				return fmt.Errorf("invalid database: missing table %s", table)
+			}
+		}
+		var errs error
+		for err := range tx.Check() {
+			errs = errors.Join(errs, err)
+		}
+		if errs != nil {
+			return fmt.Errorf("invalid database %w", errs)
+		}
+		return nil
+	})
+}
+
+// Restore replaces the database and server seed with those of a backup
+// archive. The archive is validated before anything is replaced and the
+// server must not be running; the previous files are kept with a .bak suffix.
+func Restore(file string) error {
+	config, err := getConfiguration()
+	if err != nil {
+		return err
+	}
+	dbFile := filepath.Join(config.DataHome, config.DBFile)
+	seedFile := filepath.Join(config.DataHome, backupSeed)
+	if _, err := os.Stat(dbFile); err == nil {
+		db, err := bbolt.Open(dbFile, 0o600, &bbolt.Options{Timeout: time.Second})
+		if errors.Is(err, bbolt.ErrTimeout) {
+			return ErrServerRunning
+		}
+		if err == nil {
+			db.Close()
+		}
+	}
+	archive, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer archive.Close()
+	if err := os.MkdirAll(config.DataHome, os.ModePerm); err != nil {
+		return err
+	}
+	dir, err := os.MkdirTemp(config.DataHome, "restore")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	if err := extractBackup(archive, dir); err != nil {
+		return err
+	}
+	for _, existing := range []string{dbFile, seedFile} {
+		if err := os.Rename(existing, existing+".bak"); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	if err := os.Rename(filepath.Join(dir, backupDB), dbFile); err != nil {
+		return err
+	}
+	if err := os.Rename(filepath.Join(dir, backupSeed), seedFile); err != nil {
+		return err
+	}
+	slog.Info("restored backup", "archive", file, "database", dbFile)
+	return nil
+}
+
+// Backup downloads a backup archive from the running server to file,
+// authenticating with the api token in PLEXUS_TOKEN. The archive is validated
+// before it is saved.
+func Backup(file string) error {
+	response, err := serverRequest(http.MethodGet, "/api/v1/backup", "", nil)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(response.Body)
+		return fmt.Errorf("backup failed: %s %s", response.Status, body)
+	}
+	temp, err := os.CreateTemp(filepath.Dir(file), "backup")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(temp.Name())
+	if _, err := io.Copy(temp, response.Body); err != nil {
+		temp.Close()
+		return err
+	}
+	if err := temp.Close(); err != nil {
+		return err
+	}
+	if err := checkBackup(temp.Name()); err != nil {
+		return err
+	}
+	return os.Rename(temp.Name(), file)
+}
+
+// serverRequest sends an api request to the server on this host,
+// authenticating with the api token in PLEXUS_TOKEN.
+func serverRequest(method, path, contentType string, body io.Reader) (*http.Response, error) {
+	config, err := getConfiguration()
+	if err != nil {
+		return nil, err
+	}
+	token := os.Getenv("PLEXUS_TOKEN")
+	if token == "" {
+		return nil, ErrNoToken
+	}
+	url := "http://localhost:" + config.Port
+	if config.Secure {
+		url = "https://" + config.FQDN
+	}
+	request, err := http.NewRequest(method, url+path, body)
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Authorization", "Bearer "+token)
+	if contentType != "" {
+		request.Header.Set("Content-Type", contentType)
+	}
+	return http.DefaultClient.Do(request)
+}
+
+// checkBackup validates a backup archive without restoring it.
+func checkBackup(file string) error {
+	archive, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer archive.Close()
+	dir, err := os.MkdirTemp("", "plexus-backup")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	return extractBackup(archive, dir)
+}
+
+func apiBackup(w http.ResponseWriter, r *http.Request) {
+	if !GetSessionData(r).IsAdmin {
+		apiError(w, http.StatusForbidden, "admin rights required")
+		return
+	}
+	// the archive holds the server seed and every credential of the database.
+	if scope, ok := tokenScope(r); ok && scope != scopeWrite {
+		apiError(w, http.StatusForbidden, ErrTokenScope.Error())
+		return
+	}
+	config, err := getConfiguration()
+	if err != nil {
+		apiError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	seed, err := os.ReadFile(filepath.Join(config.DataHome, backupSeed))
+	if err != nil {
+		apiError(w, http.StatusInternalServerError, "read seed "+err.Error())
+		return
+	}
+	name := "plexus-backup-" + time.Now().Format("20060102-150405") + ".tar.gz"
+	w.Header().Set("Content-Type", "application/gzip")
+	w.Header().Set("Content-Disposition", `attachment; filename="`+name+`"`)
+	if err := writeBackup(w, seed); err != nil {
+		// the archive may be partially sent; the client validates it.
+		slog.Error("backup", "error", err)
+		return
+	}
+	audit(userActor(r), "server.backup", name, nil, nil)
+}
@@ -0,0 +1,120 @@
+package server
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Kairum-Labs/should"
+	"github.com/devilcove/plexus"
+	"go.etcd.io/bbolt"
+)
+
+func TestBackup(t *testing.T) {
+	setup(t)
+	defer shutdown(t)
+	deleteAllUsers(t)
+	admin := plexus.User{Username: "admin", Password: "pass", IsAdmin: true}
+	createTestUser(t, admin)
+	dataHome := filepath.Join(dir, ".local/share", progName)
+	archive := filepath.Join(t.TempDir(), "backup.tar.gz")
+
+	t.Run("forbidden", func(t *testing.T) {
+		user := plexus.User{Username: "user", Password: "pass"}
+		createTestUser(t, user)
+		w := apiRequest(t, testLogin(t, user), http.MethodGet, "/api/v1/backup", "")
+		should.BeEqual(t, w.Code, http.StatusForbidden)
+	})
+	t.Run("readScope", func(t *testing.T) {
+		deleteAllTokens(t)
+		defer deleteAllTokens(t)
+		_, read, err := createToken("admin", plexus.Token{Name: "read", Owner: "admin", Scope: scopeRead})
+		should.NotBeError(t, err)
+		w := tokenRequestRecorder(t, read, http.MethodGet, "/api/v1/backup")
+		should.BeEqual(t, w.Code, http.StatusForbidden)
+		_, write, err := createToken("admin", plexus.Token{Name: "write", Owner: "admin", Scope: scopeWrite})
+		should.NotBeError(t, err)
+		w = tokenRequestRecorder(t, write, http.MethodGet, "/api/v1/backup")
+		should.BeEqual(t, w.Code, http.StatusOK)
+	})
+	t.Run("backup", func(t *testing.T) {
+		w := apiRequest(t, testLogin(t, admin), http.MethodGet, "/api/v1/backup", "")
+		should.BeEqual(t, w.Code, http.StatusOK)
+		should.BeEqual(t, w.Header().Get("Content-Type"), "application/gzip")
+		should.NotBeError(t, os.WriteFile(archive, w.Body.Bytes(), 0o600))
+		should.NotBeError(t, checkBackup(archive))
+	})
+	t.Run("invalid", func(t *testing.T) {
+		garbage := filepath.Join(t.TempDir(), "garbage.tar.gz")
+		should.NotBeError(t, os.WriteFile(garbage, []byte("not an archive"), 0o600))
+		err := Restore(garbage)
+		should.BeError(t, err)
+		should.ContainSubstring(t, err.Error(), "invalid archive")
+		// an archive without the seed.
+		buf := bytes.Buffer{}
+		gz := gzip.NewWriter(&buf)
+		tw := tar.NewWriter(gz)
+		should.NotBeError(t, tw.WriteHeader(&tar.Header{Name: backupDB, Mode: 0o600, Size: 4}))
+		_, err = tw.Write([]byte("test"))
+		should.NotBeError(t, err)
+		should.NotBeError(t, tw.Close())
+		should.NotBeError(t, gz.Close())
+		should.NotBeError(t, os.WriteFile(garbage, buf.Bytes(), 0o600))
+		err = Restore(garbage)
+		should.BeError(t, err)
+		should.ContainSubstring(t, err.Error(), "missing server.seed")
+		_, err = os.Stat(filepath.Join(dataHome, backupDB))
+		should.BeError(t, err)
+		// archives with a file given twice or larger than allowed.
+		for message, headers := range map[string][]*tar.Header{
+			"duplicate file": {{Name: backupSeed, Mode: 0o600, Size: 4}, {Name: backupSeed, Mode: 0o600, Size: 4}},
+			"too large":      {{Name: backupSeed, Mode: 0o600, Size: backupLimits[backupSeed] + 1}},
+		} {
+			buf := bytes.Buffer{}
+			gz := gzip.NewWriter(&buf)
+			tw := tar.NewWriter(gz)
+			for _, header := range headers {
+				should.NotBeError(t, tw.WriteHeader(header))
+				_, err = tw.Write(bytes.Repeat([]byte("a"), int(header.Size)))
+				should.NotBeError(t, err)
+			}
+			should.NotBeError(t, tw.Close())
+			should.NotBeError(t, gz.Close())
+			should.NotBeError(t, os.WriteFile(garbage, buf.Bytes(), 0o600))
+			err = Restore(garbage)
+			should.BeError(t, err)
+			should.ContainSubstring(t, err.Error(), message)
+		}
+	})
+	t.Run("restore", func(t *testing.T) {
+		seed, err := os.ReadFile(filepath.Join(dataHome, backupSeed))
+		should.NotBeError(t, err)
+		should.NotBeError(t, Restore(archive))
+		restored, err := os.ReadFile(filepath.Join(dataHome, backupSeed))
+		should.NotBeError(t, err)
+		should.BeEqual(t, restored, seed)
+		_, err = os.Stat(filepath.Join(dataHome, backupSeed+".bak"))
+		should.NotBeError(t, err)
+		db, err := bbolt.Open(filepath.Join(dataHome, backupDB), 0o600, &bbolt.Options{ReadOnly: true})
+		should.NotBeError(t, err)
+		err = db.View(func(tx *bbolt.Tx) error {
+			should.NotBeNil(t, tx.Bucket([]byte(userTable)).Get([]byte("admin")))
+			return nil
+		})
+		should.NotBeError(t, err)
+		should.NotBeError(t, db.Close())
+	})
+	t.Run("running", func(t *testing.T) {
+		db, err := bbolt.Open(filepath.Join(dataHome, backupDB), 0o600, &bbolt.Options{Timeout: time.Second})
+		should.NotBeError(t, err)
+		defer db.Close()
+		err = Restore(archive)
+		should.BeError(t, err)
+		should.BeEqual(t, err, ErrServerRunning)
+	})
+}
@@ -7,6 +7,7 @@ import (
 	"log/slog"
 	"net"
 	"os"
+	"strings"
 	"sync"
 	"time"
 
@@ -59,6 +60,11 @@ func broker(ctx context.Context, wg *sync.WaitGroup, tls *tls.Config) {
 		natsOptions.TLSConfig = tls
 		natsOptions.Host = config.FQDN
 	}
+	if err := clusterOptions(*config, natsOptions, tls); err != nil {
+		slog.Error("cluster", "error", err)
+		brokerfail <- 1
+		return
+	}
 	natServer, err = server.NewServer(natsOptions)
 	if err != nil {
 		slog.Error("nats server", "error", err)
@@ -78,6 +84,9 @@ func broker(ctx context.Context, wg *sync.WaitGroup, tls *tls.Config) {
 		slog.Error("nats connect", "error", err)
 		brokerfail <- 1
 	}
+	if clustered(*config) && !replicate(ctx, *config) {
+		return
+	}
 	startBroker(ctx)
 }
 
@@ -86,20 +95,31 @@ func startBroker(ctx context.Context) {
 	slog.Info("broker started")
 	pingTicker := time.NewTicker(pingTick)
 	keyTicker := time.NewTicker(keyTick)
+	pskTicker := time.NewTicker(pskTick)
 	for {
 		select {
 		case <-ctx.Done():
 			slog.Info("shutting down broker")
 			pingTicker.Stop()
 			keyTicker.Stop()
+			pskTicker.Stop()
 			for _, sub := range subscrptions {
 				_ = sub.Drain()
 			}
 			return
 		case <-pingTicker.C:
-			pingPeers()
+			if clusterLeader() {
+				pingPeers()
+			}
 		case <-keyTicker.C:
-			expireKeys()
+			if clusterLeader() {
+				expireKeys()
+				expirePending()
+			}
+		case <-pskTicker.C:
+			if clusterLeader() {
+				rotatePresharedKeys()
+			}
 		}
 	}
 }
@@ -116,12 +136,12 @@ func getTokenUsers() []*server.NkeyUser {
 			slog.Error("decodetoken", "error", err)
 			continue
 		}
-		users = append(users, createNkeyUser(token.Seed))
+		users = append(users, createNkeyUser(token.Seed, key.Name))
 	}
 	return users
 }
 
-func createNkeyUser(token string) *server.NkeyUser {
+func createNkeyUser(token, keyName string) *server.NkeyUser {
 	kp, err := nkeys.FromSeed([]byte(token))
 	if err != nil {
 		slog.Error("unable to create keypair", "error", err)
@@ -133,7 +153,7 @@ func createNkeyUser(token string) *server.NkeyUser {
 	}
 	return &server.NkeyUser{
 		Nkey:        pk,
-		Permissions: registerPermissions(),
+		Permissions: registerPermissions(keyName),
 	}
 }
 
@@ -193,10 +213,12 @@ func devicePermissions(id string) *server.Permissions {
 	}
 }
 
-func registerPermissions() *server.Permissions {
+// registerPermissions returns the permissions of the nkey of a registration
+// key; devices can only register with the key they authenticated with.
+func registerPermissions(keyName string) *server.Permissions {
 	return &server.Permissions{
 		Publish: &server.SubjectPermission{
-			Allow: []string{"register"},
+			Allow: []string{plexus.RegisterKey + keyName, plexus.RegistrationStatus},
 		},
 		Subscribe: &server.SubjectPermission{
 			Allow: []string{"_INBOX.>"},
@@ -209,7 +231,7 @@ func serverSubcriptions() []*nats.Subscription {
 
 	// token subscriptions.
 	// register handler.
-	register, err := natsConn.Subscribe("register", subscribeRegister)
+	register, err := natsConn.QueueSubscribe(plexus.RegisterKey+"*", serverQueue, subscribeRegister)
 	// 	func(msg *nats.Msg) {
 	// 	request := &plexus.ServerRegisterRequest{}
 	// 	if err := json.Unmarshal(msg.Data, request); err != nil {
@@ -228,70 +250,101 @@ func serverSubcriptions() []*nats.Subscription {
 	}
 	subcriptions = append(subcriptions, register)
 
+	// approval decisions for pending registrations.
+	status, err := natsConn.QueueSubscribe(plexus.RegistrationStatus, serverQueue, subscribeRegistrationStatus)
+	if err != nil {
+		slog.Error("subscribe registration status", "error", err)
+	}
+	subcriptions = append(subcriptions, status)
+
 	// device subscriptions,
 	// checkin.
-	checkin, err := natsConn.Subscribe("*"+plexus.Checkin, subscribeCheckin)
+	checkin, err := natsConn.QueueSubscribe("*"+plexus.Checkin, serverQueue, subscribeCheckin)
 	if err != nil {
 		slog.Error("subcribe checkin", "error", err)
 	}
 	subcriptions = append(subcriptions, checkin)
 
 	// join.
-	join, err := natsConn.Subscribe("*"+plexus.JoinNetwork, subscribeJoinNetwork)
+	join, err := natsConn.QueueSubscribe("*"+plexus.JoinNetwork, serverQueue, subscribeJoinNetwork)
 	if err != nil {
 		slog.Error("subcribe join", "error", err)
 	}
 	subcriptions = append(subcriptions, join)
 
 	// version.
-	version, err := natsConn.Subscribe("*"+plexus.Version, subscribeVersion)
+	version, err := natsConn.QueueSubscribe("*"+plexus.Version, serverQueue, subscribeVersion)
 	if err != nil {
 		slog.Error("subcribe version", "error", err)
 	}
 	subcriptions = append(subcriptions, version)
 
 	// leave.
-	leave, err := natsConn.Subscribe("*"+plexus.LeaveNetwork, subscribeLeaveNetwork)
+	leave, err := natsConn.QueueSubscribe("*"+plexus.LeaveNetwork, serverQueue, subscribeLeaveNetwork)
 	if err != nil {
 		slog.Error("subcribe leave", "error", err)
 	}
 	subcriptions = append(subcriptions, leave)
 
 	// leaveServer.
-	leaveServer, err := natsConn.Subscribe("*"+plexus.LeaveServer, subscribeLeaveServer)
+	leaveServer, err := natsConn.QueueSubscribe("*"+plexus.LeaveServer, serverQueue, subscribeLeaveServer)
 	if err != nil {
 		slog.Error("subcribe leave server", "error", err)
 	}
 	subcriptions = append(subcriptions, leaveServer)
 
 	// reload.
-	reload, err := natsConn.Subscribe("*"+plexus.Reload, subscribeReload)
+	reload, err := natsConn.QueueSubscribe("*"+plexus.Reload, serverQueue, subscribeReload)
 	if err != nil {
 		slog.Error("subcribe reload", "error", err)
 	}
 	subcriptions = append(subcriptions, reload)
 
 	// listenPortUpdate  -- reply to a listenPortRequest.
-	portUpdate, err := natsConn.Subscribe("*"+plexus.UpdateListenPorts, subscribeUpdateListenPort)
+	portUpdate, err := natsConn.QueueSubscribe("*"+plexus.UpdateListenPorts, serverQueue, subscribeUpdateListenPort)
 	if err != nil {
 		slog.Error("subscribe network peer update", "error", err)
 	}
 	subcriptions = append(subcriptions, portUpdate)
 
 	// deviceUpdate.
-	deviceUpdate, err := natsConn.Subscribe("*"+plexus.UpdatePeer, subscribeUpdatePeer)
+	deviceUpdate, err := natsConn.QueueSubscribe("*"+plexus.UpdatePeer, serverQueue, subscribeUpdatePeer)
 	if err != nil {
 		slog.Error("subscribe device updates", "error", err)
 	}
 	subcriptions = append(subcriptions, deviceUpdate)
 
 	// network peer updates.
-	peerUpdate, err := natsConn.Subscribe("*"+plexus.UpdateNetworkPeer, subscribeUpdateNetworkPeer)
+	peerUpdate, err := natsConn.QueueSubscribe("*"+plexus.UpdateNetworkPeer, serverQueue, subscribeUpdateNetworkPeer)
 	if err != nil {
 		slog.Error("subscribe peer update", "error", err)
 	}
 	subcriptions = append(subcriptions, peerUpdate)
 
+	// key rotation.
+	rotate, err := natsConn.QueueSubscribe("*"+plexus.RotateKeys, serverQueue, subscribeRotateKeys)
+	if err != nil {
+		slog.Error("subscribe rotate keys", "error", err)
+	}
+	subcriptions = append(subcriptions, rotate)
+	confirm, err := natsConn.QueueSubscribe("*"+plexus.ConfirmRotation, serverQueue, subscribeConfirmRotation)
+	if err != nil {
+		slog.Error("subscribe confirm rotation", "error", err)
+	}
+	subcriptions = append(subcriptions, confirm)
+
+	// preshared keys.
+	psk, err := natsConn.QueueSubscribe("*"+plexus.PresharedKeys, serverQueue, subscribePresharedKeys)
+	if err != nil {
+		slog.Error("subscribe preshared keys", "error", err)
+	}
+	subcriptions = append(subcriptions, psk)
+	pskAck, err := natsConn.QueueSubscribe("*"+plexus.PresharedKeysAck, serverQueue, subscribePresharedKeysAck)
+	if err != nil {
+		slog.Error("subscribe preshared keys ack", "error", err)
+	}
+	subcriptions = append(subcriptions, pskAck)
+
 	return subcriptions
 }
 
@@ -301,10 +354,15 @@ func subscribeRegister(msg *nats.Msg) {
 		slog.Debug("invalid register Request", "error", err, "data", string(msg.Data))
 		publish.ErrorMessage(natsConn, msg.Reply, "invalid request", err)
 	}
-	response := registerHandler(request)
+	keyName := strings.TrimPrefix(msg.Subject, plexus.RegisterKey)
+	response := registerHandler(keyName, request)
 	slog.Debug("publish register reply", "response", response)
 	publish.Message(natsConn, msg.Reply, response)
-	if err := decrementKeyUsage(request.KeyName); err != nil {
+	// keys requiring approval are used when the registration is decided.
+	if response.Message == plexus.RegistrationPending || strings.HasPrefix(response.Message, "error") {
+		return
+	}
+	if err := decrementKeyUsage("peer:"+request.Name, keyName); err != nil {
 		slog.Error("decrement key usage", "error", err)
 	}
 }
@@ -322,7 +380,10 @@ func subscribeCheckin(msg *nats.Msg) {
 		publish.ErrorMessage(natsConn, msg.Reply, "invalid request", err)
 		return
 	}
-	publish.Message(natsConn, msg.Reply, processCheckin(request))
+	start := time.Now()
+	response := processCheckin(request)
+	observeCheckin(start, response)
+	publish.Message(natsConn, msg.Reply, response)
 }
 
 func subscribeJoinNetwork(msg *nats.Msg) {
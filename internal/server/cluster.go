@@ -0,0 +1,724 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/url"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/devilcove/boltdb"
+	"github.com/devilcove/plexus"
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+	"go.etcd.io/bbolt"
+)
+
+const (
+	defaultClusterName = "plexus"
+	defaultClusterPort = 6222
+	clusterUser        = "plexus"
+	clusterBucket      = "plexus"
+	// auditStream holds the audit events of the servers of the cluster; the
+	// sequence of an event in the stream is its id.
+	auditStream      = "plexus-audit"
+	auditSubject     = "plexus.audit"
+	clusterRetryTime = time.Second * 5
+	// modifyAttempts is how many times a change is applied to a record that
+	// other servers of the cluster keep changing.
+	modifyAttempts = 5
+	// serverQueue is the queue group of the subscriptions of the servers, so
+	// that a single server of a cluster handles each request.
+	serverQueue = "plexus-server"
+)
+
+var (
+	ErrClusterPassword = errors.New("cluster requires a password")
+	ErrConflict        = errors.New("record changed by another server")
+	// errUnchanged is returned by the change of modify to leave the record as
+	// it is.
+	errUnchanged = errors.New("unchanged")
+)
+
+// replicatedTables are the tables shared by the servers of a cluster. The
+// audit log is shared through the audit stream.
+var replicatedTables = []string{
+	userTable, keyTable, networkTable, peerTable, settingTable, tokenTable, groupTable, pskTable, pendingTable,
+	rotationTable,
+}
+
+// replica replicates the database to the other servers of the cluster; nil
+// when the server is not clustered.
+var replica atomic.Pointer[replicator]
+
+// ClusterConfig holds the settings to run several servers as a cluster.
+type ClusterConfig struct {
+	Name string
+	// Port is the port of the cluster routes; 0 is the default port. All
+	// servers of the cluster use the same port.
+	Port int
+	// Password authenticates the routes between the servers.
+	Password string
+	// Servers are the fqdns of the servers of the cluster; the server itself
+	// may be listed.
+	Servers []string
+}
+
+// replicator replicates the replicated tables of the database through a
+// JetStream key value bucket. Every server applies the changes of the bucket,
+// its own included, in order, so the databases of the servers converge.
+type replicator struct {
+	kv      jetstream.KeyValue
+	mu      sync.Mutex
+	applied map[string]uint64
+	// js publishes audit events to the audit stream; nil when the audit log
+	// is not replicated.
+	js jetstream.JetStream
+}
+
+// clusterServers returns the fqdns of the other servers of the cluster.
+func clusterServers(config Configuration) []string {
+	servers := []string{}
+	for _, fqdn := range config.Cluster.Servers {
+		fqdn = strings.TrimSpace(fqdn)
+		if fqdn == "" || fqdn == config.FQDN || slices.Contains(servers, fqdn) {
+			continue
+		}
+		servers = append(servers, fqdn)
+	}
+	return servers
+}
+
+// clustered reports whether the server is part of a cluster.
+func clustered(config Configuration) bool {
+	return len(clusterServers(config)) > 0
+}
+
+// clusterReplicas returns the number of copies of the replicated tables kept
+// by the cluster.
+func clusterReplicas(config Configuration) int {
+	return min(len(clusterServers(config))+1, 3)
+}
+
+// clusterOptions configures the broker to route messages to the other servers
+// of the cluster and to run JetStream for the replicated tables.
+func clusterOptions(config Configuration, options *server.Options, tlsConfig *tls.Config) error {
+	servers := clusterServers(config)
+	if len(servers) == 0 {
+		return nil
+	}
+	if config.Cluster.Password == "" {
+		return ErrClusterPassword
+	}
+	name := config.Cluster.Name
+	if name == "" {
+		name = defaultClusterName
+	}
+	port := config.Cluster.Port
+	if port == 0 {
+		port = defaultClusterPort
+	}
+	options.ServerName = config.FQDN
+	options.Cluster = server.ClusterOpts{
+		Name:     name,
+		Port:     port,
+		Username: clusterUser,
+		Password: config.Cluster.Password,
+	}
+	if config.Secure {
+		options.Cluster.TLSConfig = tlsConfig
+	}
+	options.Routes = []*url.URL{}
+	for _, fqdn := range servers {
+		options.Routes = append(options.Routes, &url.URL{
+			Scheme: "nats-route",
+			User:   url.UserPassword(clusterUser, config.Cluster.Password),
+			Host:   net.JoinHostPort(fqdn, strconv.Itoa(port)),
+		})
+	}
+	options.JetStream = true
+	options.StoreDir = filepath.Join(config.DataHome, "jetstream")
+	return nil
+}
+
+// clusterLeader reports whether the server runs the periodic tasks: the
+// JetStream leader of a cluster or a server that is not clustered.
+func clusterLeader() bool {
+	return replica.Load() == nil || natServer.JetStreamIsLeader()
+}
+
+// replicate starts the replication of the database, retrying until the
+// cluster is available or ctx is done.
+func replicate(ctx context.Context, config Configuration) bool {
+	for {
+		r, err := startReplication(ctx, natsConn, clusterReplicas(config))
+		if err == nil {
+			replica.Store(r)
+			slog.Info("cluster replication started", "servers", clusterServers(config))
+			return true
+		}
+		slog.Warn("cluster replication", "error", err)
+		select {
+		case <-ctx.Done():
+			return false
+		case <-time.After(clusterRetryTime):
+		}
+	}
+}
+
+// startReplication synchronizes the database with the bucket and keeps
+// applying the changes of the bucket until ctx is done. The database of the
+// first server of a cluster seeds an empty bucket; otherwise the bucket
+// replaces the replicated tables.
+func startReplication(ctx context.Context, conn *nats.Conn, replicas int) (*replicator, error) {
+	js, err := jetstream.New(conn)
+	if err != nil {
+		return nil, err
+	}
+	setup, cancel := context.WithTimeout(ctx, natsTimeout*5)
+	defer cancel()
+	kv, err := js.CreateOrUpdateKeyValue(setup, jetstream.KeyValueConfig{
+		Bucket:   clusterBucket,
+		Replicas: replicas,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("create bucket %w", err)
+	}
+	r := &replicator{kv: kv, applied: map[string]uint64{}}
+	watcher, err := kv.WatchAll(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("watch bucket %w", err)
+	}
+	known := map[string]bool{}
+	for entry := range watcher.Updates() {
+		// a nil entry marks the end of the initial values.
+		if entry == nil {
+			break
+		}
+		known[entry.Key()] = true
+		r.apply(entry)
+	}
+	if ctx.Err() != nil {
+		_ = watcher.Stop()
+		return nil, ctx.Err()
+	}
+	if len(known) == 0 {
+		err = r.seed(ctx)
+	} else {
+		err = r.prune(known)
+	}
+	if err != nil {
+		_ = watcher.Stop()
+		return nil, err
+	}
+	if err := r.replicateAudit(ctx, js, replicas); err != nil {
+		_ = watcher.Stop()
+		return nil, fmt.Errorf("replicate audit %w", err)
+	}
+	reloadNkeys()
+	go r.watch(ctx, watcher)
+	return r, nil
+}
+
+// replicateAudit replaces the audit table with the events of the audit stream
+// and keeps adding the events of the stream until ctx is done. The audit log
+// of the first server of a cluster seeds an empty stream.
+func (r *replicator) replicateAudit(ctx context.Context, js jetstream.JetStream, replicas int) error {
+	setup, cancel := context.WithTimeout(ctx, natsTimeout*5)
+	defer cancel()
+	stream, err := js.CreateOrUpdateStream(setup, jetstream.StreamConfig{
+		Name:     auditStream,
+		Subjects: []string{auditSubject},
+		Replicas: replicas,
+	})
+	if err != nil {
+		return err
+	}
+	info, err := stream.Info(setup)
+	if err != nil {
+		return err
+	}
+	if info.State.LastSeq == 0 {
+		if err := seedAudit(setup, js); err != nil {
+			return err
+		}
+		if info, err = stream.Info(setup); err != nil {
+			return err
+		}
+	}
+	if err := clearAudit(); err != nil {
+		return err
+	}
+	consumer, err := stream.OrderedConsumer(ctx, jetstream.OrderedConsumerConfig{})
+	if err != nil {
+		return err
+	}
+	messages, err := consumer.Messages()
+	if err != nil {
+		return err
+	}
+	go func() {
+		<-ctx.Done()
+		messages.Stop()
+	}()
+	for last := uint64(0); last < info.State.LastSeq; {
+		msg, err := messages.Next()
+		if err != nil {
+			return err
+		}
+		if last, err = applyAudit(msg); err != nil {
+			slog.Error("audit replication", "error", err)
+		}
+	}
+	r.js = js
+	go func() {
+		for {
+			msg, err := messages.Next()
+			if err != nil {
+				return
+			}
+			if _, err := applyAudit(msg); err != nil {
+				slog.Error("audit replication", "error", err)
+			}
+		}
+	}()
+	return nil
+}
+
+// seedAudit publishes the events of the audit table to the empty audit stream,
+// unless another server seeded it first.
+func seedAudit(ctx context.Context, js jetstream.JetStream) error {
+	events := [][]byte{}
+	if err := boltdb.Connection().View(func(tx *bbolt.Tx) error {
+		b := tx.Bucket([]byte(auditTable))
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(_, v []byte) error {
+			event := plexus.AuditEvent{}
+			if err := json.Unmarshal(v, &event); err != nil {
+				return err
+			}
+			event.ID = 0
+			value, err := json.Marshal(event)
+			if err != nil {
+				return err
+			}
+			events = append(events, value)
+			return nil
+		})
+	}); err != nil {
+		return err
+	}
+	for i, event := range events {
+		_, err := js.Publish(ctx, auditSubject, event, jetstream.WithExpectLastSequence(uint64(i)))
+		if i == 0 && errors.Is(err, jetstream.ErrKeyExists) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// applyAudit saves an event of the audit stream to the audit table and returns
+// its sequence.
+func applyAudit(msg jetstream.Msg) (uint64, error) {
+	meta, err := msg.Metadata()
+	if err != nil {
+		return 0, err
+	}
+	event := plexus.AuditEvent{}
+	if err := json.Unmarshal(msg.Data(), &event); err != nil {
+		return meta.Sequence.Stream, err
+	}
+	event.ID = meta.Sequence.Stream
+	return event.ID, saveAuditEvent(event)
+}
+
+// publishAudit adds an event to the audit stream and then to the audit table.
+func (r *replicator) publishAudit(event plexus.AuditEvent) error {
+	value, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), natsTimeout)
+	defer cancel()
+	ack, err := r.js.Publish(ctx, auditSubject, value)
+	if err != nil {
+		return fmt.Errorf("replicate audit %w", err)
+	}
+	event.ID = ack.Sequence
+	return saveAuditEvent(event)
+}
+
+// watch applies the changes of the bucket until ctx is done.
+func (r *replicator) watch(ctx context.Context, watcher jetstream.KeyWatcher) {
+	defer func() {
+		_ = watcher.Stop()
+		replica.CompareAndSwap(r, nil)
+	}()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case entry, ok := <-watcher.Updates():
+			if !ok {
+				slog.Error("cluster replication stopped")
+				return
+			}
+			if entry == nil {
+				continue
+			}
+			if table := r.apply(entry); table == peerTable || table == keyTable {
+				reloadNkeys()
+			}
+		}
+	}
+}
+
+// apply writes a change of the bucket to the database, unless a later
+// revision of the record was already written, and returns its table.
+func (r *replicator) apply(entry jetstream.KeyValueEntry) string {
+	table, key, err := recordKey(entry.Key())
+	if err != nil {
+		slog.Error("cluster replication", "key", entry.Key(), "error", err)
+		return ""
+	}
+	value := entry.Value()
+	if entry.Operation() != jetstream.KeyValuePut {
+		value = nil
+	}
+	applied, err := r.write(table, key, value, entry.Revision())
+	if err != nil {
+		slog.Error("cluster replication", "table", table, "key", key, "error", err)
+	}
+	if !applied {
+		return ""
+	}
+	return table
+}
+
+// write writes revision of a record of table to the database, deleting it when
+// value is nil, unless a later revision was already written, and reports
+// whether it did. A revision of 0 is always written.
+func (r *replicator) write(table, key string, value []byte, revision uint64) (bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if revision > 0 && revision <= r.applied[bucketKey(table, key)] {
+		return false, nil
+	}
+	if err := boltdb.Connection().Update(func(tx *bbolt.Tx) error {
+		b := tx.Bucket([]byte(table))
+		if b == nil {
+			return boltdb.ErrInvalidTableName
+		}
+		if value == nil {
+			return b.Delete([]byte(key))
+		}
+		return b.Put([]byte(key), value)
+	}); err != nil {
+		return true, err
+	}
+	r.written(bucketKey(table, key), revision)
+	return true, nil
+}
+
+// seed copies the replicated tables to the bucket.
+func (r *replicator) seed(ctx context.Context) error {
+	records := map[string][]byte{}
+	if err := boltdb.Connection().View(func(tx *bbolt.Tx) error {
+		for _, table := range replicatedTables {
+			b := tx.Bucket([]byte(table))
+			if b == nil {
+				continue
+			}
+			if err := b.ForEach(func(k, v []byte) error {
+				records[bucketKey(table, string(k))] = slices.Clone(v)
+				return nil
+			}); err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+	slog.Info("seeding cluster", "records", len(records))
+	for key, value := range records {
+		revision, err := r.kv.Put(ctx, key, value)
+		if err != nil {
+			return fmt.Errorf("seed %s %w", key, err)
+		}
+		r.mu.Lock()
+		r.written(key, revision)
+		r.mu.Unlock()
+	}
+	return nil
+}
+
+// prune deletes the records of the replicated tables that are not in the
+// bucket.
+func (r *replicator) prune(known map[string]bool) error {
+	return boltdb.Connection().Update(func(tx *bbolt.Tx) error {
+		for _, table := range replicatedTables {
+			b := tx.Bucket([]byte(table))
+			if b == nil {
+				continue
+			}
+			stale := [][]byte{}
+			if err := b.ForEach(func(k, _ []byte) error {
+				if !known[bucketKey(table, string(k))] {
+					stale = append(stale, slices.Clone(k))
+				}
+				return nil
+			}); err != nil {
+				return err
+			}
+			for _, k := range stale {
+				if err := b.Delete(k); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+// put saves a record to the bucket and then to the database, so that a record
+// the cluster did not get is not kept by the server.
+func (r *replicator) put(table, key string, value []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), natsTimeout)
+	defer cancel()
+	revision, err := r.kv.Put(ctx, bucketKey(table, key), value)
+	if err != nil {
+		return fmt.Errorf("replicate %s %w", table, err)
+	}
+	_, err = r.write(table, key, value, revision)
+	return err
+}
+
+// update saves a record to the bucket, if it is still at revision, and then to
+// the database. When it is not, the database is brought up to date with the
+// bucket and ErrConflict is returned.
+func (r *replicator) update(table, key string, value []byte, revision uint64) error {
+	ctx, cancel := context.WithTimeout(context.Background(), natsTimeout)
+	defer cancel()
+	var updated uint64
+	var err error
+	if revision == 0 {
+		updated, err = r.kv.Create(ctx, bucketKey(table, key), value)
+	} else {
+		updated, err = r.kv.Update(ctx, bucketKey(table, key), value, revision)
+	}
+	// a wrong last revision is reported as an existing key.
+	if errors.Is(err, jetstream.ErrKeyExists) {
+		if err := r.refresh(ctx, table, key); err != nil {
+			return fmt.Errorf("replicate %s %w", table, err)
+		}
+		return ErrConflict
+	}
+	if err != nil {
+		return fmt.Errorf("replicate %s %w", table, err)
+	}
+	_, err = r.write(table, key, value, updated)
+	return err
+}
+
+// refresh writes the latest revision of a record of the bucket to the
+// database, without waiting for the watch to apply it.
+func (r *replicator) refresh(ctx context.Context, table, key string) error {
+	entry, err := r.kv.Get(ctx, bucketKey(table, key))
+	if errors.Is(err, jetstream.ErrKeyNotFound) {
+		_, err = r.write(table, key, nil, 0)
+		return err
+	}
+	if err != nil {
+		return err
+	}
+	_, err = r.write(table, key, entry.Value(), entry.Revision())
+	return err
+}
+
+// delete deletes a record from the bucket and then from the database. The
+// revision of a delete is not known, so the delete is always written.
+func (r *replicator) delete(table, key string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), natsTimeout)
+	defer cancel()
+	if err := r.kv.Delete(ctx, bucketKey(table, key)); err != nil {
+		return fmt.Errorf("replicate %s %w", table, err)
+	}
+	_, err := r.write(table, key, nil, 0)
+	return err
+}
+
+// written records that the database holds revision of key, so that earlier
+// changes of the bucket are not applied over it. The caller holds r.mu.
+func (r *replicator) written(key string, revision uint64) {
+	r.applied[key] = max(r.applied[key], revision)
+}
+
+// bucketKey returns the key of a record in the bucket. Record keys are
+// encoded as they may hold characters that are not valid in bucket keys.
+func bucketKey(table, key string) string {
+	return table + "." + base64.RawURLEncoding.EncodeToString([]byte(key))
+}
+
+// recordKey returns the table and key of a key of the bucket.
+func recordKey(key string) (string, string, error) {
+	table, encoded, ok := strings.Cut(key, ".")
+	if !ok || !slices.Contains(replicatedTables, table) {
+		return "", "", fmt.Errorf("invalid bucket key %s", key)
+	}
+	record, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", "", err
+	}
+	return table, string(record), nil
+}
+
+// save saves value under key in table and replicates it to the other servers
+// of the cluster; the value is only saved once the cluster has it.
+func save(value any, key, table string) error {
+	r := replica.Load()
+	if r == nil || !slices.Contains(replicatedTables, table) {
+		return boltdb.Save(value, key, table)
+	}
+	// stored as boltdb stores it.
+	marshalled, err := json.Marshal(&value)
+	if err != nil {
+		return err
+	}
+	return r.put(table, key, marshalled)
+}
+
+// remove deletes the record with key from table and from the other servers of
+// the cluster; the record is only deleted once the cluster has deleted it.
+func remove(key, table string) error {
+	r := replica.Load()
+	if r == nil || !slices.Contains(replicatedTables, table) {
+		return boltdb.Delete[any](key, table)
+	}
+	if _, err := boltdb.Get[any](key, table); err != nil {
+		return err
+	}
+	return r.delete(table, key)
+}
+
+// modify applies change to the record with key in table and saves it. In a
+// cluster, the record is only saved if no other server changed it since it was
+// read; otherwise the latest record is fetched from the cluster and change is
+// applied again. change must only alter the record, as it may be called
+// several times; it returns errUnchanged when there is nothing to save.
+func modify[T any](key, table string, change func(*T) error) (T, error) {
+	var value T
+	for range modifyAttempts {
+		var revision uint64
+		var err error
+		value, revision, err = load[T](key, table)
+		if err != nil {
+			return value, err
+		}
+		if err := change(&value); errors.Is(err, errUnchanged) {
+			return value, nil
+		} else if err != nil {
+			return value, err
+		}
+		err = saveRevision(value, key, table, revision)
+		if !errors.Is(err, ErrConflict) {
+			return value, err
+		}
+		slog.Debug("record changed by another server", "table", table, "key", key)
+	}
+	return value, ErrConflict
+}
+
+// load returns the record with key in table and the revision of the bucket it
+// was read at, 0 when the server is not clustered.
+func load[T any](key, table string) (T, uint64, error) {
+	r := replica.Load()
+	if r == nil || !slices.Contains(replicatedTables, table) {
+		value, err := boltdb.Get[T](key, table)
+		return value, 0, err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	value, err := boltdb.Get[T](key, table)
+	return value, r.applied[bucketKey(table, key)], err
+}
+
+// saveRevision saves value under key in table, as save does, if the record of
+// the bucket is still at revision; ErrConflict is returned otherwise.
+func saveRevision(value any, key, table string, revision uint64) error {
+	r := replica.Load()
+	if r == nil || !slices.Contains(replicatedTables, table) {
+		return boltdb.Save(value, key, table)
+	}
+	marshalled, err := json.Marshal(&value)
+	if err != nil {
+		return err
+	}
+	return r.update(table, key, marshalled, revision)
+}
+
+// reloadNkeys updates the users of the broker after the keys or peers were
+// changed by another server of the cluster.
+func reloadNkeys() {
+	if natsOptions == nil || natServer == nil {
+		return
+	}
+	nkeysLock.Lock()
+	defer nkeysLock.Unlock()
+	admin, err := getAdminKey().PublicKey()
+	if err != nil {
+		slog.Error("admin public key", "error", err)
+		return
+	}
+	users := []*server.NkeyUser{}
+	for _, user := range natsOptions.Nkeys {
+		if user != nil && user.Nkey == admin {
+			users = append(users, user)
+		}
+	}
+	for _, user := range append(getTokenUsers(), getDeviceUsers()...) {
+		if user != nil {
+			users = append(users, user)
+		}
+	}
+	nkey := func(user *server.NkeyUser) string {
+		if user == nil {
+			return ""
+		}
+		return user.Nkey
+	}
+	current := []string{}
+	for _, user := range natsOptions.Nkeys {
+		current = append(current, nkey(user))
+	}
+	updated := []string{}
+	for _, user := range users {
+		updated = append(updated, nkey(user))
+	}
+	slices.Sort(current)
+	slices.Sort(updated)
+	if slices.Equal(current, updated) {
+		return
+	}
+	natsOptions.Nkeys = users
+	if err := natServer.ReloadOptions(natsOptions); err != nil {
+		slog.Error("reload nkeys", "error", err)
+	}
+}
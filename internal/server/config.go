@@ -28,14 +28,28 @@ type Configuration struct {
 	Verbosity string
 	DataHome  string
 	DBFile    string
+	// StunPort is the udp port of the embedded STUN server; 0 is the default
+	// port and a negative port disables the server.
+	StunPort int
+	// RelayPort is the tcp port of the packet relay; the relay only runs when
+	// a port is set.
+	RelayPort int
+	OIDC      OIDCConfig
+	Cluster   ClusterConfig
 }
 
 const (
-	userTable    = "users"
-	keyTable     = "keys"
-	networkTable = "networks"
-	peerTable    = "peers"
-	settingTable = "settings"
+	userTable     = "users"
+	keyTable      = "keys"
+	networkTable  = "networks"
+	peerTable     = "peers"
+	settingTable  = "settings"
+	tokenTable    = "tokens"
+	auditTable    = "audit"
+	groupTable    = "groups"
+	pskTable      = "psks"
+	pendingTable  = "pending"
+	rotationTable = "rotations"
 )
 
 var (
@@ -46,6 +60,12 @@ var (
 	ErrSecureBlankFQDN = errors.New("secure server requires FQDN")
 	ErrSecureWithIP    = errors.New("cannot use IP address with secure")
 	ErrInValidEmail    = errors.New("valid email address required")
+	ErrPeerNotFound    = errors.New("peer not found")
+	ErrInvalidToken    = errors.New("invalid token")
+	ErrTokenExpired    = errors.New("token expired")
+	ErrTokenScope      = errors.New("token scope does not permit request")
+	ErrServerRunning   = errors.New("database in use; stop the server before restoring")
+	ErrNoToken         = errors.New("PLEXUS_TOKEN is not set")
 )
 
 const (
@@ -54,40 +74,20 @@ const (
 	natsTimeout   = time.Second * 3
 	keyExpiry     = time.Hour * 24
 	keyTick       = time.Hour * 6
+	pendingExpiry = time.Hour * 24
 	pingTick      = time.Minute * 3
+	pskTick       = time.Hour
+	pskLifetime   = time.Hour * 24
 )
 
 func configureServer() (*tls.Config, error) {
 	var tlsConfig *tls.Config
 	plexus.SetUpLogging("INFO")
 
-	home, err := os.UserHomeDir()
+	config, err := getConfiguration()
 	if err != nil {
 		return nil, err
 	}
-	config := Configuration{}
-	if err := configuration.Get(&config); err != nil {
-		return nil, err
-	}
-	// set defaults
-	if config.AdminName == "" {
-		config.AdminName = "admin"
-	}
-	if config.AdminPass == "" {
-		config.AdminPass = "password"
-	}
-	if config.Verbosity == "" {
-		config.Verbosity = "INFO"
-	}
-	if config.Port == "" {
-		config.Port = "8080"
-	}
-	if config.DBFile == "" {
-		config.DBFile = "plexus-server.db"
-	}
-	if config.DataHome == "" {
-		config.DataHome = home + "/.local/share/" + filepath.Base(os.Args[0]) + "/"
-	}
 	if _, err := os.Stat(config.DataHome); err != nil {
 		return nil, ErrDataDir
 	}
@@ -115,6 +115,9 @@ func configureServer() (*tls.Config, error) {
 			return nil, ErrInValidEmail
 		}
 	}
+	if clustered(config) && config.Cluster.Password == "" {
+		return nil, ErrClusterPassword
+	}
 
 	// get TLS.
 	if config.Secure {
@@ -130,6 +133,38 @@ func configureServer() (*tls.Config, error) {
 	return tlsConfig, nil
 }
 
+// getConfiguration returns the server configuration with defaults applied.
+func getConfiguration() (Configuration, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return Configuration{}, err
+	}
+	config := Configuration{}
+	if err := configuration.Get(&config); err != nil {
+		return config, err
+	}
+	// set defaults
+	if config.AdminName == "" {
+		config.AdminName = "admin"
+	}
+	if config.AdminPass == "" {
+		config.AdminPass = "password"
+	}
+	if config.Verbosity == "" {
+		config.Verbosity = "INFO"
+	}
+	if config.Port == "" {
+		config.Port = "8080"
+	}
+	if config.DBFile == "" {
+		config.DBFile = "plexus-server.db"
+	}
+	if config.DataHome == "" {
+		config.DataHome = home + "/.local/share/" + filepath.Base(os.Args[0]) + "/"
+	}
+	return config, nil
+}
+
 func emailValid(email string) bool {
 	_, err := mail.ParseAddress(email)
 	if err != nil {
@@ -149,7 +184,8 @@ func initializeDatabase(config Configuration) error {
 	slog.Info("init db", "path", config.DataHome, "file", config.DBFile)
 	if err := boltdb.Initialize(
 		filepath.Join(config.DataHome, config.DBFile),
-		[]string{"users", "keys", "networks", "peers", "settings"},
+		[]string{"users", "keys", "networks", "peers", "settings", "tokens", "audit", "groups", "psks",
+			"pending", "rotations"},
 	); err != nil {
 		return fmt.Errorf("init database %w", err)
 	}
@@ -0,0 +1,113 @@
+package server
+
+import (
+	"log/slog"
+	"net/http"
+	"slices"
+
+	"github.com/devilcove/boltdb"
+	"github.com/devilcove/plexus"
+	"github.com/devilcove/plexus/internal/publish"
+)
+
+func addExitNode(w http.ResponseWriter, r *http.Request) {
+	netID := r.PathValue("id")
+	peer := r.PathValue("peer")
+	slog.Debug("exit node", "network", netID, "peer", peer)
+	network, err := boltdb.Get[plexus.Network](netID, networkTable)
+	if err != nil {
+		processError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if _, err := createExitNode(userActor(r), network, peer); err != nil {
+		processError(w, errorStatus(err), err.Error())
+		return
+	}
+	networkDetails(w, r)
+}
+
+// createExitNode makes peer an exit node, routing the internet traffic of the
+// peers that choose it, and publishes the update.
+func createExitNode(actor string, network plexus.Network, id string) (plexus.Network, error) {
+	if !peerInNetwork(network, id) {
+		return network, ErrPeerNotFound
+	}
+	before := network
+	before.Peers = slices.Clone(network.Peers)
+	update := plexus.NetworkUpdate{Action: plexus.UpdatePeer}
+	for i, peer := range network.Peers {
+		if peer.WGPublicKey == id {
+			if peer.IsRelayed {
+				return network, requestError("a relayed peer cannot be an exit node")
+			}
+			peer.IsExitNode = true
+			network.Peers[i] = peer
+			update.Peer = peer
+			break
+		}
+	}
+	if err := save(network, network.Name, networkTable); err != nil {
+		return network, err
+	}
+	audit(actor, "exitnode.create", network.Name+"/"+update.Peer.HostName, before, network)
+	publish.Message(natsConn, plexus.Networks+network.Name, update)
+	publish.Message(natsConn, plexus.Update+id+plexus.AddRouter, update.Peer)
+	return network, nil
+}
+
+func deleteExitNode(w http.ResponseWriter, r *http.Request) {
+	netID := r.PathValue("id")
+	peer := r.PathValue("peer")
+	slog.Info("delete exit node", "network", netID, "peer", peer)
+	network, err := boltdb.Get[plexus.Network](netID, networkTable)
+	if err != nil {
+		processError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if _, err := removeExitNode(userActor(r), network, peer); err != nil {
+		processError(w, errorStatus(err), err.Error())
+		return
+	}
+	networkDetails(w, r)
+}
+
+// removeExitNode unsets peer as an exit node, clears it as the exit node of
+// the peers using it and publishes the updates.
+func removeExitNode(actor string, network plexus.Network, id string) (plexus.Network, error) {
+	if !peerInNetwork(network, id) {
+		return network, ErrPeerNotFound
+	}
+	before := network
+	before.Peers = slices.Clone(network.Peers)
+	updates := []plexus.NetworkUpdate{}
+	var exitNode plexus.NetworkPeer
+	for i, peer := range network.Peers {
+		switch {
+		case peer.WGPublicKey == id:
+			peer.IsExitNode = false
+			exitNode = peer
+		case peer.ExitNode == id:
+			peer.ExitNode = ""
+		default:
+			continue
+		}
+		network.Peers[i] = peer
+		updates = append(updates, plexus.NetworkUpdate{Action: plexus.UpdatePeer, Peer: peer})
+	}
+	if err := save(network, network.Name, networkTable); err != nil {
+		return network, err
+	}
+	audit(actor, "exitnode.delete", network.Name+"/"+exitNode.HostName, before, network)
+	for _, update := range updates {
+		publish.Message(natsConn, plexus.Networks+network.Name, update)
+	}
+	publish.Message(natsConn, plexus.Update+id+plexus.DeleteRouter, exitNode)
+	return network, nil
+}
+
+// validExitNode reports whether id is an exit node of network.
+func validExitNode(network plexus.Network, id string) bool {
+	return slices.ContainsFunc(network.Peers, func(peer plexus.NetworkPeer) bool {
+		return peer.WGPublicKey == id && peer.IsExitNode
+	})
+}
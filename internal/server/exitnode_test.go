@@ -0,0 +1,90 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/Kairum-Labs/should"
+	"github.com/devilcove/boltdb"
+	"github.com/devilcove/plexus"
+)
+
+func TestExitNode(t *testing.T) {
+	setup(t)
+	defer shutdown(t)
+	deleteAllPeers(t)
+	deleteAllNetworks(t)
+	deleteAllUsers(t)
+	defer deleteAllPeers(t)
+	defer deleteAllNetworks(t)
+	createTestNetwork(t)
+	exit := createTestNetworkPeer(t)
+	client := createTestNetworkPeer(t)
+	user := plexus.User{Username: "test", Password: "pass", IsAdmin: true}
+	createTestUser(t, user)
+	cookie := testLogin(t, user)
+	getPeer := func(t *testing.T, id string) plexus.NetworkPeer {
+		t.Helper()
+		network, err := boltdb.Get[plexus.Network]("valid", networkTable)
+		should.NotBeError(t, err)
+		for _, peer := range network.Peers {
+			if peer.WGPublicKey == id {
+				return peer
+			}
+		}
+		t.Fatal("peer not found", id)
+		return plexus.NetworkPeer{}
+	}
+
+	t.Run("create", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodPost, "/networks/exit/valid/"+exit, nil)
+		r.AddCookie(cookie)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		should.BeEqual(t, w.Code, http.StatusOK)
+		should.ContainSubstring(t, w.Body.String(), "Delete Exit Node")
+		should.BeTrue(t, getPeer(t, exit).IsExitNode)
+	})
+	t.Run("missing", func(t *testing.T) {
+		w := apiRequest(t, cookie, http.MethodPost, "/api/v1/networks/valid/exit/missing", "")
+		should.BeEqual(t, w.Code, http.StatusNotFound)
+	})
+	t.Run("choose", func(t *testing.T) {
+		peer := getPeer(t, client)
+		peer.ExitNode = exit
+		processNetworkPeerUpdate(client, &peer)
+		should.BeEqual(t, getPeer(t, client).ExitNode, exit)
+		// only exit nodes can be chosen and peers cannot make themselves exit nodes.
+		peer.ExitNode = client
+		peer.IsExitNode = true
+		processNetworkPeerUpdate(client, &peer)
+		should.BeEqual(t, getPeer(t, client).ExitNode, "")
+		should.BeFalse(t, getPeer(t, client).IsExitNode)
+		peer = getPeer(t, client)
+		peer.ExitNode = exit
+		processNetworkPeerUpdate(client, &peer)
+	})
+	t.Run("otherNetwork", func(t *testing.T) {
+		peer := getPeer(t, client)
+		peer.Address.IP = []byte{10, 201, 0, 2}
+		peer.ExitNode = ""
+		processNetworkPeerUpdate(client, &peer)
+		should.BeEqual(t, getPeer(t, client).ExitNode, exit)
+	})
+	t.Run("delete", func(t *testing.T) {
+		w := apiRequest(t, cookie, http.MethodDelete, "/api/v1/networks/valid/exit/"+exit, "")
+		should.BeEqual(t, w.Code, http.StatusOK)
+		should.BeFalse(t, getPeer(t, exit).IsExitNode)
+		should.BeEqual(t, getPeer(t, client).ExitNode, "")
+	})
+	t.Run("relayed", func(t *testing.T) {
+		network, err := boltdb.Get[plexus.Network]("valid", networkTable)
+		should.NotBeError(t, err)
+		network, err = createRelay("test", network, client, []string{exit})
+		should.NotBeError(t, err)
+		_, err = createExitNode("test", network, exit)
+		should.BeError(t, err)
+		should.ContainSubstring(t, err.Error(), "relayed peer")
+	})
+}
@@ -0,0 +1,120 @@
+package server
+
+import (
+	"log/slog"
+
+	"github.com/devilcove/plexus"
+	"github.com/devilcove/plexus/internal/publish"
+)
+
+// routerHealthy reports whether a router can be the primary router of a subnet:
+// it answers pings from the server and has handshakes with its peers.
+func routerHealthy(peer plexus.NetworkPeer) bool {
+	return peer.NatsConnected && peer.Connectivity > 0
+}
+
+// subnetKey identifies the subnet routed by the routers of a highly available
+// group: the routed subnet and the subnet advertised to peers.
+func subnetKey(subnet plexus.RouterSubnet) string {
+	advertised := subnet.Advertised()
+	return subnet.Subnet.String() + " " + advertised.String()
+}
+
+// subnetRouted reports whether subnet is routed by a router of network other
+// than router.
+func subnetRouted(network plexus.Network, router string, subnet plexus.RouterSubnet) bool {
+	for _, peer := range network.Peers {
+		if peer.WGPublicKey == router {
+			continue
+		}
+		for _, routed := range peer.Subnets {
+			if subnetKey(routed) == subnetKey(subnet) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// electRouters chooses the primary router of each subnet routed by several
+// routers of network; the other routers are standby and do not advertise the
+// subnet. A healthy primary is kept, otherwise the healthy router with the best
+// connectivity takes over. It returns the routers that changed.
+func electRouters(network *plexus.Network) []plexus.NetworkPeer {
+	type location struct{ peer, subnet int }
+	groups := map[string][]location{}
+	keys := []string{}
+	for i, peer := range network.Peers {
+		for j, subnet := range peer.Subnets {
+			key := subnetKey(subnet)
+			if _, ok := groups[key]; !ok {
+				keys = append(keys, key)
+			}
+			groups[key] = append(groups[key], location{i, j})
+		}
+	}
+	changed := map[int]bool{}
+	for _, key := range keys {
+		group := groups[key]
+		current := -1
+		best := -1
+		for i, loc := range group {
+			peer := network.Peers[loc.peer]
+			if current < 0 && !peer.Subnets[loc.subnet].Standby {
+				current = i
+			}
+			if routerHealthy(peer) && (best < 0 || peer.Connectivity > network.Peers[group[best].peer].Connectivity) {
+				best = i
+			}
+		}
+		primary := current
+		switch {
+		case current >= 0 && routerHealthy(network.Peers[group[current].peer]):
+		case best >= 0:
+			primary = best
+		case current < 0:
+			primary = 0
+		}
+		for i, loc := range group {
+			subnet := &network.Peers[loc.peer].Subnets[loc.subnet]
+			if subnet.Standby != (i != primary) {
+				subnet.Standby = i != primary
+				changed[loc.peer] = true
+			}
+		}
+		if primary != current && len(group) > 1 {
+			slog.Info("subnet router failover", "network", network.Name, "subnet", key,
+				"primary", network.Peers[group[primary].peer].HostName)
+		}
+	}
+	routers := []plexus.NetworkPeer{}
+	for i, peer := range network.Peers {
+		if changed[i] {
+			routers = append(routers, peer)
+		}
+	}
+	return routers
+}
+
+// publishRouters publishes the routers changed by an election, except skip
+// which is published by the caller, so peers move the allowed ips of the
+// subnets to the primary routers.
+func publishRouters(network, skip string, routers []plexus.NetworkPeer) {
+	for _, router := range routers {
+		if router.WGPublicKey == skip {
+			continue
+		}
+		publish.Message(natsConn, plexus.Networks+network,
+			plexus.NetworkUpdate{Action: plexus.UpdatePeer, Peer: router})
+	}
+}
+
+// routerPeer returns the peer of network with key id.
+func routerPeer(network plexus.Network, id string) plexus.NetworkPeer {
+	for _, peer := range network.Peers {
+		if peer.WGPublicKey == id {
+			return peer
+		}
+	}
+	return plexus.NetworkPeer{}
+}
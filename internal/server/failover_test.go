@@ -0,0 +1,107 @@
+package server
+
+import (
+	"net"
+	"net/http"
+	"testing"
+
+	"github.com/Kairum-Labs/should"
+	"github.com/devilcove/boltdb"
+	"github.com/devilcove/plexus"
+)
+
+func TestElectRouters(t *testing.T) {
+	_, lan, _ := net.ParseCIDR("192.168.10.0/24")
+	_, other, _ := net.ParseCIDR("192.168.20.0/24")
+	network := plexus.Network{Name: "site", Peers: []plexus.NetworkPeer{
+		{WGPublicKey: "a", IsSubnetRouter: true, NatsConnected: true, Connectivity: 0.5,
+			Subnets: []plexus.RouterSubnet{{Subnet: *lan}, {Subnet: *other}}},
+		{WGPublicKey: "b", IsSubnetRouter: true, NatsConnected: true, Connectivity: 1,
+			Subnets: []plexus.RouterSubnet{{Subnet: *lan, Standby: true}}},
+		{WGPublicKey: "c", IsSubnetRouter: true, NatsConnected: true, Connectivity: 0.8,
+			Subnets: []plexus.RouterSubnet{{Subnet: *lan, Standby: true}}},
+	}}
+	t.Run("healthy", func(t *testing.T) {
+		// a healthy primary is kept.
+		should.BeEqual(t, len(electRouters(&network)), 0)
+	})
+	t.Run("failover", func(t *testing.T) {
+		network.Peers[0].NatsConnected = false
+		changed := electRouters(&network)
+		should.BeEqual(t, len(changed), 2)
+		should.BeTrue(t, network.Peers[0].Subnets[0].Standby)
+		// the only router of a subnet is never standby.
+		should.BeFalse(t, network.Peers[0].Subnets[1].Standby)
+		should.BeFalse(t, network.Peers[1].Subnets[0].Standby)
+		should.BeTrue(t, network.Peers[2].Subnets[0].Standby)
+	})
+	t.Run("recovered", func(t *testing.T) {
+		network.Peers[0].NatsConnected = true
+		network.Peers[0].Connectivity = 1
+		should.BeEqual(t, len(electRouters(&network)), 0)
+		should.BeFalse(t, network.Peers[1].Subnets[0].Standby)
+	})
+	t.Run("noneHealthy", func(t *testing.T) {
+		for i := range network.Peers {
+			network.Peers[i].Connectivity = 0
+		}
+		should.BeEqual(t, len(electRouters(&network)), 0)
+		should.BeFalse(t, network.Peers[1].Subnets[0].Standby)
+	})
+}
+
+func TestRouterFailover(t *testing.T) {
+	setup(t)
+	defer shutdown(t)
+	deleteAllPeers(t)
+	deleteAllNetworks(t)
+	deleteAllUsers(t)
+	defer deleteAllPeers(t)
+	defer deleteAllNetworks(t)
+	createTestNetwork(t)
+	primary := createTestNetworkPeer(t)
+	standby := createTestNetworkPeer(t)
+	user := plexus.User{Username: "test", Password: "pass", IsAdmin: true}
+	createTestUser(t, user)
+	cookie := testLogin(t, user)
+	subnets := func(t *testing.T, id string) []plexus.RouterSubnet {
+		t.Helper()
+		network, err := boltdb.Get[plexus.Network]("valid", networkTable)
+		should.NotBeError(t, err)
+		return routerPeer(network, id).Subnets
+	}
+
+	t.Run("standby", func(t *testing.T) {
+		for _, id := range []string{primary, standby} {
+			w := apiRequest(t, cookie, http.MethodPost, "/api/v1/networks/valid/router/"+id,
+				`{"Subnet":"192.168.70.0/24","Nat":"nat"}`)
+			should.BeEqual(t, w.Code, http.StatusOK)
+		}
+		should.BeFalse(t, subnets(t, primary)[0].Standby)
+		should.BeTrue(t, subnets(t, standby)[0].Standby)
+	})
+	t.Run("overlap", func(t *testing.T) {
+		// only the same subnet can be routed by several routers.
+		w := apiRequest(t, cookie, http.MethodPost, "/api/v1/networks/valid/router/"+standby,
+			`{"Subnet":"192.168.70.128/25"}`)
+		should.BeEqual(t, w.Code, http.StatusBadRequest)
+	})
+	t.Run("checkin", func(t *testing.T) {
+		network, err := boltdb.Get[plexus.Network]("valid", networkTable)
+		should.NotBeError(t, err)
+		for i := range network.Peers {
+			network.Peers[i].NatsConnected = network.Peers[i].WGPublicKey == standby
+		}
+		should.NotBeError(t, boltdb.Save(network, network.Name, networkTable))
+		processConnectionData(&plexus.CheckinData{ID: standby, Connections: []plexus.ConnectivityData{
+			{Network: "valid", Connectivity: 1},
+		}})
+		should.BeTrue(t, subnets(t, primary)[0].Standby)
+		should.BeFalse(t, subnets(t, standby)[0].Standby)
+	})
+	t.Run("removePrimary", func(t *testing.T) {
+		w := apiRequest(t, cookie, http.MethodDelete, "/api/v1/networks/valid/router/"+standby, "")
+		should.BeEqual(t, w.Code, http.StatusOK)
+		should.BeFalse(t, subnets(t, primary)[0].Standby)
+	})
+}
@@ -0,0 +1,258 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/devilcove/boltdb"
+	"github.com/devilcove/plexus"
+	"github.com/devilcove/plexus/internal/publish"
+)
+
+// parseLabels splits a comma separated list of tags or groups.
+func parseLabels(value string) []string {
+	return normalizeLabels(strings.Split(value, ","))
+}
+
+// normalizeLabels trims labels and returns them sorted without blanks or duplicates.
+func normalizeLabels(labels []string) []string {
+	normalized := []string{}
+	for _, label := range labels {
+		label = strings.TrimSpace(label)
+		if label != "" {
+			normalized = append(normalized, label)
+		}
+	}
+	slices.Sort(normalized)
+	return slices.Compact(normalized)
+}
+
+func validateTag(tag string) bool {
+	if len(tag) > 255 {
+		return false
+	}
+	return regexp.MustCompile(`^[A-Za-z0-9_.-]+$`).MatchString(tag)
+}
+
+// validateLabels normalizes tags and groups and checks that tags are valid and
+// that groups exist.
+func validateLabels(tags, groups []string) ([]string, []string, error) {
+	tags = normalizeLabels(tags)
+	groups = normalizeLabels(groups)
+	for _, tag := range tags {
+		if !validateTag(tag) {
+			return tags, groups, requestError("invalid tag " + tag)
+		}
+	}
+	for _, group := range groups {
+		if _, err := boltdb.Get[plexus.Group](group, groupTable); err != nil {
+			if errors.Is(err, boltdb.ErrNoResults) {
+				return tags, groups, requestError("no such group " + group)
+			}
+			return tags, groups, fmt.Errorf("retrieve group %w", err)
+		}
+	}
+	return tags, groups, nil
+}
+
+// createGroup validates and saves a new group.
+func createGroup(actor string, group plexus.Group) (plexus.Group, error) {
+	if !validateNetworkName(group.Name) {
+		return group, requestError("invalid group name")
+	}
+	if _, err := boltdb.Get[plexus.Group](group.Name, groupTable); err == nil {
+		return group, requestError("group exists")
+	} else if !errors.Is(err, boltdb.ErrNoResults) {
+		return group, fmt.Errorf("retrieve group %w", err)
+	}
+	if err := save(group, group.Name, groupTable); err != nil {
+		return group, fmt.Errorf("save group %w", err)
+	}
+	slog.Info("group created", "group", group.Name)
+	audit(actor, "group.create", group.Name, nil, group)
+	return group, nil
+}
+
+// removeGroup deletes a group that is not used by a policy, removing it from
+// peers and registration keys.
+func removeGroup(actor, name string) error {
+	group, err := boltdb.Get[plexus.Group](name, groupTable)
+	if err != nil {
+		return err
+	}
+	networks, err := boltdb.GetAll[plexus.Network](networkTable)
+	if err != nil {
+		return fmt.Errorf("get networks %w", err)
+	}
+	selector := plexus.PolicyGroup + name
+	for _, network := range networks {
+		for _, policy := range network.Policies {
+			if policy.Source == selector || policy.Destination == selector {
+				return requestError("group in use by policy " + network.Name + "/" + policy.Name)
+			}
+		}
+	}
+	for _, peer := range groupMembers(name) {
+		groups := slices.DeleteFunc(slices.Clone(peer.Groups), func(g string) bool { return g == name })
+		if _, err := setPeerLabels(actor, peer.WGPublicKey, peer.Tags, groups); err != nil {
+			return fmt.Errorf("remove group from peer %s %w", peer.Name, err)
+		}
+	}
+	keys, err := boltdb.GetAll[plexus.Key](keyTable)
+	if err != nil {
+		return fmt.Errorf("get keys %w", err)
+	}
+	for _, key := range keys {
+		if !slices.Contains(key.Groups, name) && key.Relay != name {
+			continue
+		}
+		key.Groups = slices.DeleteFunc(key.Groups, func(g string) bool { return g == name })
+		if key.Relay == name {
+			key.Relay = ""
+		}
+		if err := save(key, key.Name, keyTable); err != nil {
+			return fmt.Errorf("save key %w", err)
+		}
+	}
+	if err := remove(name, groupTable); err != nil {
+		return fmt.Errorf("delete group %w", err)
+	}
+	slog.Info("group deleted", "group", name)
+	audit(actor, "group.delete", name, group, nil)
+	return nil
+}
+
+// groupMembers returns the peers belonging to a group.
+func groupMembers(name string) []plexus.Peer {
+	members := []plexus.Peer{}
+	peers, err := boltdb.GetAll[plexus.Peer](peerTable)
+	if err != nil {
+		slog.Error("get peers", "error", err)
+		return members
+	}
+	for _, peer := range peers {
+		if slices.Contains(peer.Groups, name) {
+			members = append(members, peer)
+		}
+	}
+	return members
+}
+
+// setPeerLabels replaces the tags and groups of a peer and publishes the change
+// to the networks of the peer.
+func setPeerLabels(actor, id string, tags, groups []string) (plexus.Peer, error) {
+	peer, err := boltdb.Get[plexus.Peer](id, peerTable)
+	if err != nil {
+		return peer, err
+	}
+	tags, groups, err = validateLabels(tags, groups)
+	if err != nil {
+		return peer, err
+	}
+	before := peer
+	peer.Tags = tags
+	peer.Groups = groups
+	if err := save(peer, peer.WGPublicKey, peerTable); err != nil {
+		return peer, fmt.Errorf("save peer %w", err)
+	}
+	audit(actor, "peer.labels", peer.Name, before, peer)
+	networks, err := boltdb.GetAll[plexus.Network](networkTable)
+	if err != nil {
+		return peer, fmt.Errorf("get networks %w", err)
+	}
+	for _, network := range networks {
+		for i, netPeer := range network.Peers {
+			if netPeer.WGPublicKey != peer.WGPublicKey {
+				continue
+			}
+			network.Peers[i].Tags = peer.Tags
+			network.Peers[i].Groups = peer.Groups
+			if err := save(network, network.Name, networkTable); err != nil {
+				return peer, fmt.Errorf("save network %w", err)
+			}
+			slog.Debug("publish network update", "network", network.Name, "reason", "peer labels")
+			publish.Message(natsConn, plexus.Networks+network.Name, plexus.NetworkUpdate{
+				Action: plexus.UpdatePeer,
+				Peer:   network.Peers[i],
+			})
+		}
+	}
+	return peer, nil
+}
+
+// addGroupToNetwork adds the members of a group that are not yet in a network
+// to the network. Members that cannot be added are reported in the error; the
+// others are still added.
+func addGroupToNetwork(actor, networkName, group string) (plexus.Network, error) {
+	network, err := boltdb.Get[plexus.Network](networkName, networkTable)
+	if err != nil {
+		return network, err
+	}
+	if _, err := boltdb.Get[plexus.Group](group, groupTable); err != nil {
+		return network, err
+	}
+	var errs error
+	for _, peer := range groupMembers(group) {
+		if peerInNetwork(network, peer.WGPublicKey) {
+			continue
+		}
+		priv, pub, err := getListenPorts(peer.WGPublicKey, networkName)
+		if err != nil {
+			errs = errors.Join(errs, fmt.Errorf("%s: %w", peer.Name, err))
+			continue
+		}
+		updated, err := addPeerToNetwork(actor, peer.WGPublicKey, networkName, priv, pub)
+		if err != nil {
+			errs = errors.Join(errs, fmt.Errorf("%s: %w", peer.Name, err))
+			continue
+		}
+		network = updated
+	}
+	return network, errs
+}
+
+func addGroup(w http.ResponseWriter, r *http.Request) {
+	group := plexus.Group{
+		Name:        r.FormValue("name"),
+		Description: r.FormValue("description"),
+	}
+	if _, err := createGroup(userActor(r), group); err != nil {
+		processError(w, errorStatus(err), err.Error())
+		return
+	}
+	displayPeers(w, r)
+}
+
+func deleteGroup(w http.ResponseWriter, r *http.Request) {
+	if err := removeGroup(userActor(r), r.PathValue("name")); err != nil {
+		processError(w, errorStatus(err), err.Error())
+		return
+	}
+	displayPeers(w, r)
+}
+
+func editPeerLabels(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		processError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	tags := parseLabels(r.PostForm.Get("tags"))
+	if _, err := setPeerLabels(userActor(r), r.PathValue("id"), tags, r.PostForm["groups"]); err != nil {
+		processError(w, errorStatus(err), err.Error())
+		return
+	}
+	peerDetails(w, r)
+}
+
+func networkAddGroup(w http.ResponseWriter, r *http.Request) {
+	if _, err := addGroupToNetwork(userActor(r), r.PathValue("id"), r.PathValue("group")); err != nil {
+		processError(w, errorStatus(err), err.Error())
+		return
+	}
+	networkDetails(w, r)
+}
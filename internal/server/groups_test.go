@@ -0,0 +1,213 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/Kairum-Labs/should"
+	"github.com/devilcove/boltdb"
+	"github.com/devilcove/plexus"
+)
+
+func deleteAllGroups(t *testing.T) {
+	t.Helper()
+	groups, err := boltdb.GetAll[plexus.Group](groupTable)
+	should.NotBeError(t, err)
+	for _, group := range groups {
+		should.NotBeError(t, boltdb.Delete[plexus.Group](group.Name, groupTable))
+	}
+}
+
+func TestParseLabels(t *testing.T) {
+	should.BeEqual(t, parseLabels(""), []string{})
+	should.BeEqual(t, parseLabels(" web, db,,web "), []string{"db", "web"})
+}
+
+func TestPeerGroups(t *testing.T) {
+	setup(t)
+	defer shutdown(t)
+	deleteAllGroups(t)
+	deleteAllNetworks(t)
+	deleteAllPeers(t)
+	defer deleteAllGroups(t)
+	defer deleteAllNetworks(t)
+	defer deleteAllPeers(t)
+	createTestNetwork(t)
+	peer := createTestNetworkPeer(t)
+
+	t.Run("create", func(t *testing.T) {
+		_, err := createGroup("admin", plexus.Group{Name: "Bad Name"})
+		should.BeError(t, err)
+		should.BeEqual(t, errorStatus(err), http.StatusBadRequest)
+		_, err = createGroup("admin", plexus.Group{Name: "servers", Description: "servers"})
+		should.NotBeError(t, err)
+		_, err = createGroup("admin", plexus.Group{Name: "servers"})
+		should.BeError(t, err)
+		should.ContainSubstring(t, err.Error(), "group exists")
+	})
+	t.Run("labels", func(t *testing.T) {
+		_, err := setPeerLabels("admin", peer, []string{"bad tag"}, nil)
+		should.BeError(t, err)
+		should.ContainSubstring(t, err.Error(), "invalid tag")
+		_, err = setPeerLabels("admin", peer, nil, []string{"laptops"})
+		should.BeError(t, err)
+		should.ContainSubstring(t, err.Error(), "no such group laptops")
+		updated, err := setPeerLabels("admin", peer, []string{"web", "db", "web"}, []string{"servers"})
+		should.NotBeError(t, err)
+		should.BeEqual(t, updated.Tags, []string{"db", "web"})
+		network, err := boltdb.Get[plexus.Network]("valid", networkTable)
+		should.NotBeError(t, err)
+		should.BeEqual(t, network.Peers[0].Tags, []string{"db", "web"})
+		should.BeEqual(t, network.Peers[0].Groups, []string{"servers"})
+		should.BeEqual(t, len(groupMembers("servers")), 1)
+	})
+	t.Run("agentUpdate", func(t *testing.T) {
+		processDeviceUpdate(peer, &plexus.Peer{WGPublicKey: peer, Name: "testing"})
+		stored, err := boltdb.Get[plexus.Peer](peer, peerTable)
+		should.NotBeError(t, err)
+		should.BeEqual(t, stored.Groups, []string{"servers"})
+	})
+	t.Run("join", func(t *testing.T) {
+		other := createTestPeer(t)
+		_, err := setPeerLabels("admin", other, nil, []string{"servers"})
+		should.NotBeError(t, err)
+		// the peer is not connected so its listen ports are unavailable.
+		network, err := addGroupToNetwork("admin", "valid", "servers")
+		should.BeError(t, err)
+		should.ContainSubstring(t, err.Error(), "testing:")
+		should.BeEqual(t, len(network.Peers), 1)
+		_, err = addGroupToNetwork("admin", "valid", "laptops")
+		should.BeError(t, err)
+		should.BeEqual(t, errorStatus(err), http.StatusNotFound)
+	})
+	t.Run("remove", func(t *testing.T) {
+		_, err := createPolicy("admin", "valid", plexus.Policy{
+			Name: "servers", Source: "tag:web", Destination: "group:servers",
+		})
+		should.NotBeError(t, err)
+		err = removeGroup("admin", "servers")
+		should.BeError(t, err)
+		should.ContainSubstring(t, err.Error(), "group in use by policy valid/servers")
+		_, err = removePolicy("admin", "valid", "servers")
+		should.NotBeError(t, err)
+		should.NotBeError(t, removeGroup("admin", "servers"))
+		should.BeEqual(t, len(groupMembers("servers")), 0)
+		network, err := boltdb.Get[plexus.Network]("valid", networkTable)
+		should.NotBeError(t, err)
+		should.BeEqual(t, network.Peers[0].Groups, []string{})
+		should.BeEqual(t, network.Peers[0].Tags, []string{"db", "web"})
+	})
+}
+
+func TestRegisterWithLabels(t *testing.T) {
+	setup(t)
+	defer shutdown(t)
+	deleteAllKeys(t)
+	deleteAllGroups(t)
+	deleteAllPeers(t)
+	defer deleteAllGroups(t)
+	defer deleteAllPeers(t)
+	_, err := createGroup("admin", plexus.Group{Name: "laptops"})
+	should.NotBeError(t, err)
+	_, err = createKey("admin", plexus.Key{
+		Name: "labels", DispExp: time.Now().Add(time.Hour).Format("2006-01-02"), Groups: []string{"servers"},
+	})
+	should.BeError(t, err)
+	should.ContainSubstring(t, err.Error(), "no such group servers")
+	_, err = createKey("admin", plexus.Key{
+		Name:    "labels",
+		DispExp: time.Now().Add(time.Hour).Format("2006-01-02"),
+		Tags:    []string{"sales"},
+		Groups:  []string{"laptops"},
+	})
+	should.NotBeError(t, err)
+	pub, err := generateKeys()
+	should.NotBeError(t, err)
+	response := registerHandler("labels", &plexus.ServerRegisterRequest{
+		Peer:    plexus.Peer{WGPublicKey: pub.String(), Name: "laptop", Tags: []string{"admin"}},
+		KeyName: "fleet",
+	})
+	should.BeEqual(t, response.Message, "registration successful")
+	peer, err := boltdb.Get[plexus.Peer](pub.String(), peerTable)
+	should.NotBeError(t, err)
+	should.BeEqual(t, peer.Tags, []string{"sales"})
+	should.BeEqual(t, peer.Groups, []string{"laptops"})
+}
+
+func TestRelayGroup(t *testing.T) {
+	setup(t)
+	defer shutdown(t)
+	deleteAllUsers(t)
+	deleteAllGroups(t)
+	deleteAllNetworks(t)
+	deleteAllPeers(t)
+	defer deleteAllGroups(t)
+	defer deleteAllNetworks(t)
+	defer deleteAllPeers(t)
+	admin := plexus.User{Username: "admin", Password: "pass", IsAdmin: true}
+	createTestUser(t, admin)
+	cookie := testLogin(t, admin)
+	createTestNetwork(t)
+	relay := createTestNetworkPeer(t)
+	member := createTestNetworkPeer(t)
+	createTestNetworkPeer(t)
+	_, err := createGroup("admin", plexus.Group{Name: "branch"})
+	should.NotBeError(t, err)
+	_, err = setPeerLabels("admin", relay, nil, []string{"branch"})
+	should.NotBeError(t, err)
+	_, err = setPeerLabels("admin", member, nil, []string{"branch"})
+	should.NotBeError(t, err)
+
+	w := apiRequest(t, cookie, http.MethodPost, "/api/v1/networks/valid/relay/"+relay, `{"Group":"branch"}`)
+	should.BeEqual(t, w.Code, http.StatusOK)
+	network := plexus.Network{}
+	should.NotBeError(t, json.NewDecoder(w.Body).Decode(&network))
+	should.BeEqual(t, network.Peers[0].RelayedPeers, []string{member})
+	should.BeTrue(t, network.Peers[1].IsRelayed)
+	should.BeFalse(t, network.Peers[2].IsRelayed)
+}
+
+func TestAPIGroups(t *testing.T) {
+	setup(t)
+	defer shutdown(t)
+	deleteAllUsers(t)
+	deleteAllGroups(t)
+	deleteAllPeers(t)
+	defer deleteAllGroups(t)
+	defer deleteAllPeers(t)
+	admin := plexus.User{Username: "admin", Password: "pass", IsAdmin: true}
+	createTestUser(t, admin)
+	cookie := testLogin(t, admin)
+	peer := createTestPeer(t)
+
+	w := apiRequest(t, cookie, http.MethodPost, "/api/v1/groups", `{"Name":"servers","Description":"all servers"}`)
+	should.BeEqual(t, w.Code, http.StatusCreated)
+	w = apiRequest(t, cookie, http.MethodGet, "/api/v1/groups", "")
+	should.BeEqual(t, w.Code, http.StatusOK)
+	groups := []plexus.Group{}
+	should.NotBeError(t, json.NewDecoder(w.Body).Decode(&groups))
+	should.BeEqual(t, groups, []plexus.Group{{Name: "servers", Description: "all servers"}})
+
+	w = apiRequest(t, cookie, http.MethodPut, "/api/v1/peers/"+peer+"/labels",
+		`{"Tags":["web"],"Groups":["servers"]}`)
+	should.BeEqual(t, w.Code, http.StatusOK)
+	w = apiRequest(t, cookie, http.MethodPut, "/api/v1/peers/"+peer+"/labels", `{"Groups":["missing"]}`)
+	should.BeEqual(t, w.Code, http.StatusBadRequest)
+
+	w = apiRequest(t, cookie, http.MethodGet, "/peers/", "")
+	should.BeEqual(t, w.Code, http.StatusOK)
+	should.ContainSubstring(t, w.Body.String(), "group:servers")
+	should.ContainSubstring(t, w.Body.String(), "all servers")
+	w = apiRequest(t, cookie, http.MethodGet, "/peers/"+peer, "")
+	should.BeEqual(t, w.Code, http.StatusOK)
+	should.ContainSubstring(t, w.Body.String(), `value="web"`)
+	should.ContainSubstring(t, w.Body.String(), "checked")
+
+	w = apiRequest(t, cookie, http.MethodDelete, "/api/v1/groups/servers", "")
+	should.BeEqual(t, w.Code, http.StatusNoContent)
+	stored, err := boltdb.Get[plexus.Peer](peer, peerTable)
+	should.NotBeError(t, err)
+	should.BeEqual(t, stored.Groups, []string{})
+}
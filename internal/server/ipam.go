@@ -0,0 +1,408 @@
+package server
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"log/slog"
+	"math"
+	"net"
+	"net/http"
+	"net/netip"
+	"slices"
+
+	"github.com/devilcove/boltdb"
+	"github.com/devilcove/plexus"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// IPAM is the address usage of a network.
+type IPAM struct {
+	Network      string
+	Subnets      []SubnetUsage
+	Reservations []ReservationStatus
+	Excluded     []plexus.AddressRange
+}
+
+// SubnetUsage counts the assignable addresses of a network subnet. Counts of
+// very large (ipv6) subnets saturate at the maximum uint64.
+type SubnetUsage struct {
+	Subnet   string
+	Size     uint64
+	Used     uint64
+	Reserved uint64
+	Excluded uint64
+	Free     uint64
+}
+
+// ReservationStatus is a reservation and the peer, if any, holding it.
+type ReservationStatus struct {
+	plexus.Reservation
+
+	HostName string
+	InUse    bool
+}
+
+// reservedAddress returns the address in subnet reserved for peerID, or nil.
+func reservedAddress(network plexus.Network, subnet net.IPNet, peerID string) net.IP {
+	for _, reservation := range network.Reservations {
+		if reservation.WGPublicKey == peerID && subnet.Contains(reservation.Address) {
+			return reservation.Address
+		}
+	}
+	return nil
+}
+
+// excludedRangeEnd returns the end of the excluded range containing addr or
+// the zero Addr if addr is not excluded.
+func excludedRangeEnd(excluded []plexus.AddressRange, addr netip.Addr) netip.Addr {
+	ip := net.IP(addr.AsSlice())
+	for _, r := range excluded {
+		if r.Contains(ip) {
+			end, _ := netip.AddrFromSlice(r.End)
+			return end.Unmap()
+		}
+	}
+	return netip.Addr{}
+}
+
+// subnetFor returns the network subnet containing ip.
+func subnetFor(network plexus.Network, ip net.IP) (net.IPNet, bool) {
+	for _, subnet := range network.Nets() {
+		if subnet.Contains(ip) {
+			return subnet, true
+		}
+	}
+	return net.IPNet{}, false
+}
+
+// assignable reports whether ip may be assigned to a peer of subnet; the
+// network address and the ipv4 broadcast address may not.
+func assignable(subnet net.IPNet, ip net.IP) bool {
+	if ip.Equal(subnet.IP) {
+		return false
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		broadcast := make(net.IP, len(ip4))
+		for i := range ip4 {
+			broadcast[i] = subnet.IP.To4()[i] | ^subnet.Mask[len(subnet.Mask)-len(ip4)+i]
+		}
+		return !ip4.Equal(broadcast)
+	}
+	return true
+}
+
+// peerAddress returns the address of a network peer in the address family of ip.
+func peerAddress(peer plexus.NetworkPeer, ip net.IP) net.IP {
+	if ip.To4() != nil {
+		return peer.Address.IP
+	}
+	return peer.Address6.IP
+}
+
+// parseAddress parses an ip address in a request.
+func parseAddress(value string) (net.IP, error) {
+	ip := net.ParseIP(value)
+	if ip == nil {
+		return nil, requestError("invalid address " + value)
+	}
+	return ip, nil
+}
+
+// createReservation reserves an address of a network for a peer. A peer has at
+// most one reservation per address family and may already hold the address.
+func createReservation(actor, networkName string, reservation plexus.Reservation) (plexus.Network, error) {
+	network, err := boltdb.Get[plexus.Network](networkName, networkTable)
+	if err != nil {
+		return network, err
+	}
+	if _, err := wgtypes.ParseKey(reservation.WGPublicKey); err != nil {
+		return network, requestError("invalid wireguard key")
+	}
+	subnet, ok := subnetFor(network, reservation.Address)
+	if !ok || !assignable(subnet, reservation.Address) {
+		return network, requestError(fmt.Sprintf("address %s is not assignable in network %s",
+			reservation.Address, network.Name))
+	}
+	for _, r := range network.Excluded {
+		if r.Contains(reservation.Address) {
+			return network, requestError("address is in excluded range " + r.Start.String() + "-" + r.End.String())
+		}
+	}
+	for _, existing := range network.Reservations {
+		if existing.Address.Equal(reservation.Address) {
+			return network, requestError("address already reserved")
+		}
+		if existing.WGPublicKey == reservation.WGPublicKey && subnet.Contains(existing.Address) {
+			return network, requestError("peer already has reservation " + existing.Address.String())
+		}
+	}
+	for _, peer := range network.Peers {
+		current := peerAddress(peer, reservation.Address)
+		if peer.WGPublicKey == reservation.WGPublicKey {
+			if current != nil && !current.Equal(reservation.Address) {
+				return network, requestError("peer already has address " + current.String() + " in network")
+			}
+			continue
+		}
+		if current.Equal(reservation.Address) {
+			return network, requestError("address in use by " + peer.HostName)
+		}
+	}
+	before := network
+	before.Reservations = slices.Clone(network.Reservations)
+	network.Reservations = append(network.Reservations, reservation)
+	slices.SortFunc(network.Reservations, func(a, b plexus.Reservation) int {
+		return bytes.Compare(a.Address.To16(), b.Address.To16())
+	})
+	if err := save(network, network.Name, networkTable); err != nil {
+		return network, fmt.Errorf("save network %w", err)
+	}
+	slog.Info("address reserved", "network", network.Name, "address", reservation.Address,
+		"peer", reservation.WGPublicKey)
+	audit(actor, "network.reservation.add", network.Name+"/"+reservation.Address.String(), before, network)
+	return network, nil
+}
+
+// removeReservation releases a reserved address. A peer holding the address keeps it.
+func removeReservation(actor, networkName string, address net.IP) (plexus.Network, error) {
+	network, err := boltdb.Get[plexus.Network](networkName, networkTable)
+	if err != nil {
+		return network, err
+	}
+	before := network
+	before.Reservations = slices.Clone(network.Reservations)
+	index := slices.IndexFunc(network.Reservations, func(r plexus.Reservation) bool {
+		return r.Address.Equal(address)
+	})
+	if index < 0 {
+		return network, requestError("no reservation for " + address.String())
+	}
+	network.Reservations = slices.Delete(network.Reservations, index, index+1)
+	if err := save(network, network.Name, networkTable); err != nil {
+		return network, fmt.Errorf("save network %w", err)
+	}
+	audit(actor, "network.reservation.remove", network.Name+"/"+address.String(), before, network)
+	return network, nil
+}
+
+// createExclusion excludes a range of addresses of a network from assignment.
+// The range may not contain peer addresses, reservations or other excluded ranges.
+func createExclusion(actor, networkName string, excluded plexus.AddressRange) (plexus.Network, error) {
+	network, err := boltdb.Get[plexus.Network](networkName, networkTable)
+	if err != nil {
+		return network, err
+	}
+	subnet, ok := subnetFor(network, excluded.Start)
+	if !ok || !subnet.Contains(excluded.End) {
+		return network, requestError("range is not within network " + network.Name)
+	}
+	if bytes.Compare(excluded.Start.To16(), excluded.End.To16()) > 0 {
+		return network, requestError("range start is after range end")
+	}
+	for _, peer := range network.Peers {
+		for _, address := range peer.Addresses() {
+			if excluded.Contains(address.IP) {
+				return network, requestError("range includes address of " + peer.HostName)
+			}
+		}
+	}
+	for _, reservation := range network.Reservations {
+		if excluded.Contains(reservation.Address) {
+			return network, requestError("range includes reservation " + reservation.Address.String())
+		}
+	}
+	for _, existing := range network.Excluded {
+		if existing.Contains(excluded.Start) || existing.Contains(excluded.End) ||
+			excluded.Contains(existing.Start) {
+			return network, requestError("range overlaps excluded range " +
+				existing.Start.String() + "-" + existing.End.String())
+		}
+	}
+	before := network
+	before.Excluded = slices.Clone(network.Excluded)
+	network.Excluded = append(network.Excluded, excluded)
+	slices.SortFunc(network.Excluded, func(a, b plexus.AddressRange) int {
+		return bytes.Compare(a.Start.To16(), b.Start.To16())
+	})
+	if err := save(network, network.Name, networkTable); err != nil {
+		return network, fmt.Errorf("save network %w", err)
+	}
+	slog.Info("address range excluded", "network", network.Name, "start", excluded.Start, "end", excluded.End)
+	audit(actor, "network.exclude.add", network.Name+"/"+excluded.Start.String(), before, network)
+	return network, nil
+}
+
+// removeExclusion removes the excluded range starting at start.
+func removeExclusion(actor, networkName string, start net.IP) (plexus.Network, error) {
+	network, err := boltdb.Get[plexus.Network](networkName, networkTable)
+	if err != nil {
+		return network, err
+	}
+	before := network
+	before.Excluded = slices.Clone(network.Excluded)
+	index := slices.IndexFunc(network.Excluded, func(r plexus.AddressRange) bool {
+		return r.Start.Equal(start)
+	})
+	if index < 0 {
+		return network, requestError("no excluded range starting at " + start.String())
+	}
+	network.Excluded = slices.Delete(network.Excluded, index, index+1)
+	if err := save(network, network.Name, networkTable); err != nil {
+		return network, fmt.Errorf("save network %w", err)
+	}
+	audit(actor, "network.exclude.remove", network.Name+"/"+start.String(), before, network)
+	return network, nil
+}
+
+// networkIPAM returns the address usage of network.
+func networkIPAM(network plexus.Network) IPAM {
+	ipam := IPAM{
+		Network:      network.Name,
+		Subnets:      []SubnetUsage{},
+		Reservations: []ReservationStatus{},
+		Excluded:     network.Excluded,
+	}
+	if ipam.Excluded == nil {
+		ipam.Excluded = []plexus.AddressRange{}
+	}
+	for _, reservation := range network.Reservations {
+		status := ReservationStatus{Reservation: reservation}
+		for _, peer := range network.Peers {
+			if peer.WGPublicKey == reservation.WGPublicKey {
+				status.HostName = peer.HostName
+				status.InUse = reservation.Address.Equal(peerAddress(peer, reservation.Address))
+			}
+		}
+		ipam.Reservations = append(ipam.Reservations, status)
+	}
+	for _, subnet := range network.Nets() {
+		usage := SubnetUsage{Subnet: subnet.String(), Size: subnetSize(subnet)}
+		for _, peer := range network.Peers {
+			for _, address := range peer.Addresses() {
+				if subnet.Contains(address.IP) {
+					usage.Used++
+				}
+			}
+		}
+		for _, reservation := range ipam.Reservations {
+			if subnet.Contains(reservation.Address) && !reservation.InUse {
+				usage.Reserved++
+			}
+		}
+		for _, r := range network.Excluded {
+			if subnet.Contains(r.Start) {
+				usage.Excluded = saturatingAdd(usage.Excluded, rangeSize(r))
+			}
+		}
+		usage.Free = usage.Size
+		for _, n := range []uint64{usage.Used, usage.Reserved, usage.Excluded} {
+			if usage.Free == math.MaxUint64 {
+				break
+			}
+			usage.Free -= min(n, usage.Free)
+		}
+		ipam.Subnets = append(ipam.Subnets, usage)
+	}
+	return ipam
+}
+
+// subnetSize returns the number of assignable addresses in subnet.
+func subnetSize(subnet net.IPNet) uint64 {
+	ones, bits := subnet.Mask.Size()
+	if bits-ones >= 64 {
+		return math.MaxUint64
+	}
+	size := uint64(1) << (bits - ones)
+	if bits == 32 {
+		// network and broadcast address.
+		return max(size, 2) - 2
+	}
+	return size - 1
+}
+
+// rangeSize returns the number of addresses in r.
+func rangeSize(r plexus.AddressRange) uint64 {
+	start, end := r.Start.To16(), r.End.To16()
+	if !bytes.Equal(start[:8], end[:8]) {
+		return math.MaxUint64
+	}
+	return saturatingAdd(binary.BigEndian.Uint64(end[8:])-binary.BigEndian.Uint64(start[8:]), 1)
+}
+
+func saturatingAdd(a, b uint64) uint64 {
+	if a > math.MaxUint64-b {
+		return math.MaxUint64
+	}
+	return a + b
+}
+
+func addReservation(w http.ResponseWriter, r *http.Request) {
+	address, err := parseAddress(r.FormValue("address"))
+	if err != nil {
+		processError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	reservation := plexus.Reservation{
+		WGPublicKey: r.FormValue("key"),
+		Address:     address,
+		Description: r.FormValue("description"),
+	}
+	if _, err := createReservation(userActor(r), r.PathValue("id"), reservation); err != nil {
+		processError(w, errorStatus(err), err.Error())
+		return
+	}
+	networkDetails(w, r)
+}
+
+func deleteReservation(w http.ResponseWriter, r *http.Request) {
+	address, err := parseAddress(r.PathValue("address"))
+	if err != nil {
+		processError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if _, err := removeReservation(userActor(r), r.PathValue("id"), address); err != nil {
+		processError(w, errorStatus(err), err.Error())
+		return
+	}
+	networkDetails(w, r)
+}
+
+func addExclusion(w http.ResponseWriter, r *http.Request) {
+	start, err := parseAddress(r.FormValue("start"))
+	if err != nil {
+		processError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	end := start
+	if r.FormValue("end") != "" {
+		end, err = parseAddress(r.FormValue("end"))
+		if err != nil {
+			processError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+	excluded := plexus.AddressRange{
+		Start:       start,
+		End:         end,
+		Description: r.FormValue("description"),
+	}
+	if _, err := createExclusion(userActor(r), r.PathValue("id"), excluded); err != nil {
+		processError(w, errorStatus(err), err.Error())
+		return
+	}
+	networkDetails(w, r)
+}
+
+func deleteExclusion(w http.ResponseWriter, r *http.Request) {
+	start, err := parseAddress(r.PathValue("start"))
+	if err != nil {
+		processError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if _, err := removeExclusion(userActor(r), r.PathValue("id"), start); err != nil {
+		processError(w, errorStatus(err), err.Error())
+		return
+	}
+	networkDetails(w, r)
+}
@@ -0,0 +1,184 @@
+package server
+
+import (
+	"encoding/json"
+	"math"
+	"net"
+	"net/http"
+	"testing"
+
+	"github.com/Kairum-Labs/should"
+	"github.com/devilcove/boltdb"
+	"github.com/devilcove/plexus"
+)
+
+func TestReservations(t *testing.T) {
+	setup(t)
+	defer shutdown(t)
+	deleteAllNetworks(t)
+	deleteAllPeers(t)
+	defer deleteAllNetworks(t)
+	defer deleteAllPeers(t)
+	createTestNetwork(t)
+	createTestNetworkPeer(t)
+	reserved := createTestPeer(t)
+
+	t.Run("invalid", func(t *testing.T) {
+		for address, message := range map[string]string{
+			"10.200.0.0":   "not assignable",
+			"10.200.0.255": "not assignable",
+			"10.201.0.1":   "not assignable",
+			"10.200.0.1":   "address in use by testing",
+		} {
+			_, err := createReservation("admin", "valid", plexus.Reservation{
+				WGPublicKey: reserved,
+				Address:     net.ParseIP(address),
+			})
+			should.BeError(t, err)
+			should.ContainSubstring(t, err.Error(), message)
+			should.BeEqual(t, errorStatus(err), http.StatusBadRequest)
+		}
+		_, err := createReservation("admin", "valid", plexus.Reservation{
+			WGPublicKey: "bad key",
+			Address:     net.ParseIP("10.200.0.50"),
+		})
+		should.BeError(t, err)
+		should.ContainSubstring(t, err.Error(), "invalid wireguard key")
+	})
+	t.Run("valid", func(t *testing.T) {
+		network, err := createReservation("admin", "valid", plexus.Reservation{
+			WGPublicKey: reserved,
+			Address:     net.ParseIP("10.200.0.50"),
+			Description: "printer",
+		})
+		should.NotBeError(t, err)
+		should.BeEqual(t, len(network.Reservations), 1)
+		_, err = createReservation("admin", "valid", plexus.Reservation{
+			WGPublicKey: reserved,
+			Address:     net.ParseIP("10.200.0.51"),
+		})
+		should.BeError(t, err)
+		should.ContainSubstring(t, err.Error(), "peer already has reservation")
+	})
+	t.Run("exclusions", func(t *testing.T) {
+		_, err := createExclusion("admin", "valid", plexus.AddressRange{
+			Start: net.ParseIP("10.200.0.40"), End: net.ParseIP("10.200.0.60"),
+		})
+		should.BeError(t, err)
+		should.ContainSubstring(t, err.Error(), "range includes reservation")
+		_, err = createExclusion("admin", "valid", plexus.AddressRange{
+			Start: net.ParseIP("10.200.0.1"), End: net.ParseIP("10.200.0.9"),
+		})
+		should.BeError(t, err)
+		should.ContainSubstring(t, err.Error(), "range includes address of testing")
+		_, err = createExclusion("admin", "valid", plexus.AddressRange{
+			Start: net.ParseIP("10.200.0.9"), End: net.ParseIP("10.200.0.2"),
+		})
+		should.BeError(t, err)
+		should.ContainSubstring(t, err.Error(), "range start is after range end")
+		_, err = createExclusion("admin", "valid", plexus.AddressRange{
+			Start: net.ParseIP("10.200.0.2"), End: net.ParseIP("10.200.0.9"), Description: "gateways",
+		})
+		should.NotBeError(t, err)
+		_, err = createExclusion("admin", "valid", plexus.AddressRange{
+			Start: net.ParseIP("10.200.0.9"), End: net.ParseIP("10.200.0.12"),
+		})
+		should.BeError(t, err)
+		should.ContainSubstring(t, err.Error(), "overlaps excluded range")
+	})
+	t.Run("assignment", func(t *testing.T) {
+		next := createTestPeer(t)
+		network, err := addPeerToNetwork("admin", next, "valid", 51821, 51821)
+		should.NotBeError(t, err)
+		should.BeEqual(t, network.Peers[1].Address.IP.String(), "10.200.0.10")
+		network, err = addPeerToNetwork("admin", reserved, "valid", 51821, 51821)
+		should.NotBeError(t, err)
+		should.BeEqual(t, network.Peers[2].Address.IP.String(), "10.200.0.50")
+		ipam := networkIPAM(network)
+		should.BeEqual(t, ipam.Subnets, []SubnetUsage{{
+			Subnet: "10.200.0.0/24", Size: 254, Used: 3, Reserved: 0, Excluded: 8, Free: 243,
+		}})
+		should.BeTrue(t, ipam.Reservations[0].InUse)
+		should.BeEqual(t, ipam.Reservations[0].HostName, "testing")
+	})
+	t.Run("remove", func(t *testing.T) {
+		_, err := removeReservation("admin", "valid", net.ParseIP("10.200.0.60"))
+		should.BeError(t, err)
+		network, err := removeReservation("admin", "valid", net.ParseIP("10.200.0.50"))
+		should.NotBeError(t, err)
+		should.BeEqual(t, len(network.Reservations), 0)
+		network, err = removeExclusion("admin", "valid", net.ParseIP("10.200.0.2"))
+		should.NotBeError(t, err)
+		should.BeEqual(t, len(network.Excluded), 0)
+		// the peer keeps its address.
+		should.BeEqual(t, network.Peers[2].Address.IP.String(), "10.200.0.50")
+	})
+}
+
+func TestAPIIPAM(t *testing.T) {
+	setup(t)
+	defer shutdown(t)
+	deleteAllUsers(t)
+	deleteAllNetworks(t)
+	deleteAllPeers(t)
+	defer deleteAllNetworks(t)
+	defer deleteAllPeers(t)
+	createTestNetwork(t)
+	peer := createTestPeer(t)
+	admin := plexus.User{Username: "admin", Password: "pass", IsAdmin: true}
+	createTestUser(t, admin)
+	cookie := testLogin(t, admin)
+
+	w := apiRequest(t, cookie, http.MethodPost, "/api/v1/networks/valid/reservations",
+		`{"WGPublicKey":"`+peer+`","Address":"10.200.0.20"}`)
+	should.BeEqual(t, w.Code, http.StatusCreated)
+	w = apiRequest(t, cookie, http.MethodPost, "/api/v1/networks/valid/excluded",
+		`{"Start":"10.200.0.1"}`)
+	should.BeEqual(t, w.Code, http.StatusCreated)
+	w = apiRequest(t, cookie, http.MethodPost, "/api/v1/networks/valid/excluded",
+		`{"Start":"10.200.0.20","End":"10.200.0.30"}`)
+	should.BeEqual(t, w.Code, http.StatusBadRequest)
+	w = apiRequest(t, cookie, http.MethodGet, "/api/v1/networks/valid/ipam", "")
+	should.BeEqual(t, w.Code, http.StatusOK)
+	ipam := IPAM{}
+	should.NotBeError(t, json.NewDecoder(w.Body).Decode(&ipam))
+	should.BeEqual(t, ipam.Subnets[0].Reserved, uint64(1))
+	should.BeEqual(t, ipam.Subnets[0].Excluded, uint64(1))
+	should.BeEqual(t, ipam.Subnets[0].Free, uint64(252))
+	should.BeEqual(t, ipam.Reservations[0].WGPublicKey, peer)
+	should.BeFalse(t, ipam.Reservations[0].InUse)
+
+	w = apiRequest(t, cookie, http.MethodGet, "/networks/details/valid", "")
+	should.BeEqual(t, w.Code, http.StatusOK)
+	should.ContainSubstring(t, w.Body.String(), "<h2>Addresses</h2>")
+	should.ContainSubstring(t, w.Body.String(), "10.200.0.20")
+
+	w = apiRequest(t, cookie, http.MethodDelete, "/api/v1/networks/valid/reservations/10.200.0.20", "")
+	should.BeEqual(t, w.Code, http.StatusNoContent)
+	w = apiRequest(t, cookie, http.MethodDelete, "/api/v1/networks/valid/excluded/10.200.0.1", "")
+	should.BeEqual(t, w.Code, http.StatusNoContent)
+	network, err := boltdb.Get[plexus.Network]("valid", networkTable)
+	should.NotBeError(t, err)
+	should.BeEqual(t, len(network.Reservations), 0)
+	should.BeEqual(t, len(network.Excluded), 0)
+}
+
+func TestSubnetSize(t *testing.T) {
+	for cidr, size := range map[string]uint64{
+		"10.0.0.0/24":   254,
+		"10.0.0.0/31":   0,
+		"fd00::/120":    255,
+		"fd00::/64":     math.MaxUint64,
+		"172.16.0.0/12": 1<<20 - 2,
+	} {
+		_, subnet, err := net.ParseCIDR(cidr)
+		should.NotBeError(t, err)
+		should.BeEqual(t, subnetSize(*subnet), size)
+	}
+	should.BeEqual(t, rangeSize(plexus.AddressRange{
+		Start: net.ParseIP("fd00::1"), End: net.ParseIP("fd00::1:0"),
+	}), uint64(65536))
+	should.BeEqual(t, rangeSize(plexus.AddressRange{
+		Start: net.ParseIP("fd00::"), End: net.ParseIP("fd00:0:0:1::"),
+	}), uint64(math.MaxUint64))
+}
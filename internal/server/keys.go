@@ -4,6 +4,7 @@ import (
 	"encoding/base64"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"log/slog"
 	"net/http"
 	"regexp"
@@ -26,32 +27,64 @@ func displayCreateKey(w http.ResponseWriter, r *http.Request) {
 }
 
 func addKey(w http.ResponseWriter, r *http.Request) {
-	var err error
 	usage, err := strconv.Atoi(r.FormValue("usage"))
 	if err != nil {
 		usage = 1
 	}
 	key := plexus.Key{
-		Name:    r.FormValue("name"),
-		Usage:   usage,
-		DispExp: r.FormValue("expires"),
+		Name:      r.FormValue("name"),
+		Usage:     usage,
+		DispExp:   r.FormValue("expires"),
+		Tags:      parseLabels(r.FormValue("tags")),
+		Groups:    parseLabels(r.FormValue("groups")),
+		Networks:  parseLabels(r.FormValue("networks")),
+		Relay:     r.FormValue("relay"),
+		Router:    r.FormValue("router"),
+		RouterNat: r.FormValue("routernat") == "on",
+		Approval:  r.FormValue("approval") == "on",
+	}
+	if err := keyNetworksAllowed(GetSessionData(r), key); err != nil {
+		processError(w, http.StatusForbidden, err.Error())
+		return
 	}
+	if _, err := createKey(userActor(r), key); err != nil {
+		processError(w, errorStatus(err), err.Error())
+		return
+	}
+	displayKeys(w, r)
+}
+
+// createKey validates a new registration key, generates its value and saves it.
+func createKey(actor string, key plexus.Key) (plexus.Key, error) {
+	var err error
 	key.Expires, err = time.Parse("2006-01-02", key.DispExp)
 	if err != nil {
-		processError(w, http.StatusBadRequest, "invalid key "+err.Error())
-		return
+		return key, requestError("invalid key " + err.Error())
 	}
 	if err := validateKey(key); err != nil {
-		processError(w, http.StatusBadRequest, "invalid key "+err.Error())
-		return
+		return key, requestError("invalid key " + err.Error())
+	}
+	key.Tags, key.Groups, err = validateLabels(key.Tags, key.Groups)
+	if err != nil {
+		return key, err
+	}
+	key, err = validateKeyNetworks(key)
+	if err != nil {
+		return key, err
+	}
+	existing, err := boltdb.Get[plexus.Key](key.Name, keyTable)
+	if err != nil && !errors.Is(err, boltdb.ErrNoResults) {
+		return key, fmt.Errorf("retrieve key %w", err)
+	}
+	if existing.Name != "" {
+		return key, requestError("key exists with name:" + existing.Name)
 	}
 	key.Value, err = newValue(key.Name)
 	if err != nil {
-		processError(w, http.StatusInternalServerError, "unable to encode key"+err.Error())
-		return
+		return key, fmt.Errorf("unable to encode key %w", err)
 	}
 	if err := addDevice(key.Value); err != nil {
-		processError(w, http.StatusInternalServerError, "unable to add device"+err.Error())
+		return key, fmt.Errorf("unable to add device %w", err)
 	}
 	if key.Usage == 0 {
 		key.Usage = 1
@@ -59,29 +92,21 @@ func addKey(w http.ResponseWriter, r *http.Request) {
 	if key.Expires.IsZero() {
 		key.Expires = time.Now().Add(keyExpiry)
 	}
-	existing, err := boltdb.Get[plexus.Key](key.Name, keyTable)
-	if err != nil && !errors.Is(err, boltdb.ErrNoResults) {
-		processError(w, http.StatusInternalServerError, "retrieve key"+err.Error())
-		return
-	}
-	if existing.Name != "" {
-		processError(w, http.StatusBadRequest, "key exists with name:"+existing.Name)
-		return
-	}
-	if err := boltdb.Save(key, key.Name, keyTable); err != nil {
-		processError(w, http.StatusInternalServerError, "saving key "+err.Error())
-		return
+	key.Creator = actor
+	if err := save(key, key.Name, keyTable); err != nil {
+		return key, fmt.Errorf("saving key %w", err)
 	}
-	displayKeys(w, r)
+	audit(actor, "key.create", key.Name, nil, auditKeyValue(key))
+	return key, nil
 }
 
-func displayKeys(w http.ResponseWriter, _ *http.Request) {
+func displayKeys(w http.ResponseWriter, r *http.Request) {
 	keys, err := boltdb.GetAll[plexus.Key](keyTable)
 	if err != nil {
 		processError(w, http.StatusInternalServerError, err.Error())
 		return
 	}
-	render(w, keyTable, keys)
+	render(w, keyTable, visibleKeys(GetSessionData(r), keys))
 }
 
 func deleteKey(w http.ResponseWriter, r *http.Request) {
@@ -91,7 +116,11 @@ func deleteKey(w http.ResponseWriter, r *http.Request) {
 		processError(w, http.StatusBadRequest, "key does not exist")
 		return
 	}
-	if err := removeKey(key); err != nil {
+	if err := keyNetworksAllowed(GetSessionData(r), key); err != nil {
+		processError(w, http.StatusForbidden, err.Error())
+		return
+	}
+	if err := removeKey(userActor(r), key); err != nil {
 		processError(w, http.StatusInternalServerError, "delete key "+err.Error())
 		return
 	}
@@ -126,6 +155,9 @@ func newValue(name string) (string, error) {
 		URL:     config.FQDN,
 		Seed:    string(seed),
 		KeyName: name,
+		Stun:    stunAddress(config),
+		Relay:   relayAddress(config),
+		Servers: clusterServers(config),
 	}
 	payload, err := json.Marshal(&keyValue)
 	if err != nil {
@@ -134,21 +166,30 @@ func newValue(name string) (string, error) {
 	return base64.StdEncoding.EncodeToString(payload), nil
 }
 
-func decrementKeyUsage(name string) error {
+func decrementKeyUsage(actor, name string) error {
 	key, err := boltdb.Get[plexus.Key](name, keyTable)
 	if err != nil {
 		return err
 	}
+	before := auditKeyValue(key)
 	if key.Usage == 1 {
-		return removeKey(key)
+		audit(actor, "key.use", key.Name, before, nil)
+		return removeKey(actor, key)
 	}
 	key.Usage--
-	if err := boltdb.Save(key, key.Name, keyTable); err != nil {
+	if err := save(key, key.Name, keyTable); err != nil {
 		return err
 	}
+	audit(actor, "key.use", key.Name, before, auditKeyValue(key))
 	return nil
 }
 
+// auditKeyValue returns key without the secret value for recording in the audit log.
+func auditKeyValue(key plexus.Key) plexus.Key {
+	key.Value = ""
+	return key
+}
+
 func expireKeys() {
 	slog.Debug("checking for expired keys")
 	keys, err := boltdb.GetAll[plexus.Key](keyTable)
@@ -162,25 +203,29 @@ func expireKeys() {
 				"key", key.Name,
 				"expiry time", key.Expires.Format(time.RFC822),
 			)
-			if err := removeKey(key); err != nil {
+			if err := removeKey(actorSystem, key); err != nil {
 				slog.Error("remove key", "error", err)
 			}
 		}
 	}
 }
 
-func removeKey(key plexus.Key) error {
+func removeKey(actor string, key plexus.Key) error {
 	var errs error
-	if err := boltdb.Delete[plexus.Key](key.Name, keyTable); err != nil {
+	if err := remove(key.Name, keyTable); err != nil {
 		slog.Error("delete key from db", "error", err)
 		errs = errors.Join(errs, err)
+	} else {
+		audit(actor, "key.delete", key.Name, auditKeyValue(key), nil)
 	}
 	token, err := plexus.DecodeToken(key.Value)
 	if err != nil {
 		errs = errors.Join(errs, err)
 		return errs
 	}
-	pk := createNkeyUser(token.Seed)
+	pk := createNkeyUser(token.Seed, key.Name)
+	nkeysLock.Lock()
+	defer nkeysLock.Unlock()
 	for i, nkey := range natsOptions.Nkeys {
 		if nkey == nil {
 			continue
@@ -212,9 +257,11 @@ func addDevice(token string) error {
 		slog.Error("publickey", "error", err)
 		return err
 	}
+	nkeysLock.Lock()
+	defer nkeysLock.Unlock()
 	natsOptions.Nkeys = append(natsOptions.Nkeys, &server.NkeyUser{
 		Nkey:        nPubKey,
-		Permissions: registerPermissions(),
+		Permissions: registerPermissions(keyValue.KeyName),
 	})
 	return natServer.ReloadOptions(natsOptions)
 }
@@ -1,6 +1,7 @@
 package server
 
 import (
+	"encoding/json"
 	"errors"
 	"io"
 	"net/http"
@@ -12,12 +13,15 @@ import (
 	"github.com/Kairum-Labs/should"
 	"github.com/devilcove/boltdb"
 	"github.com/devilcove/plexus"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nkeys"
 )
 
 func TestDisplayKeys(t *testing.T) {
 	user := plexus.User{
 		Username: "hello",
 		Password: "world",
+		IsAdmin:  true,
 	}
 	createTestUser(t, user)
 	r := httptest.NewRequest(http.MethodGet, "/keys/", nil)
@@ -34,6 +38,7 @@ func TestDisplayAddKey(t *testing.T) {
 	user := plexus.User{
 		Username: "hello",
 		Password: "world",
+		IsAdmin:  true,
 	}
 	createTestUser(t, user)
 	cookie := testLogin(t, user)
@@ -53,6 +58,7 @@ func TestAddKey(t *testing.T) {
 	user := plexus.User{
 		Username: "hello",
 		Password: "world",
+		IsAdmin:  true,
 	}
 	createTestUser(t, user)
 	cookie := testLogin(t, user)
@@ -176,6 +182,7 @@ func TestDeleteKeys(t *testing.T) {
 	user := plexus.User{
 		Username: "hello",
 		Password: "world",
+		IsAdmin:  true,
 	}
 	createTestUser(t, user)
 	cookie := testLogin(t, user)
@@ -234,19 +241,19 @@ func TestUpdateKey(t *testing.T) {
 	err = boltdb.Save(key2, key2.Name, keyTable)
 	should.NotBeError(t, err)
 	t.Run("keyDoesNotExist", func(t *testing.T) {
-		err := decrementKeyUsage("doesnotexist")
+		err := decrementKeyUsage(actorSystem, "doesnotexist")
 		should.NotBeNil(t, err)
 		should.BeTrue(t, errors.Is(err, boltdb.ErrNoResults))
 	})
 	t.Run("deleteKey", func(t *testing.T) {
-		err := decrementKeyUsage(key1.Name)
+		err := decrementKeyUsage(actorSystem, key1.Name)
 		should.NotBeError(t, err)
 		newKey, err := boltdb.Get[plexus.Key](key1.Name, keyTable)
 		should.BeEqual(t, newKey, plexus.Key{})
 		should.BeTrue(t, errors.Is(err, boltdb.ErrNoResults))
 	})
 	t.Run("decrement usage", func(t *testing.T) {
-		err := decrementKeyUsage(key2.Name)
+		err := decrementKeyUsage(actorSystem, key2.Name)
 		should.NotBeError(t, err)
 	})
 	deleteAllKeys(t)
@@ -269,3 +276,73 @@ func TestExpireKeys(t *testing.T) {
 	should.NotBeError(t, err)
 	should.BeEqual(t, len(keys), 0)
 }
+
+func TestRegisterKeySubject(t *testing.T) {
+	setup(t)
+	defer shutdown(t)
+	deleteAllKeys(t)
+	deleteAllPeers(t)
+	defer deleteAllKeys(t)
+	defer deleteAllPeers(t)
+	expires := time.Now().Add(time.Hour).Format("2006-01-02")
+	mine, err := createKey("admin", plexus.Key{Name: "mine", Usage: 2, DispExp: expires})
+	should.NotBeError(t, err)
+	_, err = createKey("admin", plexus.Key{Name: "other", DispExp: expires, Tags: []string{"other"}})
+	should.NotBeError(t, err)
+	sub, err := natsConn.QueueSubscribe(plexus.RegisterKey+"*", serverQueue, subscribeRegister)
+	should.NotBeError(t, err)
+	defer func() {
+		_ = sub.Unsubscribe()
+	}()
+	token, err := plexus.DecodeToken(mine.Value)
+	should.NotBeError(t, err)
+	kp, err := nkeys.FromSeed([]byte(token.Seed))
+	should.NotBeError(t, err)
+	public, err := kp.PublicKey()
+	should.NotBeError(t, err)
+	conn, err := nats.Connect("nats://127.0.0.1:4222", nats.Nkey(public, kp.Sign))
+	should.NotBeError(t, err)
+	defer conn.Close()
+	pub, err := generateKeys()
+	should.NotBeError(t, err)
+	request, err := json.Marshal(plexus.ServerRegisterRequest{
+		Peer:    plexus.Peer{WGPublicKey: pub.String(), Name: "device"},
+		KeyName: "other",
+	})
+	should.NotBeError(t, err)
+
+	t.Run("otherKey", func(t *testing.T) {
+		_, err := conn.Request(plexus.RegisterKey+"other", request, time.Millisecond*200)
+		should.BeError(t, err)
+		_, err = boltdb.Get[plexus.Peer](pub.String(), peerTable)
+		should.BeError(t, err)
+	})
+	t.Run("unknownKey", func(t *testing.T) {
+		response := registerHandler("missing", &plexus.ServerRegisterRequest{Peer: plexus.Peer{WGPublicKey: pub.String()}})
+		should.BeEqual(t, response.Message, "error: unknown registration key")
+	})
+	t.Run("ownKey", func(t *testing.T) {
+		msg, err := conn.Request(plexus.RegisterKey+"mine", request, time.Second)
+		should.NotBeError(t, err)
+		response := plexus.MessageResponse{}
+		should.NotBeError(t, json.Unmarshal(msg.Data, &response))
+		should.BeEqual(t, response.Message, "registration successful")
+		peer, err := boltdb.Get[plexus.Peer](pub.String(), peerTable)
+		should.NotBeError(t, err)
+		should.BeEqual(t, len(peer.Tags), 0)
+		// the key is used after the reply is sent.
+		used := false
+		for range 50 {
+			key, err := boltdb.Get[plexus.Key]("mine", keyTable)
+			should.NotBeError(t, err)
+			if used = key.Usage == 1; used {
+				break
+			}
+			time.Sleep(time.Millisecond * 10)
+		}
+		should.BeTrue(t, used)
+		other, err := boltdb.Get[plexus.Key]("other", keyTable)
+		should.NotBeError(t, err)
+		should.BeEqual(t, other.Usage, 1)
+	})
+}
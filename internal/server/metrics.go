@@ -0,0 +1,193 @@
+package server
+
+import (
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/devilcove/boltdb"
+	"github.com/devilcove/plexus"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const (
+	metricsNamespace = "plexus"
+	checkinProcessed = "checkin processed"
+)
+
+var (
+	checkinTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "checkins_total",
+		Help:      "Number of peer checkins processed, by result.",
+	}, []string{"result"})
+	checkinDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "checkin_duration_seconds",
+		Help:      "Time taken to process a peer checkin.",
+		Buckets:   prometheus.ExponentialBuckets(0.0005, 2, 12),
+	})
+)
+
+var (
+	peersDesc = prometheus.NewDesc(metricsNamespace+"_peers",
+		"Number of registered peers.", nil, nil)
+	peersConnectedDesc = prometheus.NewDesc(metricsNamespace+"_peers_nats_connected",
+		"Number of peers that responded to the last nats ping or checkin.", nil, nil)
+	networksDesc = prometheus.NewDesc(metricsNamespace+"_networks",
+		"Number of networks.", nil, nil)
+	networkPeersDesc = prometheus.NewDesc(metricsNamespace+"_network_peers",
+		"Number of peers in a network.", []string{"network"}, nil)
+	networkConnectivityDesc = prometheus.NewDesc(metricsNamespace+"_network_connectivity",
+		"Average connectivity (0-1) reported by the peers of a network.", []string{"network"}, nil)
+	keysDesc = prometheus.NewDesc(metricsNamespace+"_keys",
+		"Number of registration keys.", nil, nil)
+	keyUsesDesc = prometheus.NewDesc(metricsNamespace+"_key_uses_remaining",
+		"Remaining uses of a registration key.", []string{"key"}, nil)
+	keyExpiryDesc = prometheus.NewDesc(metricsNamespace+"_key_expiry_timestamp_seconds",
+		"Expiry time of a registration key.", []string{"key"}, nil)
+	natsConnectionsDesc = prometheus.NewDesc(metricsNamespace+"_nats_connections",
+		"Current connections to the embedded nats server.", nil, nil)
+	natsTotalConnectionsDesc = prometheus.NewDesc(metricsNamespace+"_nats_connections_total",
+		"Connections handled by the embedded nats server since start.", nil, nil)
+	natsSubscriptionsDesc = prometheus.NewDesc(metricsNamespace+"_nats_subscriptions",
+		"Current subscriptions on the embedded nats server.", nil, nil)
+	natsMsgsDesc = prometheus.NewDesc(metricsNamespace+"_nats_messages_total",
+		"Messages handled by the embedded nats server, by direction.", []string{"direction"}, nil)
+	natsBytesDesc = prometheus.NewDesc(metricsNamespace+"_nats_bytes_total",
+		"Bytes handled by the embedded nats server, by direction.", []string{"direction"}, nil)
+	natsSlowConsumersDesc = prometheus.NewDesc(metricsNamespace+"_nats_slow_consumers_total",
+		"Clients disconnected by the embedded nats server for being slow consumers.", nil, nil)
+)
+
+// plexusCollector reads fleet state from the database and the embedded nats server on each scrape.
+type plexusCollector struct{}
+
+func newMetricsRegistry() *prometheus.Registry {
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		checkinTotal,
+		checkinDuration,
+		plexusCollector{},
+	)
+	return registry
+}
+
+func (plexusCollector) Describe(ch chan<- *prometheus.Desc) {
+	for _, desc := range []*prometheus.Desc{
+		peersDesc, peersConnectedDesc, networksDesc, networkPeersDesc, networkConnectivityDesc,
+		keysDesc, keyUsesDesc, keyExpiryDesc, natsConnectionsDesc, natsTotalConnectionsDesc,
+		natsSubscriptionsDesc, natsMsgsDesc, natsBytesDesc, natsSlowConsumersDesc,
+	} {
+		ch <- desc
+	}
+}
+
+func (plexusCollector) Collect(ch chan<- prometheus.Metric) {
+	collectPeers(ch)
+	collectNetworks(ch)
+	collectKeys(ch)
+	collectNats(ch)
+}
+
+func collectPeers(ch chan<- prometheus.Metric) {
+	peers, err := boltdb.GetAll[plexus.Peer](peerTable)
+	if err != nil {
+		slog.Error("metrics: get peers", "error", err)
+		return
+	}
+	connected := 0
+	for _, peer := range peers {
+		if peer.NatsConnected {
+			connected++
+		}
+	}
+	ch <- prometheus.MustNewConstMetric(peersDesc, prometheus.GaugeValue, float64(len(peers)))
+	ch <- prometheus.MustNewConstMetric(peersConnectedDesc, prometheus.GaugeValue, float64(connected))
+}
+
+func collectNetworks(ch chan<- prometheus.Metric) {
+	networks, err := boltdb.GetAll[plexus.Network](networkTable)
+	if err != nil {
+		slog.Error("metrics: get networks", "error", err)
+		return
+	}
+	ch <- prometheus.MustNewConstMetric(networksDesc, prometheus.GaugeValue, float64(len(networks)))
+	for _, network := range networks {
+		ch <- prometheus.MustNewConstMetric(networkPeersDesc, prometheus.GaugeValue,
+			float64(len(network.Peers)), network.Name)
+		if len(network.Peers) == 0 {
+			continue
+		}
+		total := 0.0
+		for _, peer := range network.Peers {
+			total += peer.Connectivity
+		}
+		ch <- prometheus.MustNewConstMetric(networkConnectivityDesc, prometheus.GaugeValue,
+			total/float64(len(network.Peers)), network.Name)
+	}
+}
+
+func collectKeys(ch chan<- prometheus.Metric) {
+	keys, err := boltdb.GetAll[plexus.Key](keyTable)
+	if err != nil {
+		slog.Error("metrics: get keys", "error", err)
+		return
+	}
+	ch <- prometheus.MustNewConstMetric(keysDesc, prometheus.GaugeValue, float64(len(keys)))
+	for _, key := range keys {
+		ch <- prometheus.MustNewConstMetric(keyUsesDesc, prometheus.GaugeValue,
+			float64(key.Usage), key.Name)
+		ch <- prometheus.MustNewConstMetric(keyExpiryDesc, prometheus.GaugeValue,
+			float64(key.Expires.Unix()), key.Name)
+	}
+}
+
+func collectNats(ch chan<- prometheus.Metric) {
+	if natServer == nil {
+		return
+	}
+	varz, err := natServer.Varz(nil)
+	if err != nil {
+		slog.Error("metrics: nats varz", "error", err)
+		return
+	}
+	ch <- prometheus.MustNewConstMetric(natsConnectionsDesc, prometheus.GaugeValue,
+		float64(varz.Connections))
+	ch <- prometheus.MustNewConstMetric(natsTotalConnectionsDesc, prometheus.CounterValue,
+		float64(varz.TotalConnections))
+	ch <- prometheus.MustNewConstMetric(natsSubscriptionsDesc, prometheus.GaugeValue,
+		float64(natServer.NumSubscriptions()))
+	ch <- prometheus.MustNewConstMetric(natsMsgsDesc, prometheus.CounterValue, float64(varz.InMsgs), "in")
+	ch <- prometheus.MustNewConstMetric(natsMsgsDesc, prometheus.CounterValue, float64(varz.OutMsgs), "out")
+	ch <- prometheus.MustNewConstMetric(natsBytesDesc, prometheus.CounterValue, float64(varz.InBytes), "in")
+	ch <- prometheus.MustNewConstMetric(natsBytesDesc, prometheus.CounterValue, float64(varz.OutBytes), "out")
+	ch <- prometheus.MustNewConstMetric(natsSlowConsumersDesc, prometheus.CounterValue,
+		float64(varz.SlowConsumers))
+}
+
+// observeCheckin records the outcome and duration of a checkin started at start.
+func observeCheckin(start time.Time, response plexus.MessageResponse) {
+	result := "ok"
+	if response.Message != checkinProcessed {
+		result = "error"
+	}
+	checkinTotal.WithLabelValues(result).Inc()
+	checkinDuration.Observe(time.Since(start).Seconds())
+}
+
+// metricsHandler serves prometheus metrics to admin users and admin api tokens.
+func metricsHandler() http.Handler {
+	handler := promhttp.HandlerFor(newMetricsRegistry(), promhttp.HandlerOpts{})
+	return apiAuth(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !GetSessionData(r).IsAdmin {
+			apiError(w, http.StatusForbidden, "admin rights required")
+			return
+		}
+		handler.ServeHTTP(w, r)
+	}))
+}
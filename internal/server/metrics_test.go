@@ -0,0 +1,61 @@
+package server
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/Kairum-Labs/should"
+	"github.com/devilcove/plexus"
+)
+
+func TestMetrics(t *testing.T) {
+	setup(t)
+	defer shutdown(t)
+	deleteAllUsers(t)
+	deleteAllNetworks(t)
+	deleteAllPeers(t)
+	deleteAllTokens(t)
+	defer deleteAllNetworks(t)
+	defer deleteAllPeers(t)
+	defer deleteAllTokens(t)
+	createTestNetwork(t)
+	createTestNetworkPeer(t)
+	admin := plexus.User{Username: "admin", Password: "pass", IsAdmin: true}
+	user := plexus.User{Username: "user", Password: "pass"}
+	createTestUser(t, admin)
+	createTestUser(t, user)
+	observeCheckin(time.Now(), plexus.MessageResponse{Message: checkinProcessed})
+	observeCheckin(time.Now(), plexus.MessageResponse{Message: "no such peer"})
+
+	t.Run("unauthenticated", func(t *testing.T) {
+		w := apiRequest(t, nil, http.MethodGet, "/metrics", "")
+		should.BeEqual(t, w.Code, http.StatusUnauthorized)
+	})
+	t.Run("notAdmin", func(t *testing.T) {
+		w := apiRequest(t, testLogin(t, user), http.MethodGet, "/metrics", "")
+		should.BeEqual(t, w.Code, http.StatusForbidden)
+	})
+	t.Run("admin", func(t *testing.T) {
+		w := apiRequest(t, testLogin(t, admin), http.MethodGet, "/metrics", "")
+		should.BeEqual(t, w.Code, http.StatusOK)
+		body := w.Body.String()
+		should.ContainSubstring(t, body, "plexus_peers 1\n")
+		should.ContainSubstring(t, body, "plexus_networks 1\n")
+		should.ContainSubstring(t, body, `plexus_network_peers{network="valid"} 1`)
+		should.ContainSubstring(t, body, `plexus_network_connectivity{network="valid"} 0`)
+		should.ContainSubstring(t, body, `plexus_checkins_total{result="ok"}`)
+		should.ContainSubstring(t, body, `plexus_checkins_total{result="error"}`)
+		should.ContainSubstring(t, body, "plexus_checkin_duration_seconds_count")
+		should.ContainSubstring(t, body, "plexus_nats_connections ")
+		should.ContainSubstring(t, body, `plexus_nats_messages_total{direction="in"}`)
+		should.ContainSubstring(t, body, "go_goroutines")
+	})
+	t.Run("token", func(t *testing.T) {
+		_, value, err := createToken("admin", plexus.Token{Name: "prometheus", Owner: "admin"})
+		should.NotBeError(t, err)
+		w := tokenRequestRecorder(t, value, http.MethodGet, "/metrics")
+		should.BeEqual(t, w.Code, http.StatusOK)
+		should.ContainSubstring(t, w.Body.String(), "plexus_keys ")
+	})
+}
@@ -5,27 +5,50 @@ import (
 	"fmt"
 	"log/slog"
 	"net"
+	"net/netip"
 	"runtime/debug"
 	"slices"
 	"time"
 
-	"github.com/c-robinson/iplib"
 	"github.com/devilcove/boltdb"
 	"github.com/devilcove/plexus"
 	"github.com/devilcove/plexus/internal/publish"
 	"github.com/nats-io/nats-server/v2/server"
 )
 
-func registerHandler(request *plexus.ServerRegisterRequest) plexus.MessageResponse {
-	slog.Debug("register request", "request", request)
-	if err := saveNewPeer(request.Peer); err != nil {
+// registerHandler registers a device with the key named by the subject it
+// registered on. The key name in the request is ignored as the broker only
+// lets a device publish on the subject of the key it authenticated with.
+func registerHandler(keyName string, request *plexus.ServerRegisterRequest) plexus.MessageResponse {
+	slog.Debug("register request", "key", keyName, "request", request)
+	key, err := boltdb.Get[plexus.Key](keyName, keyTable)
+	if err != nil {
+		slog.Debug("unknown registration key", "key", keyName, "error", err)
+		return plexus.MessageResponse{Message: "error: unknown registration key"}
+	}
+	// tags and groups are set by the registration key, never by the peer.
+	request.Tags = key.Tags
+	request.Groups = key.Groups
+	if key.Approval {
+		return queueRegistration(request.Peer, key)
+	}
+	return completeRegistration(request.Peer, key)
+}
+
+// completeRegistration saves a new device, gives it access to the broker and
+// joins it to the networks of its registration key.
+func completeRegistration(peer plexus.Peer, key plexus.Key) plexus.MessageResponse {
+	if err := saveNewPeer(peer); err != nil {
 		slog.Debug(err.Error())
 		return plexus.MessageResponse{Message: "error: " + err.Error()}
 	}
-	if err := addNKeyUser(request.Peer); err != nil {
+	if err := addNKeyUser(peer); err != nil {
 		slog.Debug(err.Error())
 		return plexus.MessageResponse{Message: "error: " + err.Error()}
 	}
+	if len(key.Networks) > 0 {
+		go autoJoin(peer, key)
+	}
 	return plexus.MessageResponse{Message: "registration successful"}
 }
 
@@ -34,14 +57,17 @@ func saveNewPeer(peer plexus.Peer) error {
 		return errors.New("peer exists")
 	}
 	// save new peer(device).
-	if err := boltdb.Save(peer, peer.WGPublicKey, peerTable); err != nil {
+	if err := save(peer, peer.WGPublicKey, peerTable); err != nil {
 		slog.Debug("unable to save new peer", "error", err)
 		return err
 	}
+	audit("peer:"+peer.Name, "peer.register", peer.Name, nil, peer)
 	return nil
 }
 
 func addNKeyUser(peer plexus.Peer) error {
+	nkeysLock.Lock()
+	defer nkeysLock.Unlock()
 	for _, nkeys := range natsOptions.Nkeys {
 		slog.Debug("checking device nKeys", nkeys.Nkey, peer.PubNkey)
 		if nkeys.Nkey == peer.PubNkey {
@@ -61,16 +87,12 @@ func addNKeyUser(peer plexus.Peer) error {
 }
 
 func addPeerToNetwork(
-	peerID, network string,
+	actor, peerID, network string,
 	listenPort, publicListenPort int,
 ) (plexus.Network, error) {
-	netToUpdate, err := boltdb.Get[plexus.Network](network, networkTable)
-	if err != nil {
-		return netToUpdate, err
-	}
 	peer, err := boltdb.Get[plexus.Peer](peerID, peerTable)
 	if err != nil {
-		return netToUpdate, err
+		return plexus.Network{}, err
 	}
 	netPeer := plexus.NetworkPeer{
 		WGPublicKey:      peer.WGPublicKey,
@@ -78,36 +100,67 @@ func addPeerToNetwork(
 		ListenPort:       listenPort,
 		PublicListenPort: publicListenPort,
 		Endpoint:         peer.Endpoint,
-	}
-	// check if peer is already part of network.
-	for _, existing := range netToUpdate.Peers {
-		if existing.WGPublicKey == peer.WGPublicKey {
-			return netToUpdate, fmt.Errorf("peer exists in network %s", network)
+		Tags:             peer.Tags,
+		Groups:           peer.Groups,
+	}
+	var before plexus.Network
+	netToUpdate, err := modify(network, networkTable, func(netToUpdate *plexus.Network) error {
+		// check if peer is already part of network.
+		for _, existing := range netToUpdate.Peers {
+			if existing.WGPublicKey == peer.WGPublicKey {
+				return fmt.Errorf("peer exists in network %s", network)
+			}
 		}
-	}
-	addr, err := getNextIP(netToUpdate)
+		addr := reservedAddress(*netToUpdate, netToUpdate.Net, peer.WGPublicKey)
+		var err error
+		if addr == nil {
+			addr, err = getNextIP(*netToUpdate)
+		}
+		if err != nil {
+			return fmt.Errorf(
+				"unable to get ip for peer %s %s %w",
+				peer.WGPublicKey,
+				network,
+				err,
+			)
+		}
+		slog.Debug("setting ip to", "ip", addr)
+		netPeer.Address = net.IPNet{
+			IP:   addr,
+			Mask: netToUpdate.Net.Mask,
+		}
+		if netToUpdate.Net6.IP != nil {
+			addr6 := reservedAddress(*netToUpdate, netToUpdate.Net6, peer.WGPublicKey)
+			if addr6 == nil {
+				addr6, err = getNextIP6(*netToUpdate)
+			}
+			if err != nil {
+				return fmt.Errorf(
+					"unable to get ipv6 for peer %s %s %w",
+					peer.WGPublicKey,
+					network,
+					err,
+				)
+			}
+			slog.Debug("setting ipv6 to", "ip", addr6)
+			netPeer.Address6 = net.IPNet{
+				IP:   addr6,
+				Mask: netToUpdate.Net6.Mask,
+			}
+		}
+		before = *netToUpdate
+		netToUpdate.Peers = append(slices.Clone(netToUpdate.Peers), netPeer)
+		return nil
+	})
 	if err != nil {
-		return netToUpdate, fmt.Errorf(
-			"unable to get ip for peer %s %s %w",
-			peer.WGPublicKey,
-			network,
-			err,
-		)
-	}
-	slog.Debug("setting ip to", "ip", addr)
-	netPeer.Address = net.IPNet{
-		IP:   addr,
-		Mask: netToUpdate.Net.Mask,
+		slog.Error("save updated network", "error", err)
+		return netToUpdate, err
 	}
 	update := plexus.NetworkUpdate{
 		Action: plexus.AddPeer,
 		Peer:   netPeer,
 	}
-	netToUpdate.Peers = append(netToUpdate.Peers, update.Peer)
-	if err := boltdb.Save(netToUpdate, netToUpdate.Name, networkTable); err != nil {
-		slog.Error("save updated network", "error", err)
-		return netToUpdate, err
-	}
+	audit(actor, "network.peer.add", network+"/"+peer.Name, before, netToUpdate)
 	slog.Debug("publish device update", "name", netPeer.HostName)
 	deviceUpdate := plexus.DeviceUpdate{
 		Action:  plexus.JoinNetwork,
@@ -116,34 +169,67 @@ func addPeerToNetwork(
 	publish.Message(natsConn, plexus.Update+peer.WGPublicKey+plexus.JoinNetwork, deviceUpdate)
 	slog.Debug("publish network update", "network", network, "update", update)
 	publish.Message(natsConn, plexus.Networks+network, update)
+	refreshPresharedKeys(netToUpdate)
 	return netToUpdate, nil
 }
 
+// getNextIP returns the first unused, unreserved address in network.Net.
 func getNextIP(network plexus.Network) (net.IP, error) {
 	taken := make(map[string]bool)
 	for _, peer := range network.Peers {
 		taken[peer.Address.IP.String()] = true
 	}
+	for _, reservation := range network.Reservations {
+		taken[reservation.Address.String()] = true
+	}
 	slog.Debug("getnextIP", "network", network)
+	return nextIP(network.Net, taken, network.Excluded)
+}
+
+// getNextIP6 returns the first unused, unreserved address in network.Net6 of a
+// dual-stack network.
+func getNextIP6(network plexus.Network) (net.IP, error) {
+	taken := make(map[string]bool)
+	for _, peer := range network.Peers {
+		if peer.Address6.IP != nil {
+			taken[peer.Address6.IP.String()] = true
+		}
+	}
+	for _, reservation := range network.Reservations {
+		taken[reservation.Address.String()] = true
+	}
+	slog.Debug("getnextIP6", "network", network)
+	return nextIP(network.Net6, taken, network.Excluded)
+}
+
+// nextIP returns the first address in subnet that is not taken or excluded. The
+// network address and, for IPv4, the broadcast address are never returned.
+func nextIP(subnet net.IPNet, taken map[string]bool, excluded []plexus.AddressRange) (net.IP, error) {
 	slog.Debug("getNextIP", "taken", taken)
-	slog.Debug("getNextIP", "net", network.Net)
-	ipnet := iplib.Net4FromStr(network.Net.String())
-	ipToCheck := ipnet.FirstAddress()
-	broadcast := ipnet.BroadcastAddress()
-	for {
-		slog.Debug("checking", "ip", ipToCheck, "network", network.Net)
-		_, ok := taken[ipToCheck.String()]
-		if !ok {
-			slog.Debug("found available ip", "ip", ipToCheck, "taken", taken)
+	slog.Debug("getNextIP", "net", subnet)
+	addr, ok := netip.AddrFromSlice(subnet.IP)
+	if !ok {
+		return net.IP{}, errors.New("invalid network address")
+	}
+	ones, _ := subnet.Mask.Size()
+	prefix := netip.PrefixFrom(addr.Unmap(), ones).Masked()
+	for ipToCheck := prefix.Addr().Next(); prefix.Contains(ipToCheck); ipToCheck = ipToCheck.Next() {
+		if ipToCheck.Is4() && !prefix.Contains(ipToCheck.Next()) {
+			// broadcast address.
 			break
 		}
-		next := iplib.NextIP(ipToCheck)
-		if next.Equal(broadcast) {
-			return net.IP{}, errors.New("no addresses available")
+		slog.Debug("checking", "ip", ipToCheck, "network", subnet)
+		if end := excludedRangeEnd(excluded, ipToCheck); end.IsValid() {
+			// skip to the end of the excluded range.
+			ipToCheck = end
+			continue
+		}
+		if !taken[ipToCheck.String()] {
+			slog.Debug("found available ip", "ip", ipToCheck, "taken", taken)
+			return net.IP(ipToCheck.AsSlice()), nil
 		}
-		ipToCheck = next
 	}
-	return ipToCheck, nil
+	return net.IP{}, errors.New("no addresses available")
 }
 
 // processCheckin handle messages published to checkin.<ID>.
@@ -151,28 +237,35 @@ func processCheckin(data *plexus.CheckinData) plexus.MessageResponse {
 	publishUpdate := false
 	response := plexus.MessageResponse{}
 	slog.Info("received checkin", "host", data.Name, "device", data.ID)
-	peer, err := boltdb.Get[plexus.Peer](data.ID, peerTable)
-	if err != nil {
+	peer, err := modify(data.ID, peerTable, func(peer *plexus.Peer) error {
+		publishUpdate = false
+		peer.Updated = time.Now()
+		peer.NatsConnected = true
+		if peer.Version != data.Version {
+			peer.Version = data.Version
+		}
+		if !peer.Endpoint.Equal(data.Endpoint) {
+			slog.Debug(
+				"endpoint changed",
+				"peer", peer.Name,
+				"old", peer.Endpoint,
+				"new", data.Endpoint,
+			)
+			peer.Endpoint = data.Endpoint
+			publishUpdate = true
+		}
+		if data.NatType != "" && peer.NatType != data.NatType {
+			slog.Info("nat type changed", "peer", peer.Name, "old", peer.NatType, "new", data.NatType)
+			peer.NatType = data.NatType
+		}
+		return nil
+	})
+	if errors.Is(err, boltdb.ErrNoResults) {
 		slog.Error("peer checkin", "error", err)
 		response.Message = "no such peer"
 		return response
 	}
-	peer.Updated = time.Now()
-	peer.NatsConnected = true
-	if peer.Version != data.Version {
-		peer.Version = data.Version
-	}
-	if !peer.Endpoint.Equal(data.Endpoint) {
-		slog.Debug(
-			"endpoint changed",
-			"peer", peer.Name,
-			"old", peer.Endpoint,
-			"new", data.Endpoint,
-		)
-		peer.Endpoint = data.Endpoint
-		publishUpdate = true
-	}
-	if err := boltdb.Save(peer, peer.WGPublicKey, peerTable); err != nil {
+	if err != nil {
 		slog.Error("peer checkin save", "error", err)
 		response.Message = "could not save peer" + err.Error()
 		return response
@@ -184,7 +277,7 @@ func processCheckin(data *plexus.CheckinData) plexus.MessageResponse {
 	}
 	processConnectionData(data)
 	processPrivateEndpoints(data.ID, data.PrivateEndpoints)
-	return plexus.MessageResponse{Message: "checkin processed"}
+	return plexus.MessageResponse{Message: checkinProcessed}
 }
 
 // configHandler handles requests for device configuration ie request published to config.<ID>.
@@ -200,24 +293,34 @@ func processReload(id string) plexus.NetworkResponse {
 // processConnectionData handles connectivity (nats, handshakes) stats.
 func processConnectionData(data *plexus.CheckinData) {
 	slog.Debug("received connectivity stats", "device", data.ID)
+	devices := registeredPeers()
+	serverRelay := relayEnabled()
 	for _, conn := range data.Connections {
-		network, err := boltdb.Get[plexus.Network](conn.Network, networkTable)
+		var elected []plexus.NetworkPeer
+		var relays []plexus.NetworkUpdate
+		var before plexus.Network
+		network, err := modify(conn.Network, networkTable, func(network *plexus.Network) error {
+			for i, peer := range network.Peers {
+				if peer.WGPublicKey == data.ID {
+					network.Peers[i].Connectivity = conn.Connectivity
+					network.Peers[i].NatsConnected = true
+				}
+			}
+			elected = electRouters(network)
+			before = *network
+			before.Peers = slices.Clone(network.Peers)
+			relays = autoRelays(network, devices, serverRelay)
+			slog.Debug("save connection data", "network", network.Name)
+			return nil
+		})
 		if err != nil {
-			slog.Error("connectivity data received for invalid network", "network", conn.Network)
+			slog.Error("save connection data", "network", conn.Network, "error", err)
 			continue
 		}
-		updatedPeers := []plexus.NetworkPeer{}
-		for _, peer := range network.Peers {
-			if peer.WGPublicKey == data.ID {
-				peer.Connectivity = conn.Connectivity
-				peer.NatsConnected = true
-			}
-			updatedPeers = append(updatedPeers, peer)
-		}
-		network.Peers = updatedPeers
-		slog.Debug("save connection data", "network", network.Name)
-		if err := boltdb.Save(network, network.Name, networkTable); err != nil {
-			slog.Error("save peers", "error", err)
+		publishRouters(network.Name, "", elected)
+		if len(relays) > 0 {
+			audit(actorSystem, "relay.auto", network.Name, before, network)
+			publishUpdates(network.Name, relays)
 		}
 	}
 }
@@ -228,29 +331,32 @@ func processPrivateEndpoints(id string, endpoints []plexus.PrivateEndpoint) {
 		return
 	}
 	for _, ep := range endpoints {
-		network, err := boltdb.Get[plexus.Network](ep.Network, networkTable)
+		var updated []plexus.NetworkPeer
+		network, err := modify(ep.Network, networkTable, func(network *plexus.Network) error {
+			updated = nil
+			for i, peer := range network.Peers {
+				if peer.WGPublicKey != id || peer.PrivateEndpoint.Equal(net.ParseIP(ep.IP)) {
+					continue
+				}
+				network.Peers[i].PrivateEndpoint = net.ParseIP(ep.IP)
+				updated = append(updated, network.Peers[i])
+			}
+			if len(updated) == 0 {
+				return errUnchanged
+			}
+			return nil
+		})
 		if err != nil {
-			slog.Error("get network", "error", err)
+			slog.Error("save network", "network", ep.Network, "error", err)
 			continue
 		}
-		for i, peer := range network.Peers {
-			if peer.WGPublicKey != id {
-				continue
-			}
-			if network.Peers[i].PrivateEndpoint.Equal(net.ParseIP(ep.IP)) {
-				continue
-			}
-			network.Peers[i].PrivateEndpoint = net.ParseIP(ep.IP)
-			data := plexus.NetworkUpdate{
-				Action: plexus.UpdatePeer,
-				Peer:   network.Peers[i],
-			}
+		for _, peer := range updated {
 			slog.Debug("publish network update", "network", network.Name, "peer",
-				network.Peers[i], "reason", "private endpoint update")
-			publish.Message(natsConn, plexus.Networks+network.Name, data)
-			if err := boltdb.Save(network, network.Name, networkTable); err != nil {
-				slog.Error("save network", "network", network.Name, "error", err)
-			}
+				peer, "reason", "private endpoint update")
+			publish.Message(natsConn, plexus.Networks+network.Name, plexus.NetworkUpdate{
+				Action: plexus.UpdatePeer,
+				Peer:   peer,
+			})
 		}
 	}
 }
@@ -258,25 +364,33 @@ func processPrivateEndpoints(id string, endpoints []plexus.PrivateEndpoint) {
 // processLeave handles leaving a network.
 func processLeave(id string, request *plexus.LeaveRequest) plexus.MessageResponse {
 	slog.Debug("leave handler", "peer", id, "network", request.Network)
-	network, err := boltdb.Get[plexus.Network](request.Network, networkTable)
+	var left plexus.NetworkPeer
+	var elected []plexus.NetworkPeer
+	found := false
+	network, err := modify(request.Network, networkTable, func(network *plexus.Network) error {
+		for i, peer := range network.Peers {
+			if peer.WGPublicKey != id {
+				continue
+			}
+			found = true
+			left = peer
+			network.Peers = slices.Delete(slices.Clone(network.Peers), i, i+1)
+			elected = electRouters(network)
+			return nil
+		}
+		found = false
+		return errUnchanged
+	})
 	if err != nil {
-		slog.Error("get network to leave", "error", err)
+		slog.Error("save delete peer", "error", err)
 		return plexus.MessageResponse{Message: "error: " + err.Error()}
 	}
-	found := false
-	for i, peer := range network.Peers {
-		if peer.WGPublicKey != id {
-			continue
-		}
-		found = true
-		network.Peers = slices.Delete(network.Peers, i, i+1)
-		if err := boltdb.Save(network, network.Name, networkTable); err != nil {
-			slog.Error("save delete peer", "error", err)
-			return plexus.MessageResponse{Message: "error: " + err.Error()}
-		}
+	if found {
+		publishRouters(network.Name, "", elected)
+		audit(peerActor(id), "network.leave", network.Name+"/"+left.HostName, left, nil)
 		update := plexus.NetworkUpdate{
 			Action: plexus.DeletePeer,
-			Peer:   peer,
+			Peer:   left,
 		}
 		slog.Debug(
 			"publishing network update for peer leaving network",
@@ -326,7 +440,7 @@ func processJoin(id string, request *plexus.JoinRequest) plexus.JoinResponse {
 	if id != request.WGPublicKey {
 		return plexus.JoinResponse{Message: "peer id does not match subject"}
 	}
-	network, err := addPeerToNetwork(request.WGPublicKey, request.Network,
+	network, err := addPeerToNetwork(peerActor(id), request.WGPublicKey, request.Network,
 		request.ListenPort, request.PublicListenPort)
 	if err != nil {
 		return plexus.JoinResponse{Message: err.Error()}
@@ -339,7 +453,7 @@ func processJoin(id string, request *plexus.JoinRequest) plexus.JoinResponse {
 
 func processLeaveServer(id string) error {
 	slog.Debug("remove peer", "peer", id)
-	peer, err := discardPeer(id)
+	peer, err := discardPeer(peerActor(id), id)
 	if err != nil {
 		slog.Debug(err.Error())
 		return err
@@ -354,19 +468,24 @@ func processDeviceUpdate(id string, request *plexus.Peer) {
 		slog.Error("invalid device update", "id", id, "request", request)
 		return
 	}
-	peer, err := boltdb.Get[plexus.Peer](id, peerTable)
+	var peer plexus.Peer
+	updated, err := modify(id, peerTable, func(current *plexus.Peer) error {
+		peer = *current
+		*current = *request
+		current.Tags = peer.Tags
+		current.Groups = peer.Groups
+		return nil
+	})
 	if err != nil {
-		slog.Error("get peer", "id", id, "error", err)
+		slog.Error("save device update", "id", id, "error", err)
 		return
 	}
-	if !peer.Endpoint.Equal(request.Endpoint) {
-		if err := publishNetworkPeerUpdate(*request, "device update"); err != nil {
+	if !peer.Endpoint.Equal(updated.Endpoint) {
+		if err := publishNetworkPeerUpdate(updated, "device update"); err != nil {
 			slog.Error("publish network peer update", "error", err)
 		}
 	}
-	if err := boltdb.Save(request, id, peerTable); err != nil {
-		slog.Error("save device update", "error", err)
-	}
+	audit("peer:"+updated.Name, "peer.update", updated.Name, peer, updated)
 }
 
 func processNetworkPeerUpdate(id string, request *plexus.NetworkPeer) {
@@ -381,25 +500,51 @@ func processNetworkPeerUpdate(id string, request *plexus.NetworkPeer) {
 		return
 	}
 	for _, network := range networks {
-		updatedPeers := []plexus.NetworkPeer{}
-		for _, peer := range network.Peers {
-			slog.Debug("checking peer", "peer", peer.HostName)
-			if peer.WGPublicKey == id {
-				peer = *request
-				data := plexus.NetworkUpdate{
-					Action: plexus.UpdatePeer,
-					Peer:   *request,
+		// the update is for the network holding the peer address.
+		if request.Address.IP != nil && !network.Net.Contains(request.Address.IP) {
+			continue
+		}
+		name := network.Name
+		var before, updated plexus.NetworkPeer
+		network, err := modify(name, networkTable, func(network *plexus.Network) error {
+			for i, peer := range network.Peers {
+				slog.Debug("checking peer", "peer", peer.HostName)
+				if peer.WGPublicKey != id {
+					continue
 				}
-				slog.Debug("publish peer update", "network", network.Name, "peer", request.HostName)
-				publish.Message(natsConn, plexus.Networks+network.Name, data)
+				updated = *request
+				updated.Tags = peer.Tags
+				updated.Groups = peer.Groups
+				updated.IsExitNode = peer.IsExitNode
+				updated.IsSubnetRouter = peer.IsSubnetRouter
+				updated.Subnets = peer.Subnets
+				updated.AutoRelayed = peer.AutoRelayed
+				updated.ServerRelayed = peer.ServerRelayed
+				if updated.ExitNode != "" && !validExitNode(*network, updated.ExitNode) {
+					slog.Warn("invalid exit node", "peer", updated.HostName, "exit node", updated.ExitNode)
+					updated.ExitNode = ""
+				}
+				before = peer
+				network.Peers[i] = updated
+				slog.Debug("updating network", "network", network.Name)
+				return nil
 			}
-			updatedPeers = append(updatedPeers, peer)
+			return errUnchanged
+		})
+		if err != nil {
+			slog.Error("save network", "network", name, "error", err)
+			continue
 		}
-		network.Peers = updatedPeers
-		slog.Debug("updating network", "network", network.Name)
-		if err := boltdb.Save(network, network.Name, networkTable); err != nil {
-			slog.Error("save network", "error", err)
+		if updated.WGPublicKey == "" {
+			continue
 		}
+		audit("peer:"+updated.HostName, "network.peer.update",
+			network.Name+"/"+updated.HostName, before, updated)
+		slog.Debug("publish peer update", "network", network.Name, "peer", updated.HostName)
+		publish.Message(natsConn, plexus.Networks+network.Name, plexus.NetworkUpdate{
+			Action: plexus.UpdatePeer,
+			Peer:   updated,
+		})
 	}
 }
 
@@ -411,25 +556,45 @@ func processPortUpdate(id string, ports *plexus.ListenPortResponse) {
 		return
 	}
 	for _, network := range networks {
-		for i, peer := range network.Peers {
-			if peer.WGPublicKey == id {
+		if !slices.ContainsFunc(network.Peers, func(peer plexus.NetworkPeer) bool {
+			return peer.WGPublicKey == id
+		}) {
+			continue
+		}
+		name := network.Name
+		var before, peer plexus.NetworkPeer
+		network, err := modify(name, networkTable, func(network *plexus.Network) error {
+			for i, current := range network.Peers {
+				if current.WGPublicKey != id {
+					continue
+				}
+				before = current
+				peer = current
 				peer.ListenPort = ports.ListenPort
 				peer.PublicListenPort = ports.PublicListenPort
 				network.Peers[i] = peer
-				if err := boltdb.Save(network, network.Name, networkTable); err != nil {
-					slog.Error("save network", "error", err)
-				}
-				data := plexus.NetworkUpdate{
-					Action: plexus.UpdatePeer,
-					Peer:   peer,
-				}
-				slog.Debug(
-					"publish network update for port change",
-					"network", network.Name,
-					"peer", peer.HostName,
-				)
-				publish.Message(natsConn, plexus.Networks+network.Name, data)
+				return nil
 			}
+			return errUnchanged
+		})
+		if err != nil {
+			slog.Error("save network", "network", name, "error", err)
+			continue
 		}
+		if peer.WGPublicKey == "" {
+			continue
+		}
+		audit("peer:"+peer.HostName, "network.peer.update",
+			network.Name+"/"+peer.HostName, before, peer)
+		data := plexus.NetworkUpdate{
+			Action: plexus.UpdatePeer,
+			Peer:   peer,
+		}
+		slog.Debug(
+			"publish network update for port change",
+			"network", network.Name,
+			"peer", peer.HostName,
+		)
+		publish.Message(natsConn, plexus.Networks+network.Name, data)
 	}
 }
@@ -41,3 +41,32 @@ func TestGetNextIP(t *testing.T) {
 	should.BeEqual(t, iplib.CompareIPs(ip, net.ParseIP("192.168.0.3")), 0)
 	t.Log(ip)
 }
+
+func TestGetNextIP6(t *testing.T) {
+	_, cidr, err := net.ParseCIDR("192.168.0.0/30")
+	should.NotBeError(t, err)
+	_, cidr6, err := net.ParseCIDR("fd00:1::/64")
+	should.NotBeError(t, err)
+	network := plexus.Network{
+		Net:  *cidr,
+		Net6: *cidr6,
+		Peers: []plexus.NetworkPeer{
+			{
+				Address:  net.IPNet{IP: net.ParseIP("192.168.0.1"), Mask: cidr.Mask},
+				Address6: net.IPNet{IP: net.ParseIP("fd00:1::1"), Mask: cidr6.Mask},
+			},
+		},
+	}
+	ip, err := getNextIP6(network)
+	should.NotBeError(t, err)
+	should.BeEqual(t, ip.String(), "fd00:1::2")
+	ip, err = getNextIP(network)
+	should.NotBeError(t, err)
+	should.BeEqual(t, ip.String(), "192.168.0.2")
+	network.Peers = append(network.Peers, plexus.NetworkPeer{
+		Address: net.IPNet{IP: net.ParseIP("192.168.0.2"), Mask: cidr.Mask},
+	})
+	// 192.168.0.3 is the broadcast address.
+	_, err = getNextIP(network)
+	should.BeError(t, err)
+}
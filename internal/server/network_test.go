@@ -15,6 +15,7 @@ func TestDisplayAddNetwork(t *testing.T) {
 	user := plexus.User{
 		Username: "hello",
 		Password: "world",
+		IsAdmin:  true,
 	}
 	createTestUser(t, user)
 	cookie := testLogin(t, user)
@@ -32,6 +33,7 @@ func TestAddNetwork(t *testing.T) {
 	user := plexus.User{
 		Username: "hello",
 		Password: "world",
+		IsAdmin:  true,
 	}
 	createTestUser(t, user)
 	cookie := testLogin(t, user)
@@ -159,6 +161,78 @@ func TestAddNetwork(t *testing.T) {
 		should.NotBeError(t, err)
 		should.ContainSubstring(t, string(body), "network name exists")
 	})
+	t.Run("invalidIPv6", func(t *testing.T) {
+		payload := bodyParams("name", "badv6", "addressstring", "10.10.30.0/24", "address6string", "10.10.31.0/24")
+		req := httptest.NewRequest(http.MethodPost, "/networks/add", payload)
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.AddCookie(cookie)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		should.BeEqual(t, w.Code, http.StatusBadRequest)
+		body, err := io.ReadAll(w.Body)
+		should.NotBeError(t, err)
+		should.ContainSubstring(t, string(body), "invalid ipv6 address for network")
+	})
+	t.Run("ipv6NotULA", func(t *testing.T) {
+		payload := bodyParams("name", "globalv6", "addressstring", "10.10.30.0/24", "address6string", "2001:db8::/64")
+		req := httptest.NewRequest(http.MethodPost, "/networks/add", payload)
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.AddCookie(cookie)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		should.BeEqual(t, w.Code, http.StatusBadRequest)
+		body, err := io.ReadAll(w.Body)
+		should.NotBeError(t, err)
+		should.ContainSubstring(t, string(body), "ipv6 network address is not unique local")
+	})
+	t.Run("ipv6Primary", func(t *testing.T) {
+		payload := bodyParams("name", "v6primary", "addressstring", "fd10:10:30::/64", "address6string", "fd10:10:31::/64")
+		req := httptest.NewRequest(http.MethodPost, "/networks/add", payload)
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.AddCookie(cookie)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		should.BeEqual(t, w.Code, http.StatusBadRequest)
+		body, err := io.ReadAll(w.Body)
+		should.NotBeError(t, err)
+		should.ContainSubstring(t, string(body), "dual-stack network requires an ipv4 address and an ipv6 address")
+	})
+	t.Run("dualStack", func(t *testing.T) {
+		payload := bodyParams("name", "dualstack", "addressstring", "10.10.30.0/24", "address6string", "fd10:10:30::1/64")
+		req := httptest.NewRequest(http.MethodPost, "/networks/add", payload)
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.AddCookie(cookie)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		should.BeEqual(t, w.Code, http.StatusOK)
+		body, err := io.ReadAll(w.Body)
+		should.NotBeError(t, err)
+		should.ContainSubstring(t, string(body), "fd10:10:30::/64")
+	})
+	t.Run("ipv6InUse", func(t *testing.T) {
+		payload := bodyParams("name", "dualstack2", "addressstring", "10.10.40.0/24", "address6string", "fd10:10:30::/64")
+		req := httptest.NewRequest(http.MethodPost, "/networks/add", payload)
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.AddCookie(cookie)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		should.BeEqual(t, w.Code, http.StatusBadRequest)
+		body, err := io.ReadAll(w.Body)
+		should.NotBeError(t, err)
+		should.ContainSubstring(t, string(body), "network CIDR in use by dualstack")
+	})
+	t.Run("ipv6Only", func(t *testing.T) {
+		payload := bodyParams("name", "ipv6only", "addressstring", "fd10:10:50::/64")
+		req := httptest.NewRequest(http.MethodPost, "/networks/add", payload)
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.AddCookie(cookie)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		should.BeEqual(t, w.Code, http.StatusOK)
+		body, err := io.ReadAll(w.Body)
+		should.NotBeError(t, err)
+		should.ContainSubstring(t, string(body), "fd10:10:50::/64")
+	})
 	deleteAllNetworks(t)
 }
 
@@ -166,6 +240,7 @@ func TestDisplayNetworkDetails(t *testing.T) {
 	user := plexus.User{
 		Username: "hello",
 		Password: "world",
+		IsAdmin:  true,
 	}
 	createTestUser(t, user)
 	createTestNetwork(t)
@@ -188,6 +263,7 @@ func TestDeleteNetwork(t *testing.T) {
 	user := plexus.User{
 		Username: "hello",
 		Password: "world",
+		IsAdmin:  true,
 	}
 	createTestUser(t, user)
 	cookie := testLogin(t, user)
@@ -219,6 +295,7 @@ func TestNetworkSideBar(t *testing.T) {
 	user := plexus.User{
 		Username: "hello",
 		Password: "world",
+		IsAdmin:  true,
 	}
 	createTestUser(t, user)
 	r := httptest.NewRequest(http.MethodGet, "/sidebar/", nil)
@@ -2,6 +2,7 @@ package server
 
 import (
 	"errors"
+	"fmt"
 	"log"
 	"log/slog"
 	"net"
@@ -24,50 +25,78 @@ func displayAddNetwork(w http.ResponseWriter, r *http.Request) {
 }
 
 func addNetwork(w http.ResponseWriter, r *http.Request) {
-	var errs error
 	network := plexus.Network{
-		Name:          r.FormValue("name"),
-		AddressString: r.FormValue("addressstring"),
+		Name:           r.FormValue("name"),
+		AddressString:  r.FormValue("addressstring"),
+		Address6String: r.FormValue("address6string"),
+		UsePSK:         r.FormValue("usepsk") == "on",
+	}
+	network, err := createNetwork(userActor(r), network)
+	if err != nil {
+		processError(w, errorStatus(err), err.Error())
+		return
 	}
+	if err := setRole(userActor(r), GetSessionData(r).Username, network.Name, roleOwner); err != nil {
+		slog.Error("set network owner", "network", network.Name, "error", err)
+	}
+	displayNetworks(w, r)
+}
+
+// createNetwork validates and saves a new network.
+func createNetwork(actor string, network plexus.Network) (plexus.Network, error) {
+	var errs error
 	_, cidr, err := net.ParseCIDR(network.AddressString)
 	if err != nil {
 		log.Println("net.ParseCIDR", network.AddressString)
-		processError(w, http.StatusBadRequest, "invalid address for network")
-		return
+		return network, requestError("invalid address for network")
 	}
 	network.Net = *cidr
 	network.AddressString = network.Net.String()
+	if network.Address6String != "" {
+		_, cidr6, err := net.ParseCIDR(network.Address6String)
+		if err != nil || cidr6.IP.To4() != nil {
+			return network, requestError("invalid ipv6 address for network")
+		}
+		if network.Net.IP.To4() == nil {
+			return network, requestError("dual-stack network requires an ipv4 address and an ipv6 address")
+		}
+		network.Net6 = *cidr6
+		network.Address6String = network.Net6.String()
+	}
 	if !validateNetworkName(network.Name) {
 		errs = errors.Join(errs, errors.New("invalid network name"))
 	}
 	if !validateNetworkAddress(network.Net) {
 		errs = errors.Join(errs, errors.New("network address is not private"))
 	}
+	if network.Net6.IP != nil && !validateNetworkAddress(network.Net6) {
+		errs = errors.Join(errs, errors.New("ipv6 network address is not unique local"))
+	}
 	if errs != nil {
-		processError(w, http.StatusBadRequest, errs.Error())
-		return
+		return network, requestError(errs.Error())
 	}
 	networks, err := boltdb.GetAll[plexus.Network](networkTable)
 	if err != nil {
-		processError(w, http.StatusInternalServerError, "database error "+err.Error())
-		return
+		return network, fmt.Errorf("database error %w", err)
 	}
-	for _, net := range networks {
-		if net.Name == network.Name {
-			processError(w, http.StatusBadRequest, "network name exists")
-			return
+	for _, existing := range networks {
+		if existing.Name == network.Name {
+			return network, requestError("network name exists")
 		}
-		if net.Net.IP.Equal(network.Net.IP) {
-			processError(w, http.StatusBadRequest, "network CIDR in use by "+net.Name)
-			return
+		for _, inUse := range existing.Nets() {
+			for _, subnet := range network.Nets() {
+				if inUse.IP.Equal(subnet.IP) {
+					return network, requestError("network CIDR in use by " + existing.Name)
+				}
+			}
 		}
 	}
 	slog.Debug("network validation complete ... saving", "network", network)
-	if err := boltdb.Save(network, network.Name, networkTable); err != nil {
-		processError(w, http.StatusInternalServerError, "unable to save network "+err.Error())
-		return
+	if err := save(network, network.Name, networkTable); err != nil {
+		return network, fmt.Errorf("unable to save network %w", err)
 	}
-	displayNetworks(w, r)
+	audit(actor, "network.create", network.Name, nil, network)
+	return network, nil
 }
 
 func displayNetworks(w http.ResponseWriter, r *http.Request) {
@@ -78,19 +107,19 @@ func displayNetworks(w http.ResponseWriter, r *http.Request) {
 		processError(w, http.StatusInternalServerError, err.Error())
 		return
 	}
-	page.Data = networks
+	page.Data = visibleNetworks(session, networks)
 
 	w.Header().Add("Hx-Trigger", "networkChange")
 	render(w, "networks", page)
 }
 
-func networksSideBar(w http.ResponseWriter, _ *http.Request) {
+func networksSideBar(w http.ResponseWriter, r *http.Request) {
 	networks, err := boltdb.GetAll[plexus.Network](networkTable)
 	if err != nil {
 		processError(w, http.StatusInternalServerError, err.Error())
 		return
 	}
-	render(w, "sidebarNetworks", networks)
+	render(w, "sidebarNetworks", visibleNetworks(GetSessionData(r), networks))
 }
 
 func getAvailablePeers(network plexus.Network) []plexus.Peer {
@@ -122,7 +151,7 @@ func networkAddPeer(w http.ResponseWriter, r *http.Request) {
 		processError(w, http.StatusInternalServerError, err.Error())
 		return
 	}
-	if _, err := addPeerToNetwork(peerID, network, priv, pub); err != nil {
+	if _, err := addPeerToNetwork(userActor(r), peerID, network, priv, pub); err != nil {
 		processError(w, http.StatusInternalServerError, err.Error())
 		return
 	}
@@ -134,6 +163,13 @@ func networkDetails(w http.ResponseWriter, r *http.Request) {
 		Name           string
 		Peers          []plexus.NetworkPeer
 		AvailablePeers []plexus.Peer
+		Groups         []plexus.Group
+		IsOwner        bool
+		IsOperator     bool
+		Members        []NetworkMember
+		IPAM           IPAM
+		Policies       []plexus.Policy
+		UsePSK         bool
 	}{}
 	networkName := r.PathValue("id")
 	network, err := boltdb.Get[plexus.Network](networkName, networkTable)
@@ -164,28 +200,57 @@ func networkDetails(w http.ResponseWriter, r *http.Request) {
 	}
 	details.Name = networkName
 	details.AvailablePeers = getAvailablePeers(network)
+	details.Groups, err = boltdb.GetAll[plexus.Group](groupTable)
+	if err != nil {
+		processError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	details.IPAM = networkIPAM(network)
+	details.Policies = network.Policies
+	details.UsePSK = network.UsePSK
+	details.IsOperator = hasRole(GetSessionData(r), networkName, roleOperator)
+	if hasRole(GetSessionData(r), networkName, roleOwner) {
+		details.IsOwner = true
+		details.Members = networkMembers(networkName)
+	}
 	render(w, "networkDetails", details)
 }
 
 func deleteNetwork(w http.ResponseWriter, r *http.Request) {
-	network := r.PathValue("id")
-	if err := boltdb.Delete[plexus.Network](network, networkTable); err != nil {
+	if err := removeNetwork(userActor(r), r.PathValue("id")); err != nil {
 		if errors.Is(err, boltdb.ErrNoResults) {
 			processError(w, http.StatusBadRequest, "network does not exist")
 			return
 		}
-		processError(w, http.StatusInternalServerError, "delete network "+err.Error())
+		processError(w, http.StatusInternalServerError, err.Error())
 		return
 	}
+	displayNetworks(w, r)
+}
+
+// removeNetwork deletes a network and notifies the network peers.
+func removeNetwork(actor, network string) error {
+	before, err := boltdb.Get[plexus.Network](network, networkTable)
+	if err != nil {
+		return err
+	}
+	if err := remove(network, networkTable); err != nil {
+		if errors.Is(err, boltdb.ErrNoResults) {
+			return err
+		}
+		return fmt.Errorf("delete network %w", err)
+	}
 	log.Println("deleting network", network)
+	audit(actor, "network.delete", network, before, nil)
+	if err := removeNetworkRoles(network); err != nil {
+		slog.Error("remove network roles", "network", network, "error", err)
+	}
+	if err := remove(network, pskTable); err != nil && !errors.Is(err, boltdb.ErrNoResults) {
+		slog.Error("remove preshared keys", "network", network, "error", err)
+	}
 	if natsConn == nil {
 		slog.Error("not connected to nats")
-		processError(
-			w,
-			http.StatusInternalServerError,
-			"nats failure:  network update not published",
-		)
-		return
+		return errors.New("nats failure:  network update not published")
 	}
 	slog.Debug("publish network update", "network", network, "reason", "delete network")
 	publish.Message(
@@ -193,7 +258,7 @@ func deleteNetwork(w http.ResponseWriter, r *http.Request) {
 		plexus.Networks+network,
 		plexus.NetworkUpdate{Action: plexus.DeleteNetwork},
 	)
-	displayNetworks(w, r)
+	return nil
 }
 
 func validateNetworkName(name string) bool {
@@ -204,7 +269,13 @@ func validateNetworkName(name string) bool {
 	return valid.MatchString(name)
 }
 
+// validateNetworkAddress checks that address is an RFC 1918 IPv4 network or an
+// IPv6 unique local (fc00::/7) network with room for at least two hosts.
 func validateNetworkAddress(address net.IPNet) bool {
+	ones, bits := address.Mask.Size()
+	if address.IP.To4() == nil && bits == net.IPv6len*8 {
+		return address.IP.IsPrivate() && ones <= 126
+	}
 	return address.IP.IsPrivate()
 }
 
@@ -216,33 +287,54 @@ func removePeerFromNetwork(w http.ResponseWriter, r *http.Request) {
 		processError(w, http.StatusBadRequest, "invalid network"+err.Error())
 		return
 	}
-	found := false
-	for i, peer := range network.Peers {
-		if peer.WGPublicKey == peerid {
-			found = true
-			slog.Info("deleting peer", "peer", peer.WGPublicKey, "network", network.Name)
-			network.Peers = slices.Delete(network.Peers, i, i+1)
-			if err := boltdb.Save(network, network.Name, networkTable); err != nil {
-				slog.Error("save network after peer deletion", "error", err)
-				processError(w, http.StatusInternalServerError, err.Error())
-				return
-			}
-			update := plexus.NetworkUpdate{
-				Action: plexus.DeletePeer,
-				Peer:   peer,
-			}
-			slog.Info("publishing network update", "topic", "networks."+network.Name)
-			publish.Message(natsConn, "networks."+network.Name, update)
-			break
+	if _, err := deletePeerFromNetwork(userActor(r), network, peerid); err != nil {
+		if errors.Is(err, ErrPeerNotFound) {
+			processError(w, http.StatusBadRequest, "invalid peer")
+			return
 		}
-	}
-	if !found {
-		processError(w, http.StatusBadRequest, "invalid peer")
+		processError(w, http.StatusInternalServerError, err.Error())
 		return
 	}
 	networkDetails(w, r)
 }
 
+// deletePeerFromNetwork removes a peer from network and notifies the remaining peers.
+func deletePeerFromNetwork(actor string, network plexus.Network, peerID string) (plexus.Network, error) {
+	before := network
+	before.Peers = slices.Clone(network.Peers)
+	for i, peer := range network.Peers {
+		if peer.WGPublicKey != peerID {
+			continue
+		}
+		slog.Info("deleting peer", "peer", peer.WGPublicKey, "network", network.Name)
+		network.Peers = slices.Delete(network.Peers, i, i+1)
+		elected := electRouters(&network)
+		if err := save(network, network.Name, networkTable); err != nil {
+			slog.Error("save network after peer deletion", "error", err)
+			return network, err
+		}
+		publishRouters(network.Name, "", elected)
+		audit(actor, "network.peer.remove", network.Name+"/"+peer.HostName, before, network)
+		update := plexus.NetworkUpdate{
+			Action: plexus.DeletePeer,
+			Peer:   peer,
+		}
+		slog.Info("publishing network update", "topic", "networks."+network.Name)
+		publish.Message(natsConn, "networks."+network.Name, update)
+		return network, nil
+	}
+	return network, ErrPeerNotFound
+}
+
+func peerInNetwork(network plexus.Network, id string) bool {
+	for _, peer := range network.Peers {
+		if peer.WGPublicKey == id {
+			return true
+		}
+	}
+	return false
+}
+
 func getNetworksForPeer(id string) ([]plexus.Network, error) {
 	response := []plexus.Network{}
 	networks, err := boltdb.GetAll[plexus.Network](networkTable)
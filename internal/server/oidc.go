@@ -0,0 +1,348 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"github.com/devilcove/boltdb"
+	"github.com/devilcove/plexus"
+	"github.com/gorilla/sessions"
+	"golang.org/x/oauth2"
+)
+
+const (
+	oidcCookieName = "plexus-oidc"
+	oidcProvider   = "oidc"
+	oidcLoginTime  = time.Minute * 10
+)
+
+// OIDCConfig holds the settings for single sign-on with an OpenID Connect provider.
+type OIDCConfig struct {
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	RedirectURL  string
+	GroupsClaim  string
+	AdminGroups  []string
+}
+
+// oidcClaims are the ID token claims used to provision users.
+type oidcClaims struct {
+	Issuer            string `json:"iss"`
+	Subject           string `json:"sub"`
+	Email             string `json:"email"`
+	PreferredUsername string `json:"preferred_username"`
+	Nonce             string `json:"nonce"`
+}
+
+type oidcClient struct {
+	config      oauth2.Config
+	verifier    *oidc.IDTokenVerifier
+	groupsClaim string
+	adminGroups []string
+}
+
+var (
+	oidcSettings OIDCConfig
+	oidcCache    *oidcClient
+	oidcLock     sync.Mutex
+)
+
+// configureOIDC sets the single sign-on settings; a blank issuer disables sso.
+func configureOIDC(config Configuration) {
+	oidcLock.Lock()
+	defer oidcLock.Unlock()
+	oidcSettings = config.OIDC
+	if oidcSettings.GroupsClaim == "" {
+		oidcSettings.GroupsClaim = "groups"
+	}
+	if oidcSettings.RedirectURL == "" {
+		oidcSettings.RedirectURL = serverURL(config) + "/oidc/callback"
+	}
+	oidcCache = nil
+}
+
+// serverURL returns the external url of the web server.
+func serverURL(config Configuration) string {
+	if config.Secure {
+		return "https://" + config.FQDN
+	}
+	return "http://" + config.FQDN + ":" + config.Port
+}
+
+func oidcEnabled() bool {
+	oidcLock.Lock()
+	defer oidcLock.Unlock()
+	return oidcSettings.Issuer != ""
+}
+
+// getOIDCClient returns the oidc client, performing provider discovery on first use.
+func getOIDCClient(ctx context.Context) (*oidcClient, error) {
+	oidcLock.Lock()
+	defer oidcLock.Unlock()
+	if oidcSettings.Issuer == "" {
+		return nil, errors.New("single sign-on is not configured")
+	}
+	if oidcCache != nil {
+		return oidcCache, nil
+	}
+	provider, err := oidc.NewProvider(ctx, oidcSettings.Issuer)
+	if err != nil {
+		return nil, fmt.Errorf("oidc discovery %w", err)
+	}
+	oidcCache = &oidcClient{
+		config: oauth2.Config{
+			ClientID:     oidcSettings.ClientID,
+			ClientSecret: oidcSettings.ClientSecret,
+			RedirectURL:  oidcSettings.RedirectURL,
+			Endpoint:     provider.Endpoint(),
+			Scopes:       []string{oidc.ScopeOpenID, "profile", "email"},
+		},
+		verifier:    provider.Verifier(&oidc.Config{ClientID: oidcSettings.ClientID}),
+		groupsClaim: oidcSettings.GroupsClaim,
+		adminGroups: oidcSettings.AdminGroups,
+	}
+	return oidcCache, nil
+}
+
+func randomString() string {
+	buf := make([]byte, 16)
+	_, _ = rand.Read(buf)
+	return hex.EncodeToString(buf)
+}
+
+func oidcLogin(w http.ResponseWriter, r *http.Request) {
+	client, err := getOIDCClient(r.Context())
+	if err != nil {
+		processError(w, http.StatusServiceUnavailable, err.Error())
+		return
+	}
+	state := randomString()
+	nonce := randomString()
+	verifier := oauth2.GenerateVerifier()
+	s := oidcSession(r, int(oidcLoginTime.Seconds()))
+	s.Values["state"] = state
+	s.Values["nonce"] = nonce
+	s.Values["verifier"] = verifier
+	if err := s.Save(r, w); err != nil {
+		processError(w, http.StatusInternalServerError, "save oidc session "+err.Error())
+		return
+	}
+	http.Redirect(w, r, client.config.AuthCodeURL(state,
+		oidc.Nonce(nonce), oauth2.S256ChallengeOption(verifier)), http.StatusFound)
+}
+
+func oidcCallback(w http.ResponseWriter, r *http.Request) {
+	client, err := getOIDCClient(r.Context())
+	if err != nil {
+		processError(w, http.StatusServiceUnavailable, err.Error())
+		return
+	}
+	// the login attempt can only be used once.
+	s := oidcSession(r, -1)
+	state, _ := s.Values["state"].(string)
+	nonce, _ := s.Values["nonce"].(string)
+	verifier, _ := s.Values["verifier"].(string)
+	if err := s.Save(r, w); err != nil {
+		slog.Error("clear oidc session", "error", err)
+	}
+	if state == "" || r.URL.Query().Get("state") != state {
+		processError(w, http.StatusBadRequest, "invalid oidc state")
+		return
+	}
+	if errMsg := r.URL.Query().Get("error"); errMsg != "" {
+		processError(w, http.StatusUnauthorized, "oidc login failed: "+errMsg)
+		return
+	}
+	token, err := client.config.Exchange(r.Context(), r.URL.Query().Get("code"),
+		oauth2.VerifierOption(verifier))
+	if err != nil {
+		processError(w, http.StatusUnauthorized, "oidc code exchange failed")
+		slog.Error("oidc exchange", "error", err)
+		return
+	}
+	rawIDToken, ok := token.Extra("id_token").(string)
+	if !ok {
+		processError(w, http.StatusUnauthorized, "oidc response missing id token")
+		return
+	}
+	idToken, err := client.verifier.Verify(r.Context(), rawIDToken)
+	if err != nil {
+		slog.Error("oidc verify", "error", err)
+		processError(w, http.StatusUnauthorized, "invalid id token")
+		return
+	}
+	claims := oidcClaims{}
+	all := map[string]any{}
+	if err := idToken.Claims(&claims); err != nil {
+		processError(w, http.StatusUnauthorized, "invalid id token claims")
+		return
+	}
+	if err := idToken.Claims(&all); err != nil {
+		processError(w, http.StatusUnauthorized, "invalid id token claims")
+		return
+	}
+	if claims.Nonce != nonce {
+		processError(w, http.StatusUnauthorized, "invalid id token nonce")
+		return
+	}
+	user, err := provisionOIDCUser(claims, groups(all[client.groupsClaim]), client.adminGroups)
+	if err != nil {
+		processError(w, errorStatus(err), err.Error())
+		return
+	}
+	saveSession(w, r, user)
+	slog.Info("oidc login", "user", user.Username, "admin", user.IsAdmin)
+	// the session cookie is SameSite strict so it would not be sent when
+	// following a redirect from the provider; load the main page from here instead.
+	render(w, "ssoRedirect", nil)
+}
+
+// oidcSession returns the short lived session holding an in-progress oidc login.
+// It is SameSite lax so that it is returned on the redirect from the provider.
+func oidcSession(r *http.Request, maxAge int) *sessions.Session {
+	s, err := store.Get(r, oidcCookieName)
+	if err != nil {
+		s = sessions.NewSession(store, oidcCookieName)
+	}
+	options := *store.Options
+	options.MaxAge = maxAge
+	options.SameSite = http.SameSiteLaxMode
+	s.Options = &options
+	return s
+}
+
+// groups converts a groups claim to a list of group names.
+func groups(claim any) []string {
+	names := []string{}
+	switch value := claim.(type) {
+	case string:
+		names = append(names, value)
+	case []any:
+		for _, v := range value {
+			if name, ok := v.(string); ok {
+				names = append(names, name)
+			}
+		}
+	}
+	return names
+}
+
+// oidcIdentity returns the identity of a sso user; the subject is only unique
+// for an issuer.
+func oidcIdentity(issuer, subject string) string {
+	return issuer + " " + subject
+}
+
+// identityUser returns the user linked to a sso identity.
+func identityUser(identity string) (plexus.User, bool, error) {
+	users, err := boltdb.GetAll[plexus.User](userTable)
+	if err != nil {
+		return plexus.User{}, false, err
+	}
+	for _, user := range users {
+		if user.Identity == identity {
+			return user, true, nil
+		}
+	}
+	return plexus.User{}, false, nil
+}
+
+// provisionOIDCUser returns the user linked to the sso identity of claims,
+// creating it on first login. The username claims only name new users; an
+// existing user is only used by sso once an admin links it to the identity.
+// Admin rights of sso users are refreshed from the group claims on every login.
+func provisionOIDCUser(claims oidcClaims, memberOf, adminGroups []string) (plexus.User, error) {
+	if claims.Issuer == "" || claims.Subject == "" {
+		return plexus.User{}, requestError("id token has no issuer or subject")
+	}
+	identity := oidcIdentity(claims.Issuer, claims.Subject)
+	user, found, err := identityUser(identity)
+	if err != nil {
+		return user, err
+	}
+	var before any
+	if found {
+		before = auditUser(user)
+	} else {
+		username := claims.PreferredUsername
+		if username == "" {
+			username = claims.Email
+		}
+		if username == "" {
+			username = claims.Subject
+		}
+		if _, err := boltdb.Get[plexus.User](username, userTable); err == nil {
+			return user, requestError("user " + username + " exists; an admin must link it to the sso identity")
+		} else if !errors.Is(err, boltdb.ErrNoResults) {
+			return user, err
+		}
+		// sso users cannot login with a password
+		password, err := hashPassword(randomString() + randomString())
+		if err != nil {
+			return user, err
+		}
+		user = plexus.User{
+			Username: username,
+			Password: password,
+			Provider: oidcProvider,
+			Identity: identity,
+		}
+		slog.Info("provisioning oidc user", "user", username)
+	}
+	// linked local users keep the admin rights set locally.
+	if user.Provider == oidcProvider {
+		user.IsAdmin = slices.ContainsFunc(memberOf, func(group string) bool {
+			return slices.Contains(adminGroups, group)
+		})
+	}
+	user.Updated = time.Now()
+	if err := save(user, user.Username, userTable); err != nil {
+		return user, fmt.Errorf("save oidc user %w", err)
+	}
+	user.Password = ""
+	audit(oidcProvider+":"+claims.Subject, "user.provision", user.Username, before, auditUser(user))
+	return user, nil
+}
+
+// linkOIDCUser links a user to the sso subject of the configured issuer so
+// that the subject logs in as the user; a blank subject removes the link.
+func linkOIDCUser(actor, username, subject string) error {
+	oidcLock.Lock()
+	issuer := oidcSettings.Issuer
+	oidcLock.Unlock()
+	if issuer == "" {
+		return requestError("single sign-on is not configured")
+	}
+	user, err := boltdb.Get[plexus.User](username, userTable)
+	if err != nil {
+		return err
+	}
+	before := auditUser(user)
+	user.Identity = ""
+	if subject != "" {
+		user.Identity = oidcIdentity(issuer, subject)
+		linked, found, err := identityUser(user.Identity)
+		if err != nil {
+			return err
+		}
+		if found && linked.Username != username {
+			return requestError("sso subject is linked to user " + linked.Username)
+		}
+	}
+	user.Updated = time.Now()
+	if err := save(user, user.Username, userTable); err != nil {
+		return fmt.Errorf("save user %w", err)
+	}
+	audit(actor, "user.link", username, before, auditUser(user))
+	return nil
+}
@@ -0,0 +1,286 @@
+package server
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Kairum-Labs/should"
+	"github.com/devilcove/boltdb"
+	"github.com/devilcove/plexus"
+)
+
+const testRedirect = "http://plexus.test/oidc/callback"
+
+// testIDP is a minimal OpenID Connect provider supporting the authorization code flow with PKCE.
+type testIDP struct {
+	*httptest.Server
+	key      *rsa.PrivateKey
+	lock     sync.Mutex
+	claims   map[string]any
+	badNonce bool
+	codes    map[string]testGrant
+	methods  []string
+}
+
+type testGrant struct {
+	nonce     string
+	challenge string
+}
+
+func newTestIDP(t *testing.T) *testIDP {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	should.NotBeError(t, err)
+	idp := &testIDP{key: key, codes: map[string]testGrant{}}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /.well-known/openid-configuration", idp.discovery)
+	mux.HandleFunc("GET /jwks", idp.jwks)
+	mux.HandleFunc("GET /authorize", idp.authorize)
+	mux.HandleFunc("POST /token", idp.token)
+	idp.Server = httptest.NewServer(mux)
+	t.Cleanup(idp.Close)
+	return idp
+}
+
+func (idp *testIDP) discovery(w http.ResponseWriter, _ *http.Request) {
+	_ = json.NewEncoder(w).Encode(map[string]any{
+		"issuer":                                idp.URL,
+		"authorization_endpoint":                idp.URL + "/authorize",
+		"token_endpoint":                        idp.URL + "/token",
+		"jwks_uri":                              idp.URL + "/jwks",
+		"id_token_signing_alg_values_supported": []string{"RS256"},
+	})
+}
+
+func (idp *testIDP) jwks(w http.ResponseWriter, _ *http.Request) {
+	encode := base64.RawURLEncoding.EncodeToString
+	_ = json.NewEncoder(w).Encode(map[string]any{
+		"keys": []map[string]string{{
+			"kty": "RSA",
+			"kid": "test",
+			"use": "sig",
+			"alg": "RS256",
+			"n":   encode(idp.key.N.Bytes()),
+			"e":   encode(big.NewInt(int64(idp.key.E)).Bytes()),
+		}},
+	})
+}
+
+func (idp *testIDP) authorize(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	idp.lock.Lock()
+	code := randomString()
+	idp.codes[code] = testGrant{nonce: query.Get("nonce"), challenge: query.Get("code_challenge")}
+	idp.methods = append(idp.methods, query.Get("code_challenge_method"))
+	idp.lock.Unlock()
+	redirect := query.Get("redirect_uri") + "?" + url.Values{
+		"code":  {code},
+		"state": {query.Get("state")},
+	}.Encode()
+	http.Redirect(w, r, redirect, http.StatusFound)
+}
+
+func (idp *testIDP) token(w http.ResponseWriter, r *http.Request) {
+	idp.lock.Lock()
+	defer idp.lock.Unlock()
+	grant, ok := idp.codes[r.FormValue("code")]
+	delete(idp.codes, r.FormValue("code"))
+	sum := sha256.Sum256([]byte(r.FormValue("code_verifier")))
+	if !ok || base64.RawURLEncoding.EncodeToString(sum[:]) != grant.challenge {
+		w.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+		return
+	}
+	claims := map[string]any{
+		"iss":   idp.URL,
+		"aud":   "plexus",
+		"sub":   "1234",
+		"iat":   time.Now().Unix(),
+		"exp":   time.Now().Add(time.Hour).Unix(),
+		"nonce": grant.nonce,
+	}
+	if idp.badNonce {
+		claims["nonce"] = "wrong"
+	}
+	for k, v := range idp.claims {
+		claims[k] = v
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]any{
+		"access_token": "access",
+		"token_type":   "Bearer",
+		"expires_in":   3600,
+		"id_token":     idp.sign(claims),
+	})
+}
+
+func (idp *testIDP) sign(claims map[string]any) string {
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "kid": "test", "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." +
+		base64.RawURLEncoding.EncodeToString(payload)
+	sum := sha256.Sum256([]byte(signed))
+	signature, _ := rsa.SignPKCS1v15(rand.Reader, idp.key, crypto.SHA256, sum[:])
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+// ssoLogin runs the browser side of an sso login and returns the callback response.
+func ssoLogin(t *testing.T, idp *testIDP, claims map[string]any) *httptest.ResponseRecorder {
+	t.Helper()
+	idp.claims = claims
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/oidc/login", nil))
+	should.BeEqual(t, w.Code, http.StatusFound)
+	cookies := w.Result().Cookies()
+	client := http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	response, err := client.Get(w.Header().Get("Location"))
+	should.NotBeError(t, err)
+	response.Body.Close()
+	callback, err := url.Parse(response.Header.Get("Location"))
+	should.NotBeError(t, err)
+	r := httptest.NewRequest(http.MethodGet, callback.RequestURI(), nil)
+	for _, cookie := range cookies {
+		r.AddCookie(cookie)
+	}
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+	return w
+}
+
+func sessionCookie(w *httptest.ResponseRecorder) *http.Cookie {
+	for _, cookie := range w.Result().Cookies() {
+		if cookie.Name == cookieName {
+			return cookie
+		}
+	}
+	return nil
+}
+
+func TestOIDCDisabled(t *testing.T) {
+	configureOIDC(Configuration{})
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/oidc/login", nil))
+	should.BeEqual(t, w.Code, http.StatusServiceUnavailable)
+	should.BeFalse(t, oidcEnabled())
+}
+
+func TestOIDCLogin(t *testing.T) {
+	deleteAllUsers(t)
+	idp := newTestIDP(t)
+	configureOIDC(Configuration{OIDC: OIDCConfig{
+		Issuer:      idp.URL,
+		ClientID:    "plexus",
+		RedirectURL: testRedirect,
+		AdminGroups: []string{"plexus-admins"},
+	}})
+	defer configureOIDC(Configuration{})
+
+	t.Run("loginPage", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+		should.ContainSubstring(t, w.Body.String(), "/oidc/login")
+	})
+	t.Run("admin", func(t *testing.T) {
+		w := ssoLogin(t, idp, map[string]any{
+			"preferred_username": "alice",
+			"groups":             []string{"staff", "plexus-admins"},
+		})
+		should.BeEqual(t, w.Code, http.StatusOK)
+		should.ContainSubstring(t, w.Body.String(), `url=/`)
+		should.BeEqual(t, idp.methods[len(idp.methods)-1], "S256")
+		user, err := boltdb.Get[plexus.User]("alice", userTable)
+		should.NotBeError(t, err)
+		should.BeTrue(t, user.IsAdmin)
+		should.BeEqual(t, user.Provider, oidcProvider)
+		cookie := sessionCookie(w)
+		should.NotBeNil(t, cookie)
+		r := httptest.NewRequest(http.MethodGet, "/users/", nil)
+		r.AddCookie(cookie)
+		w = httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		should.ContainSubstring(t, w.Body.String(), "<h1>Authorized Users</h1>")
+	})
+	t.Run("groupsRefreshed", func(t *testing.T) {
+		w := ssoLogin(t, idp, map[string]any{"preferred_username": "alice", "groups": "staff"})
+		should.BeEqual(t, w.Code, http.StatusOK)
+		user, err := boltdb.Get[plexus.User]("alice", userTable)
+		should.NotBeError(t, err)
+		should.BeFalse(t, user.IsAdmin)
+	})
+	t.Run("emailUsername", func(t *testing.T) {
+		w := ssoLogin(t, idp, map[string]any{"sub": "5678", "email": "bob@example.org"})
+		should.BeEqual(t, w.Code, http.StatusOK)
+		_, err := boltdb.Get[plexus.User]("bob@example.org", userTable)
+		should.NotBeError(t, err)
+	})
+	t.Run("usernameTaken", func(t *testing.T) {
+		w := ssoLogin(t, idp, map[string]any{"sub": "mallory", "preferred_username": "alice"})
+		should.BeEqual(t, w.Code, http.StatusBadRequest)
+		should.BeNil(t, sessionCookie(w))
+	})
+	t.Run("localUserExists", func(t *testing.T) {
+		createTestUser(t, plexus.User{Username: "carol", Password: "pass"})
+		w := ssoLogin(t, idp, map[string]any{"sub": "9012", "preferred_username": "carol"})
+		should.BeEqual(t, w.Code, http.StatusBadRequest)
+		should.BeNil(t, sessionCookie(w))
+	})
+	t.Run("linked", func(t *testing.T) {
+		should.BeError(t, linkOIDCUser("admin", "carol", "1234"))
+		should.NotBeError(t, linkOIDCUser("admin", "carol", "9012"))
+		w := ssoLogin(t, idp, map[string]any{"sub": "9012", "groups": "plexus-admins"})
+		should.BeEqual(t, w.Code, http.StatusOK)
+		should.NotBeNil(t, sessionCookie(w))
+		user, err := boltdb.Get[plexus.User]("carol", userTable)
+		should.NotBeError(t, err)
+		should.BeEqual(t, user.Provider, "")
+		should.BeFalse(t, user.IsAdmin)
+		should.NotBeError(t, linkOIDCUser("admin", "carol", ""))
+		w = ssoLogin(t, idp, map[string]any{"sub": "9012", "preferred_username": "carol"})
+		should.BeEqual(t, w.Code, http.StatusBadRequest)
+	})
+	t.Run("badNonce", func(t *testing.T) {
+		idp.badNonce = true
+		defer func() { idp.badNonce = false }()
+		w := ssoLogin(t, idp, map[string]any{"preferred_username": "alice"})
+		should.BeEqual(t, w.Code, http.StatusUnauthorized)
+	})
+	t.Run("badState", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/oidc/login", nil))
+		r := httptest.NewRequest(http.MethodGet, "/oidc/callback?code=abc&state=wrong", nil)
+		for _, cookie := range w.Result().Cookies() {
+			r.AddCookie(cookie)
+		}
+		w = httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		should.BeEqual(t, w.Code, http.StatusBadRequest)
+	})
+	t.Run("noPassword", func(t *testing.T) {
+		err := setPassword("admin", "alice", "password")
+		var invalid requestError
+		should.BeTrue(t, errors.As(err, &invalid))
+		should.BeFalse(t, validateUser(&plexus.User{Username: "alice", Password: ""}))
+	})
+}
+
+func TestGroups(t *testing.T) {
+	should.BeEqual(t, groups(nil), []string{})
+	should.BeEqual(t, groups("a"), []string{"a"})
+	should.BeEqual(t, groups([]any{"a", 1, "b"}), []string{"a", "b"})
+	should.BeTrue(t, strings.HasSuffix(serverURL(Configuration{FQDN: "x", Secure: true}), "//x"))
+}
@@ -0,0 +1,303 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/devilcove/boltdb"
+	"github.com/devilcove/configuration"
+	"github.com/devilcove/plexus"
+	"github.com/devilcove/plexus/internal/packetrelay"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nkeys"
+)
+
+const (
+	relayHandshakeTime = time.Second * 10
+	relayWriteTime     = time.Second * 5
+	relayAuthTime      = time.Minute
+	// relaySubject is the subject on which the servers of a cluster forward
+	// packets to the server their destination is connected to.
+	relaySubject = "relay."
+)
+
+var errRelayAuth = errors.New("packet relay authentication failed")
+
+// relayHub forwards wireguard packets between the agents connected to the
+// packet relay. On a cluster, packets to agents connected to another server are
+// forwarded through the broker.
+type relayHub struct {
+	mu      sync.Mutex
+	clients map[string]*relayConn
+	cluster bool
+}
+
+// relayConn is an agent connected to the packet relay.
+type relayConn struct {
+	key     string
+	conn    net.Conn
+	mu      sync.Mutex
+	allowed map[string]time.Time
+	sub     *nats.Subscription
+}
+
+func newRelayHub() *relayHub {
+	return &relayHub{clients: map[string]*relayConn{}}
+}
+
+// relayServer runs the packet relay that tunnels wireguard packets between
+// peers that cannot reach each other directly, over tls when the server is
+// secure.
+func relayServer(ctx context.Context, wg *sync.WaitGroup, tlsConfig *tls.Config) {
+	defer wg.Done()
+	config := Configuration{}
+	if err := configuration.Get(&config); err != nil {
+		slog.Error("configuration", "error", err)
+		return
+	}
+	if config.RelayPort <= 0 {
+		slog.Info("packet relay disabled")
+		return
+	}
+	listener, err := net.Listen("tcp", ":"+strconv.Itoa(config.RelayPort))
+	if err != nil {
+		slog.Error("packet relay", "error", err)
+		return
+	}
+	if config.Secure {
+		listener = tls.NewListener(listener, tlsConfig)
+	}
+	slog.Info("packet relay started", "port", config.RelayPort)
+	hub := newRelayHub()
+	hub.cluster = clustered(config)
+	hub.serve(ctx, listener)
+	slog.Info("packet relay shutdown")
+}
+
+// serve accepts agents on listener until ctx is done.
+func (h *relayHub) serve(ctx context.Context, listener net.Listener) {
+	go func() {
+		<-ctx.Done()
+		listener.Close()
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		for _, client := range h.clients {
+			client.conn.Close()
+		}
+	}()
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if ctx.Err() != nil || errors.Is(err, net.ErrClosed) {
+				return
+			}
+			slog.Debug("packet relay accept", "error", err)
+			continue
+		}
+		go h.handle(conn)
+	}
+}
+
+// handle authenticates an agent and forwards its packets until it disconnects.
+func (h *relayHub) handle(conn net.Conn) {
+	defer conn.Close()
+	client, err := authenticateRelayConn(conn)
+	if err != nil {
+		slog.Warn("packet relay", "remote", conn.RemoteAddr(), "error", err)
+		return
+	}
+	h.add(client)
+	defer h.remove(client)
+	slog.Debug("packet relay connected", "peer", client.key, "remote", conn.RemoteAddr())
+	for {
+		kind, payload, err := packetrelay.ReadFrame(conn)
+		if err != nil {
+			slog.Debug("packet relay disconnected", "peer", client.key, "error", err)
+			return
+		}
+		if kind != packetrelay.FramePacket {
+			continue
+		}
+		packet, err := packetrelay.UnmarshalPacket(payload)
+		if err != nil {
+			slog.Debug("packet relay", "peer", client.key, "error", err)
+			continue
+		}
+		h.forward(client, packet)
+	}
+}
+
+// authenticateRelayConn checks that the agent holds the nkey of the peer it
+// claims to be.
+func authenticateRelayConn(conn net.Conn) (*relayConn, error) {
+	if err := conn.SetDeadline(time.Now().Add(relayHandshakeTime)); err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, 32)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	if err := packetrelay.WriteFrame(conn, packetrelay.FrameChallenge, nonce); err != nil {
+		return nil, err
+	}
+	kind, payload, err := packetrelay.ReadFrame(conn)
+	if err != nil {
+		return nil, err
+	}
+	hello := packetrelay.Hello{}
+	if kind != packetrelay.FrameHello {
+		return nil, errRelayAuth
+	}
+	if err := json.Unmarshal(payload, &hello); err != nil {
+		return nil, fmt.Errorf("%w: %w", errRelayAuth, err)
+	}
+	peer, err := boltdb.Get[plexus.Peer](hello.WGPublicKey, peerTable)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", errRelayAuth, err)
+	}
+	kp, err := nkeys.FromPublicKey(peer.PubNkey)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", errRelayAuth, err)
+	}
+	if err := kp.Verify(nonce, hello.Signature); err != nil {
+		return nil, fmt.Errorf("%w: %w", errRelayAuth, err)
+	}
+	if err := packetrelay.WriteFrame(conn, packetrelay.FrameAccept, nil); err != nil {
+		return nil, err
+	}
+	if err := conn.SetDeadline(time.Time{}); err != nil {
+		return nil, err
+	}
+	return &relayConn{key: peer.WGPublicKey, conn: conn, allowed: map[string]time.Time{}}, nil
+}
+
+// add registers client, replacing an earlier connection of the same peer.
+func (h *relayHub) add(client *relayConn) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if existing, ok := h.clients[client.key]; ok {
+		existing.conn.Close()
+	}
+	h.clients[client.key] = client
+	if h.cluster && natsConn != nil {
+		sub, err := natsConn.Subscribe(relaySubject+client.key, func(msg *nats.Msg) {
+			packet, err := packetrelay.UnmarshalPacket(msg.Data)
+			if err != nil {
+				slog.Debug("packet relay", "peer", client.key, "error", err)
+				return
+			}
+			client.send(packet)
+		})
+		if err != nil {
+			slog.Error("packet relay subscribe", "peer", client.key, "error", err)
+		}
+		client.sub = sub
+	}
+}
+
+func (h *relayHub) remove(client *relayConn) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.clients[client.key] == client {
+		delete(h.clients, client.key)
+	}
+	if client.sub != nil {
+		_ = client.sub.Unsubscribe()
+	}
+}
+
+// forward sends a packet of from to its destination, if connected to this
+// server or, on a cluster, to another server.
+func (h *relayHub) forward(from *relayConn, packet packetrelay.Packet) {
+	if !from.allows(packet.Network, packet.Peer) {
+		slog.Debug("packet relay: not a peer of network", "network", packet.Network,
+			"from", from.key, "to", packet.Peer)
+		return
+	}
+	h.mu.Lock()
+	to := h.clients[packet.Peer]
+	h.mu.Unlock()
+	relayed := packetrelay.Packet{Network: packet.Network, Peer: from.key, Data: packet.Data}
+	if to != nil {
+		to.send(relayed)
+		return
+	}
+	if !h.cluster || natsConn == nil {
+		return
+	}
+	payload, err := relayed.Marshal()
+	if err != nil {
+		slog.Debug("packet relay", "error", err)
+		return
+	}
+	if err := natsConn.Publish(relaySubject+packet.Peer, payload); err != nil {
+		slog.Debug("packet relay publish", "peer", packet.Peer, "error", err)
+	}
+}
+
+// allows reports whether the client and peer are peers of network. Successful
+// checks are cached for relayAuthTime.
+func (c *relayConn) allows(network, peer string) bool {
+	pair := network + "/" + peer
+	if checked, ok := c.allowed[pair]; ok && time.Since(checked) < relayAuthTime {
+		return true
+	}
+	delete(c.allowed, pair)
+	n, err := boltdb.Get[plexus.Network](network, networkTable)
+	if err != nil || !peerInNetwork(n, c.key) || !peerInNetwork(n, peer) {
+		return false
+	}
+	c.allowed[pair] = time.Now()
+	return true
+}
+
+// send writes a packet to the agent; the connection is closed when the agent
+// does not keep up.
+func (c *relayConn) send(packet packetrelay.Packet) {
+	payload, err := packet.Marshal()
+	if err != nil {
+		slog.Debug("packet relay", "error", err)
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.conn.SetWriteDeadline(time.Now().Add(relayWriteTime)); err != nil {
+		c.conn.Close()
+		return
+	}
+	if err := packetrelay.WriteFrame(c.conn, packetrelay.FramePacket, payload); err != nil {
+		slog.Debug("packet relay write", "peer", c.key, "error", err)
+		c.conn.Close()
+	}
+}
+
+// relayAddress returns the url of the packet relay advertised to agents in
+// registration keys, or a blank string when it is disabled.
+func relayAddress(config Configuration) string {
+	if config.RelayPort <= 0 || config.FQDN == "" {
+		return ""
+	}
+	scheme := "tcp://"
+	if config.Secure {
+		scheme = "tls://"
+	}
+	return scheme + net.JoinHostPort(config.FQDN, strconv.Itoa(config.RelayPort))
+}
+
+// relayEnabled reports whether the packet relay runs.
+func relayEnabled() bool {
+	config := Configuration{}
+	if err := configuration.Get(&config); err != nil {
+		return false
+	}
+	return config.RelayPort > 0
+}
@@ -0,0 +1,155 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/Kairum-Labs/should"
+	"github.com/devilcove/boltdb"
+	"github.com/devilcove/plexus"
+	"github.com/devilcove/plexus/internal/packetrelay"
+	"github.com/nats-io/nkeys"
+)
+
+// relayTestPeer gives the peer id an nkey and returns it.
+func relayTestPeer(t *testing.T, id string) nkeys.KeyPair {
+	t.Helper()
+	kp, err := nkeys.CreateUser()
+	should.NotBeError(t, err)
+	public, err := kp.PublicKey()
+	should.NotBeError(t, err)
+	peer, err := boltdb.Get[plexus.Peer](id, peerTable)
+	should.NotBeError(t, err)
+	peer.PubNkey = public
+	should.NotBeError(t, boltdb.Save(peer, id, peerTable))
+	return kp
+}
+
+// relayTestConn connects to the packet relay at addr as the peer id.
+func relayTestConn(t *testing.T, addr, id string, kp nkeys.KeyPair) (net.Conn, error) {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	should.NotBeError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	should.NotBeError(t, conn.SetDeadline(time.Now().Add(time.Second*5)))
+	kind, nonce, err := packetrelay.ReadFrame(conn)
+	should.NotBeError(t, err)
+	should.BeEqual(t, kind, packetrelay.FrameChallenge)
+	signature, err := kp.Sign(nonce)
+	should.NotBeError(t, err)
+	hello, err := json.Marshal(packetrelay.Hello{WGPublicKey: id, Signature: signature})
+	should.NotBeError(t, err)
+	should.NotBeError(t, packetrelay.WriteFrame(conn, packetrelay.FrameHello, hello))
+	kind, _, err = packetrelay.ReadFrame(conn)
+	if err != nil {
+		return nil, err
+	}
+	should.BeEqual(t, kind, packetrelay.FrameAccept)
+	return conn, nil
+}
+
+func TestPacketRelay(t *testing.T) {
+	setup(t)
+	defer shutdown(t)
+	deleteAllPeers(t)
+	deleteAllNetworks(t)
+	defer deleteAllPeers(t)
+	defer deleteAllNetworks(t)
+	createTestNetwork(t)
+	alpha := createTestNetworkPeer(t)
+	beta := createTestNetworkPeer(t)
+	outsider := createTestPeer(t)
+	alphaKey := relayTestPeer(t, alpha)
+	betaKey := relayTestPeer(t, beta)
+	outsiderKey := relayTestPeer(t, outsider)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	should.NotBeError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go newRelayHub().serve(ctx, listener)
+	addr := listener.Addr().String()
+	send := func(t *testing.T, conn net.Conn, packet packetrelay.Packet) {
+		t.Helper()
+		payload, err := packet.Marshal()
+		should.NotBeError(t, err)
+		should.NotBeError(t, packetrelay.WriteFrame(conn, packetrelay.FramePacket, payload))
+	}
+	receive := func(t *testing.T, conn net.Conn) (packetrelay.Packet, error) {
+		t.Helper()
+		should.NotBeError(t, conn.SetReadDeadline(time.Now().Add(time.Millisecond*500)))
+		kind, payload, err := packetrelay.ReadFrame(conn)
+		if err != nil {
+			return packetrelay.Packet{}, err
+		}
+		should.BeEqual(t, kind, packetrelay.FramePacket)
+		return packetrelay.UnmarshalPacket(payload)
+	}
+
+	t.Run("badSignature", func(t *testing.T) {
+		_, err := relayTestConn(t, addr, alpha, betaKey)
+		should.BeError(t, err)
+	})
+	alphaConn, err := relayTestConn(t, addr, alpha, alphaKey)
+	should.NotBeError(t, err)
+	betaConn, err := relayTestConn(t, addr, beta, betaKey)
+	should.NotBeError(t, err)
+	outsiderConn, err := relayTestConn(t, addr, outsider, outsiderKey)
+	should.NotBeError(t, err)
+
+	t.Run("forward", func(t *testing.T) {
+		send(t, alphaConn, packetrelay.Packet{Network: "valid", Peer: beta, Data: []byte("handshake")})
+		packet, err := receive(t, betaConn)
+		should.NotBeError(t, err)
+		should.BeEqual(t, packet.Network, "valid")
+		should.BeEqual(t, packet.Peer, alpha)
+		should.BeEqual(t, string(packet.Data), "handshake")
+		send(t, betaConn, packetrelay.Packet{Network: "valid", Peer: alpha, Data: []byte("response")})
+		packet, err = receive(t, alphaConn)
+		should.NotBeError(t, err)
+		should.BeEqual(t, packet.Peer, beta)
+	})
+	t.Run("notInNetwork", func(t *testing.T) {
+		send(t, outsiderConn, packetrelay.Packet{Network: "valid", Peer: beta, Data: []byte("intrusion")})
+		_, err := receive(t, betaConn)
+		should.BeError(t, err)
+		send(t, alphaConn, packetrelay.Packet{Network: "valid", Peer: outsider, Data: []byte("leak")})
+		_, err = receive(t, outsiderConn)
+		should.BeError(t, err)
+	})
+	t.Run("cluster", func(t *testing.T) {
+		// peers connected to different servers of a cluster.
+		one := newRelayHub()
+		one.cluster = true
+		two := newRelayHub()
+		two.cluster = true
+		listenerOne, err := net.Listen("tcp", "127.0.0.1:0")
+		should.NotBeError(t, err)
+		listenerTwo, err := net.Listen("tcp", "127.0.0.1:0")
+		should.NotBeError(t, err)
+		go one.serve(ctx, listenerOne)
+		go two.serve(ctx, listenerTwo)
+		alphaConn, err := relayTestConn(t, listenerOne.Addr().String(), alpha, alphaKey)
+		should.NotBeError(t, err)
+		betaConn, err := relayTestConn(t, listenerTwo.Addr().String(), beta, betaKey)
+		should.NotBeError(t, err)
+		// wait for the subscription of the server of beta.
+		should.NotBeError(t, natsConn.Flush())
+		send(t, alphaConn, packetrelay.Packet{Network: "valid", Peer: beta, Data: []byte("across")})
+		packet, err := receive(t, betaConn)
+		should.NotBeError(t, err)
+		should.BeEqual(t, packet.Peer, alpha)
+		should.BeEqual(t, string(packet.Data), "across")
+	})
+}
+
+func TestRelayAddress(t *testing.T) {
+	should.BeEqual(t, relayAddress(Configuration{FQDN: "plexus.example.com", RelayPort: 4223}),
+		"tcp://plexus.example.com:4223")
+	should.BeEqual(t, relayAddress(Configuration{FQDN: "plexus.example.com", Secure: true, RelayPort: 443}),
+		"tls://plexus.example.com:443")
+	should.BeEqual(t, relayAddress(Configuration{FQDN: "plexus.example.com"}), "")
+	should.BeEqual(t, relayAddress(Configuration{FQDN: "plexus.example.com", RelayPort: -1}), "")
+}
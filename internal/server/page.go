@@ -23,6 +23,7 @@ var (
 type Page struct {
 	Page        string
 	NeedsLogin  bool
+	SSO         bool
 	Version     string
 	Theme       string
 	Font        string
@@ -44,8 +45,17 @@ func displayMain(w http.ResponseWriter, r *http.Request) {
 	if err != nil {
 		slog.Error("get networks for main display", "error", err)
 	}
+	if session.IsNew {
+		networks = []plexus.Network{}
+	}
+	networks = visibleNetworks(GetSessionData(r), networks)
+	page.Networks = []string{}
+	for _, network := range networks {
+		page.Networks = append(page.Networks, network.Name)
+	}
 	page.Data = networks
 	page.NeedsLogin = session.IsNew
+	page.SSO = oidcEnabled()
 	slog.Debug("display main page", "session", session, "page", page)
 
 	render(w, "layout", page)
@@ -124,20 +134,23 @@ func getPage(user any) Page {
 	if user == nil {
 		return initialize()
 	}
-	if page, ok := pages[user.(string)]; ok {
-		page.DefaultDate = time.Now().Local().Format("2006-01-02")
-		networks, err := boltdb.GetAll[plexus.Network](networkTable)
-		if err != nil {
-			slog.Error("get networks", "error", err)
-		}
-		page.Networks = []string{}
-		for _, net := range networks {
-			page.Networks = append(page.Networks, net.Name)
-		}
-		return page
-	}
-	pages[user.(string)] = initialize()
-	return pages[user.(string)]
+	page, ok := pages[user.(string)]
+	if !ok {
+		page = initialize()
+		pages[user.(string)] = page
+	}
+	page.DefaultDate = time.Now().Local().Format("2006-01-02")
+	networks, err := boltdb.GetAll[plexus.Network](networkTable)
+	if err != nil {
+		slog.Error("get networks", "error", err)
+	}
+	networks = visibleNetworks(plexus.User{Username: user.(string)}, networks)
+	page.Networks = []string{}
+	for _, net := range networks {
+		page.Networks = append(page.Networks, net.Name)
+	}
+	page.Data = networks
+	return page
 }
 
 func render(w io.Writer, template string, data any) {
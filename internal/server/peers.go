@@ -5,6 +5,7 @@ import (
 	"log/slog"
 	"net/http"
 	"slices"
+	"strings"
 	"time"
 
 	"github.com/devilcove/boltdb"
@@ -13,21 +14,39 @@ import (
 	"github.com/nats-io/nats-server/v2/server"
 )
 
-func displayPeers(w http.ResponseWriter, _ *http.Request) {
-	displayPeers := []plexus.Peer{}
+func displayPeers(w http.ResponseWriter, r *http.Request) {
+	data := struct {
+		Peers      []plexus.Peer
+		Pending    []plexus.PendingPeer
+		Groups     []plexus.Group
+		IsOperator bool
+	}{}
 	peers, err := boltdb.GetAll[plexus.Peer](peerTable)
 	if err != nil {
 		processError(w, http.StatusInternalServerError, err.Error())
 		return
 	}
 	// set Status for display
-	for _, peer := range peers {
+	for _, peer := range visiblePeers(GetSessionData(r), peers) {
 		if time.Since(peer.Updated) < connectedTime {
 			peer.NatsConnected = true
 		}
-		displayPeers = append(displayPeers, peer)
+		data.Peers = append(data.Peers, peer)
+	}
+	data.Groups, err = boltdb.GetAll[plexus.Group](groupTable)
+	if err != nil {
+		processError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if GetSessionData(r).IsAdmin {
+		data.Pending, err = pendingPeers()
+		if err != nil {
+			processError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
 	}
-	render(w, peerTable, displayPeers)
+	data.IsOperator = hasAnyRole(GetSessionData(r), roleOperator)
+	render(w, peerTable, data)
 }
 
 func peerDetails(w http.ResponseWriter, r *http.Request) {
@@ -37,12 +56,37 @@ func peerDetails(w http.ResponseWriter, r *http.Request) {
 		processError(w, http.StatusInternalServerError, err.Error())
 		return
 	}
-	render(w, "peerDetails", peer)
+	groups, err := boltdb.GetAll[plexus.Group](groupTable)
+	if err != nil {
+		processError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	type groupChoice struct {
+		Name   string
+		Member bool
+	}
+	data := struct {
+		plexus.Peer
+		TagList      string
+		GroupChoices []groupChoice
+		IsOperator   bool
+	}{
+		Peer:       peer,
+		TagList:    strings.Join(peer.Tags, ","),
+		IsOperator: hasPeerRole(GetSessionData(r), id, roleOperator),
+	}
+	for _, group := range groups {
+		data.GroupChoices = append(data.GroupChoices, groupChoice{
+			Name:   group.Name,
+			Member: slices.Contains(peer.Groups, group.Name),
+		})
+	}
+	render(w, "peerDetails", data)
 }
 
 func deletePeer(w http.ResponseWriter, r *http.Request) {
 	id := r.PathValue("id")
-	peer, err := discardPeer(id)
+	peer, err := discardPeer(userActor(r), id)
 	if err != nil {
 		processError(w, http.StatusBadRequest, id+" "+err.Error())
 		return
@@ -51,7 +95,7 @@ func deletePeer(w http.ResponseWriter, r *http.Request) {
 	displayPeers(w, r)
 }
 
-func discardPeer(id string) (plexus.Peer, error) {
+func discardPeer(actor, id string) (plexus.Peer, error) {
 	peer, err := boltdb.Get[plexus.Peer](id, peerTable)
 	if err != nil {
 		return peer, err
@@ -79,14 +123,17 @@ func discardPeer(id string) (plexus.Peer, error) {
 			}
 		}
 		if found {
-			if err := boltdb.Save(network, network.Name, networkTable); err != nil {
+			elected := electRouters(&network)
+			if err := save(network, network.Name, networkTable); err != nil {
 				slog.Error("save network during peer deletion", "error", err)
 			}
+			publishRouters(network.Name, "", elected)
 		}
 	}
-	if err := boltdb.Delete[plexus.Peer](peer.WGPublicKey, peerTable); err != nil {
+	if err := remove(peer.WGPublicKey, peerTable); err != nil {
 		return peer, err
 	}
+	audit(actor, "peer.delete", peer.Name, peer, nil)
 	request := &plexus.DeviceUpdate{
 		Action: plexus.LeaveServer,
 	}
@@ -112,6 +159,8 @@ func getDeviceUsers() []*server.NkeyUser {
 }
 
 func deletePeerFromBroker(key string) {
+	nkeysLock.Lock()
+	defer nkeysLock.Unlock()
 	for i, optionKey := range natsOptions.Nkeys {
 		if optionKey.Nkey == key {
 			natsOptions.Nkeys = slices.Delete(natsOptions.Nkeys, i, i+1)
@@ -157,7 +206,7 @@ func pingPeers() {
 
 func savePeer(peer plexus.Peer) {
 	slog.Debug("saving peer", "peer", peer.Name, "key", peer.WGPublicKey)
-	if err := boltdb.Save(peer, peer.WGPublicKey, peerTable); err != nil {
+	if err := save(peer, peer.WGPublicKey, peerTable); err != nil {
 		slog.Error("save peer", "peer", peer.Name, "error", err)
 	}
 	networks, err := boltdb.GetAll[plexus.Network](networkTable)
@@ -168,15 +217,19 @@ func savePeer(peer plexus.Peer) {
 		for i, netPeer := range network.Peers {
 			if netPeer.WGPublicKey == peer.WGPublicKey {
 				network.Peers[i].NatsConnected = peer.NatsConnected
+				// routers the server lost contact with fail over.
+				elected := electRouters(&network)
 				slog.Debug(
 					"saving network peer",
 					"network", network.Name,
 					"peer", netPeer.HostName,
 					"key", netPeer.WGPublicKey,
 				)
-				if err := boltdb.Save(network, network.Name, networkTable); err != nil {
+				if err := save(network, network.Name, networkTable); err != nil {
 					slog.Error("save network", "network", network.Name, "error", err)
+					continue
 				}
+				publishRouters(network.Name, "", elected)
 			}
 		}
 	}
@@ -15,6 +15,7 @@ func TestDisplayPeers(t *testing.T) {
 	user := plexus.User{
 		Username: "hello",
 		Password: "world",
+		IsAdmin:  true,
 	}
 	createTestUser(t, user)
 	createTestNetwork(t)
@@ -41,6 +42,28 @@ func TestDisplayPeers(t *testing.T) {
 		should.ContainSubstring(t, string(body), "Peer: testing")
 	})
 
+	t.Run("natType", func(t *testing.T) {
+		peer, err := boltdb.Get[plexus.Peer](peerID, peerTable)
+		should.NotBeError(t, err)
+		response := processCheckin(&plexus.CheckinData{
+			ID:       peerID,
+			Endpoint: peer.Endpoint,
+			NatType:  plexus.NatSymmetric,
+		})
+		should.BeEqual(t, response.Message, checkinProcessed)
+		peer, err = boltdb.Get[plexus.Peer](peerID, peerTable)
+		should.NotBeError(t, err)
+		should.BeEqual(t, peer.NatType, plexus.NatSymmetric)
+		should.BeTrue(t, peer.NeedsRelay())
+		r := httptest.NewRequest(http.MethodGet, "/peers/"+peerID, nil)
+		r.AddCookie(testLogin(t, user))
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		body, err := io.ReadAll(w.Result().Body)
+		should.NotBeError(t, err)
+		should.ContainSubstring(t, string(body), "symmetric (relay needed)")
+	})
+
 	t.Run("peerDelete", func(t *testing.T) {
 		r := httptest.NewRequest(http.MethodDelete, "/peers/"+peerID, nil)
 		r.AddCookie(testLogin(t, user))
@@ -59,6 +82,7 @@ func TestAddPeerToNetwork(t *testing.T) {
 	user := plexus.User{
 		Username: "hello",
 		Password: "world",
+		IsAdmin:  true,
 	}
 	createTestUser(t, user)
 	createTestNetwork(t)
@@ -98,6 +122,7 @@ func TestRemovePeerFromNetwork(t *testing.T) {
 	user := plexus.User{
 		Username: "hello",
 		Password: "world",
+		IsAdmin:  true,
 	}
 	createTestUser(t, user)
 	createTestNetwork(t)
@@ -129,6 +154,7 @@ func TestDisplayNetworkPeer(t *testing.T) {
 	user := plexus.User{
 		Username: "hello",
 		Password: "world",
+		IsAdmin:  true,
 	}
 	createTestUser(t, user)
 	createTestNetwork(t)
@@ -168,6 +194,7 @@ func TestGetNetworksForPeer(t *testing.T) {
 	user := plexus.User{
 		Username: "hello",
 		Password: "world",
+		IsAdmin:  true,
 	}
 	createTestUser(t, user)
 	createTestNetwork(t)
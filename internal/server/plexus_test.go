@@ -35,7 +35,10 @@ func TestMain(m *testing.M) {
 		}
 	}
 	if err := boltdb.Initialize("./test.db",
-		[]string{userTable, keyTable, networkTable, peerTable, settingTable, "keypairs"},
+		[]string{
+			userTable, keyTable, networkTable, peerTable, settingTable, tokenTable, auditTable, groupTable, pskTable,
+			pendingTable, rotationTable, "keypairs",
+		},
 	); err != nil {
 		log.Println("init db", err)
 		os.Exit(2)
@@ -139,7 +142,7 @@ func createTestPeer(t *testing.T) string {
 func createTestNetworkPeer(t *testing.T) string {
 	t.Helper()
 	id := createTestPeer(t)
-	_, err := addPeerToNetwork(id, "valid", 51821, 51821)
+	_, err := addPeerToNetwork("admin", id, "valid", 51821, 51821)
 	should.NotBeError(t, err)
 	return id
 }
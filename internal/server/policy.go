@@ -0,0 +1,154 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/devilcove/boltdb"
+	"github.com/devilcove/plexus"
+	"github.com/devilcove/plexus/internal/publish"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// validatePolicy checks and normalizes a policy.
+func validatePolicy(policy plexus.Policy) (plexus.Policy, error) {
+	if !validateNetworkName(policy.Name) {
+		return policy, requestError("invalid policy name")
+	}
+	if err := validateSelector(policy.Source); err != nil {
+		return policy, requestError("invalid source: " + err.Error())
+	}
+	if _, subnet, err := net.ParseCIDR(policy.Destination); err == nil {
+		policy.Destination = subnet.String()
+	} else if err := validateSelector(policy.Destination); err != nil {
+		return policy, requestError("invalid destination: " + err.Error() + " or a subnet")
+	}
+	policy.Protocol = strings.ToLower(policy.Protocol)
+	switch policy.Protocol {
+	case "":
+		policy.Protocol = plexus.ProtoAny
+	case plexus.ProtoAny, plexus.ProtoTCP, plexus.ProtoUDP, plexus.ProtoICMP:
+	default:
+		return policy, requestError("invalid protocol " + policy.Protocol)
+	}
+	if policy.Ports != "" {
+		if policy.Protocol != plexus.ProtoTCP && policy.Protocol != plexus.ProtoUDP {
+			return policy, requestError("ports require protocol tcp or udp")
+		}
+		if _, err := plexus.ParsePorts(policy.Ports); err != nil {
+			return policy, requestError(err.Error())
+		}
+	}
+	return policy, nil
+}
+
+// validateSelector checks that selector is PolicyAny, a peer key, a valid tag
+// or an existing group.
+func validateSelector(selector string) error {
+	switch {
+	case selector == plexus.PolicyAny:
+		return nil
+	case strings.HasPrefix(selector, plexus.PolicyTag):
+		_, _, err := validateLabels([]string{strings.TrimPrefix(selector, plexus.PolicyTag)}, nil)
+		return err
+	case strings.HasPrefix(selector, plexus.PolicyGroup):
+		_, _, err := validateLabels(nil, []string{strings.TrimPrefix(selector, plexus.PolicyGroup)})
+		return err
+	}
+	if _, err := wgtypes.ParseKey(selector); err != nil {
+		return errors.New("must be " + plexus.PolicyAny + ", a peer key, a tag or a group")
+	}
+	return nil
+}
+
+// createPolicy adds a policy to a network and publishes the network policies.
+func createPolicy(actor, networkName string, policy plexus.Policy) (plexus.Network, error) {
+	network, err := boltdb.Get[plexus.Network](networkName, networkTable)
+	if err != nil {
+		return network, err
+	}
+	policy, err = validatePolicy(policy)
+	if err != nil {
+		return network, err
+	}
+	for _, existing := range network.Policies {
+		if existing.Name == policy.Name {
+			return network, requestError("policy name exists")
+		}
+	}
+	before := network
+	before.Policies = slices.Clone(network.Policies)
+	network.Policies = append(network.Policies, policy)
+	if err := save(network, network.Name, networkTable); err != nil {
+		return network, fmt.Errorf("save network %w", err)
+	}
+	slog.Info("policy added", "network", network.Name, "policy", policy.Name)
+	audit(actor, "network.policy.add", network.Name+"/"+policy.Name, before, network)
+	publishPolicies(network)
+	return network, nil
+}
+
+// removePolicy deletes a policy from a network and publishes the network policies.
+func removePolicy(actor, networkName, name string) (plexus.Network, error) {
+	network, err := boltdb.Get[plexus.Network](networkName, networkTable)
+	if err != nil {
+		return network, err
+	}
+	index := slices.IndexFunc(network.Policies, func(p plexus.Policy) bool {
+		return p.Name == name
+	})
+	if index < 0 {
+		return network, requestError("no such policy " + name)
+	}
+	before := network
+	before.Policies = slices.Clone(network.Policies)
+	network.Policies = slices.Delete(network.Policies, index, index+1)
+	if err := save(network, network.Name, networkTable); err != nil {
+		return network, fmt.Errorf("save network %w", err)
+	}
+	slog.Info("policy removed", "network", network.Name, "policy", name)
+	audit(actor, "network.policy.remove", network.Name+"/"+name, before, network)
+	publishPolicies(network)
+	return network, nil
+}
+
+func publishPolicies(network plexus.Network) {
+	if natsConn == nil {
+		slog.Error("not connected to nats", "reason", "publish policies")
+		return
+	}
+	update := plexus.NetworkUpdate{
+		Action:   plexus.UpdatePolicies,
+		Policies: network.Policies,
+	}
+	slog.Debug("publish network update", "network", network.Name, "reason", "policies")
+	publish.Message(natsConn, plexus.Networks+network.Name, update)
+}
+
+func addPolicy(w http.ResponseWriter, r *http.Request) {
+	policy := plexus.Policy{
+		Name:        r.FormValue("name"),
+		Source:      r.FormValue("source"),
+		Destination: r.FormValue("destination"),
+		Protocol:    r.FormValue("protocol"),
+		Ports:       r.FormValue("ports"),
+	}
+	if _, err := createPolicy(userActor(r), r.PathValue("id"), policy); err != nil {
+		processError(w, errorStatus(err), err.Error())
+		return
+	}
+	networkDetails(w, r)
+}
+
+func deletePolicy(w http.ResponseWriter, r *http.Request) {
+	if _, err := removePolicy(userActor(r), r.PathValue("id"), r.PathValue("name")); err != nil {
+		processError(w, errorStatus(err), err.Error())
+		return
+	}
+	networkDetails(w, r)
+}
@@ -0,0 +1,87 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/Kairum-Labs/should"
+	"github.com/devilcove/plexus"
+)
+
+func TestValidatePolicy(t *testing.T) {
+	key := "ZGVhZGJlZWZkZWFkYmVlZmRlYWRiZWVmZGVhZGJlZWY="
+	policy, err := validatePolicy(plexus.Policy{
+		Name: "web", Source: key, Destination: "192.168.1.7/24", Protocol: "TCP", Ports: "80,443",
+	})
+	should.NotBeError(t, err)
+	should.BeEqual(t, policy.Destination, "192.168.1.0/24")
+	should.BeEqual(t, policy.Protocol, plexus.ProtoTCP)
+	policy, err = validatePolicy(plexus.Policy{Name: "all", Source: "*", Destination: "*"})
+	should.NotBeError(t, err)
+	should.BeEqual(t, policy.Protocol, plexus.ProtoAny)
+	_, err = validatePolicy(plexus.Policy{Name: "tags", Source: "tag:web", Destination: "tag:db"})
+	should.NotBeError(t, err)
+	for _, invalid := range []plexus.Policy{
+		{Name: "Bad Name", Source: "*", Destination: "*"},
+		{Name: "source", Source: "laptop", Destination: "*"},
+		{Name: "destination", Source: "*", Destination: "printer"},
+		{Name: "protocol", Source: "*", Destination: "*", Protocol: "gre"},
+		{Name: "icmpports", Source: "*", Destination: "*", Protocol: "icmp", Ports: "22"},
+		{Name: "ports", Source: "*", Destination: "*", Protocol: "udp", Ports: "dns"},
+		{Name: "tag", Source: "tag:bad tag", Destination: "*"},
+		{Name: "group", Source: "*", Destination: "group:missing"},
+	} {
+		_, err := validatePolicy(invalid)
+		should.BeError(t, err)
+		should.BeEqual(t, errorStatus(err), http.StatusBadRequest)
+	}
+}
+
+func TestPolicies(t *testing.T) {
+	setup(t)
+	defer shutdown(t)
+	deleteAllUsers(t)
+	deleteAllNetworks(t)
+	defer deleteAllNetworks(t)
+	createTestNetwork(t)
+	owner := plexus.User{Username: "owner", Password: "pass"}
+	operator := plexus.User{Username: "operator", Password: "pass"}
+	createTestUser(t, owner)
+	createTestUser(t, operator)
+	should.NotBeError(t, setRole("admin", "owner", "valid", roleOwner))
+	should.NotBeError(t, setRole("admin", "operator", "valid", roleOperator))
+	ownerCookie := testLogin(t, owner)
+	operatorCookie := testLogin(t, operator)
+
+	t.Run("operator", func(t *testing.T) {
+		w := apiRequest(t, operatorCookie, http.MethodPost, "/api/v1/networks/valid/policies",
+			`{"Name":"ssh","Source":"*","Destination":"*","Protocol":"tcp","Ports":"22"}`)
+		should.BeEqual(t, w.Code, http.StatusForbidden)
+		w = apiRequest(t, operatorCookie, http.MethodGet, "/api/v1/networks/valid/policies", "")
+		should.BeEqual(t, w.Code, http.StatusOK)
+		should.BeEqual(t, w.Body.String(), "[]\n")
+	})
+	t.Run("add", func(t *testing.T) {
+		w := apiRequest(t, ownerCookie, http.MethodPost, "/api/v1/networks/valid/policies",
+			`{"Name":"ssh","Source":"*","Destination":"*","Protocol":"tcp","Ports":"22"}`)
+		should.BeEqual(t, w.Code, http.StatusCreated)
+		policies := []plexus.Policy{}
+		should.NotBeError(t, json.NewDecoder(w.Body).Decode(&policies))
+		should.BeEqual(t, len(policies), 1)
+		w = apiRequest(t, ownerCookie, http.MethodPost, "/api/v1/networks/valid/policies",
+			`{"Name":"ssh","Source":"*","Destination":"*"}`)
+		should.BeEqual(t, w.Code, http.StatusBadRequest)
+	})
+	t.Run("details", func(t *testing.T) {
+		w := apiRequest(t, ownerCookie, http.MethodGet, "/networks/details/valid", "")
+		should.BeEqual(t, w.Code, http.StatusOK)
+		should.ContainSubstring(t, w.Body.String(), "/networks/policies/valid/ssh")
+	})
+	t.Run("delete", func(t *testing.T) {
+		w := apiRequest(t, ownerCookie, http.MethodDelete, "/api/v1/networks/valid/policies/ssh", "")
+		should.BeEqual(t, w.Code, http.StatusNoContent)
+		w = apiRequest(t, ownerCookie, http.MethodDelete, "/api/v1/networks/valid/policies/ssh", "")
+		should.BeEqual(t, w.Code, http.StatusBadRequest)
+	})
+}
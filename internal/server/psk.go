@@ -0,0 +1,348 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/devilcove/boltdb"
+	"github.com/devilcove/plexus"
+	"github.com/devilcove/plexus/internal/publish"
+	"github.com/nats-io/nats.go"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// networkKeys holds the pairwise preshared keys of a network, indexed by the
+// pairKey of the two peers. Rotated is when the keys were last replaced.
+// Pending are the keys of a rotation, distributed to the peers but only used
+// once both peers of a pair acknowledged them; Acked are the peers that did.
+type networkKeys struct {
+	Network string
+	Keys    map[string]string
+	Pending map[string]string
+	Acked   []string
+	Rotated time.Time
+}
+
+// pairKey returns the index of the preshared key shared by two peers.
+func pairKey(a, b string) string {
+	if a > b {
+		a, b = b, a
+	}
+	return a + ":" + b
+}
+
+// generatePresharedKey returns a new preshared key.
+func generatePresharedKey() (string, error) {
+	psk, err := wgtypes.GenerateKey()
+	if err != nil {
+		return "", fmt.Errorf("generate preshared key %w", err)
+	}
+	return psk.String(), nil
+}
+
+// updateNetworkKeys generates keys for new pairs of peers of a network and
+// drops those of peers that left. When rotate is set, new keys are staged for
+// all pairs; pairs keep their current key until both peers acknowledged it.
+func updateNetworkKeys(network plexus.Network, rotate bool) (networkKeys, error) {
+	keys, err := boltdb.Get[networkKeys](network.Name, pskTable)
+	if err != nil && !errors.Is(err, boltdb.ErrNoResults) {
+		return keys, fmt.Errorf("retrieve preshared keys %w", err)
+	}
+	if keys.Keys == nil {
+		keys = networkKeys{Network: network.Name, Keys: map[string]string{}, Rotated: time.Now()}
+	}
+	if rotate {
+		keys.Pending = nil
+		keys.Acked = nil
+		keys.Rotated = time.Now()
+	}
+	current := map[string]string{}
+	pending := map[string]string{}
+	for i, peer := range network.Peers {
+		for _, other := range network.Peers[i+1:] {
+			pair := pairKey(peer.WGPublicKey, other.WGPublicKey)
+			psk, active := keys.Keys[pair]
+			if active {
+				current[pair] = psk
+			}
+			if staged, ok := keys.Pending[pair]; ok {
+				pending[pair] = staged
+				continue
+			}
+			if active && !rotate {
+				continue
+			}
+			psk, err := generatePresharedKey()
+			if err != nil {
+				return keys, err
+			}
+			if rotate {
+				pending[pair] = psk
+			} else {
+				// the peers of a new pair have no tunnel to break yet.
+				current[pair] = psk
+			}
+		}
+	}
+	keys.Keys = current
+	keys.Pending = pending
+	keys.Acked = slices.DeleteFunc(keys.Acked, func(id string) bool {
+		return !peerInNetwork(network, id)
+	})
+	activatePresharedKeys(&keys)
+	if err := save(keys, network.Name, pskTable); err != nil {
+		return keys, fmt.Errorf("save preshared keys %w", err)
+	}
+	return keys, nil
+}
+
+// activatePresharedKeys replaces the keys of the pairs whose peers both
+// acknowledged their pending key and returns the peers of these pairs.
+func activatePresharedKeys(keys *networkKeys) []string {
+	changed := []string{}
+	for pair, psk := range keys.Pending {
+		a, b, _ := strings.Cut(pair, ":")
+		if !slices.Contains(keys.Acked, a) || !slices.Contains(keys.Acked, b) {
+			continue
+		}
+		keys.Keys[pair] = psk
+		delete(keys.Pending, pair)
+		changed = append(changed, a, b)
+	}
+	if len(keys.Pending) == 0 {
+		keys.Pending = nil
+		keys.Acked = nil
+	}
+	slices.Sort(changed)
+	return slices.Compact(changed)
+}
+
+// renamePresharedKeys moves the preshared keys of a peer that rotated its
+// WireGuard key, so its pairs keep their keys.
+func renamePresharedKeys(network, oldKey, newKey string) error {
+	keys, err := boltdb.Get[networkKeys](network, pskTable)
+	if errors.Is(err, boltdb.ErrNoResults) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("retrieve preshared keys %w", err)
+	}
+	rename := func(pairs map[string]string) map[string]string {
+		renamed := map[string]string{}
+		for pair, psk := range pairs {
+			a, b, _ := strings.Cut(pair, ":")
+			if a == oldKey {
+				a = newKey
+			}
+			if b == oldKey {
+				b = newKey
+			}
+			renamed[pairKey(a, b)] = psk
+		}
+		return renamed
+	}
+	keys.Keys = rename(keys.Keys)
+	if keys.Pending != nil {
+		keys.Pending = rename(keys.Pending)
+	}
+	for i, id := range keys.Acked {
+		if id == oldKey {
+			keys.Acked[i] = newKey
+		}
+	}
+	return save(keys, network, pskTable)
+}
+
+// peerPresharedKeys returns the preshared keys of a peer indexed by the key of
+// the other peer.
+func peerPresharedKeys(keys networkKeys, network plexus.Network, id string) plexus.PresharedKeyUpdate {
+	update := plexus.PresharedKeyUpdate{Network: network.Name, Keys: map[string]string{}}
+	for _, peer := range network.Peers {
+		if peer.WGPublicKey == id {
+			continue
+		}
+		if psk, ok := keys.Keys[pairKey(id, peer.WGPublicKey)]; ok {
+			update.Keys[peer.WGPublicKey] = psk
+		}
+		if psk, ok := keys.Pending[pairKey(id, peer.WGPublicKey)]; ok {
+			if update.Pending == nil {
+				update.Pending = map[string]string{}
+			}
+			update.Pending[peer.WGPublicKey] = psk
+		}
+	}
+	return update
+}
+
+// publishPresharedKeys sends each peer of a network its preshared keys on its
+// own update subject. Peers of a network without preshared keys get an empty
+// set so they remove their keys.
+func publishPresharedKeys(network plexus.Network, rotate bool) error {
+	keys := networkKeys{}
+	if network.UsePSK {
+		var err error
+		keys, err = updateNetworkKeys(network, rotate)
+		if err != nil {
+			return err
+		}
+	} else if err := remove(network.Name, pskTable); err != nil &&
+		!errors.Is(err, boltdb.ErrNoResults) {
+		return fmt.Errorf("delete preshared keys %w", err)
+	}
+	for _, peer := range network.Peers {
+		publish.Message(natsConn, plexus.Update+peer.WGPublicKey+plexus.PresharedKeys,
+			peerPresharedKeys(keys, network, peer.WGPublicKey))
+	}
+	return nil
+}
+
+// refreshPresharedKeys distributes keys for the current peers of a network
+// with preshared keys.
+func refreshPresharedKeys(network plexus.Network) {
+	if !network.UsePSK {
+		return
+	}
+	if err := publishPresharedKeys(network, false); err != nil {
+		slog.Error("publish preshared keys", "network", network.Name, "error", err)
+	}
+}
+
+// rotatePresharedKeys stages new preshared keys for networks whose keys are
+// older than pskLifetime.
+func rotatePresharedKeys() {
+	networks, err := boltdb.GetAll[plexus.Network](networkTable)
+	if err != nil {
+		slog.Error("get networks", "error", err)
+		return
+	}
+	for _, network := range networks {
+		if !network.UsePSK {
+			continue
+		}
+		keys, err := boltdb.Get[networkKeys](network.Name, pskTable)
+		if err == nil && time.Since(keys.Rotated) < pskLifetime {
+			continue
+		}
+		slog.Info("rotating preshared keys", "network", network.Name)
+		if err := publishPresharedKeys(network, true); err != nil {
+			slog.Error("rotate preshared keys", "network", network.Name, "error", err)
+		}
+	}
+}
+
+// setPresharedKeys enables or disables preshared keys for a network. Enabling
+// always stages new keys.
+func setPresharedKeys(actor, name string, enabled bool) (plexus.Network, error) {
+	network, err := boltdb.Get[plexus.Network](name, networkTable)
+	if err != nil {
+		return network, err
+	}
+	before := network
+	network.UsePSK = enabled
+	if err := save(network, network.Name, networkTable); err != nil {
+		return network, fmt.Errorf("save network %w", err)
+	}
+	audit(actor, "network.psk", network.Name, before, network)
+	if err := publishPresharedKeys(network, true); err != nil {
+		return network, err
+	}
+	return network, nil
+}
+
+// processPresharedKeysRequest returns the preshared keys of a peer in all its
+// networks.
+func processPresharedKeysRequest(id string) plexus.PresharedKeyResponse {
+	response := plexus.PresharedKeyResponse{}
+	networks, err := getNetworksForPeer(id)
+	if err != nil {
+		response.Message = "error: " + err.Error()
+		return response
+	}
+	for _, network := range networks {
+		keys := networkKeys{}
+		if network.UsePSK {
+			keys, err = boltdb.Get[networkKeys](network.Name, pskTable)
+			if err != nil && !errors.Is(err, boltdb.ErrNoResults) {
+				response.Message = "error: " + err.Error()
+				return response
+			}
+		}
+		response.Networks = append(response.Networks, peerPresharedKeys(keys, network, id))
+	}
+	return response
+}
+
+func subscribePresharedKeys(msg *nats.Msg) {
+	if len(msg.Subject) != 44+len(plexus.PresharedKeys) {
+		slog.Error("invalid subj", "subj", msg.Subject)
+		publish.ErrorMessage(natsConn, msg.Reply, "invalid subject", errors.New(msg.Subject))
+		return
+	}
+	publish.Message(natsConn, msg.Reply, processPresharedKeysRequest(msg.Subject[:44]))
+}
+
+// ackPresharedKeys records that a peer holds the pending preshared keys of
+// ack and sends the peers of the pairs that can use their new key all their
+// keys.
+func ackPresharedKeys(id string, ack plexus.PresharedKeyUpdate) error {
+	network, err := boltdb.Get[plexus.Network](ack.Network, networkTable)
+	if err != nil {
+		return fmt.Errorf("retrieve network %w", err)
+	}
+	keys, err := boltdb.Get[networkKeys](network.Name, pskTable)
+	if err != nil {
+		return fmt.Errorf("retrieve preshared keys %w", err)
+	}
+	pending := peerPresharedKeys(keys, network, id).Pending
+	if len(pending) == 0 || !maps.Equal(pending, ack.Pending) {
+		return errors.New("preshared keys are not pending")
+	}
+	if slices.Contains(keys.Acked, id) {
+		return nil
+	}
+	keys.Acked = append(keys.Acked, id)
+	changed := activatePresharedKeys(&keys)
+	if err := save(keys, network.Name, pskTable); err != nil {
+		return fmt.Errorf("save preshared keys %w", err)
+	}
+	for _, peer := range changed {
+		publish.Message(natsConn, plexus.Update+peer+plexus.PresharedKeys,
+			peerPresharedKeys(keys, network, peer))
+	}
+	return nil
+}
+
+func subscribePresharedKeysAck(msg *nats.Msg) {
+	if len(msg.Subject) != 44+len(plexus.PresharedKeysAck) {
+		slog.Error("invalid subj", "subj", msg.Subject)
+		publish.ErrorMessage(natsConn, msg.Reply, "invalid subject", errors.New(msg.Subject))
+		return
+	}
+	ack := plexus.PresharedKeyUpdate{}
+	if err := json.Unmarshal(msg.Data, &ack); err != nil {
+		publish.ErrorMessage(natsConn, msg.Reply, "invalid request", err)
+		return
+	}
+	if err := ackPresharedKeys(msg.Subject[:44], ack); err != nil {
+		slog.Error("acknowledge preshared keys", "network", ack.Network, "error", err)
+		publish.ErrorMessage(natsConn, msg.Reply, "could not acknowledge preshared keys", err)
+		return
+	}
+	publish.Message(natsConn, msg.Reply, plexus.MessageResponse{Message: "preshared keys acknowledged"})
+}
+
+func networkPresharedKeys(w http.ResponseWriter, r *http.Request) {
+	enabled := r.FormValue("usepsk") == "on"
+	if _, err := setPresharedKeys(userActor(r), r.PathValue("id"), enabled); err != nil {
+		processError(w, errorStatus(err), err.Error())
+		return
+	}
+	networkDetails(w, r)
+}
@@ -0,0 +1,158 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Kairum-Labs/should"
+	"github.com/devilcove/boltdb"
+	"github.com/devilcove/plexus"
+	"github.com/nats-io/nats.go"
+)
+
+func TestPresharedKeys(t *testing.T) {
+	setup(t)
+	defer shutdown(t)
+	deleteAllUsers(t)
+	deleteAllNetworks(t)
+	deleteAllPeers(t)
+	defer deleteAllNetworks(t)
+	defer deleteAllPeers(t)
+	createTestNetwork(t)
+	first := createTestNetworkPeer(t)
+	second := createTestNetworkPeer(t)
+	updates := make(chan *nats.Msg, 10)
+	sub, err := natsConn.ChanSubscribe(plexus.Update+"*"+plexus.PresharedKeys, updates)
+	should.NotBeError(t, err)
+	defer func() {
+		_ = sub.Unsubscribe()
+	}()
+	broadcast := make(chan *nats.Msg, 10)
+	netSub, err := natsConn.ChanSubscribe(plexus.Networks+"valid", broadcast)
+	should.NotBeError(t, err)
+	defer func() {
+		_ = netSub.Unsubscribe()
+	}()
+	// receive returns the preshared keys sent to each peer.
+	receive := func(t *testing.T, count int) map[string]plexus.PresharedKeyUpdate {
+		t.Helper()
+		received := map[string]plexus.PresharedKeyUpdate{}
+		for range count {
+			select {
+			case msg := <-updates:
+				update := plexus.PresharedKeyUpdate{}
+				should.NotBeError(t, json.Unmarshal(msg.Data, &update))
+				received[msg.Subject[len(plexus.Update):len(plexus.Update)+44]] = update
+			case <-time.After(time.Second):
+				t.Fatal("no preshared keys")
+			}
+		}
+		return received
+	}
+
+	t.Run("enable", func(t *testing.T) {
+		network, err := setPresharedKeys("admin", "valid", true)
+		should.NotBeError(t, err)
+		should.BeTrue(t, network.UsePSK)
+		staged := receive(t, 2)
+		should.BeEqual(t, staged[first].Network, "valid")
+		// the keys are used once both peers hold them.
+		should.BeEqual(t, len(staged[first].Keys), 0)
+		should.NotBeEmpty(t, staged[first].Pending[second])
+		should.BeEqual(t, staged[first].Pending[second], staged[second].Pending[first])
+		should.NotBeError(t, ackPresharedKeys(first, staged[first]))
+		should.BeEqual(t, len(updates), 0)
+		should.BeError(t, ackPresharedKeys(second, staged[first]))
+		should.NotBeError(t, ackPresharedKeys(second, staged[second]))
+		received := receive(t, 2)
+		should.BeEqual(t, received[first].Keys[second], staged[first].Pending[second])
+		should.BeEqual(t, received[second].Keys[first], staged[first].Pending[second])
+		should.BeEqual(t, len(received[first].Pending), 0)
+	})
+	t.Run("join", func(t *testing.T) {
+		before := processPresharedKeysRequest(first)
+		should.BeEqual(t, len(before.Networks), 1)
+		third := createTestNetworkPeer(t)
+		received := receive(t, 3)
+		should.BeEqual(t, len(received[third].Keys), 2)
+		should.BeEqual(t, received[first].Keys[second], before.Networks[0].Keys[second])
+		should.BeEqual(t, received[first].Keys[third], received[third].Keys[first])
+		should.NotBeEqual(t, received[first].Keys[third], received[second].Keys[third])
+		// the add peer update on the network subject carries no keys.
+		should.BeTrue(t, len(broadcast) > 0)
+		for len(broadcast) > 0 {
+			msg := <-broadcast
+			should.BeFalse(t, strings.Contains(string(msg.Data), received[first].Keys[third]))
+		}
+	})
+	t.Run("rotate", func(t *testing.T) {
+		before := processPresharedKeysRequest(first)
+		keys, err := boltdb.Get[networkKeys]("valid", pskTable)
+		should.NotBeError(t, err)
+		keys.Rotated = time.Now().Add(-pskLifetime)
+		should.NotBeError(t, boltdb.Save(keys, "valid", pskTable))
+		rotatePresharedKeys()
+		staged := receive(t, 3)
+		// the tunnels keep their keys until both peers hold the new ones.
+		should.BeEqual(t, staged[first].Keys, before.Networks[0].Keys)
+		should.NotBeEqual(t, staged[first].Pending[second], before.Networks[0].Keys[second])
+		should.BeEqual(t, staged[first].Pending[second], staged[second].Pending[first])
+		should.NotBeError(t, ackPresharedKeys(first, staged[first]))
+		should.NotBeError(t, ackPresharedKeys(second, staged[second]))
+		received := receive(t, 2)
+		should.BeEqual(t, received[first].Keys[second], staged[first].Pending[second])
+		third := ""
+		for id := range staged {
+			if id != first && id != second {
+				third = id
+			}
+		}
+		// the pairs of a peer that did not acknowledge keep their key.
+		should.BeEqual(t, received[first].Keys[third], before.Networks[0].Keys[third])
+		should.BeEqual(t, received[first].Pending[third], staged[first].Pending[third])
+	})
+	t.Run("renamed", func(t *testing.T) {
+		before := processPresharedKeysRequest(first)
+		pub, err := generateKeys()
+		should.NotBeError(t, err)
+		should.NotBeError(t, renamePresharedKeys("valid", second, pub.String()))
+		network, err := boltdb.Get[plexus.Network]("valid", networkTable)
+		should.NotBeError(t, err)
+		network.ReplacePeerKey(second, pub.String())
+		should.NotBeError(t, boltdb.Save(network, "valid", networkTable))
+		after := processPresharedKeysRequest(first)
+		should.BeEqual(t, after.Networks[0].Keys[pub.String()], before.Networks[0].Keys[second])
+	})
+	t.Run("readOnly", func(t *testing.T) {
+		before, err := boltdb.Get[networkKeys]("valid", pskTable)
+		should.NotBeError(t, err)
+		network, err := boltdb.Get[plexus.Network]("valid", networkTable)
+		should.NotBeError(t, err)
+		pub, err := generateKeys()
+		should.NotBeError(t, err)
+		network.Peers = append(network.Peers, plexus.NetworkPeer{WGPublicKey: pub.String()})
+		should.NotBeError(t, boltdb.Save(network, "valid", networkTable))
+		processPresharedKeysRequest(first)
+		after, err := boltdb.Get[networkKeys]("valid", pskTable)
+		should.NotBeError(t, err)
+		should.BeEqual(t, after.Keys, before.Keys)
+		network.Peers = network.Peers[:len(network.Peers)-1]
+		should.NotBeError(t, boltdb.Save(network, "valid", networkTable))
+	})
+	t.Run("disable", func(t *testing.T) {
+		admin := plexus.User{Username: "admin", Password: "pass", IsAdmin: true}
+		createTestUser(t, admin)
+		cookie := testLogin(t, admin)
+		w := apiRequest(t, cookie, http.MethodPut, "/api/v1/networks/valid/psk", `{"Enabled":false}`)
+		should.BeEqual(t, w.Code, http.StatusOK)
+		received := receive(t, 3)
+		should.BeEqual(t, len(received[first].Keys), 0)
+		_, err := boltdb.Get[networkKeys]("valid", pskTable)
+		should.BeError(t, err)
+		response := processPresharedKeysRequest(first)
+		should.BeEqual(t, response.Networks[0].Keys, map[string]string{})
+	})
+}
@@ -0,0 +1,321 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/devilcove/boltdb"
+	"github.com/devilcove/plexus"
+)
+
+// network roles; each role includes the rights of the roles below it.
+const (
+	roleViewer   = "viewer"
+	roleOperator = "operator"
+	roleOwner    = "owner"
+)
+
+var roleRank = map[string]int{
+	roleViewer:   1,
+	roleOperator: 2,
+	roleOwner:    3,
+}
+
+// NetworkMember is a user holding a role on a network.
+type NetworkMember struct {
+	Username string
+	Role     string
+}
+
+// RoleRequest is the json body for assigning a network role via the api.
+type RoleRequest struct {
+	Role string
+}
+
+// currentUser returns the stored record of the session user so that role
+// changes take effect without logging in again.
+func currentUser(session plexus.User) (plexus.User, bool) {
+	user, err := boltdb.Get[plexus.User](session.Username, userTable)
+	if err != nil {
+		return user, false
+	}
+	user.Password = ""
+	return user, true
+}
+
+// roleAllows reports whether user holds at least role on network.
+// Admins hold every role on every network.
+func roleAllows(user plexus.User, network, role string) bool {
+	if user.IsAdmin {
+		return true
+	}
+	held, ok := roleRank[user.Roles[network]]
+	return ok && held >= roleRank[role]
+}
+
+// hasRole reports whether the session user holds at least role on network.
+func hasRole(session plexus.User, network, role string) bool {
+	user, ok := currentUser(session)
+	if !ok {
+		return false
+	}
+	return roleAllows(user, network, role)
+}
+
+// hasAnyRole reports whether the session user holds at least role on any network.
+func hasAnyRole(session plexus.User, role string) bool {
+	user, ok := currentUser(session)
+	if !ok {
+		return false
+	}
+	if user.IsAdmin {
+		return true
+	}
+	for network := range user.Roles {
+		if roleAllows(user, network, role) {
+			return true
+		}
+	}
+	return false
+}
+
+// keyNetworksAllowed checks that the session user holds the operator role on
+// every network joined by devices registered with key. Keys without networks
+// let devices join any network and are admin only.
+func keyNetworksAllowed(session plexus.User, key plexus.Key) error {
+	user, ok := currentUser(session)
+	if len(key.Networks) == 0 && (!ok || !user.IsAdmin) {
+		return errors.New("admin rights required for keys of all networks")
+	}
+	for _, network := range key.Networks {
+		if !ok || !roleAllows(user, network, roleOperator) {
+			return errors.New("operator role required on network " + network)
+		}
+	}
+	return nil
+}
+
+// hasPeerRole reports whether the session user may act on a peer with role.
+// Viewing a peer requires role on any of its networks; other actions require
+// role on all of them. Peers that are not in any network are admin only.
+func hasPeerRole(session plexus.User, peerID, role string) bool {
+	user, ok := currentUser(session)
+	if !ok {
+		return false
+	}
+	if user.IsAdmin {
+		return true
+	}
+	networks, err := boltdb.GetAll[plexus.Network](networkTable)
+	if err != nil {
+		slog.Error("get networks for peer access", "error", err)
+		return false
+	}
+	found := false
+	for _, network := range networks {
+		if !peerInNetwork(network, peerID) {
+			continue
+		}
+		found = true
+		allowed := roleAllows(user, network.Name, role)
+		if role == roleViewer && allowed {
+			return true
+		}
+		if role != roleViewer && !allowed {
+			return false
+		}
+	}
+	return found && role != roleViewer
+}
+
+// visibleNetworks filters networks to those the session user may view.
+func visibleNetworks(session plexus.User, networks []plexus.Network) []plexus.Network {
+	user, ok := currentUser(session)
+	if !ok {
+		return []plexus.Network{}
+	}
+	visible := []plexus.Network{}
+	for _, network := range networks {
+		if roleAllows(user, network.Name, roleViewer) {
+			visible = append(visible, network)
+		}
+	}
+	return visible
+}
+
+// visiblePeers filters peers to those in networks the session user may view.
+func visiblePeers(session plexus.User, peers []plexus.Peer) []plexus.Peer {
+	user, ok := currentUser(session)
+	if !ok {
+		return []plexus.Peer{}
+	}
+	if user.IsAdmin {
+		return peers
+	}
+	networks, err := boltdb.GetAll[plexus.Network](networkTable)
+	if err != nil {
+		slog.Error("get networks for peer visibility", "error", err)
+		return []plexus.Peer{}
+	}
+	visible := []plexus.Peer{}
+	for _, peer := range peers {
+		for _, network := range networks {
+			if peerInNetwork(network, peer.WGPublicKey) &&
+				roleAllows(user, network.Name, roleViewer) {
+				visible = append(visible, peer)
+				break
+			}
+		}
+	}
+	return visible
+}
+
+// visibleKeys filters keys to those the session user may manage. The secret
+// value is only shown to admins and the creator of the key.
+func visibleKeys(session plexus.User, keys []plexus.Key) []plexus.Key {
+	user, ok := currentUser(session)
+	if !ok {
+		return []plexus.Key{}
+	}
+	visible := []plexus.Key{}
+	for _, key := range keys {
+		if slices.ContainsFunc(key.Networks, func(network string) bool {
+			return !roleAllows(user, network, roleOperator)
+		}) {
+			continue
+		}
+		if !user.IsAdmin && key.Creator != user.Username {
+			key.Value = ""
+		}
+		visible = append(visible, key)
+	}
+	return visible
+}
+
+// setRole assigns role on network to a user; a blank role removes it.
+func setRole(actor, username, network, role string) error {
+	if _, ok := roleRank[role]; !ok && role != "" {
+		return requestError("invalid role " + role)
+	}
+	if _, err := boltdb.Get[plexus.Network](network, networkTable); err != nil {
+		return err
+	}
+	user, err := boltdb.Get[plexus.User](username, userTable)
+	if err != nil {
+		return err
+	}
+	var before, after any
+	if old, ok := user.Roles[network]; ok {
+		before = old
+	}
+	if role == "" {
+		delete(user.Roles, network)
+	} else {
+		after = role
+		if user.Roles == nil {
+			user.Roles = make(map[string]string)
+		}
+		user.Roles[network] = role
+	}
+	if err := save(user, user.Username, userTable); err != nil {
+		return fmt.Errorf("save user roles %w", err)
+	}
+	slog.Info("network role updated", "user", username, "network", network, "role", role)
+	audit(actor, "role.set", network+"/"+username, before, after)
+	return nil
+}
+
+// removeNetworkRoles removes all roles on a deleted network.
+func removeNetworkRoles(network string) error {
+	users, err := boltdb.GetAll[plexus.User](userTable)
+	if err != nil {
+		return err
+	}
+	for _, user := range users {
+		if _, ok := user.Roles[network]; !ok {
+			continue
+		}
+		delete(user.Roles, network)
+		if err := save(user, user.Username, userTable); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// networkMembers returns the users holding a role on network.
+func networkMembers(network string) []NetworkMember {
+	members := []NetworkMember{}
+	users, err := boltdb.GetAll[plexus.User](userTable)
+	if err != nil {
+		slog.Error("get users for network members", "error", err)
+		return members
+	}
+	for _, user := range users {
+		if role, ok := user.Roles[network]; ok {
+			members = append(members, NetworkMember{Username: user.Username, Role: role})
+		}
+	}
+	slices.SortFunc(members, func(a, b NetworkMember) int {
+		return strings.Compare(a.Username, b.Username)
+	})
+	return members
+}
+
+func setNetworkRole(w http.ResponseWriter, r *http.Request) {
+	if err := setRole(userActor(r), r.FormValue("username"), r.PathValue("id"), r.FormValue("role")); err != nil {
+		processError(w, errorStatus(err), err.Error())
+		return
+	}
+	networkDetails(w, r)
+}
+
+func deleteNetworkRole(w http.ResponseWriter, r *http.Request) {
+	if err := setRole(userActor(r), r.PathValue("user"), r.PathValue("id"), ""); err != nil {
+		processError(w, errorStatus(err), err.Error())
+		return
+	}
+	networkDetails(w, r)
+}
+
+type errorFunc func(http.ResponseWriter, int, string)
+
+// networkRole wraps a handler so it is only called when the session user holds
+// at least role on the network named by the id path value.
+func networkRole(role string, fail errorFunc, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !hasRole(GetSessionData(r), r.PathValue("id"), role) {
+			fail(w, http.StatusForbidden, role+" role required for network "+r.PathValue("id"))
+			return
+		}
+		next(w, r)
+	}
+}
+
+// peerRole wraps a handler so it is only called when the session user may act
+// with role on the peer named by the id path value.
+func peerRole(role string, fail errorFunc, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !hasPeerRole(GetSessionData(r), r.PathValue("id"), role) {
+			fail(w, http.StatusForbidden, role+" role required for peer")
+			return
+		}
+		next(w, r)
+	}
+}
+
+// anyNetworkRole wraps a handler so it is only called when the session user
+// holds at least role on some network.
+func anyNetworkRole(role string, fail errorFunc, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !hasAnyRole(GetSessionData(r), role) {
+			fail(w, http.StatusForbidden, role+" role required")
+			return
+		}
+		next(w, r)
+	}
+}
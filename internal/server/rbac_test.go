@@ -0,0 +1,203 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/Kairum-Labs/should"
+	"github.com/devilcove/boltdb"
+	"github.com/devilcove/plexus"
+)
+
+func rbacRequest(t *testing.T, cookie *http.Cookie, method, path string, params ...string) *httptest.ResponseRecorder {
+	t.Helper()
+	r := httptest.NewRequest(method, path, bodyParams(params...))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.AddCookie(cookie)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+	return w
+}
+
+func TestRoleAllows(t *testing.T) {
+	user := plexus.User{Roles: map[string]string{"a": roleViewer, "b": roleOperator, "c": roleOwner}}
+	should.BeTrue(t, roleAllows(user, "a", roleViewer))
+	should.BeFalse(t, roleAllows(user, "a", roleOperator))
+	should.BeTrue(t, roleAllows(user, "b", roleOperator))
+	should.BeFalse(t, roleAllows(user, "b", roleOwner))
+	should.BeTrue(t, roleAllows(user, "c", roleViewer))
+	should.BeTrue(t, roleAllows(user, "c", roleOwner))
+	should.BeFalse(t, roleAllows(user, "d", roleViewer))
+	should.BeFalse(t, roleAllows(plexus.User{Roles: map[string]string{"a": "bogus"}}, "a", roleViewer))
+	should.BeTrue(t, roleAllows(plexus.User{IsAdmin: true}, "d", roleOwner))
+}
+
+func TestNetworkRoles(t *testing.T) {
+	setup(t)
+	defer shutdown(t)
+	deleteAllUsers(t)
+	deleteAllNetworks(t)
+	defer deleteAllNetworks(t)
+	defer deleteAllPeers(t)
+	createTestNetwork(t)
+	peerID := createTestNetworkPeer(t)
+	viewer := plexus.User{Username: "viewer", Password: "pass"}
+	operator := plexus.User{Username: "operator", Password: "pass"}
+	owner := plexus.User{Username: "owner", Password: "pass"}
+	outsider := plexus.User{Username: "outsider", Password: "pass"}
+	for _, user := range []plexus.User{viewer, operator, owner, outsider} {
+		createTestUser(t, user)
+	}
+	should.NotBeError(t, setRole("admin", "viewer", "valid", roleViewer))
+	should.NotBeError(t, setRole("admin", "operator", "valid", roleOperator))
+	should.NotBeError(t, setRole("admin", "owner", "valid", roleOwner))
+	viewerCookie := testLogin(t, viewer)
+	operatorCookie := testLogin(t, operator)
+	ownerCookie := testLogin(t, owner)
+	outsiderCookie := testLogin(t, outsider)
+
+	t.Run("networkList", func(t *testing.T) {
+		w := rbacRequest(t, viewerCookie, http.MethodGet, "/networks/")
+		should.BeEqual(t, w.Code, http.StatusOK)
+		should.ContainSubstring(t, w.Body.String(), "networks/details/valid")
+		w = rbacRequest(t, outsiderCookie, http.MethodGet, "/networks/")
+		should.BeEqual(t, w.Code, http.StatusOK)
+		should.BeFalse(t, strings.Contains(w.Body.String(), "networks/details/valid"))
+	})
+	t.Run("sidebar", func(t *testing.T) {
+		w := rbacRequest(t, viewerCookie, http.MethodGet, "/sidebar/")
+		should.ContainSubstring(t, w.Body.String(), "/networks/details/valid")
+		w = rbacRequest(t, outsiderCookie, http.MethodGet, "/sidebar/")
+		should.BeFalse(t, strings.Contains(w.Body.String(), "/networks/details/valid"))
+	})
+	t.Run("details", func(t *testing.T) {
+		w := rbacRequest(t, viewerCookie, http.MethodGet, "/networks/details/valid")
+		should.BeEqual(t, w.Code, http.StatusOK)
+		should.BeFalse(t, strings.Contains(w.Body.String(), "<h2>Members</h2>"))
+		w = rbacRequest(t, outsiderCookie, http.MethodGet, "/networks/details/valid")
+		should.BeEqual(t, w.Code, http.StatusForbidden)
+		w = rbacRequest(t, ownerCookie, http.MethodGet, "/networks/details/valid")
+		should.BeEqual(t, w.Code, http.StatusOK)
+		should.ContainSubstring(t, w.Body.String(), "<h2>Members</h2>")
+	})
+	t.Run("peers", func(t *testing.T) {
+		w := rbacRequest(t, viewerCookie, http.MethodGet, "/peers/")
+		should.ContainSubstring(t, w.Body.String(), "testing")
+		w = rbacRequest(t, outsiderCookie, http.MethodGet, "/peers/")
+		should.BeFalse(t, strings.Contains(w.Body.String(), "testing"))
+		w = rbacRequest(t, viewerCookie, http.MethodGet, "/peers/"+peerID)
+		should.BeEqual(t, w.Code, http.StatusOK)
+		w = rbacRequest(t, outsiderCookie, http.MethodGet, "/peers/"+peerID)
+		should.BeEqual(t, w.Code, http.StatusForbidden)
+		w = rbacRequest(t, viewerCookie, http.MethodDelete, "/peers/"+peerID)
+		should.BeEqual(t, w.Code, http.StatusForbidden)
+	})
+	t.Run("operatorActions", func(t *testing.T) {
+		w := rbacRequest(t, viewerCookie, http.MethodDelete, "/networks/peers/valid/"+peerID)
+		should.BeEqual(t, w.Code, http.StatusForbidden)
+		w = rbacRequest(t, viewerCookie, http.MethodGet, "/keys/")
+		should.BeEqual(t, w.Code, http.StatusForbidden)
+		w = rbacRequest(t, operatorCookie, http.MethodGet, "/keys/")
+		should.BeEqual(t, w.Code, http.StatusOK)
+		w = rbacRequest(t, operatorCookie, http.MethodGet, "/networks/relay/valid/"+peerID)
+		should.BeEqual(t, w.Code, http.StatusOK)
+	})
+	t.Run("assignRole", func(t *testing.T) {
+		w := rbacRequest(t, operatorCookie, http.MethodPost, "/networks/roles/valid",
+			"username", "outsider", "role", roleViewer)
+		should.BeEqual(t, w.Code, http.StatusForbidden)
+		w = rbacRequest(t, ownerCookie, http.MethodPost, "/networks/roles/valid",
+			"username", "outsider", "role", "superuser")
+		should.BeEqual(t, w.Code, http.StatusBadRequest)
+		w = rbacRequest(t, ownerCookie, http.MethodPost, "/networks/roles/valid",
+			"username", "outsider", "role", roleViewer)
+		should.BeEqual(t, w.Code, http.StatusOK)
+		w = rbacRequest(t, outsiderCookie, http.MethodGet, "/networks/details/valid")
+		should.BeEqual(t, w.Code, http.StatusOK)
+		w = rbacRequest(t, ownerCookie, http.MethodDelete, "/networks/roles/valid/outsider")
+		should.BeEqual(t, w.Code, http.StatusOK)
+		w = rbacRequest(t, outsiderCookie, http.MethodGet, "/networks/details/valid")
+		should.BeEqual(t, w.Code, http.StatusForbidden)
+	})
+	t.Run("api", func(t *testing.T) {
+		w := apiRequest(t, outsiderCookie, http.MethodGet, "/api/v1/networks/valid", "")
+		should.BeEqual(t, w.Code, http.StatusForbidden)
+		w = apiRequest(t, ownerCookie, http.MethodPut, "/api/v1/networks/valid/roles/outsider",
+			`{"Role":"operator"}`)
+		should.BeEqual(t, w.Code, http.StatusOK)
+		should.ContainSubstring(t, w.Body.String(), "outsider")
+		w = apiRequest(t, outsiderCookie, http.MethodGet, "/api/v1/networks/valid", "")
+		should.BeEqual(t, w.Code, http.StatusOK)
+		w = apiRequest(t, outsiderCookie, http.MethodDelete, "/api/v1/networks/valid", "")
+		should.BeEqual(t, w.Code, http.StatusForbidden)
+	})
+	t.Run("keys", func(t *testing.T) {
+		_, err := createKey("operator", plexus.Key{Name: "mine", DispExp: "2099-01-01", Networks: []string{"valid"}})
+		should.NotBeError(t, err)
+		_, err = createKey("admin", plexus.Key{Name: "theirs", DispExp: "2099-01-01", Networks: []string{"valid"}})
+		should.NotBeError(t, err)
+		should.NotBeError(t, boltdb.Save(plexus.Key{Name: "hidden", Networks: []string{"other"}}, "hidden", keyTable))
+		defer deleteAllKeys(t)
+		w := apiRequest(t, operatorCookie, http.MethodGet, "/api/v1/keys", "")
+		should.BeEqual(t, w.Code, http.StatusOK)
+		keys := []plexus.Key{}
+		should.NotBeError(t, json.Unmarshal(w.Body.Bytes(), &keys))
+		should.BeEqual(t, len(keys), 2)
+		for _, key := range keys {
+			should.BeEqual(t, key.Value != "", key.Name == "mine")
+		}
+		w = rbacRequest(t, operatorCookie, http.MethodDelete, "/keys/hidden")
+		should.BeEqual(t, w.Code, http.StatusForbidden)
+		w = apiRequest(t, operatorCookie, http.MethodDelete, "/api/v1/keys/hidden", "")
+		should.BeEqual(t, w.Code, http.StatusForbidden)
+		w = apiRequest(t, operatorCookie, http.MethodDelete, "/api/v1/keys/theirs", "")
+		should.BeEqual(t, w.Code, http.StatusNoContent)
+	})
+	t.Run("globalKeys", func(t *testing.T) {
+		_, err := createKey("admin", plexus.Key{Name: "global", DispExp: "2099-01-01"})
+		should.NotBeError(t, err)
+		defer deleteAllKeys(t)
+		w := rbacRequest(t, operatorCookie, http.MethodPost, "/keys/add", "name", "unrestricted",
+			"usage", "1", "expires", "2099-01-01")
+		should.BeEqual(t, w.Code, http.StatusForbidden)
+		w = apiRequest(t, operatorCookie, http.MethodPost, "/api/v1/keys",
+			`{"Name":"unrestricted","Usage":1,"DispExp":"2099-01-01"}`)
+		should.BeEqual(t, w.Code, http.StatusForbidden)
+		_, err = boltdb.Get[plexus.Key]("unrestricted", keyTable)
+		should.BeError(t, err)
+		w = rbacRequest(t, operatorCookie, http.MethodDelete, "/keys/global")
+		should.BeEqual(t, w.Code, http.StatusForbidden)
+		w = apiRequest(t, operatorCookie, http.MethodDelete, "/api/v1/keys/global", "")
+		should.BeEqual(t, w.Code, http.StatusForbidden)
+		_, err = boltdb.Get[plexus.Key]("global", keyTable)
+		should.NotBeError(t, err)
+	})
+	t.Run("createOwns", func(t *testing.T) {
+		w := rbacRequest(t, outsiderCookie, http.MethodPost, "/networks/add",
+			"name", "mine", "addressstring", "10.201.0.0/24")
+		should.BeEqual(t, w.Code, http.StatusForbidden)
+		w = apiRequest(t, viewerCookie, http.MethodPost, "/api/v1/networks",
+			`{"Name":"mine","AddressString":"10.201.0.0/24"}`)
+		should.BeEqual(t, w.Code, http.StatusForbidden)
+		should.NotBeError(t, setRole("admin", "outsider", "valid", roleOwner))
+		w = rbacRequest(t, outsiderCookie, http.MethodPost, "/networks/add",
+			"name", "mine", "addressstring", "10.201.0.0/24")
+		should.BeEqual(t, w.Code, http.StatusOK)
+		user, err := boltdb.Get[plexus.User]("outsider", userTable)
+		should.NotBeError(t, err)
+		should.BeEqual(t, user.Roles["mine"], roleOwner)
+	})
+	t.Run("deleteNetwork", func(t *testing.T) {
+		w := rbacRequest(t, operatorCookie, http.MethodDelete, "/networks/valid")
+		should.BeEqual(t, w.Code, http.StatusForbidden)
+		w = rbacRequest(t, ownerCookie, http.MethodDelete, "/networks/valid")
+		should.BeEqual(t, w.Code, http.StatusOK)
+		user, err := boltdb.Get[plexus.User]("viewer", userTable)
+		should.NotBeError(t, err)
+		_, ok := user.Roles["valid"]
+		should.BeFalse(t, ok)
+	})
+}
@@ -15,6 +15,7 @@ func displayAddRelay(w http.ResponseWriter, r *http.Request) {
 		Network        string
 		Relay          plexus.NetworkPeer
 		AvailablePeers []plexus.NetworkPeer
+		Groups         []plexus.Group
 	}{}
 	data.Network = r.PathValue("id")
 	relay := r.PathValue("peer")
@@ -29,11 +30,16 @@ func displayAddRelay(w http.ResponseWriter, r *http.Request) {
 			data.Relay = peer
 			continue
 		}
-		if peer.IsRelay || peer.IsRelayed || peer.IsSubnetRouter {
+		if peer.IsRelay || peer.IsRelayed || peer.IsSubnetRouter || peer.IsExitNode {
 			continue
 		}
 		data.AvailablePeers = append(data.AvailablePeers, peer)
 	}
+	data.Groups, err = boltdb.GetAll[plexus.Group](groupTable)
+	if err != nil {
+		processError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
 	render(w, "addRelayToNetwork", data)
 }
 
@@ -50,9 +56,47 @@ func addRelay(w http.ResponseWriter, r *http.Request) {
 		processError(w, http.StatusBadRequest, err.Error())
 		return
 	}
+	if group := r.PostForm.Get("group"); group != "" {
+		relayedIDs = append(relayedIDs, groupRelayed(network, relayID, group)...)
+	}
+	if _, err := createRelay(userActor(r), network, relayID, relayedIDs); err != nil {
+		processError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	networkDetails(w, r)
+}
+
+// groupRelayed returns the peers of a group in network that can be relayed by relayID.
+func groupRelayed(network plexus.Network, relayID, group string) []string {
+	relayed := []string{}
+	for _, peer := range network.Peers {
+		if peer.WGPublicKey == relayID || peer.IsRelay || peer.IsRelayed || peer.IsSubnetRouter ||
+			peer.IsExitNode {
+			continue
+		}
+		if slices.Contains(peer.Groups, group) {
+			relayed = append(relayed, peer.WGPublicKey)
+		}
+	}
+	return relayed
+}
+
+// createRelay sets relay as the relay for relayed peers and publishes the update.
+func createRelay(actor string, network plexus.Network, relayID string, relayedIDs []string) (plexus.Network, error) {
 	update := plexus.NetworkUpdate{
 		Action: plexus.AddRelay,
 	}
+	if !peerInNetwork(network, relayID) {
+		return network, ErrPeerNotFound
+	}
+	// peers the server relays through relayID stay relayed.
+	for _, peer := range network.Peers {
+		if peer.AutoRelayed && slices.Contains(routerPeer(network, relayID).RelayedPeers, peer.WGPublicKey) {
+			relayedIDs = append(relayedIDs, peer.WGPublicKey)
+		}
+	}
+	relayedIDs = slices.Compact(slices.Sorted(slices.Values(relayedIDs)))
+	before := network
 	peers := []plexus.NetworkPeer{}
 	for _, peer := range network.Peers {
 		if peer.WGPublicKey == relayID {
@@ -66,13 +110,13 @@ func addRelay(w http.ResponseWriter, r *http.Request) {
 		peers = append(peers, peer)
 	}
 	network.Peers = peers
-	if err := boltdb.Save(network, network.Name, networkTable); err != nil {
-		processError(w, http.StatusInternalServerError, err.Error())
-		return
+	if err := save(network, network.Name, networkTable); err != nil {
+		return network, err
 	}
+	audit(actor, "relay.create", network.Name+"/"+update.Peer.HostName, before, network)
 	slog.Debug("publish network update - add relay", "network", network.Name, "relay", relayID)
 	publish.Message(natsConn, "networks."+network.Name, update)
-	networkDetails(w, r)
+	return network, nil
 }
 
 func deleteRelay(w http.ResponseWriter, r *http.Request) {
@@ -84,9 +128,22 @@ func deleteRelay(w http.ResponseWriter, r *http.Request) {
 		processError(w, http.StatusBadRequest, err.Error())
 		return
 	}
+	if _, err := removeRelay(userActor(r), network, peerID); err != nil {
+		processError(w, http.StatusBadRequest, "failed to save update network peers "+err.Error())
+		return
+	}
+	networkDetails(w, r)
+}
+
+// removeRelay unsets relay and its relayed peers and publishes the update.
+func removeRelay(actor string, network plexus.Network, peerID string) (plexus.Network, error) {
 	update := plexus.NetworkUpdate{
 		Action: plexus.DeleteRelay,
 	}
+	if !peerInNetwork(network, peerID) {
+		return network, ErrPeerNotFound
+	}
+	before := network
 	peersToUnrelay := []string{}
 	updatedPeers := []plexus.NetworkPeer{}
 	for _, peer := range network.Peers {
@@ -107,14 +164,15 @@ func deleteRelay(w http.ResponseWriter, r *http.Request) {
 		}
 		if slices.Contains(peersToUnrelay, peer.WGPublicKey) {
 			peer.IsRelayed = false
+			peer.AutoRelayed = false
 		}
 		updatedPeers = append(updatedPeers, peer)
 	}
 	network.Peers = updatedPeers
-	if err := boltdb.Save(network, network.Name, networkTable); err != nil {
-		processError(w, http.StatusBadRequest, "failed to save update network peers "+err.Error())
-		return
+	if err := save(network, network.Name, networkTable); err != nil {
+		return network, err
 	}
+	audit(actor, "relay.delete", network.Name+"/"+update.Peer.HostName, before, network)
 	slog.Debug(
 		"publish network update",
 		"network", network.Name,
@@ -122,5 +180,5 @@ func deleteRelay(w http.ResponseWriter, r *http.Request) {
 		"reason", "delete relay",
 	)
 	publish.Message(natsConn, plexus.Networks+network.Name, update)
-	networkDetails(w, r)
+	return network, nil
 }
@@ -17,7 +17,7 @@ func TestRelay(t *testing.T) {
 	deleteAllPeers(t)
 	deleteAllUsers(t)
 
-	user := plexus.User{Username: "admin", Password: "pass"}
+	user := plexus.User{Username: "admin", Password: "pass", IsAdmin: true}
 	createTestUser(t, user)
 	createTestNetwork(t)
 	peer := createTestNetworkPeer(t)
@@ -0,0 +1,188 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/devilcove/boltdb"
+	"github.com/devilcove/plexus"
+	"github.com/devilcove/plexus/internal/publish"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nkeys"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// rotateGracePeriod is how long the previous nkey of a device stays valid
+// after a key rotation, so the device can receive the reply before it
+// reconnects with the new nkey.
+var rotateGracePeriod = time.Minute
+
+func subscribeRotateKeys(msg *nats.Msg) {
+	if len(msg.Subject) != 44+len(plexus.RotateKeys) {
+		slog.Error("invalid subj", "subj", msg.Subject)
+		publish.ErrorMessage(natsConn, msg.Reply, "invalid subject", errors.New(msg.Subject))
+		return
+	}
+	request := plexus.RotateKeysRequest{}
+	if err := json.Unmarshal(msg.Data, &request); err != nil {
+		slog.Error("invalid rotate keys request", "error", err, "data", string(msg.Data))
+		publish.ErrorMessage(natsConn, msg.Reply, "invalid request", err)
+		return
+	}
+	peer, err := processRotateKeys(msg.Subject[:44], request)
+	if err != nil {
+		slog.Error("rotate keys", "error", err)
+		publish.ErrorMessage(natsConn, msg.Reply, "could not rotate keys", err)
+		return
+	}
+	publish.Message(natsConn, msg.Reply, plexus.MessageResponse{Message: "keys rotated"})
+	time.AfterFunc(rotateGracePeriod, func() {
+		deletePeerFromBroker(peer.PubNkey)
+	})
+}
+
+// Rotation is a key rotation waiting for the device to confirm that it uses
+// its new keys.
+type Rotation struct {
+	WGPublicKey string
+	OldKey      string
+}
+
+// processRotateKeys re-keys a device: the new nkey is authorized for the new
+// id and the peer record and networks are moved to the new WireGuard public
+// key. The other peers are not notified until the device confirms that it
+// uses the new keys. The old peer is returned; its nkey is still authorized
+// and must be removed by the caller.
+func processRotateKeys(id string, request plexus.RotateKeysRequest) (plexus.Peer, error) {
+	slog.Debug("received rotate keys request", "peer", id)
+	peer, err := boltdb.Get[plexus.Peer](id, peerTable)
+	if err != nil {
+		return peer, err
+	}
+	key, err := wgtypes.ParseKey(request.WGPublicKey)
+	if err != nil {
+		return peer, requestError("invalid wireguard public key")
+	}
+	if key.String() != request.WGPublicKey || strings.Contains(request.WGPublicKey, "/") {
+		return peer, requestError("invalid wireguard public key")
+	}
+	if !nkeys.IsValidPublicUserKey(request.PubNkey) {
+		return peer, requestError("invalid nkey")
+	}
+	if _, err := boltdb.Get[plexus.Peer](request.WGPublicKey, peerTable); err == nil {
+		return peer, requestError("key in use")
+	} else if !errors.Is(err, boltdb.ErrNoResults) {
+		return peer, fmt.Errorf("retrieve peer %w", err)
+	}
+	rotated := peer
+	rotated.WGPublicKey = request.WGPublicKey
+	rotated.PubNkey = request.PubNkey
+	if err := addNKeyUser(rotated); err != nil {
+		return peer, fmt.Errorf("add nkey %w", err)
+	}
+	if err := save(rotated, rotated.WGPublicKey, peerTable); err != nil {
+		return peer, fmt.Errorf("save peer %w", err)
+	}
+	if err := remove(id, peerTable); err != nil {
+		return peer, fmt.Errorf("delete peer %w", err)
+	}
+	networks, err := boltdb.GetAll[plexus.Network](networkTable)
+	if err != nil {
+		return peer, fmt.Errorf("get networks %w", err)
+	}
+	for _, network := range networks {
+		if !network.ReplacePeerKey(id, rotated.WGPublicKey) {
+			continue
+		}
+		if err := save(network, network.Name, networkTable); err != nil {
+			return peer, fmt.Errorf("save network %w", err)
+		}
+		if err := renamePresharedKeys(network.Name, id, rotated.WGPublicKey); err != nil {
+			return peer, err
+		}
+	}
+	rotation := Rotation{WGPublicKey: rotated.WGPublicKey, OldKey: id}
+	if err := save(rotation, rotation.WGPublicKey, rotationTable); err != nil {
+		return peer, fmt.Errorf("save rotation %w", err)
+	}
+	slog.Info("peer keys rotated", "peer", peer.Name, "old", id, "new", rotated.WGPublicKey)
+	audit("peer:"+peer.Name, "peer.rotate", peer.Name, peer, rotated)
+	return peer, nil
+}
+
+func subscribeConfirmRotation(msg *nats.Msg) {
+	if len(msg.Subject) != 44+len(plexus.ConfirmRotation) {
+		slog.Error("invalid subj", "subj", msg.Subject)
+		publish.ErrorMessage(natsConn, msg.Reply, "invalid subject", errors.New(msg.Subject))
+		return
+	}
+	if err := confirmRotation(msg.Subject[:44]); err != nil {
+		slog.Error("confirm rotation", "error", err)
+		publish.ErrorMessage(natsConn, msg.Reply, "could not confirm rotation", err)
+		return
+	}
+	publish.Message(natsConn, msg.Reply, plexus.MessageResponse{Message: "rotation confirmed"})
+}
+
+// confirmRotation completes the key rotation of a device that has applied its
+// new keys: the networks of the device are notified so the other peers replace
+// its key without resetting their interfaces.
+func confirmRotation(id string) error {
+	rotation, err := boltdb.Get[Rotation](id, rotationTable)
+	if err != nil {
+		return fmt.Errorf("retrieve rotation %w", err)
+	}
+	networks, err := boltdb.GetAll[plexus.Network](networkTable)
+	if err != nil {
+		return fmt.Errorf("get networks %w", err)
+	}
+	for _, network := range networks {
+		for _, netPeer := range network.Peers {
+			if netPeer.WGPublicKey != id {
+				continue
+			}
+			slog.Debug("publish network update", "network", network.Name, "reason", "key rotation")
+			publish.Message(natsConn, plexus.Networks+network.Name, plexus.NetworkUpdate{
+				Action: plexus.UpdatePeerKey,
+				Peer:   netPeer,
+				OldKey: rotation.OldKey,
+			})
+		}
+	}
+	return remove(id, rotationTable)
+}
+
+// requestKeyRotation asks a device to rotate its keys. The device replies
+// before it starts the rotation.
+func requestKeyRotation(actor, id string) error {
+	peer, err := boltdb.Get[plexus.Peer](id, peerTable)
+	if err != nil {
+		return err
+	}
+	msg, err := natsConn.Request(plexus.Update+id+plexus.RotateKeys, nil, natsTimeout)
+	if err != nil {
+		return fmt.Errorf("request key rotation %w", err)
+	}
+	response := plexus.MessageResponse{}
+	if err := json.Unmarshal(msg.Data, &response); err != nil {
+		return fmt.Errorf("invalid response %w", err)
+	}
+	if response.IncludesError {
+		return errors.New(response.Error)
+	}
+	audit(actor, "peer.rotate.request", peer.Name, nil, nil)
+	return nil
+}
+
+func rotatePeerKeys(w http.ResponseWriter, r *http.Request) {
+	if err := requestKeyRotation(userActor(r), r.PathValue("id")); err != nil {
+		processError(w, errorStatus(err), err.Error())
+		return
+	}
+	displayPeers(w, r)
+}
@@ -0,0 +1,109 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/Kairum-Labs/should"
+	"github.com/devilcove/boltdb"
+	"github.com/devilcove/plexus"
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nkeys"
+)
+
+func TestRotateKeys(t *testing.T) {
+	setup(t)
+	defer shutdown(t)
+	deleteAllUsers(t)
+	deleteAllNetworks(t)
+	deleteAllPeers(t)
+	defer deleteAllNetworks(t)
+	defer deleteAllPeers(t)
+	createTestNetwork(t)
+	relay := createTestNetworkPeer(t)
+	old := createTestNetworkPeer(t)
+	network, err := boltdb.Get[plexus.Network]("valid", networkTable)
+	should.NotBeError(t, err)
+	_, err = createRelay("admin", network, relay, []string{old})
+	should.NotBeError(t, err)
+	_, err = createPolicy("admin", "valid", plexus.Policy{
+		Name: "from", Source: old, Destination: plexus.PolicyAny,
+	})
+	should.NotBeError(t, err)
+	kp, err := nkeys.CreateUser()
+	should.NotBeError(t, err)
+	nkey, err := kp.PublicKey()
+	should.NotBeError(t, err)
+	pub, err := generateKeys()
+	should.NotBeError(t, err)
+	updates := make(chan *nats.Msg, 1)
+	sub, err := natsConn.ChanSubscribe(plexus.Networks+"valid", updates)
+	should.NotBeError(t, err)
+	defer func() {
+		_ = sub.Unsubscribe()
+	}()
+
+	t.Run("invalid", func(t *testing.T) {
+		_, err := processRotateKeys(old, plexus.RotateKeysRequest{WGPublicKey: "bad", PubNkey: nkey})
+		should.BeError(t, err)
+		should.BeEqual(t, errorStatus(err), http.StatusBadRequest)
+		_, err = processRotateKeys(old, plexus.RotateKeysRequest{WGPublicKey: pub.String(), PubNkey: "bad"})
+		should.BeError(t, err)
+		should.ContainSubstring(t, err.Error(), "invalid nkey")
+		_, err = processRotateKeys(old, plexus.RotateKeysRequest{WGPublicKey: relay, PubNkey: nkey})
+		should.BeError(t, err)
+		should.ContainSubstring(t, err.Error(), "key in use")
+		_, err = processRotateKeys(pub.String(), plexus.RotateKeysRequest{WGPublicKey: pub.String(), PubNkey: nkey})
+		should.BeError(t, err)
+		should.BeEqual(t, errorStatus(err), http.StatusNotFound)
+	})
+	t.Run("valid", func(t *testing.T) {
+		_, err := processRotateKeys(old, plexus.RotateKeysRequest{WGPublicKey: pub.String(), PubNkey: nkey})
+		should.NotBeError(t, err)
+		_, err = boltdb.Get[plexus.Peer](old, peerTable)
+		should.BeError(t, err)
+		peer, err := boltdb.Get[plexus.Peer](pub.String(), peerTable)
+		should.NotBeError(t, err)
+		should.BeEqual(t, peer.PubNkey, nkey)
+		should.BeTrue(t, slices.ContainsFunc(natsOptions.Nkeys, func(user *server.NkeyUser) bool {
+			return user.Nkey == nkey
+		}))
+		network, err := boltdb.Get[plexus.Network]("valid", networkTable)
+		should.NotBeError(t, err)
+		should.BeEqual(t, network.Peers[1].WGPublicKey, pub.String())
+		should.BeEqual(t, network.Peers[0].RelayedPeers, []string{pub.String()})
+		should.BeEqual(t, network.Policies[0].Source, pub.String())
+		// peers are notified once the device confirms that it uses the new keys.
+		select {
+		case <-updates:
+			t.Fatal("network update before rotation is confirmed")
+		case <-time.After(time.Millisecond * 100):
+		}
+		should.NotBeError(t, confirmRotation(pub.String()))
+		should.BeError(t, confirmRotation(pub.String()))
+		select {
+		case msg := <-updates:
+			update := plexus.NetworkUpdate{}
+			should.NotBeError(t, json.Unmarshal(msg.Data, &update))
+			should.BeEqual(t, update.Action, plexus.UpdatePeerKey)
+			should.BeEqual(t, update.OldKey, old)
+			should.BeEqual(t, update.Peer.WGPublicKey, pub.String())
+		case <-time.After(time.Second):
+			t.Fatal("no network update")
+		}
+	})
+	t.Run("request", func(t *testing.T) {
+		admin := plexus.User{Username: "admin", Password: "pass", IsAdmin: true}
+		createTestUser(t, admin)
+		cookie := testLogin(t, admin)
+		// the peer is not connected.
+		w := apiRequest(t, cookie, http.MethodPost, "/api/v1/peers/"+pub.String()+"/rotate", "")
+		should.BeEqual(t, w.Code, http.StatusBadGateway)
+		w = apiRequest(t, cookie, http.MethodPost, "/api/v1/peers/"+old+"/rotate", "")
+		should.BeEqual(t, w.Code, http.StatusNotFound)
+	})
+}
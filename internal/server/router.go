@@ -3,6 +3,7 @@ package server
 import (
 	"bytes"
 	"embed"
+	"errors"
 	"fmt"
 	"html/template"
 	"log"
@@ -10,6 +11,7 @@ import (
 	"net/http"
 	"os"
 
+	"github.com/devilcove/boltdb"
 	"github.com/devilcove/mux"
 )
 
@@ -34,36 +36,57 @@ func setupRouter() *mux.Router {
 	router.Post("/login/", login)
 	router.Get("/logout/", logout)
 	router.Get("/{$}", displayMain)
+	router.Get("/oidc/login", oidcLogin)
+	router.Get("/oidc/callback", oidcCallback)
+	router.Get("/metrics", metricsHandler().ServeHTTP)
 
 	sidebar := router.Group("/sidebar", auth)
 	sidebar.Get("/", networksSideBar)
 
 	networks := router.Group("/networks", auth)
-	networks.Get("/add", displayAddNetwork)
-	networks.Post("/add", addNetwork)
+	networks.Get("/add", anyNetworkRole(roleOwner, processError, displayAddNetwork))
+	networks.Post("/add", anyNetworkRole(roleOwner, processError, addNetwork))
 	networks.Get("/{$}", displayNetworks)
-	networks.Get("/details/{id}", networkDetails)
-	networks.Post("/addPeer/{id}/{peer}", networkAddPeer)
-	networks.Delete("/{id}", deleteNetwork)
-	networks.Delete("/peers/{id}/{peer}", removePeerFromNetwork)
-	networks.Get("/relay/{id}/{peer}", displayAddRelay)
-	networks.Post("/relay/{id}/{peer}", addRelay)
-	networks.Delete("/relay/{id}/{peer}", deleteRelay)
-	networks.Get("/peers/{id}/{peer}", networkPeerDetails)
-	networks.Get("/router/{id}/{peer}", displayAddRouter)
-	networks.Post("/router/{id}/{peer}", addRouter)
-	networks.Delete("/router/{id}/{peer}", deleteRouter)
+	networks.Get("/details/{id}", networkRole(roleViewer, processError, networkDetails))
+	networks.Post("/addPeer/{id}/{peer}", networkRole(roleOperator, processError, networkAddPeer))
+	networks.Post("/addGroup/{id}/{group}", networkRole(roleOperator, processError, networkAddGroup))
+	networks.Delete("/{id}", networkRole(roleOwner, processError, deleteNetwork))
+	networks.Delete("/peers/{id}/{peer}", networkRole(roleOperator, processError, removePeerFromNetwork))
+	networks.Get("/relay/{id}/{peer}", networkRole(roleOperator, processError, displayAddRelay))
+	networks.Post("/relay/{id}/{peer}", networkRole(roleOperator, processError, addRelay))
+	networks.Delete("/relay/{id}/{peer}", networkRole(roleOperator, processError, deleteRelay))
+	networks.Get("/peers/{id}/{peer}", networkRole(roleViewer, processError, networkPeerDetails))
+	networks.Get("/router/{id}/{peer}", networkRole(roleOperator, processError, displayAddRouter))
+	networks.Post("/router/{id}/{peer}", networkRole(roleOperator, processError, addRouter))
+	networks.Delete("/router/{id}/{peer}", networkRole(roleOperator, processError, deleteRouter))
+	networks.Post("/exit/{id}/{peer}", networkRole(roleOperator, processError, addExitNode))
+	networks.Delete("/exit/{id}/{peer}", networkRole(roleOperator, processError, deleteExitNode))
+	networks.Post("/reservations/{id}", networkRole(roleOperator, processError, addReservation))
+	networks.Delete("/reservations/{id}/{address}", networkRole(roleOperator, processError, deleteReservation))
+	networks.Post("/excluded/{id}", networkRole(roleOperator, processError, addExclusion))
+	networks.Delete("/excluded/{id}/{start}", networkRole(roleOperator, processError, deleteExclusion))
+	networks.Post("/policies/{id}", networkRole(roleOwner, processError, addPolicy))
+	networks.Post("/psk/{id}", networkRole(roleOwner, processError, networkPresharedKeys))
+	networks.Delete("/policies/{id}/{name}", networkRole(roleOwner, processError, deletePolicy))
+	networks.Post("/roles/{id}", networkRole(roleOwner, processError, setNetworkRole))
+	networks.Delete("/roles/{id}/{user}", networkRole(roleOwner, processError, deleteNetworkRole))
 
 	keys := router.Group("/keys", auth)
-	keys.Get("/", displayKeys)
-	keys.Get("/add", displayCreateKey)
-	keys.Post("/add", addKey)
-	keys.Delete("/{id}", deleteKey)
+	keys.Get("/", anyNetworkRole(roleOperator, processError, displayKeys))
+	keys.Get("/add", anyNetworkRole(roleOperator, processError, displayCreateKey))
+	keys.Post("/add", anyNetworkRole(roleOperator, processError, addKey))
+	keys.Delete("/{id}", anyNetworkRole(roleOperator, processError, deleteKey))
 
 	peers := router.Group("/peers", auth)
 	peers.Get("/{$}", displayPeers)
-	peers.Get("/{id}", peerDetails)
-	peers.Delete("/{id}", deletePeer)
+	peers.Get("/{id}", peerRole(roleViewer, processError, peerDetails))
+	peers.Post("/{id}", peerRole(roleOperator, processError, editPeerLabels))
+	peers.Delete("/{id}", peerRole(roleOperator, processError, deletePeer))
+	peers.Post("/rotate/{id}", peerRole(roleOperator, processError, rotatePeerKeys))
+	peers.Post("/pending/{id}", approvePeer)
+	peers.Delete("/pending/{id}", rejectPeer)
+	peers.Post("/groups", anyNetworkRole(roleOperator, processError, addGroup))
+	peers.Delete("/groups/{name}", anyNetworkRole(roleOperator, processError, deleteGroup))
 
 	users := router.Group("/users", auth)
 	users.Get("/{$}", getUsers)
@@ -72,11 +95,22 @@ func setupRouter() *mux.Router {
 	users.Delete("/{name}", deleteUser)
 	users.Get("/user/{name}", getUser)
 	users.Post("/user/{name}", editUser)
+	users.Post("/sso/{name}", linkUser)
+	users.Get("/tokens", displayTokens)
+	users.Get("/tokens/add", displayAddToken)
+	users.Post("/tokens/add", addToken)
+	users.Delete("/tokens/{id}", deleteToken)
+
+	auditLog := router.Group("/audit", auth)
+	auditLog.Get("/{$}", displayAudit)
+	auditLog.Get("/export", exportAudit)
 
 	server := router.Group("/server", auth)
 	server.Get("/", getServer)
 	server.Post("/logs/{level}", setLogLevel)
 
+	setupAPI(router)
+
 	return router
 }
 
@@ -90,8 +124,37 @@ func processError(w http.ResponseWriter, status int, message string) {
 	http.Error(w, message, status)
 }
 
+// requestError is an error caused by an invalid client request.
+type requestError string
+
+func (e requestError) Error() string {
+	return string(e)
+}
+
+// errorStatus returns the http status code to report for err.
+func errorStatus(err error) int {
+	var invalid requestError
+	switch {
+	case errors.As(err, &invalid):
+		return http.StatusBadRequest
+	case errors.Is(err, boltdb.ErrNoResults), errors.Is(err, ErrPeerNotFound):
+		return http.StatusNotFound
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
 func auth(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if value, ok := bearerToken(r); ok {
+			request, status, err := tokenRequest(r, value)
+			if err != nil {
+				processError(w, status, err.Error())
+				return
+			}
+			next.ServeHTTP(w, request)
+			return
+		}
 		session := GetSession(r)
 		if session.IsNew {
 			http.Redirect(w, r, "/login/", http.StatusUnauthorized)
@@ -25,7 +25,10 @@ var (
 	webfail     chan int
 	natServer   *server.Server
 	natsOptions *server.Options
-	natsConn    *nats.Conn
+	// nkeysLock guards the users of natsOptions, changed by the handlers of
+	// keys and peers and by the replication of other servers of the cluster.
+	nkeysLock sync.Mutex
+	natsConn  *nats.Conn
 	// eConn       *nats.EncodedConn.
 )
 
@@ -76,9 +79,11 @@ func Run() {
 }
 
 func start(ctx context.Context, wg *sync.WaitGroup, tls *tls.Config) {
-	wg.Add(2)
+	wg.Add(4)
 	go web(ctx, wg, tls)
 	go broker(ctx, wg, tls)
+	go stunServer(ctx, wg)
+	go relayServer(ctx, wg, tls)
 }
 
 func web(ctx context.Context, wg *sync.WaitGroup, tls *tls.Config) {
@@ -89,6 +94,7 @@ func web(ctx context.Context, wg *sync.WaitGroup, tls *tls.Config) {
 		webfail <- 1
 		return
 	}
+	configureOIDC(config)
 	router := setupRouter()
 	server := http.Server{
 		Addr:    ":" + config.Port,
@@ -50,6 +50,9 @@ func keypairs() ([]byte, []byte) {
 }
 
 func GetSessionData(r *http.Request) plexus.User {
+	if user, ok := tokenUser(r); ok {
+		return user
+	}
 	s := GetSession(r)
 	data, ok := s.Values[dataName].(plexus.User)
 	if !ok {
@@ -0,0 +1,115 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"strconv"
+	"sync"
+
+	"github.com/devilcove/configuration"
+	"github.com/pion/stun/v3"
+)
+
+const defaultStunPort = 3478
+
+var errNotBindingRequest = errors.New("not a binding request")
+
+// stunServer runs the embedded STUN server that agents use to discover their
+// public address and port, so registration and joins do not depend on public
+// STUN servers being reachable.
+func stunServer(ctx context.Context, wg *sync.WaitGroup) {
+	defer wg.Done()
+	config := Configuration{}
+	if err := configuration.Get(&config); err != nil {
+		slog.Error("configuration", "error", err)
+		return
+	}
+	if config.StunPort < 0 {
+		slog.Info("stun server disabled")
+		return
+	}
+	port := config.StunPort
+	if port == 0 {
+		port = defaultStunPort
+	}
+	conn, err := net.ListenPacket("udp", ":"+strconv.Itoa(port))
+	if err != nil {
+		slog.Error("stun server", "error", err)
+		return
+	}
+	slog.Info("stun server started", "port", port)
+	serveStun(ctx, conn)
+	slog.Info("stun server shutdown")
+}
+
+// serveStun answers the STUN binding requests received on conn until ctx is
+// done.
+func serveStun(ctx context.Context, conn net.PacketConn) {
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+	buf := make([]byte, 1500)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			if ctx.Err() != nil || errors.Is(err, net.ErrClosed) {
+				return
+			}
+			slog.Debug("stun read", "error", err)
+			continue
+		}
+		response, err := stunResponse(buf[:n], addr)
+		if err != nil {
+			slog.Debug("invalid stun request", "from", addr, "error", err)
+			continue
+		}
+		if _, err := conn.WriteTo(response, addr); err != nil {
+			slog.Debug("stun response", "to", addr, "error", err)
+		}
+	}
+}
+
+// stunResponse returns the binding response to a binding request from addr.
+func stunResponse(data []byte, addr net.Addr) ([]byte, error) {
+	request := &stun.Message{Raw: append([]byte{}, data...)}
+	if err := request.Decode(); err != nil {
+		return nil, err
+	}
+	if request.Type != stun.BindingRequest {
+		return nil, errNotBindingRequest
+	}
+	udp, ok := addr.(*net.UDPAddr)
+	if !ok {
+		return nil, errNotBindingRequest
+	}
+	ip := udp.IP
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	response, err := stun.Build(
+		stun.NewTransactionIDSetter(request.TransactionID),
+		stun.BindingSuccess,
+		&stun.XORMappedAddress{IP: ip, Port: udp.Port},
+		stun.Fingerprint,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return response.Raw, nil
+}
+
+// stunAddress returns the address of the embedded STUN server advertised to
+// agents in registration keys, or a blank string when it is disabled.
+func stunAddress(config Configuration) string {
+	if config.StunPort < 0 || config.FQDN == "" {
+		return ""
+	}
+	port := config.StunPort
+	if port == 0 {
+		port = defaultStunPort
+	}
+	return net.JoinHostPort(config.FQDN, strconv.Itoa(port))
+}
@@ -0,0 +1,48 @@
+package server
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/Kairum-Labs/should"
+	"github.com/pion/stun/v3"
+)
+
+func TestStunServer(t *testing.T) {
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	should.NotBeError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go serveStun(ctx, conn)
+
+	t.Run("binding", func(t *testing.T) {
+		c, err := net.DialUDP("udp4", nil, conn.LocalAddr().(*net.UDPAddr))
+		should.NotBeError(t, err)
+		client, err := stun.NewClient(c)
+		should.NotBeError(t, err)
+		defer client.Close()
+		local := c.LocalAddr().(*net.UDPAddr)
+		address := stun.XORMappedAddress{}
+		err = client.Do(stun.MustBuild(stun.TransactionID, stun.BindingRequest), func(event stun.Event) {
+			should.NotBeError(t, event.Error)
+			should.NotBeError(t, address.GetFrom(event.Message))
+		})
+		should.NotBeError(t, err)
+		should.BeEqual(t, address.IP.String(), "127.0.0.1")
+		should.BeEqual(t, address.Port, local.Port)
+	})
+	t.Run("invalid", func(t *testing.T) {
+		addr := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 1234}
+		_, err := stunResponse([]byte("not stun"), addr)
+		should.BeError(t, err)
+		indication := stun.MustBuild(stun.TransactionID, stun.NewType(stun.MethodBinding, stun.ClassIndication))
+		_, err = stunResponse(indication.Raw, addr)
+		should.BeError(t, err)
+	})
+	t.Run("address", func(t *testing.T) {
+		should.BeEqual(t, stunAddress(Configuration{FQDN: "plexus.example.org"}), "plexus.example.org:3478")
+		should.BeEqual(t, stunAddress(Configuration{FQDN: "10.0.0.1", StunPort: 3479}), "10.0.0.1:3479")
+		should.BeEqual(t, stunAddress(Configuration{FQDN: "plexus.example.org", StunPort: -1}), "")
+	})
+}
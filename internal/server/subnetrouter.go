@@ -5,6 +5,8 @@ import (
 	"log/slog"
 	"net"
 	"net/http"
+	"slices"
+	"strings"
 
 	"github.com/devilcove/boltdb"
 	"github.com/devilcove/plexus"
@@ -29,103 +31,171 @@ func addRouter(w http.ResponseWriter, r *http.Request) {
 	cidr := r.FormValue("cidr")
 	nat := r.FormValue("nat")
 	vcidr := r.FormValue("vcidr")
-	var virtSubnet *net.IPNet
 	slog.Debug("subnet router", "network", netID, "router", router, "subnet", cidr, "use NAT", nat)
-	_, subnet, err := net.ParseCIDR(cidr)
+	network, err := boltdb.Get[plexus.Network](netID, networkTable)
+	if err != nil {
+		processError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	subnet, err := parseRouterSubnet(network, router, cidr, nat, vcidr)
 	if err != nil {
 		processError(w, http.StatusBadRequest, err.Error())
 		return
 	}
+	if _, err := createRouter(userActor(r), network, router, subnet); err != nil {
+		processError(w, errorStatus(err), err.Error())
+		return
+	}
+	networkDetails(w, r)
+}
+
+// parseRouterSubnet parses and validates the subnet and, for nat mode virt, the
+// virtual subnet of a subnet router. A subnet routed by another router of
+// network with the same virtual subnet is valid: the routers form a highly
+// available group.
+func parseRouterSubnet(network plexus.Network, router, cidr, nat, vcidr string) (plexus.RouterSubnet, error) {
+	routerSubnet := plexus.RouterSubnet{UseNat: nat == "nat", UseVirtSubnet: nat == "virt"}
+	_, subnet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return routerSubnet, requestError(err.Error())
+	}
+	routerSubnet.Subnet = *subnet
 	if nat == "virt" {
-		_, virtSubnet, err = net.ParseCIDR(vcidr)
+		_, virtSubnet, err := net.ParseCIDR(vcidr)
 		if err != nil {
-			processError(w, http.StatusBadRequest, err.Error())
-			return
+			return routerSubnet, requestError(err.Error())
 		}
 		if virtSubnet.Mask.String() != subnet.Mask.String() {
-			processError(w, http.StatusBadRequest, "subnet/virtual subnet masks must be the same")
-			return
+			return routerSubnet, requestError("subnet/virtual subnet masks must be the same")
 		}
-		if message, err := validateSubnet(virtSubnet); err != nil {
-			processError(w, http.StatusBadRequest, message)
-			return
+		routerSubnet.VirtSubnet = *virtSubnet
+	}
+	if subnetRouted(network, router, routerSubnet) {
+		return routerSubnet, nil
+	}
+	if routerSubnet.UseVirtSubnet {
+		if message, err := validateSubnet(&routerSubnet.VirtSubnet); err != nil {
+			return routerSubnet, requestError(message)
 		}
 	}
 	if message, err := validateSubnet(subnet); err != nil {
-		processError(w, http.StatusBadRequest, message)
-		return
-	}
-	network, err := boltdb.Get[plexus.Network](netID, networkTable)
-	if err != nil {
-		processError(w, http.StatusBadRequest, err.Error())
-		return
+		return routerSubnet, requestError(message)
 	}
+	return routerSubnet, nil
+}
+
+// createRouter adds subnet to the subnets routed by router, making it a subnet
+// router if required, and publishes the update.
+func createRouter(
+	actor string,
+	network plexus.Network,
+	router string,
+	subnet plexus.RouterSubnet,
+) (plexus.Network, error) {
 	update := plexus.NetworkUpdate{
 		Action: plexus.UpdatePeer,
 	}
+	if !peerInNetwork(network, router) {
+		return network, ErrPeerNotFound
+	}
+	before := network
+	before.Peers = slices.Clone(network.Peers)
 	for i, peer := range network.Peers {
 		if peer.WGPublicKey == router {
 			peer.IsSubnetRouter = true
-			if nat == "nat" {
-				peer.UseNat = true
-			}
-			if nat == "virt" {
-				peer.UseVirtSubnet = true
-				peer.VirtSubnet = *virtSubnet
-			}
-			peer.Subnet = *subnet
+			// a router joining the routers of a subnet is a standby router.
+			subnet.Standby = subnetRouted(network, router, subnet)
+			// adding a subnet the router already routes changes its nat mode.
+			peer.Subnets = slices.DeleteFunc(slices.Clone(peer.Subnets), func(s plexus.RouterSubnet) bool {
+				return s.Subnet.String() == subnet.Subnet.String()
+			})
+			peer.Subnets = append(peer.Subnets, subnet)
 			network.Peers[i] = peer
-			update.Peer = peer
 			break
 		}
 	}
-	if err := boltdb.Save(network, network.Name, networkTable); err != nil {
-		processError(w, http.StatusInternalServerError, err.Error())
-		return
+	elected := electRouters(&network)
+	update.Peer = routerPeer(network, router)
+	if err := save(network, network.Name, networkTable); err != nil {
+		return network, err
 	}
+	audit(actor, "router.create", network.Name+"/"+update.Peer.HostName+" "+subnet.Subnet.String(),
+		before, network)
 	publish.Message(natsConn, "networks."+network.Name, update)
 	publish.Message(natsConn, plexus.Update+update.Peer.WGPublicKey+plexus.AddRouter, update.Peer)
-	networkDetails(w, r)
+	publishRouters(network.Name, router, elected)
+	return network, nil
 }
 
 func deleteRouter(w http.ResponseWriter, r *http.Request) {
 	netID := r.PathValue("id")
 	router := r.PathValue("peer")
-	slog.Info("delete subnet router", "network", netID, "router", router)
+	subnet := r.URL.Query().Get("subnet")
+	slog.Info("delete subnet router", "network", netID, "router", router, "subnet", subnet)
 	network, err := boltdb.Get[plexus.Network](netID, networkTable)
 	if err != nil {
 		processError(w, http.StatusBadRequest, err.Error())
 		return
 	}
+	if _, err := removeRouter(userActor(r), network, router, subnet); err != nil {
+		processError(w, errorStatus(err), err.Error())
+		return
+	}
+	networkDetails(w, r)
+}
+
+// removeRouter removes subnet from the subnets routed by router, or all of them
+// when subnet is empty, and publishes the update. The router stops being a subnet
+// router once it routes no subnets.
+func removeRouter(actor string, network plexus.Network, router, subnet string) (plexus.Network, error) {
 	update := plexus.NetworkUpdate{
 		Action: plexus.UpdatePeer,
 	}
+	if !peerInNetwork(network, router) {
+		return network, ErrPeerNotFound
+	}
+	before := network
+	before.Peers = slices.Clone(network.Peers)
 	for i, peer := range network.Peers {
 		if peer.WGPublicKey == router {
-			peer.IsSubnetRouter = false
-			peer.UseNat = false
-			peer.UseVirtSubnet = false
+			subnets := []plexus.RouterSubnet{}
+			if subnet != "" {
+				subnets = slices.DeleteFunc(slices.Clone(peer.Subnets), func(s plexus.RouterSubnet) bool {
+					return sameCIDR(s.Subnet.String(), subnet)
+				})
+				if len(subnets) == len(peer.Subnets) {
+					return network, requestError("peer does not route subnet " + subnet)
+				}
+			}
+			peer.Subnets = subnets
+			peer.IsSubnetRouter = len(subnets) > 0
 			network.Peers[i] = peer
-			update.Peer = peer
 			break
 		}
 	}
-	if err := boltdb.Save(network, network.Name, networkTable); err != nil {
-		processError(w, http.StatusInternalServerError, err.Error())
-		return
+	// the standby routers of removed subnets take over.
+	elected := electRouters(&network)
+	update.Peer = routerPeer(network, router)
+	if err := save(network, network.Name, networkTable); err != nil {
+		return network, err
 	}
+	audit(actor, "router.delete", strings.TrimSpace(network.Name+"/"+update.Peer.HostName+" "+subnet),
+		before, network)
 	slog.Debug(
 		"publish network update - delete router",
 		"network", network.Name,
 		"peer", update.Peer.HostName,
+		"subnet", subnet,
 	)
 	publish.Message(natsConn, "networks."+network.Name, update)
-	publish.Message(
-		natsConn,
-		plexus.Update+update.Peer.WGPublicKey+plexus.DeleteRouter,
-		update.Peer,
-	)
-	networkDetails(w, r)
+	// the router reconfigures nat and virtual subnets for the remaining subnets.
+	action := plexus.DeleteRouter
+	if update.Peer.IsSubnetRouter {
+		action = plexus.AddRouter
+	}
+	publish.Message(natsConn, plexus.Update+update.Peer.WGPublicKey+action, update.Peer)
+	publishRouters(network.Name, router, elected)
+	return network, nil
 }
 
 func subnetInUse(subnet *net.IPNet) (string, string, error) {
@@ -135,14 +205,16 @@ func subnetInUse(subnet *net.IPNet) (string, string, error) {
 		return "", "", err
 	}
 	for _, network := range networks {
-		if network.Net.Contains(subnet.IP) || subnet.Contains(network.Net.IP) {
-			slog.Debug(
-				"subnet in use - network",
-				"network", network.Name,
-				"net", network.Net,
-				"subnet", subnet,
-			)
-			return "network", network.Name, ErrSubnetInUse
+		for _, inUse := range network.Nets() {
+			if inUse.Contains(subnet.IP) || subnet.Contains(inUse.IP) {
+				slog.Debug(
+					"subnet in use - network",
+					"network", network.Name,
+					"net", inUse,
+					"subnet", subnet,
+				)
+				return "network", network.Name, ErrSubnetInUse
+			}
 		}
 		for _, peer := range network.Peers {
 			if err := checkSubNetRouter(peer, network, subnet); err != nil {
@@ -157,16 +229,11 @@ func checkSubNetRouter(peer plexus.NetworkPeer, network plexus.Network, subnet *
 	if !peer.IsSubnetRouter {
 		return nil
 	}
-	if peer.UseVirtSubnet {
-		if subnet.Contains(peer.VirtSubnet.IP) || peer.VirtSubnet.Contains(subnet.IP) {
-			slog.Debug("virt subnet in use peer", "network", network.Name, "net",
-				network.Net, "subnet", subnet, "peer", peer.VirtSubnet)
-			return ErrSubnetInUse
-		}
-	} else {
-		if subnet.Contains(peer.Subnet.IP) || peer.Subnet.Contains(subnet.IP) {
+	for _, routed := range peer.Subnets {
+		advertised := routed.Advertised()
+		if subnet.Contains(advertised.IP) || advertised.Contains(subnet.IP) {
 			slog.Debug("subnet in use by peer", "network", network.Name, "net",
-				network.Net, "subnet", subnet, "peer", peer.Subnet)
+				network.Net, "subnet", subnet, "peer", advertised, "virtual", routed.UseVirtSubnet)
 			return ErrSubnetInUse
 		}
 	}
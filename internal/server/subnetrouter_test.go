@@ -21,7 +21,7 @@ func TestSubnetRouter(t *testing.T) {
 	deleteAllUsers(t)
 	createTestNetwork(t)
 	peer := createTestNetworkPeer(t)
-	user := plexus.User{Username: "test", Password: "pass", IsAdmin: false}
+	user := plexus.User{Username: "test", Password: "pass", IsAdmin: true}
 	createTestUser(t, user)
 
 	t.Run("display", func(t *testing.T) {
@@ -152,6 +152,37 @@ func TestSubnetRouter(t *testing.T) {
 		should.ContainSubstring(t, string(body), "Network:")
 	})
 
+	t.Run("multiple", func(t *testing.T) {
+		setup(t)
+		defer shutdown(t)
+		subnets := func(t *testing.T) []plexus.RouterSubnet {
+			t.Helper()
+			network, err := boltdb.Get[plexus.Network]("valid", networkTable)
+			should.NotBeError(t, err)
+			for _, p := range network.Peers {
+				if p.WGPublicKey == peer {
+					return p.Subnets
+				}
+			}
+			return nil
+		}
+		cookie := testLogin(t, user)
+		w := apiRequest(t, cookie, http.MethodPost, "/api/v1/networks/valid/router/"+peer,
+			`{"Subnet":"192.168.1.0/24"}`)
+		should.BeEqual(t, w.Code, http.StatusOK)
+		should.BeEqual(t, len(subnets(t)), 2)
+		should.BeTrue(t, subnets(t)[0].UseNat)
+		w = apiRequest(t, cookie, http.MethodPost, "/api/v1/networks/valid/router/"+peer,
+			`{"Subnet":"192.168.1.128/25"}`)
+		should.BeEqual(t, w.Code, http.StatusBadRequest)
+		w = apiRequest(t, cookie, http.MethodDelete, "/api/v1/networks/valid/router/"+peer+"?subnet=192.168.0.0/24", "")
+		should.BeEqual(t, w.Code, http.StatusOK)
+		should.BeEqual(t, len(subnets(t)), 1)
+		should.BeEqual(t, subnets(t)[0].Subnet.String(), "192.168.1.0/24")
+		w = apiRequest(t, cookie, http.MethodDelete, "/api/v1/networks/valid/router/"+peer+"?subnet=10.0.0.0/8", "")
+		should.BeEqual(t, w.Code, http.StatusBadRequest)
+	})
+
 	t.Run("delete", func(t *testing.T) {
 		setup(t)
 		defer shutdown(t)
@@ -206,10 +237,10 @@ func TestSubnetInUse(t *testing.T) {
 		should.BeEmpty(t, name)
 	})
 	t.Run("no overlap", func(t *testing.T) {
-		peer.Subnet = net.IPNet{
+		peer.Subnets = []plexus.RouterSubnet{{Subnet: net.IPNet{
 			IP:   net.ParseIP("192.168.0.0").To4(),
 			Mask: net.CIDRMask(20, 32),
-		}
+		}}}
 		peer.IsSubnetRouter = true
 		network.Peers = []plexus.NetworkPeer{peer}
 		err = boltdb.Save(network, network.Name, networkTable)
@@ -235,8 +266,8 @@ func TestSubnetInUse(t *testing.T) {
 	})
 	t.Run("overlap virtual subnet", func(t *testing.T) {
 		peer.IsSubnetRouter = true
-		peer.UseVirtSubnet = true
-		peer.VirtSubnet = net.IPNet{
+		peer.Subnets[0].UseVirtSubnet = true
+		peer.Subnets[0].VirtSubnet = net.IPNet{
 			IP:   net.ParseIP("172.16.0.0").To4(),
 			Mask: net.CIDRMask(20, 32),
 		}
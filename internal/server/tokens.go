@@ -0,0 +1,257 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/devilcove/boltdb"
+	"github.com/devilcove/plexus"
+)
+
+const (
+	tokenPrefix = "plexus_"
+	scopeRead   = "read"
+	scopeWrite  = "write"
+)
+
+type contextKey string
+
+const (
+	tokenUserKey  contextKey = "tokenUser"
+	tokenScopeKey contextKey = "tokenScope"
+)
+
+// TokenPage is the data used to display a newly created token.
+type TokenPage struct {
+	Token plexus.Token
+	Value string
+}
+
+func displayTokens(w http.ResponseWriter, r *http.Request) {
+	session := GetSessionData(r)
+	tokens, err := getTokens(session)
+	if err != nil {
+		processError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	render(w, "tokens", tokens)
+}
+
+func displayAddToken(w http.ResponseWriter, r *http.Request) {
+	session := GetSessionData(r)
+	page := getPage(session.Username)
+	render(w, "addToken", page)
+}
+
+func addToken(w http.ResponseWriter, r *http.Request) {
+	if _, ok := tokenUser(r); ok {
+		processError(w, http.StatusForbidden, "tokens cannot be created with a token")
+		return
+	}
+	session := GetSessionData(r)
+	token := plexus.Token{
+		Name:  r.FormValue("name"),
+		Owner: session.Username,
+		Scope: r.FormValue("scope"),
+	}
+	if expires := r.FormValue("expires"); expires != "" {
+		var err error
+		token.Expires, err = time.Parse("2006-01-02", expires)
+		if err != nil {
+			processError(w, http.StatusBadRequest, "invalid expiry "+err.Error())
+			return
+		}
+	}
+	token, value, err := createToken(userActor(r), token)
+	if err != nil {
+		processError(w, errorStatus(err), err.Error())
+		return
+	}
+	render(w, "newToken", TokenPage{Token: token, Value: value})
+}
+
+func deleteToken(w http.ResponseWriter, r *http.Request) {
+	session := GetSessionData(r)
+	token, err := boltdb.Get[plexus.Token](r.PathValue("id"), tokenTable)
+	if err != nil {
+		processError(w, http.StatusNotFound, "token does not exist")
+		return
+	}
+	if !session.IsAdmin && token.Owner != session.Username {
+		processError(w, http.StatusUnauthorized, "admin rights required to revoke tokens of other users")
+		return
+	}
+	if err := remove(token.ID, tokenTable); err != nil {
+		processError(w, http.StatusInternalServerError, "revoke token "+err.Error())
+		return
+	}
+	audit(userActor(r), "token.revoke", token.Owner+"/"+token.Name, auditToken(token), nil)
+	slog.Info("token revoked", "name", token.Name, "owner", token.Owner, "by", session.Username)
+	displayTokens(w, r)
+}
+
+// getTokens returns the tokens visible to user; admins see all tokens.
+func getTokens(user plexus.User) ([]plexus.Token, error) {
+	all, err := boltdb.GetAll[plexus.Token](tokenTable)
+	if err != nil {
+		return nil, err
+	}
+	tokens := []plexus.Token{}
+	for _, token := range all {
+		if user.IsAdmin || token.Owner == user.Username {
+			tokens = append(tokens, token)
+		}
+	}
+	slices.SortFunc(tokens, func(a, b plexus.Token) int {
+		return strings.Compare(a.Owner+a.Name, b.Owner+b.Name)
+	})
+	return tokens, nil
+}
+
+// createToken generates and saves a new token. The returned value is the only
+// copy of the token secret.
+func createToken(actor string, token plexus.Token) (plexus.Token, string, error) {
+	if token.Name == "" || len(token.Name) > 255 {
+		return token, "", requestError("invalid token name")
+	}
+	if token.Scope == "" {
+		token.Scope = scopeRead
+	}
+	if token.Scope != scopeRead && token.Scope != scopeWrite {
+		return token, "", requestError("invalid token scope")
+	}
+	if !token.Expires.IsZero() && token.Expires.Before(time.Now()) {
+		return token, "", requestError("token expiry is in the past")
+	}
+	id := make([]byte, 8)
+	secret := make([]byte, 32)
+	if _, err := rand.Read(id); err != nil {
+		return token, "", err
+	}
+	if _, err := rand.Read(secret); err != nil {
+		return token, "", err
+	}
+	token.ID = hex.EncodeToString(id)
+	encoded := base64.RawURLEncoding.EncodeToString(secret)
+	token.Hash = hashToken(encoded)
+	token.Created = time.Now()
+	if err := save(token, token.ID, tokenTable); err != nil {
+		return token, "", fmt.Errorf("saving token %w", err)
+	}
+	slog.Info("token created", "name", token.Name, "owner", token.Owner, "scope", token.Scope)
+	audit(actor, "token.create", token.Owner+"/"+token.Name, nil, auditToken(token))
+	return token, tokenPrefix + token.ID + "." + encoded, nil
+}
+
+// auditToken returns token without the secret hash for recording in the audit log.
+func auditToken(token plexus.Token) plexus.Token {
+	token.Hash = ""
+	return token
+}
+
+func hashToken(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// removeUserTokens revokes all tokens owned by user.
+func removeUserTokens(actor, user string) error {
+	tokens, err := boltdb.GetAll[plexus.Token](tokenTable)
+	if err != nil {
+		return err
+	}
+	var errs error
+	for _, token := range tokens {
+		if token.Owner != user {
+			continue
+		}
+		if err := remove(token.ID, tokenTable); err != nil {
+			errs = errors.Join(errs, err)
+			continue
+		}
+		audit(actor, "token.revoke", token.Owner+"/"+token.Name, auditToken(token), nil)
+	}
+	return errs
+}
+
+// bearerToken returns the token from the Authorization header of r, if any.
+func bearerToken(r *http.Request) (string, bool) {
+	value, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return value, ok && value != ""
+}
+
+// validateToken checks a bearer token value and returns the user that owns it
+// and the scope of the token. Read scoped tokens are only valid for safe
+// methods.
+func validateToken(value, method string) (plexus.User, string, error) {
+	value, ok := strings.CutPrefix(value, tokenPrefix)
+	if !ok {
+		return plexus.User{}, "", ErrInvalidToken
+	}
+	id, secret, ok := strings.Cut(value, ".")
+	if !ok {
+		return plexus.User{}, "", ErrInvalidToken
+	}
+	token, err := boltdb.Get[plexus.Token](id, tokenTable)
+	if err != nil {
+		return plexus.User{}, "", ErrInvalidToken
+	}
+	if subtle.ConstantTimeCompare([]byte(hashToken(secret)), []byte(token.Hash)) != 1 {
+		return plexus.User{}, "", ErrInvalidToken
+	}
+	if !token.Expires.IsZero() && token.Expires.Before(time.Now()) {
+		return plexus.User{}, "", ErrTokenExpired
+	}
+	if token.Scope != scopeWrite && method != http.MethodGet && method != http.MethodHead {
+		return plexus.User{}, "", ErrTokenScope
+	}
+	user, err := boltdb.Get[plexus.User](token.Owner, userTable)
+	if err != nil {
+		return plexus.User{}, "", ErrInvalidToken
+	}
+	if time.Since(token.LastUsed) > time.Minute {
+		token.LastUsed = time.Now()
+		if err := save(token, token.ID, tokenTable); err != nil {
+			slog.Error("update token last used", "token", token.Name, "error", err)
+		}
+	}
+	user.Password = ""
+	return user, token.Scope, nil
+}
+
+// tokenRequest authenticates r with its bearer token. The returned request
+// carries the token owner for GetSessionData and the scope of the token.
+func tokenRequest(r *http.Request, value string) (*http.Request, int, error) {
+	user, scope, err := validateToken(value, r.Method)
+	if err != nil {
+		if errors.Is(err, ErrTokenScope) {
+			return r, http.StatusForbidden, err
+		}
+		return r, http.StatusUnauthorized, err
+	}
+	ctx := context.WithValue(r.Context(), tokenUserKey, user)
+	return r.WithContext(context.WithValue(ctx, tokenScopeKey, scope)), http.StatusOK, nil
+}
+
+// tokenUser returns the user authenticated by a bearer token for r, if any.
+func tokenUser(r *http.Request) (plexus.User, bool) {
+	user, ok := r.Context().Value(tokenUserKey).(plexus.User)
+	return user, ok
+}
+
+// tokenScope returns the scope of the bearer token authenticating r, if any.
+func tokenScope(r *http.Request) (string, bool) {
+	scope, ok := r.Context().Value(tokenScopeKey).(string)
+	return scope, ok
+}
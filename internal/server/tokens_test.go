@@ -0,0 +1,174 @@
+package server
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Kairum-Labs/should"
+	"github.com/devilcove/boltdb"
+	"github.com/devilcove/plexus"
+)
+
+func deleteAllTokens(t *testing.T) {
+	t.Helper()
+	tokens, err := boltdb.GetAll[plexus.Token](tokenTable)
+	should.NotBeError(t, err)
+	for _, token := range tokens {
+		err := boltdb.Delete[plexus.Token](token.ID, tokenTable)
+		should.NotBeError(t, err)
+	}
+}
+
+func tokenRequestRecorder(t *testing.T, value, method, path string) *httptest.ResponseRecorder {
+	t.Helper()
+	r := httptest.NewRequest(method, path, nil)
+	r.Header.Set("Authorization", "Bearer "+value)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+	return w
+}
+
+func TestCreateToken(t *testing.T) {
+	deleteAllTokens(t)
+	defer deleteAllTokens(t)
+	t.Run("blankName", func(t *testing.T) {
+		_, _, err := createToken("admin", plexus.Token{Owner: "admin"})
+		should.BeErrorIs(t, err, requestError("invalid token name"))
+	})
+	t.Run("invalidScope", func(t *testing.T) {
+		_, _, err := createToken("admin", plexus.Token{Name: "ci", Owner: "admin", Scope: "all"})
+		should.BeErrorIs(t, err, requestError("invalid token scope"))
+	})
+	t.Run("expired", func(t *testing.T) {
+		_, _, err := createToken("admin", plexus.Token{
+			Name:    "ci",
+			Owner:   "admin",
+			Expires: time.Now().Add(-time.Hour),
+		})
+		should.BeErrorIs(t, err, requestError("token expiry is in the past"))
+	})
+	t.Run("valid", func(t *testing.T) {
+		token, value, err := createToken("admin", plexus.Token{Name: "ci", Owner: "admin"})
+		should.NotBeError(t, err)
+		should.BeEqual(t, token.Scope, scopeRead)
+		should.StartWith(t, value, tokenPrefix+token.ID+".")
+		saved, err := boltdb.Get[plexus.Token](token.ID, tokenTable)
+		should.NotBeError(t, err)
+		should.BeFalse(t, strings.Contains(value, saved.Hash))
+	})
+}
+
+func TestTokenAuth(t *testing.T) {
+	setup(t)
+	defer shutdown(t)
+	deleteAllUsers(t)
+	deleteAllTokens(t)
+	defer deleteAllTokens(t)
+	admin := plexus.User{Username: "admin", Password: "pass", IsAdmin: true}
+	createTestUser(t, admin)
+	_, read, err := createToken("admin", plexus.Token{Name: "read", Owner: "admin", Scope: scopeRead})
+	should.NotBeError(t, err)
+	writeToken, write, err := createToken("admin", plexus.Token{Name: "write", Owner: "admin", Scope: scopeWrite})
+	should.NotBeError(t, err)
+
+	t.Run("api", func(t *testing.T) {
+		w := tokenRequestRecorder(t, read, http.MethodGet, "/api/v1/users")
+		should.BeEqual(t, w.Code, http.StatusOK)
+	})
+	t.Run("ui", func(t *testing.T) {
+		w := tokenRequestRecorder(t, read, http.MethodGet, "/users/")
+		should.BeEqual(t, w.Code, http.StatusOK)
+		should.ContainSubstring(t, w.Body.String(), "<h1>Authorized Users</h1>")
+	})
+	t.Run("readScope", func(t *testing.T) {
+		w := tokenRequestRecorder(t, read, http.MethodDelete, "/api/v1/keys/missing")
+		should.BeEqual(t, w.Code, http.StatusForbidden)
+	})
+	t.Run("writeScope", func(t *testing.T) {
+		w := tokenRequestRecorder(t, write, http.MethodDelete, "/api/v1/keys/missing")
+		should.BeEqual(t, w.Code, http.StatusNotFound)
+	})
+	t.Run("invalid", func(t *testing.T) {
+		w := tokenRequestRecorder(t, read+"x", http.MethodGet, "/api/v1/users")
+		should.BeEqual(t, w.Code, http.StatusUnauthorized)
+		w = tokenRequestRecorder(t, "garbage", http.MethodGet, "/networks/")
+		should.BeEqual(t, w.Code, http.StatusUnauthorized)
+	})
+	t.Run("noTokenCreation", func(t *testing.T) {
+		w := tokenRequestRecorder(t, write, http.MethodPost, "/users/tokens/add")
+		should.BeEqual(t, w.Code, http.StatusForbidden)
+	})
+	t.Run("revoked", func(t *testing.T) {
+		cookie := testLogin(t, admin)
+		r := httptest.NewRequest(http.MethodDelete, "/users/tokens/"+writeToken.ID, nil)
+		r.AddCookie(cookie)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		should.BeEqual(t, w.Code, http.StatusOK)
+		w = tokenRequestRecorder(t, write, http.MethodGet, "/api/v1/users")
+		should.BeEqual(t, w.Code, http.StatusUnauthorized)
+	})
+	t.Run("deletedOwner", func(t *testing.T) {
+		deleteAllUsers(t)
+		w := tokenRequestRecorder(t, read, http.MethodGet, "/api/v1/users")
+		should.BeEqual(t, w.Code, http.StatusUnauthorized)
+	})
+}
+
+func TestTokensPage(t *testing.T) {
+	deleteAllUsers(t)
+	deleteAllTokens(t)
+	defer deleteAllTokens(t)
+	admin := plexus.User{Username: "admin", Password: "pass", IsAdmin: true}
+	user := plexus.User{Username: "test", Password: "pass", IsAdmin: false}
+	createTestUser(t, admin)
+	createTestUser(t, user)
+	_, _, err := createToken("admin", plexus.Token{Name: "admintoken", Owner: "admin"})
+	should.NotBeError(t, err)
+	userToken, _, err := createToken("admin", plexus.Token{Name: "usertoken", Owner: "test"})
+	should.NotBeError(t, err)
+
+	t.Run("create", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodPost, "/users/tokens/add",
+			bodyParams("name", "ci", "scope", "write", "expires", time.Now().Add(48*time.Hour).Format("2006-01-02")))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r.AddCookie(testLogin(t, user))
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		should.BeEqual(t, w.Code, http.StatusOK)
+		body, err := io.ReadAll(w.Result().Body)
+		should.NotBeError(t, err)
+		should.ContainSubstring(t, string(body), tokenPrefix)
+	})
+	t.Run("userList", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodGet, "/users/tokens", nil)
+		r.AddCookie(testLogin(t, user))
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		should.BeEqual(t, w.Code, http.StatusOK)
+		should.ContainSubstring(t, w.Body.String(), "usertoken")
+		should.BeFalse(t, strings.Contains(w.Body.String(), "admintoken"))
+	})
+	t.Run("adminList", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodGet, "/users/tokens", nil)
+		r.AddCookie(testLogin(t, admin))
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		should.BeEqual(t, w.Code, http.StatusOK)
+		should.ContainSubstring(t, w.Body.String(), "usertoken")
+		should.ContainSubstring(t, w.Body.String(), "admintoken")
+	})
+	t.Run("deleteOwnerTokens", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodDelete, "/users/test", nil)
+		r.AddCookie(testLogin(t, admin))
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		should.BeEqual(t, w.Code, http.StatusOK)
+		_, err := boltdb.Get[plexus.Token](userToken.ID, tokenTable)
+		should.BeErrorIs(t, err, boltdb.ErrNoResults)
+	})
+}
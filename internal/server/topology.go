@@ -0,0 +1,979 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/devilcove/boltdb"
+	"github.com/devilcove/plexus"
+	"go.yaml.in/yaml/v3"
+)
+
+// Topology is the declarative configuration of the server. Peers are
+// referred to by name, or by WireGuard public key when names are not unique;
+// peers register themselves and are never created by an apply.
+type Topology struct {
+	Groups   []TopologyGroup
+	Networks []TopologyNetwork
+	Keys     []TopologyKey
+}
+
+// TopologyGroup is a peer group.
+type TopologyGroup struct {
+	Name        string
+	Description string `json:",omitempty" yaml:",omitempty"`
+}
+
+// TopologyNetwork is a network with its peers and their roles.
+type TopologyNetwork struct {
+	Name         string
+	Address      string
+	Address6     string                `json:",omitempty" yaml:",omitempty"`
+	UsePSK       bool                  `json:",omitempty" yaml:",omitempty"`
+	Peers        []string              `json:",omitempty" yaml:",omitempty"`
+	Relays       []TopologyRelay       `json:",omitempty" yaml:",omitempty"`
+	Routers      []TopologyRouter      `json:",omitempty" yaml:",omitempty"`
+	ExitNodes    []string              `json:",omitempty" yaml:",omitempty"`
+	Reservations []TopologyReservation `json:",omitempty" yaml:",omitempty"`
+	Excluded     []TopologyRange       `json:",omitempty" yaml:",omitempty"`
+	Policies     []plexus.Policy       `json:",omitempty" yaml:",omitempty"`
+}
+
+// TopologyRelay is a relay and the peers it relays.
+type TopologyRelay struct {
+	Peer    string
+	Relayed []string
+}
+
+// TopologyRouter is a subnet routed by a subnet router; a router of several
+// subnets has an entry for each. Nat is one of "", "nat" or "virt".
+type TopologyRouter struct {
+	Peer       string
+	Subnet     string
+	Nat        string `json:",omitempty" yaml:",omitempty"`
+	VirtSubnet string `json:",omitempty" yaml:",omitempty"`
+}
+
+// TopologyReservation is an address reserved for a peer.
+type TopologyReservation struct {
+	Peer        string
+	Address     string
+	Description string `json:",omitempty" yaml:",omitempty"`
+}
+
+// TopologyRange is an excluded address range.
+type TopologyRange struct {
+	Start       string
+	End         string
+	Description string `json:",omitempty" yaml:",omitempty"`
+}
+
+// TopologyKey is a registration key; its value is generated when the key is
+// created and never exported.
+type TopologyKey struct {
+	Name      string
+	Usage     int
+	Expires   string
+	Tags      []string `json:",omitempty" yaml:",omitempty"`
+	Groups    []string `json:",omitempty" yaml:",omitempty"`
+	Networks  []string `json:",omitempty" yaml:",omitempty"`
+	Relay     string   `json:",omitempty" yaml:",omitempty"`
+	Router    string   `json:",omitempty" yaml:",omitempty"`
+	RouterNat bool     `json:",omitempty" yaml:",omitempty"`
+	Approval  bool     `json:",omitempty" yaml:",omitempty"`
+}
+
+// Change is a step of a plan to bring the server to a desired topology.
+type Change struct {
+	Action string
+	Target string
+
+	apply func(actor string) error
+}
+
+// ApplyResponse is returned by an apply; Changes are the steps that were
+// applied.
+type ApplyResponse struct {
+	Changes []Change
+	Error   string `json:",omitempty"`
+}
+
+// peerNames resolves peer names used in a topology.
+type peerNames struct {
+	byKey  map[string]string
+	byName map[string][]string
+}
+
+func newPeerNames() (peerNames, error) {
+	names := peerNames{byKey: map[string]string{}, byName: map[string][]string{}}
+	peers, err := boltdb.GetAll[plexus.Peer](peerTable)
+	if err != nil {
+		return names, fmt.Errorf("get peers %w", err)
+	}
+	for _, peer := range peers {
+		names.byKey[peer.WGPublicKey] = peer.Name
+		names.byName[peer.Name] = append(names.byName[peer.Name], peer.WGPublicKey)
+	}
+	return names, nil
+}
+
+// name returns the name of a peer, or its key if the name is not unique.
+func (p peerNames) name(id string) string {
+	name, ok := p.byKey[id]
+	if !ok || len(p.byName[name]) != 1 {
+		return id
+	}
+	return name
+}
+
+// id returns the key of a peer given its name or key.
+func (p peerNames) id(name string) (string, error) {
+	if _, ok := p.byKey[name]; ok {
+		return name, nil
+	}
+	switch len(p.byName[name]) {
+	case 0:
+		return "", requestError("no such peer " + name)
+	case 1:
+		return p.byName[name][0], nil
+	default:
+		return "", requestError("peer name " + name + " is not unique; use its public key")
+	}
+}
+
+func (p peerNames) ids(names []string) ([]string, error) {
+	ids := []string{}
+	for _, name := range names {
+		id, err := p.id(name)
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	slices.Sort(ids)
+	return slices.Compact(ids), nil
+}
+
+// exportTopology returns the current topology of the server.
+func exportTopology() (Topology, error) {
+	topology := Topology{Groups: []TopologyGroup{}, Networks: []TopologyNetwork{}, Keys: []TopologyKey{}}
+	names, err := newPeerNames()
+	if err != nil {
+		return topology, err
+	}
+	groups, err := boltdb.GetAll[plexus.Group](groupTable)
+	if err != nil {
+		return topology, fmt.Errorf("get groups %w", err)
+	}
+	for _, group := range groups {
+		topology.Groups = append(topology.Groups, TopologyGroup(group))
+	}
+	networks, err := boltdb.GetAll[plexus.Network](networkTable)
+	if err != nil {
+		return topology, fmt.Errorf("get networks %w", err)
+	}
+	for _, network := range networks {
+		topology.Networks = append(topology.Networks, exportNetwork(network, names))
+	}
+	keys, err := boltdb.GetAll[plexus.Key](keyTable)
+	if err != nil {
+		return topology, fmt.Errorf("get keys %w", err)
+	}
+	for _, key := range keys {
+		topology.Keys = append(topology.Keys, exportKey(key))
+	}
+	return topology, nil
+}
+
+func exportNetwork(network plexus.Network, names peerNames) TopologyNetwork {
+	exported := TopologyNetwork{
+		Name:     network.Name,
+		Address:  network.Net.String(),
+		UsePSK:   network.UsePSK,
+		Policies: network.Policies,
+	}
+	if network.Net6.IP != nil {
+		exported.Address6 = network.Net6.String()
+	}
+	for _, peer := range network.Peers {
+		exported.Peers = append(exported.Peers, names.name(peer.WGPublicKey))
+		if peer.IsRelay {
+			relay := TopologyRelay{Peer: names.name(peer.WGPublicKey), Relayed: []string{}}
+			for _, relayed := range peer.RelayedPeers {
+				// relays made by the server are not part of the topology.
+				if routerPeer(network, relayed).AutoRelayed {
+					continue
+				}
+				relay.Relayed = append(relay.Relayed, names.name(relayed))
+			}
+			if len(relay.Relayed) > 0 || len(peer.RelayedPeers) == 0 {
+				exported.Relays = append(exported.Relays, relay)
+			}
+		}
+		for _, subnet := range peer.Subnets {
+			exported.Routers = append(exported.Routers, exportRouter(peer, subnet, names))
+		}
+		if peer.IsExitNode {
+			exported.ExitNodes = append(exported.ExitNodes, names.name(peer.WGPublicKey))
+		}
+	}
+	for _, reservation := range network.Reservations {
+		exported.Reservations = append(exported.Reservations, TopologyReservation{
+			Peer:        names.name(reservation.WGPublicKey),
+			Address:     reservation.Address.String(),
+			Description: reservation.Description,
+		})
+	}
+	for _, excluded := range network.Excluded {
+		exported.Excluded = append(exported.Excluded, TopologyRange{
+			Start:       excluded.Start.String(),
+			End:         excluded.End.String(),
+			Description: excluded.Description,
+		})
+	}
+	return exported
+}
+
+func exportRouter(peer plexus.NetworkPeer, subnet plexus.RouterSubnet, names peerNames) TopologyRouter {
+	router := TopologyRouter{Peer: names.name(peer.WGPublicKey), Subnet: subnet.Subnet.String()}
+	if subnet.UseNat {
+		router.Nat = "nat"
+	}
+	if subnet.UseVirtSubnet {
+		router.Nat = "virt"
+		router.VirtSubnet = subnet.VirtSubnet.String()
+	}
+	return router
+}
+
+func exportKey(key plexus.Key) TopologyKey {
+	return TopologyKey{
+		Name:      key.Name,
+		Usage:     key.Usage,
+		Expires:   key.Expires.Format("2006-01-02"),
+		Tags:      key.Tags,
+		Groups:    key.Groups,
+		Networks:  key.Networks,
+		Relay:     key.Relay,
+		Router:    key.Router,
+		RouterNat: key.RouterNat,
+		Approval:  key.Approval,
+	}
+}
+
+// planTopology returns the changes that bring the server to the desired
+// topology. Objects missing from the desired topology are removed.
+func planTopology(desired Topology) ([]Change, error) {
+	current, err := exportTopology()
+	if err != nil {
+		return nil, err
+	}
+	names, err := newPeerNames()
+	if err != nil {
+		return nil, err
+	}
+	changes := []Change{}
+	for _, group := range desired.Groups {
+		if !slices.ContainsFunc(current.Groups, func(g TopologyGroup) bool { return g.Name == group.Name }) {
+			changes = append(changes, Change{
+				Action: "group.create", Target: group.Name,
+				apply: func(actor string) error {
+					_, err := createGroup(actor, plexus.Group(group))
+					return err
+				},
+			})
+		}
+	}
+	removals := []Change{}
+	for _, network := range desired.Networks {
+		index := slices.IndexFunc(current.Networks, func(n TopologyNetwork) bool { return n.Name == network.Name })
+		existing := TopologyNetwork{Name: network.Name}
+		if index < 0 {
+			changes = append(changes, Change{
+				Action: "network.create", Target: network.Name,
+				apply: func(actor string) error {
+					_, err := createNetwork(actor, plexus.Network{
+						Name:           network.Name,
+						AddressString:  network.Address,
+						Address6String: network.Address6,
+					})
+					return err
+				},
+			})
+		} else {
+			existing = current.Networks[index]
+			if !sameCIDR(existing.Address, network.Address) || !sameCIDR(existing.Address6, network.Address6) {
+				return nil, requestError("the addresses of network " + network.Name + " cannot be changed")
+			}
+		}
+		added, removed, err := planNetwork(existing, network, names)
+		if err != nil {
+			return nil, err
+		}
+		changes = append(changes, added...)
+		removals = append(removals, removed...)
+	}
+	for _, network := range current.Networks {
+		if !slices.ContainsFunc(desired.Networks, func(n TopologyNetwork) bool { return n.Name == network.Name }) {
+			removals = append(removals, Change{
+				Action: "network.delete", Target: network.Name,
+				apply: func(actor string) error {
+					return removeNetwork(actor, network.Name)
+				},
+			})
+		}
+	}
+	// removals run first so that replaced objects free their names,
+	// addresses and subnets.
+	changes = append(removals, changes...)
+	for _, key := range desired.Keys {
+		index := slices.IndexFunc(current.Keys, func(k TopologyKey) bool { return k.Name == key.Name })
+		if index >= 0 && sameKey(current.Keys[index], key) {
+			continue
+		}
+		if index >= 0 {
+			changes = append(changes, deleteKeyChange(key.Name, "key.replace"))
+		}
+		changes = append(changes, Change{
+			Action: "key.create", Target: key.Name,
+			apply: func(actor string) error {
+				_, err := createKey(actor, plexus.Key{
+					Name:      key.Name,
+					Usage:     key.Usage,
+					DispExp:   key.Expires,
+					Tags:      key.Tags,
+					Groups:    key.Groups,
+					Networks:  key.Networks,
+					Relay:     key.Relay,
+					Router:    key.Router,
+					RouterNat: key.RouterNat,
+					Approval:  key.Approval,
+				})
+				return err
+			},
+		})
+	}
+	for _, key := range current.Keys {
+		if !slices.ContainsFunc(desired.Keys, func(k TopologyKey) bool { return k.Name == key.Name }) {
+			changes = append(changes, deleteKeyChange(key.Name, "key.delete"))
+		}
+	}
+	for _, group := range current.Groups {
+		if !slices.ContainsFunc(desired.Groups, func(g TopologyGroup) bool { return g.Name == group.Name }) {
+			changes = append(changes, Change{
+				Action: "group.delete", Target: group.Name,
+				apply: func(actor string) error {
+					return removeGroup(actor, group.Name)
+				},
+			})
+		}
+	}
+	return changes, nil
+}
+
+// planNetwork returns the changes to a network; removals are returned
+// separately as they must run before additions.
+func planNetwork(current, desired TopologyNetwork, names peerNames) ([]Change, []Change, error) {
+	changes := []Change{}
+	removals := []Change{}
+	name := desired.Name
+	if current.UsePSK != desired.UsePSK {
+		changes = append(changes, Change{
+			Action: "network.psk", Target: fmt.Sprintf("%s (%t)", name, desired.UsePSK),
+			apply: func(actor string) error {
+				_, err := setPresharedKeys(actor, name, desired.UsePSK)
+				return err
+			},
+		})
+	}
+	currentPeers, err := names.ids(current.Peers)
+	if err != nil {
+		return nil, nil, err
+	}
+	desiredPeers, err := names.ids(desired.Peers)
+	if err != nil {
+		return nil, nil, err
+	}
+	// excluded ranges and reservations are set before peers join.
+	for _, excluded := range desired.Excluded {
+		if slices.Contains(current.Excluded, excluded) {
+			continue
+		}
+		start, end := net.ParseIP(excluded.Start), net.ParseIP(excluded.End)
+		if start == nil || end == nil {
+			return nil, nil, requestError("invalid excluded range " + excluded.Start + "-" + excluded.End)
+		}
+		changes = append(changes, Change{
+			Action: "network.excluded.add", Target: name + "/" + excluded.Start + "-" + excluded.End,
+			apply: func(actor string) error {
+				_, err := createExclusion(actor, name, plexus.AddressRange{
+					Start: start, End: end, Description: excluded.Description,
+				})
+				return err
+			},
+		})
+	}
+	for _, excluded := range current.Excluded {
+		if slices.Contains(desired.Excluded, excluded) {
+			continue
+		}
+		removals = append(removals, Change{
+			Action: "network.excluded.remove", Target: name + "/" + excluded.Start + "-" + excluded.End,
+			apply: func(actor string) error {
+				_, err := removeExclusion(actor, name, net.ParseIP(excluded.Start))
+				return err
+			},
+		})
+	}
+	currentReservations, err := resolveReservations(current.Reservations, names)
+	if err != nil {
+		return nil, nil, err
+	}
+	desiredReservations, err := resolveReservations(desired.Reservations, names)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, reservation := range desiredReservations {
+		if slices.Contains(currentReservations, reservation) {
+			continue
+		}
+		address := net.ParseIP(reservation.Address)
+		if address == nil {
+			return nil, nil, requestError("invalid reservation address " + reservation.Address)
+		}
+		changes = append(changes, Change{
+			Action: "network.reservation.add", Target: name + "/" + reservation.Address,
+			apply: func(actor string) error {
+				_, err := createReservation(actor, name, plexus.Reservation{
+					WGPublicKey: reservation.Peer, Address: address, Description: reservation.Description,
+				})
+				return err
+			},
+		})
+	}
+	for _, reservation := range currentReservations {
+		if slices.Contains(desiredReservations, reservation) {
+			continue
+		}
+		removals = append(removals, Change{
+			Action: "network.reservation.remove", Target: name + "/" + reservation.Address,
+			apply: func(actor string) error {
+				_, err := removeReservation(actor, name, net.ParseIP(reservation.Address))
+				return err
+			},
+		})
+	}
+	for _, id := range desiredPeers {
+		if slices.Contains(currentPeers, id) {
+			continue
+		}
+		changes = append(changes, Change{
+			Action: "network.peer.add", Target: name + "/" + names.name(id),
+			apply: func(actor string) error {
+				priv, pub, err := getListenPorts(id, name)
+				if err != nil {
+					return fmt.Errorf("get listen ports of %s %w", names.name(id), err)
+				}
+				_, err = addPeerToNetwork(actor, id, name, priv, pub)
+				return err
+			},
+		})
+	}
+	for _, id := range currentPeers {
+		if slices.Contains(desiredPeers, id) {
+			continue
+		}
+		removals = append(removals, Change{
+			Action: "network.peer.remove", Target: name + "/" + names.name(id),
+			apply: func(actor string) error {
+				network, err := boltdb.Get[plexus.Network](name, networkTable)
+				if err != nil {
+					return err
+				}
+				_, err = deletePeerFromNetwork(actor, network, id)
+				return err
+			},
+		})
+	}
+	added, removed, err := planRelays(name, current.Relays, desired.Relays, desiredPeers, names)
+	if err != nil {
+		return nil, nil, err
+	}
+	changes = append(changes, added...)
+	removals = append(removals, removed...)
+	added, removed, err = planRouters(name, current.Routers, desired.Routers, desiredPeers, names)
+	if err != nil {
+		return nil, nil, err
+	}
+	changes = append(changes, added...)
+	removals = append(removals, removed...)
+	added, removed, err = planExitNodes(name, current.ExitNodes, desired.ExitNodes, desiredPeers, names)
+	if err != nil {
+		return nil, nil, err
+	}
+	changes = append(changes, added...)
+	removals = append(removals, removed...)
+	for _, policy := range desired.Policies {
+		index := slices.IndexFunc(current.Policies, func(p plexus.Policy) bool { return p.Name == policy.Name })
+		if index >= 0 && current.Policies[index] == policy {
+			continue
+		}
+		if index >= 0 {
+			removals = append(removals, removePolicyChange(name, policy.Name))
+		}
+		changes = append(changes, Change{
+			Action: "network.policy.add", Target: name + "/" + policy.Name,
+			apply: func(actor string) error {
+				_, err := createPolicy(actor, name, policy)
+				return err
+			},
+		})
+	}
+	for _, policy := range current.Policies {
+		if !slices.ContainsFunc(desired.Policies, func(p plexus.Policy) bool { return p.Name == policy.Name }) {
+			removals = append(removals, removePolicyChange(name, policy.Name))
+		}
+	}
+	// roles are removed before the peers that hold them leave.
+	slices.Reverse(removals)
+	return changes, removals, nil
+}
+
+// planRelays returns the changes to the relays of a network; a relay whose
+// relayed peers change is deleted and created again.
+func planRelays(
+	name string, current, desired []TopologyRelay, members []string, names peerNames,
+) ([]Change, []Change, error) {
+	changes := []Change{}
+	removals := []Change{}
+	currentRelays := map[string][]string{}
+	for _, relay := range current {
+		id, err := names.id(relay.Peer)
+		if err != nil {
+			return nil, nil, err
+		}
+		if currentRelays[id], err = names.ids(relay.Relayed); err != nil {
+			return nil, nil, err
+		}
+	}
+	desiredRelays := map[string][]string{}
+	for _, relay := range desired {
+		id, err := names.id(relay.Peer)
+		if err != nil {
+			return nil, nil, err
+		}
+		relayed, err := names.ids(relay.Relayed)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, peer := range append([]string{id}, relayed...) {
+			if !slices.Contains(members, peer) {
+				return nil, nil, requestError("relay peer " + names.name(peer) + " is not a peer of network " + name)
+			}
+		}
+		desiredRelays[id] = relayed
+		if existing, ok := currentRelays[id]; ok && slices.Equal(existing, relayed) {
+			continue
+		}
+		changes = append(changes, Change{
+			Action: "relay.create", Target: name + "/" + names.name(id),
+			apply: func(actor string) error {
+				network, err := boltdb.Get[plexus.Network](name, networkTable)
+				if err != nil {
+					return err
+				}
+				_, err = createRelay(actor, network, id, relayed)
+				return err
+			},
+		})
+	}
+	for id, relayed := range currentRelays {
+		if existing, ok := desiredRelays[id]; ok && slices.Equal(existing, relayed) {
+			continue
+		}
+		removals = append(removals, Change{
+			Action: "relay.delete", Target: name + "/" + names.name(id),
+			apply: func(actor string) error {
+				network, err := boltdb.Get[plexus.Network](name, networkTable)
+				if err != nil {
+					return err
+				}
+				if !peerInNetwork(network, id) {
+					return nil
+				}
+				_, err = removeRelay(actor, network, id)
+				return err
+			},
+		})
+	}
+	slices.SortFunc(removals, func(a, b Change) int { return strings.Compare(a.Target, b.Target) })
+	return changes, removals, nil
+}
+
+// planRouters returns the changes to the subnet routers of a network; a
+// router whose subnet changes is deleted and created again.
+func planRouters(
+	name string, current, desired []TopologyRouter, members []string, names peerNames,
+) ([]Change, []Change, error) {
+	changes := []Change{}
+	removals := []Change{}
+	currentRouters := map[string]TopologyRouter{}
+	for _, router := range current {
+		id, err := names.id(router.Peer)
+		if err != nil {
+			return nil, nil, err
+		}
+		router.Peer = id
+		currentRouters[routerKey(router)] = router
+	}
+	desiredRouters := map[string]TopologyRouter{}
+	for _, router := range desired {
+		id, err := names.id(router.Peer)
+		if err != nil {
+			return nil, nil, err
+		}
+		if !slices.Contains(members, id) {
+			return nil, nil, requestError("router " + router.Peer + " is not a peer of network " + name)
+		}
+		router.Peer = id
+		if router.Nat == "" {
+			router.Nat = "none"
+		}
+		key := routerKey(router)
+		if _, ok := desiredRouters[key]; ok {
+			return nil, nil, requestError("router " + names.name(id) + " lists subnet " + router.Subnet + " twice")
+		}
+		desiredRouters[key] = router
+		if sameRouter(currentRouters[key], router) {
+			continue
+		}
+		changes = append(changes, Change{
+			Action: "router.create", Target: name + "/" + names.name(id) + " " + router.Subnet,
+			apply: func(actor string) error {
+				network, err := boltdb.Get[plexus.Network](name, networkTable)
+				if err != nil {
+					return err
+				}
+				subnet, err := parseRouterSubnet(network, id, router.Subnet, router.Nat, router.VirtSubnet)
+				if err != nil {
+					return err
+				}
+				_, err = createRouter(actor, network, id, subnet)
+				return err
+			},
+		})
+	}
+	for key, router := range currentRouters {
+		if sameRouter(router, desiredRouters[key]) {
+			continue
+		}
+		removals = append(removals, Change{
+			Action: "router.delete", Target: name + "/" + names.name(router.Peer) + " " + router.Subnet,
+			apply: func(actor string) error {
+				network, err := boltdb.Get[plexus.Network](name, networkTable)
+				if err != nil {
+					return err
+				}
+				if !peerInNetwork(network, router.Peer) {
+					return nil
+				}
+				_, err = removeRouter(actor, network, router.Peer, router.Subnet)
+				return err
+			},
+		})
+	}
+	slices.SortFunc(removals, func(a, b Change) int { return strings.Compare(a.Target, b.Target) })
+	return changes, removals, nil
+}
+
+// planExitNodes returns the changes to the exit nodes of a network.
+func planExitNodes(
+	name string, current, desired []string, members []string, names peerNames,
+) ([]Change, []Change, error) {
+	changes := []Change{}
+	removals := []Change{}
+	currentExits, err := names.ids(current)
+	if err != nil {
+		return nil, nil, err
+	}
+	desiredExits, err := names.ids(desired)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, id := range desiredExits {
+		if !slices.Contains(members, id) {
+			return nil, nil, requestError("exit node " + names.name(id) + " is not a peer of network " + name)
+		}
+		if slices.Contains(currentExits, id) {
+			continue
+		}
+		changes = append(changes, Change{
+			Action: "exitnode.create", Target: name + "/" + names.name(id),
+			apply: func(actor string) error {
+				network, err := boltdb.Get[plexus.Network](name, networkTable)
+				if err != nil {
+					return err
+				}
+				_, err = createExitNode(actor, network, id)
+				return err
+			},
+		})
+	}
+	for _, id := range currentExits {
+		if slices.Contains(desiredExits, id) {
+			continue
+		}
+		removals = append(removals, Change{
+			Action: "exitnode.delete", Target: name + "/" + names.name(id),
+			apply: func(actor string) error {
+				network, err := boltdb.Get[plexus.Network](name, networkTable)
+				if err != nil {
+					return err
+				}
+				if !peerInNetwork(network, id) {
+					return nil
+				}
+				_, err = removeExitNode(actor, network, id)
+				return err
+			},
+		})
+	}
+	return changes, removals, nil
+}
+
+// routerKey identifies a subnet routed by a router.
+func routerKey(router TopologyRouter) string {
+	subnet := router.Subnet
+	if _, cidr, err := net.ParseCIDR(subnet); err == nil {
+		subnet = cidr.String()
+	}
+	return router.Peer + " " + subnet
+}
+
+func sameRouter(a, b TopologyRouter) bool {
+	natA, natB := a.Nat, b.Nat
+	if natA == "" {
+		natA = "none"
+	}
+	if natB == "" {
+		natB = "none"
+	}
+	return a.Peer == b.Peer && natA == natB && sameCIDR(a.Subnet, b.Subnet) &&
+		sameCIDR(a.VirtSubnet, b.VirtSubnet)
+}
+
+// resolveReservations returns reservations with peers referred to by key.
+func resolveReservations(reservations []TopologyReservation, names peerNames) ([]TopologyReservation, error) {
+	resolved := []TopologyReservation{}
+	for _, reservation := range reservations {
+		id, err := names.id(reservation.Peer)
+		if err != nil {
+			return nil, err
+		}
+		reservation.Peer = id
+		resolved = append(resolved, reservation)
+	}
+	return resolved, nil
+}
+
+func removePolicyChange(network, policy string) Change {
+	return Change{
+		Action: "network.policy.remove", Target: network + "/" + policy,
+		apply: func(actor string) error {
+			_, err := removePolicy(actor, network, policy)
+			return err
+		},
+	}
+}
+
+func deleteKeyChange(name, action string) Change {
+	return Change{
+		Action: action, Target: name,
+		apply: func(actor string) error {
+			key, err := boltdb.Get[plexus.Key](name, keyTable)
+			if err != nil {
+				return err
+			}
+			return removeKey(actor, key)
+		},
+	}
+}
+
+func sameKey(a, b TopologyKey) bool {
+	return a.Name == b.Name && a.Usage == b.Usage && a.Expires == b.Expires &&
+		slices.Equal(normalizeLabels(a.Tags), normalizeLabels(b.Tags)) &&
+		slices.Equal(normalizeLabels(a.Groups), normalizeLabels(b.Groups)) &&
+		slices.Equal(normalizeLabels(a.Networks), normalizeLabels(b.Networks)) &&
+		a.Relay == b.Relay && sameCIDR(a.Router, b.Router) && a.RouterNat == b.RouterNat &&
+		a.Approval == b.Approval
+}
+
+// sameCIDR reports whether two cidrs are the same network; blank values are
+// only the same as blank values.
+func sameCIDR(a, b string) bool {
+	if a == "" || b == "" {
+		return a == b
+	}
+	_, netA, errA := net.ParseCIDR(a)
+	_, netB, errB := net.ParseCIDR(b)
+	if errA != nil || errB != nil {
+		return a == b
+	}
+	return netA.String() == netB.String()
+}
+
+// applyTopology applies the plan for the desired topology, stopping at the
+// first failed change. The applied changes are returned.
+func applyTopology(actor string, desired Topology) ([]Change, error) {
+	changes, err := planTopology(desired)
+	if err != nil {
+		return nil, err
+	}
+	applied := []Change{}
+	for _, change := range changes {
+		slog.Info("apply", "action", change.Action, "target", change.Target)
+		if err := change.apply(actor); err != nil {
+			return applied, fmt.Errorf("%s %s: %w", change.Action, change.Target, err)
+		}
+		applied = append(applied, change)
+	}
+	audit(actor, "topology.apply", fmt.Sprintf("%d changes", len(applied)), nil, nil)
+	return applied, nil
+}
+
+// decodeTopology decodes a json or, for other content types, yaml topology.
+func decodeTopology(r *http.Request) (Topology, error) {
+	topology := Topology{}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return topology, requestError("read request " + err.Error())
+	}
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		err = json.Unmarshal(body, &topology)
+	} else {
+		err = yaml.Unmarshal(body, &topology)
+	}
+	if err != nil {
+		return topology, requestError("invalid topology " + err.Error())
+	}
+	return topology, nil
+}
+
+func apiExportTopology(w http.ResponseWriter, r *http.Request) {
+	if !GetSessionData(r).IsAdmin {
+		apiError(w, http.StatusForbidden, "admin rights required")
+		return
+	}
+	topology, err := exportTopology()
+	if err != nil {
+		apiError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if r.URL.Query().Get("format") != "yaml" {
+		apiResponse(w, http.StatusOK, topology)
+		return
+	}
+	w.Header().Set("Content-Type", "application/yaml")
+	encoder := yaml.NewEncoder(w)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(topology); err != nil {
+		slog.Error("encode topology", "error", err)
+	}
+}
+
+// apiApplyTopology applies a topology, or with the plan query parameter
+// returns the changes an apply would make.
+func apiApplyTopology(w http.ResponseWriter, r *http.Request) {
+	if !GetSessionData(r).IsAdmin {
+		apiError(w, http.StatusForbidden, "admin rights required")
+		return
+	}
+	topology, err := decodeTopology(r)
+	if err != nil {
+		apiError(w, errorStatus(err), err.Error())
+		return
+	}
+	if r.URL.Query().Has("plan") {
+		changes, err := planTopology(topology)
+		if err != nil {
+			apiError(w, errorStatus(err), err.Error())
+			return
+		}
+		apiResponse(w, http.StatusOK, ApplyResponse{Changes: changes})
+		return
+	}
+	applied, err := applyTopology(userActor(r), topology)
+	if err != nil {
+		apiResponse(w, errorStatus(err), ApplyResponse{Changes: applied, Error: err.Error()})
+		return
+	}
+	apiResponse(w, http.StatusOK, ApplyResponse{Changes: applied})
+}
+
+// isYAML reports whether a topology file is yaml, by its extension.
+func isYAML(file string) bool {
+	ext := strings.ToLower(filepath.Ext(file))
+	return ext == ".yaml" || ext == ".yml"
+}
+
+// Export saves the topology of the running server to file, as yaml or json
+// depending on its extension.
+func Export(file string) error {
+	path := "/api/v1/topology"
+	if isYAML(file) {
+		path += "?format=yaml"
+	}
+	response, err := serverRequest(http.MethodGet, path, "", nil)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	body, err := io.ReadAll(response.Body)
+	if err != nil {
+		return err
+	}
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("export failed: %s %s", response.Status, body)
+	}
+	return os.WriteFile(file, body, 0o600)
+}
+
+// Apply sends the topology in file to the running server. With plan set
+// nothing is changed and the planned changes are returned; otherwise the
+// applied changes are returned.
+func Apply(file string, plan bool) ([]Change, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	contentType := "application/json"
+	if isYAML(file) {
+		contentType = "application/yaml"
+	}
+	path := "/api/v1/topology"
+	if plan {
+		path += "?plan=true"
+	}
+	response, err := serverRequest(http.MethodPost, path, contentType, bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	applied := ApplyResponse{}
+	if err := json.NewDecoder(response.Body).Decode(&applied); err != nil {
+		return nil, fmt.Errorf("invalid response %s %w", response.Status, err)
+	}
+	if response.StatusCode != http.StatusOK {
+		return applied.Changes, fmt.Errorf("%s %s", response.Status, applied.Error)
+	}
+	return applied.Changes, nil
+}
@@ -0,0 +1,188 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Kairum-Labs/should"
+	"github.com/devilcove/boltdb"
+	"github.com/devilcove/plexus"
+	"github.com/devilcove/plexus/internal/publish"
+	"github.com/nats-io/nats.go"
+	"go.yaml.in/yaml/v3"
+)
+
+func TestTopology(t *testing.T) {
+	setup(t)
+	defer shutdown(t)
+	deleteAllUsers(t)
+	deleteAllGroups(t)
+	deleteAllNetworks(t)
+	deleteAllPeers(t)
+	deleteAllKeys(t)
+	defer deleteAllGroups(t)
+	defer deleteAllNetworks(t)
+	defer deleteAllPeers(t)
+	defer deleteAllKeys(t)
+	admin := plexus.User{Username: "admin", Password: "pass", IsAdmin: true}
+	createTestUser(t, admin)
+	cookie := testLogin(t, admin)
+	peers := map[string]string{}
+	for _, name := range []string{"alpha", "beta", "gamma"} {
+		pub, err := generateKeys()
+		should.NotBeError(t, err)
+		peers[name] = pub.String()
+		savePeer(plexus.Peer{WGPublicKey: pub.String(), Name: name})
+		sub, err := natsConn.Subscribe(plexus.Update+pub.String()+plexus.SendListenPorts, func(msg *nats.Msg) {
+			publish.Message(natsConn, msg.Reply, plexus.ListenPortResponse{ListenPort: 51820, PublicListenPort: 51820})
+		})
+		should.NotBeError(t, err)
+		defer sub.Unsubscribe() //nolint:errcheck
+	}
+	expires := time.Now().Add(time.Hour).Format("2006-01-02")
+	desired := `
+groups:
+  - name: branch
+networks:
+  - name: office
+    address: 10.201.0.0/24
+    peers: [alpha, beta, gamma]
+    relays:
+      - peer: alpha
+        relayed: [beta]
+    routers:
+      - peer: gamma
+        subnet: 192.168.60.0/24
+        nat: nat
+    reservations:
+      - peer: beta
+        address: 10.201.0.50
+    excluded:
+      - start: 10.201.0.100
+        end: 10.201.0.110
+keys:
+  - name: fleet
+    usage: 2
+    expires: ` + expires + `
+    networks: [office]
+`
+	post := func(t *testing.T, path, body string) (int, ApplyResponse) {
+		t.Helper()
+		r := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+		r.Header.Set("Content-Type", "application/yaml")
+		r.AddCookie(cookie)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		response := ApplyResponse{}
+		should.NotBeError(t, json.Unmarshal(w.Body.Bytes(), &response))
+		return w.Code, response
+	}
+
+	t.Run("forbidden", func(t *testing.T) {
+		user := plexus.User{Username: "user", Password: "pass"}
+		createTestUser(t, user)
+		w := apiRequest(t, testLogin(t, user), http.MethodGet, "/api/v1/topology", "")
+		should.BeEqual(t, w.Code, http.StatusForbidden)
+		w = apiRequest(t, testLogin(t, user), http.MethodPost, "/api/v1/topology", desired)
+		should.BeEqual(t, w.Code, http.StatusForbidden)
+	})
+	t.Run("plan", func(t *testing.T) {
+		code, response := post(t, "/api/v1/topology?plan=true", desired)
+		should.BeEqual(t, code, http.StatusOK)
+		actions := []string{}
+		for _, change := range response.Changes {
+			actions = append(actions, change.Action)
+		}
+		should.BeEqual(t, actions, []string{
+			"group.create", "network.create", "network.excluded.add", "network.reservation.add",
+			"network.peer.add", "network.peer.add", "network.peer.add", "relay.create", "router.create",
+			"key.create",
+		})
+		_, err := boltdb.Get[plexus.Network]("office", networkTable)
+		should.BeError(t, err)
+	})
+	t.Run("invalid", func(t *testing.T) {
+		code, response := post(t, "/api/v1/topology?plan=true",
+			`networks: [{name: office, address: 10.201.0.0/24, peers: [missing]}]`)
+		should.BeEqual(t, code, http.StatusBadRequest)
+		should.ContainSubstring(t, response.Error, "no such peer missing")
+		code, _ = post(t, "/api/v1/topology", "not: [valid")
+		should.BeEqual(t, code, http.StatusBadRequest)
+	})
+	t.Run("apply", func(t *testing.T) {
+		code, response := post(t, "/api/v1/topology", desired)
+		should.BeEqual(t, code, http.StatusOK)
+		should.BeEqual(t, response.Error, "")
+		should.BeEqual(t, len(response.Changes), 10)
+		network, err := boltdb.Get[plexus.Network]("office", networkTable)
+		should.NotBeError(t, err)
+		should.BeEqual(t, len(network.Peers), 3)
+		for _, peer := range network.Peers {
+			switch peer.WGPublicKey {
+			case peers["alpha"]:
+				should.BeTrue(t, peer.IsRelay)
+				should.BeEqual(t, peer.RelayedPeers, []string{peers["beta"]})
+			case peers["beta"]:
+				should.BeEqual(t, peer.Address.IP.String(), "10.201.0.50")
+			case peers["gamma"]:
+				should.BeTrue(t, peer.IsSubnetRouter)
+				should.BeTrue(t, peer.UsesNat())
+			}
+		}
+		key, err := boltdb.Get[plexus.Key]("fleet", keyTable)
+		should.NotBeError(t, err)
+		should.BeEqual(t, key.Networks, []string{"office"})
+		// applying again changes nothing.
+		code, response = post(t, "/api/v1/topology?plan=true", desired)
+		should.BeEqual(t, code, http.StatusOK)
+		should.BeEqual(t, len(response.Changes), 0)
+	})
+	t.Run("export", func(t *testing.T) {
+		w := apiRequest(t, cookie, http.MethodGet, "/api/v1/topology?format=yaml", "")
+		should.BeEqual(t, w.Code, http.StatusOK)
+		should.BeEqual(t, w.Header().Get("Content-Type"), "application/yaml")
+		exported := Topology{}
+		should.NotBeError(t, yaml.Unmarshal(w.Body.Bytes(), &exported))
+		should.BeEqual(t, len(exported.Networks), 1)
+		should.BeEqual(t, exported.Networks[0].Relays, []TopologyRelay{{Peer: "alpha", Relayed: []string{"beta"}}})
+		changes, err := planTopology(exported)
+		should.NotBeError(t, err)
+		should.BeEqual(t, len(changes), 0)
+		w = apiRequest(t, cookie, http.MethodGet, "/api/v1/topology", "")
+		should.BeEqual(t, w.Code, http.StatusOK)
+		exported = Topology{}
+		should.NotBeError(t, json.Unmarshal(w.Body.Bytes(), &exported))
+		should.BeEqual(t, exported.Keys[0].Name, "fleet")
+	})
+	t.Run("address", func(t *testing.T) {
+		code, response := post(t, "/api/v1/topology?plan=true", `networks: [{name: office, address: 10.202.0.0/24}]`)
+		should.BeEqual(t, code, http.StatusBadRequest)
+		should.ContainSubstring(t, response.Error, "cannot be changed")
+	})
+	t.Run("remove", func(t *testing.T) {
+		code, response := post(t, "/api/v1/topology", `
+networks:
+  - name: office
+    address: 10.201.0.0/24
+    peers: [alpha, beta]
+`)
+		should.BeEqual(t, code, http.StatusOK)
+		should.BeEqual(t, response.Error, "")
+		network, err := boltdb.Get[plexus.Network]("office", networkTable)
+		should.NotBeError(t, err)
+		should.BeEqual(t, len(network.Peers), 2)
+		should.BeEqual(t, len(network.Reservations), 0)
+		should.BeEqual(t, len(network.Excluded), 0)
+		for _, peer := range network.Peers {
+			should.BeFalse(t, peer.IsRelay)
+		}
+		_, err = boltdb.Get[plexus.Key]("fleet", keyTable)
+		should.BeError(t, err)
+		_, err = boltdb.Get[plexus.Group]("branch", groupTable)
+		should.BeError(t, err)
+	})
+}
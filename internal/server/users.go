@@ -2,6 +2,7 @@ package server
 
 import (
 	"encoding/json"
+	"fmt"
 	"log/slog"
 	"net/http"
 	"time"
@@ -22,7 +23,7 @@ func checkDefaultUser(user, pass string) error {
 		slog.Error("hash error", "error", err)
 		return err
 	}
-	if err = boltdb.Save(&plexus.User{
+	if err = save(&plexus.User{
 		Username: user,
 		Password: password,
 		IsAdmin:  true,
@@ -132,13 +133,32 @@ func deleteUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	user := r.PathValue("name")
-	if err := boltdb.Delete[plexus.User](user, userTable); err != nil {
+	if err := removeUser(userActor(r), user); err != nil {
 		processError(w, http.StatusNotFound, err.Error())
 		return
 	}
 	getUsers(w, r)
 }
 
+// removeUser deletes a user and revokes any tokens it owns.
+func removeUser(actor, name string) error {
+	user, err := boltdb.Get[plexus.User](name, userTable)
+	if err != nil {
+		return err
+	}
+	if err := remove(name, userTable); err != nil {
+		return err
+	}
+	audit(actor, "user.delete", name, auditUser(user), nil)
+	return removeUserTokens(actor, name)
+}
+
+// auditUser returns user without the password hash for recording in the audit log.
+func auditUser(user plexus.User) plexus.User {
+	user.Password = ""
+	return user
+}
+
 func displayAddUser(w http.ResponseWriter, r *http.Request) {
 	session := GetSessionData(r)
 	if !session.IsAdmin {
@@ -156,26 +176,33 @@ func addUser(w http.ResponseWriter, r *http.Request) {
 	}
 	user := plexus.User{
 		Username: r.FormValue("username"),
+		Password: r.FormValue("password"),
+		IsAdmin:  r.FormValue("admin") == "on",
 	}
-	password, err := hashPassword(r.FormValue("password"))
-	if err != nil {
-		processError(w, http.StatusInternalServerError, err.Error())
+	if _, err := createUser(userActor(r), user); err != nil {
+		processError(w, errorStatus(err), err.Error())
 		return
 	}
-	user.Password = password
-	if r.FormValue("admin") == "on" {
-		user.IsAdmin = true
+	getUsers(w, r)
+}
+
+// createUser hashes the password of a new user and saves it.
+func createUser(actor string, user plexus.User) (plexus.User, error) {
+	password, err := hashPassword(user.Password)
+	if err != nil {
+		return user, err
 	}
+	user.Password = password
+	user.Updated = time.Now()
 	if _, err := boltdb.Get[plexus.User](user.Username, userTable); err == nil {
-		processError(w, http.StatusBadRequest, "user exists")
-		return
+		return user, requestError("user exists")
 	}
-	slog.Info("saving new user", "user", user)
-	if err := boltdb.Save(user, user.Username, userTable); err != nil {
-		processError(w, http.StatusInternalServerError, "unable to save user "+err.Error())
-		return
+	slog.Info("saving new user", "user", user.Username)
+	if err := save(user, user.Username, userTable); err != nil {
+		return user, fmt.Errorf("unable to save user %w", err)
 	}
-	getUsers(w, r)
+	audit(actor, "user.create", user.Username, nil, auditUser(user))
+	return user, nil
 }
 
 func editUser(w http.ResponseWriter, r *http.Request) {
@@ -190,20 +217,43 @@ func editUser(w http.ResponseWriter, r *http.Request) {
 		processError(w, http.StatusUnauthorized, "admin rights required to update other users")
 		return
 	}
-	user, err := boltdb.Get[plexus.User](userToEdit, userTable)
-	if err != nil {
-		processError(w, http.StatusBadRequest, err.Error())
+	if err := setPassword(userActor(r), userToEdit, input); err != nil {
+		processError(w, errorStatus(err), err.Error())
 		return
 	}
-	password, err := hashPassword(input)
-	if err != nil {
-		processError(w, http.StatusInternalServerError, err.Error())
+	getUsers(w, r)
+}
+
+func linkUser(w http.ResponseWriter, r *http.Request) {
+	if !GetSessionData(r).IsAdmin {
+		processError(w, http.StatusUnauthorized, "admin rights required")
 		return
 	}
-	user.Password = password
-	if err := boltdb.Save(user, user.Username, userTable); err != nil {
-		processError(w, http.StatusInternalServerError, err.Error())
+	if err := linkOIDCUser(userActor(r), r.PathValue("name"), r.FormValue("subject")); err != nil {
+		processError(w, errorStatus(err), err.Error())
 		return
 	}
 	getUsers(w, r)
 }
+
+// setPassword replaces the password of an existing user.
+func setPassword(actor, username, input string) error {
+	user, err := boltdb.Get[plexus.User](username, userTable)
+	if err != nil {
+		return requestError(err.Error())
+	}
+	if user.Provider != "" {
+		return requestError("password of " + user.Provider + " user cannot be changed")
+	}
+	password, err := hashPassword(input)
+	if err != nil {
+		return err
+	}
+	user.Password = password
+	user.Updated = time.Now()
+	if err := save(user, user.Username, userTable); err != nil {
+		return err
+	}
+	audit(actor, "user.password", username, nil, nil)
+	return nil
+}
@@ -1,10 +1,12 @@
 package plexus
 
 import (
+	"bytes"
 	"encoding/base64"
 	"encoding/json"
 	"log/slog"
 	"net"
+	"slices"
 	"time"
 )
 
@@ -33,10 +35,43 @@ const (
 	Version            = ".version"
 	Checkin            = ".checkin"
 	SendListenPorts    = ".listenPorts"
+	UpdatePolicies     = ".updatePolicies"
+	RotateKeys         = ".rotateKeys"
+	ConfirmRotation    = ".confirmRotation"
+	UpdatePeerKey      = ".updatePeerKey"
+	PresharedKeys      = ".presharedKeys"
+	PresharedKeysAck   = ".presharedKeysAck"
+	SetExitNode        = ".exitNode"
 	Update             = "update."
 	Networks           = "networks."
 )
 
+// RegistrationStatus is the subject devices registered with a key that
+// requires approval use to ask for the decision.
+const RegistrationStatus = "registrationStatus"
+
+// RegisterKey prefixes the subject devices register on; the name of the
+// registration key completes it. The broker only lets the nkey of a key
+// publish on the subject of that key.
+const RegisterKey = "register."
+
+// registration results reported to devices.
+const (
+	RegistrationPending  = "registration pending approval"
+	RegistrationApproved = "registration approved"
+	RegistrationRejected = "registration rejected"
+)
+
+// NAT types reported by devices, after the mapping behaviour of RFC 5780. A
+// device behind a symmetric NAT gets a different public port for each
+// destination, so other peers cannot reach it directly and it needs a relay.
+const (
+	NatUnknown             = "unknown"
+	NatNone                = "none"
+	NatEndpointIndependent = "endpoint independent"
+	NatSymmetric           = "symmetric"
+)
+
 type MessageResponse struct {
 	IncludesError bool
 	Message       string
@@ -48,6 +83,9 @@ type User struct {
 	Password string `form:"password" json:"password"`
 	IsAdmin  bool
 	Updated  time.Time
+	Roles    map[string]string // network name to role
+	Provider string            // blank for local users
+	Identity string            // single sign-on issuer and subject linked to the user
 }
 
 type NatsUser struct {
@@ -56,17 +94,44 @@ type NatsUser struct {
 	Subscribe []string
 	Publish   []string
 }
+
+// Network is an overlay network. Net is either an IPv4 or an IPv6 (ULA) network;
+// dual-stack networks have an IPv4 Net and an IPv6 Net6. Peers of networks with
+// UsePSK get a pairwise preshared key for each of the other peers.
 type Network struct {
-	Name          string `form:"name"`
-	Net           net.IPNet
-	AddressString string `form:"addressstring"`
-	Peers         []NetworkPeer
+	Name           string `form:"name"`
+	Net            net.IPNet
+	AddressString  string `form:"addressstring"`
+	Net6           net.IPNet
+	Address6String string `form:"address6string"`
+	Peers          []NetworkPeer
+	Reservations   []Reservation
+	Excluded       []AddressRange
+	Policies       []Policy
+	UsePSK         bool `form:"usepsk"`
 }
 
+// Nets returns the networks (one per address family) of a network.
+func (n Network) Nets() []net.IPNet {
+	nets := []net.IPNet{}
+	for _, network := range []net.IPNet{n.Net, n.Net6} {
+		if network.IP != nil {
+			nets = append(nets, network)
+		}
+	}
+	return nets
+}
+
+// NetworkPeer is a peer in a network. Address is in Network.Net and Address6
+// in Network.Net6 for dual-stack networks. AutoRelayed peers were relayed by
+// the server because they could not reach the other peers directly;
+// ServerRelayed peers, for which no peer could relay, exchange their packets
+// with the other peers through the packet relay of the server.
 type NetworkPeer struct {
 	WGPublicKey        string
 	HostName           string
 	Address            net.IPNet
+	Address6           net.IPNet
 	ListenPort         int
 	PublicListenPort   int
 	Endpoint           net.IP
@@ -77,25 +142,237 @@ type NetworkPeer struct {
 	IsRelay            bool
 	RelayedPeers       []string
 	IsRelayed          bool
-	IsSubnetRouter     bool
-	Subnet             net.IPNet
-	UseNat             bool
-	UseVirtSubnet      bool
-	VirtSubnet         net.IPNet
+	AutoRelayed        bool
+	// AutoRelayChanged is when the server last relayed the peer automatically
+	// or retried its direct connections.
+	AutoRelayChanged time.Time
+	ServerRelayed    bool
+	IsSubnetRouter   bool
+	Subnets          []RouterSubnet
+	// IsExitNode peers route the internet traffic of the peers that choose
+	// them; ExitNode is the WGPublicKey of the exit node chosen by the peer.
+	IsExitNode bool
+	ExitNode   string
+	Tags       []string
+	Groups     []string
+}
+
+// RouterSubnet is a subnet advertised by a subnet router. Traffic to the subnet
+// is masqueraded when UseNat is set; with UseVirtSubnet peers reach the subnet
+// at the addresses of VirtSubnet. When several routers of a network route the
+// same subnet the server elects a primary; the others are Standby and do not
+// advertise the subnet.
+type RouterSubnet struct {
+	Subnet        net.IPNet
+	UseNat        bool
+	UseVirtSubnet bool
+	VirtSubnet    net.IPNet
+	Standby       bool
+}
+
+// Advertised returns the subnet peers route to the router: the virtual subnet
+// when one is used, the subnet otherwise.
+func (s RouterSubnet) Advertised() net.IPNet {
+	if s.UseVirtSubnet {
+		return s.VirtSubnet
+	}
+	return s.Subnet
+}
+
+// UnmarshalJSON decodes a network peer, converting the single subnet of
+// routers saved before routers advertised a list of subnets.
+func (p *NetworkPeer) UnmarshalJSON(data []byte) error {
+	type networkPeer NetworkPeer
+	peer := struct {
+		networkPeer
+		Subnet        net.IPNet
+		UseNat        bool
+		UseVirtSubnet bool
+		VirtSubnet    net.IPNet
+	}{}
+	if err := json.Unmarshal(data, &peer); err != nil {
+		return err
+	}
+	*p = NetworkPeer(peer.networkPeer)
+	if p.IsSubnetRouter && len(p.Subnets) == 0 && peer.Subnet.IP != nil {
+		p.Subnets = []RouterSubnet{{
+			Subnet:        peer.Subnet,
+			UseNat:        peer.UseNat,
+			UseVirtSubnet: peer.UseVirtSubnet,
+			VirtSubnet:    peer.VirtSubnet,
+		}}
+	}
+	return nil
+}
+
+// UsesNat reports whether any subnet routed by the peer is masqueraded.
+func (p NetworkPeer) UsesNat() bool {
+	return slices.ContainsFunc(p.Subnets, func(s RouterSubnet) bool { return s.UseNat })
+}
+
+// VirtSubnets returns the subnets routed by the peer that use a virtual subnet.
+func (p NetworkPeer) VirtSubnets() []RouterSubnet {
+	virt := []RouterSubnet{}
+	for _, subnet := range p.Subnets {
+		if subnet.UseVirtSubnet {
+			virt = append(virt, subnet)
+		}
+	}
+	return virt
+}
+
+// Addresses returns the overlay addresses (one per address family) of a peer.
+func (p NetworkPeer) Addresses() []net.IPNet {
+	addresses := []net.IPNet{}
+	for _, address := range []net.IPNet{p.Address, p.Address6} {
+		if address.IP != nil {
+			addresses = append(addresses, address)
+		}
+	}
+	return addresses
+}
+
+// ReplacePeerKey replaces the WireGuard public key of a peer in the network
+// peers, relayed peers, exit nodes, policies and reservations. It reports
+// whether the network contained the old key.
+func (n *Network) ReplacePeerKey(oldKey, newKey string) bool {
+	found := false
+	for i, peer := range n.Peers {
+		if peer.WGPublicKey == oldKey {
+			n.Peers[i].WGPublicKey = newKey
+			found = true
+		}
+		for j, relayed := range peer.RelayedPeers {
+			if relayed == oldKey {
+				n.Peers[i].RelayedPeers[j] = newKey
+			}
+		}
+		if peer.ExitNode == oldKey {
+			n.Peers[i].ExitNode = newKey
+		}
+	}
+	for i, policy := range n.Policies {
+		if policy.Source == oldKey {
+			n.Policies[i].Source = newKey
+		}
+		if policy.Destination == oldKey {
+			n.Policies[i].Destination = newKey
+		}
+	}
+	for i, reservation := range n.Reservations {
+		if reservation.WGPublicKey == oldKey {
+			n.Reservations[i].WGPublicKey = newKey
+			found = true
+		}
+	}
+	return found
+}
+
+// Reservation pins an address of a network to a peer, whether or not the peer
+// has joined the network.
+type Reservation struct {
+	WGPublicKey string
+	Address     net.IP
+	Description string
+}
+
+// AddressRange is an inclusive range of network addresses that are never
+// assigned to peers.
+type AddressRange struct {
+	Start       net.IP
+	End         net.IP
+	Description string
 }
 
+// Contains reports whether ip is in the range.
+func (r AddressRange) Contains(ip net.IP) bool {
+	return bytes.Compare(ip.To16(), r.Start.To16()) >= 0 && bytes.Compare(ip.To16(), r.End.To16()) <= 0
+}
+
+// Key is a registration key. Peers registering with the key get its Tags
+// and Groups.
 type Key struct {
 	Name    string `form:"name"`
 	Value   string
 	Usage   int `form:"usage"`
 	Expires time.Time
 	DispExp string `form:"expires"`
+	Tags    []string
+	Groups  []string
+	// Networks are joined automatically by devices registered with the key.
+	Networks []string
+	// Relay is a group whose members a registered device relays in each of
+	// the key networks.
+	Relay string
+	// Router is a subnet a registered device routes in each of the key
+	// networks, masqueraded when RouterNat is set.
+	Router    string
+	RouterNat bool
+	// Approval holds devices registered with the key until an admin approves
+	// them.
+	Approval bool
+	// Creator is the user that created the key; only the creator and admins
+	// see its value.
+	Creator string
+}
+
+// PendingPeer is a device registered with a key that requires approval. The
+// device has no access to the broker until it is approved.
+type PendingPeer struct {
+	Peer
+
+	Key       Key
+	Requested time.Time
+	Rejected  bool
+}
+
+// RegistrationStatusRequest asks for the approval decision of a device.
+type RegistrationStatusRequest struct {
+	WGPublicKey string
+}
+
+// Group is a named set of peers; peers list the groups they belong to.
+type Group struct {
+	Name        string `form:"name"`
+	Description string `form:"description"`
+}
+
+// Token is a long-lived bearer token for non-interactive access to the server.
+// Only a hash of the token secret is stored.
+type Token struct {
+	ID       string
+	Name     string `form:"name"`
+	Owner    string
+	Scope    string `form:"scope"`
+	Hash     string
+	Created  time.Time
+	Expires  time.Time
+	LastUsed time.Time
 }
 
+// AuditEvent records a change made by a user, agent or the server itself.
+// Before and After hold the affected object, if any, as json.
+type AuditEvent struct {
+	ID     uint64
+	Time   time.Time
+	Actor  string
+	Action string
+	Target string
+	Before json.RawMessage `json:",omitempty"`
+	After  json.RawMessage `json:",omitempty"`
+}
+
+// KeyValue is the content of a registration token. Stun is the address of the
+// STUN server embedded in the server and Relay the url of its packet relay,
+// blank when they are disabled. Servers are the fqdns of the other servers of
+// a cluster.
 type KeyValue struct {
 	URL     string
 	Seed    string
 	KeyName string
+	Stun    string   `json:",omitempty"`
+	Relay   string   `json:",omitempty"`
+	Servers []string `json:",omitempty"`
 }
 
 type Peer struct {
@@ -107,6 +384,15 @@ type Peer struct {
 	Endpoint      net.IP
 	Updated       time.Time
 	NatsConnected bool
+	NatType       string
+	Tags          []string
+	Groups        []string
+}
+
+// NeedsRelay reports whether the peer is behind a NAT that other peers cannot
+// traverse.
+func (p Peer) NeedsRelay() bool {
+	return p.NatType == NatSymmetric
 }
 
 type ServerRegisterRequest struct {
@@ -145,9 +431,20 @@ type VersionResponse struct {
 	Agent  string
 }
 
+// NetworkUpdate is published to the peers of a network. OldKey is the
+// previous WireGuard public key of Peer for UpdatePeerKey.
 type NetworkUpdate struct {
-	Action string
-	Peer   NetworkPeer
+	Action   string
+	Peer     NetworkPeer
+	Policies []Policy
+	OldKey   string
+}
+
+// RotateKeysRequest is sent by a device, on the subject of its current key, to
+// replace its WireGuard public key and nkey.
+type RotateKeysRequest struct {
+	WGPublicKey string
+	PubNkey     string
 }
 
 type DeviceUpdate struct {
@@ -177,10 +474,27 @@ type CheckinData struct {
 	ListenPort       int
 	PublicListenPort int
 	Endpoint         net.IP
+	NatType          string
 	PrivateEndpoints []PrivateEndpoint
 	Connections      []ConnectivityData
 }
 
+// PresharedKeyUpdate holds the preshared keys of a peer in a network, indexed
+// by the WGPublicKey of the other peer. It is only sent on the update.<id>
+// subjects of the peer, never on the network subject. Pending keys replace
+// Keys once both peers of a pair acknowledged them; peers acknowledge by
+// sending the update back on their presharedKeysAck subject.
+type PresharedKeyUpdate struct {
+	Network string
+	Keys    map[string]string
+	Pending map[string]string
+}
+
+type PresharedKeyResponse struct {
+	Message  string
+	Networks []PresharedKeyUpdate
+}
+
 type PingResponse struct {
 	Message string
 }
@@ -204,6 +518,13 @@ type PrivateEndpoint struct {
 	Network string
 }
 
+// ExitNodeRequest chooses, by name or WGPublicKey, the exit node routing the
+// internet traffic of a device. A blank ExitNode stops using an exit node.
+type ExitNodeRequest struct {
+	Network  string
+	ExitNode string
+}
+
 func DecodeToken(token string) (KeyValue, error) {
 	kv := KeyValue{}
 	data, err := base64.StdEncoding.DecodeString(token)
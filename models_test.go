@@ -4,6 +4,7 @@ import (
 	"encoding/base64"
 	"encoding/json"
 	"errors"
+	"net"
 	"testing"
 
 	"github.com/Kairum-Labs/should"
@@ -34,3 +35,73 @@ func TestDecodeToken(t *testing.T) {
 		should.BeEqual(t, keyValue, value)
 	})
 }
+
+func TestNets(t *testing.T) {
+	_, v4, _ := net.ParseCIDR("10.10.10.0/24")
+	_, v6, _ := net.ParseCIDR("fd00:10::/64")
+	should.BeEqual(t, len(Network{}.Nets()), 0)
+	should.BeEqual(t, Network{Net: *v6}.Nets(), []net.IPNet{*v6})
+	should.BeEqual(t, Network{Net: *v4, Net6: *v6}.Nets(), []net.IPNet{*v4, *v6})
+	peer := NetworkPeer{Address: net.IPNet{IP: net.ParseIP("10.10.10.1"), Mask: v4.Mask}}
+	should.BeEqual(t, len(peer.Addresses()), 1)
+	peer.Address6 = net.IPNet{IP: net.ParseIP("fd00:10::1"), Mask: v6.Mask}
+	should.BeEqual(t, peer.Addresses()[1].IP.String(), "fd00:10::1")
+}
+
+func TestRouterSubnets(t *testing.T) {
+	// routers saved before subnet lists route their single subnet.
+	legacy := `{"WGPublicKey":"router","IsSubnetRouter":true,"Subnet":{"IP":"192.168.1.0","Mask":"////AA=="},` +
+		`"UseVirtSubnet":true,"VirtSubnet":{"IP":"10.50.1.0","Mask":"////AA=="}}`
+	peer := NetworkPeer{}
+	should.NotBeError(t, json.Unmarshal([]byte(legacy), &peer))
+	should.BeEqual(t, peer.WGPublicKey, "router")
+	should.BeEqual(t, len(peer.Subnets), 1)
+	should.BeEqual(t, peer.Subnets[0].Subnet.String(), "192.168.1.0/24")
+	advertised := peer.Subnets[0].Advertised()
+	should.BeEqual(t, advertised.String(), "10.50.1.0/24")
+	should.BeFalse(t, peer.UsesNat())
+	should.BeEqual(t, len(peer.VirtSubnets()), 1)
+	_, lan, _ := net.ParseCIDR("192.168.2.0/24")
+	peer.Subnets = append(peer.Subnets, RouterSubnet{Subnet: *lan, UseNat: true})
+	data, err := json.Marshal(peer)
+	should.NotBeError(t, err)
+	decoded := NetworkPeer{}
+	should.NotBeError(t, json.Unmarshal(data, &decoded))
+	should.BeEqual(t, len(decoded.Subnets), 2)
+	should.BeTrue(t, decoded.UsesNat())
+	advertised = decoded.Subnets[1].Advertised()
+	should.BeEqual(t, advertised.String(), "192.168.2.0/24")
+}
+
+func TestAddressRangeContains(t *testing.T) {
+	r := AddressRange{Start: net.ParseIP("10.10.10.10"), End: net.ParseIP("10.10.10.20")}
+	should.BeTrue(t, r.Contains(net.ParseIP("10.10.10.10")))
+	should.BeTrue(t, r.Contains(net.ParseIP("10.10.10.20").To4()))
+	should.BeFalse(t, r.Contains(net.ParseIP("10.10.10.21")))
+	should.BeFalse(t, r.Contains(net.ParseIP("fd00::10")))
+}
+
+func TestReplacePeerKey(t *testing.T) {
+	network := Network{
+		Peers: []NetworkPeer{
+			{WGPublicKey: "old"},
+			{WGPublicKey: "relay", IsRelay: true, RelayedPeers: []string{"other", "old"}},
+			{WGPublicKey: "client", ExitNode: "old"},
+		},
+		Policies: []Policy{
+			{Name: "from", Source: "old", Destination: PolicyAny},
+			{Name: "to", Source: "tag:web", Destination: "old"},
+		},
+		Reservations: []Reservation{{WGPublicKey: "old"}, {WGPublicKey: "other"}},
+	}
+	should.BeTrue(t, network.ReplacePeerKey("old", "new"))
+	should.BeEqual(t, network.Peers[0].WGPublicKey, "new")
+	should.BeEqual(t, network.Peers[1].RelayedPeers, []string{"other", "new"})
+	should.BeEqual(t, network.Peers[2].ExitNode, "new")
+	should.BeEqual(t, network.Peers[1].ExitNode, "")
+	should.BeEqual(t, network.Policies[0].Source, "new")
+	should.BeEqual(t, network.Policies[1].Source, "tag:web")
+	should.BeEqual(t, network.Policies[1].Destination, "new")
+	should.BeEqual(t, network.Reservations[1].WGPublicKey, "other")
+	should.BeFalse(t, network.ReplacePeerKey("missing", "new"))
+}
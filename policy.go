@@ -0,0 +1,90 @@
+package plexus
+
+import (
+	"errors"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// policy selectors and protocols.
+const (
+	PolicyAny   = "*"
+	PolicyTag   = "tag:"
+	PolicyGroup = "group:"
+	ProtoAny    = "any"
+	ProtoTCP    = "tcp"
+	ProtoUDP    = "udp"
+	ProtoICMP   = "icmp"
+)
+
+// Policy allows traffic from Source to Destination in a network. Source is a
+// peer (WGPublicKey), a tag ("tag:web"), a group ("group:servers") or PolicyAny;
+// Destination is any of those or a subnet (CIDR) behind a subnet router. Ports, a comma separated list of
+// ports and port ranges (eg. "22,8000-8080"), only apply to tcp and udp.
+// A network without policies allows all traffic; once a network has a policy,
+// traffic that does not match one is dropped.
+type Policy struct {
+	Name        string `form:"name"`
+	Source      string `form:"source"`
+	Destination string `form:"destination"`
+	Protocol    string `form:"protocol"`
+	Ports       string `form:"ports"`
+}
+
+// Selects reports whether a policy selector (PolicyAny, a WGPublicKey, a tag
+// or a group) matches the peer.
+func (p NetworkPeer) Selects(selector string) bool {
+	switch {
+	case selector == PolicyAny:
+		return true
+	case strings.HasPrefix(selector, PolicyTag):
+		return slices.Contains(p.Tags, strings.TrimPrefix(selector, PolicyTag))
+	case strings.HasPrefix(selector, PolicyGroup):
+		return slices.Contains(p.Groups, strings.TrimPrefix(selector, PolicyGroup))
+	default:
+		return p.WGPublicKey == selector
+	}
+}
+
+// PortRange is an inclusive range of ports.
+type PortRange struct {
+	First uint16
+	Last  uint16
+}
+
+// ParsePorts parses a comma separated list of ports and port ranges.
+// An empty list (all ports) returns nil.
+func ParsePorts(ports string) ([]PortRange, error) {
+	var ranges []PortRange
+	if strings.TrimSpace(ports) == "" {
+		return ranges, nil
+	}
+	for field := range strings.SplitSeq(ports, ",") {
+		first, last, found := strings.Cut(strings.TrimSpace(field), "-")
+		start, err := parsePort(first)
+		if err != nil {
+			return nil, err
+		}
+		end := start
+		if found {
+			end, err = parsePort(last)
+			if err != nil {
+				return nil, err
+			}
+		}
+		if end < start {
+			return nil, errors.New("invalid port range " + field)
+		}
+		ranges = append(ranges, PortRange{First: start, Last: end})
+	}
+	return ranges, nil
+}
+
+func parsePort(port string) (uint16, error) {
+	value, err := strconv.ParseUint(strings.TrimSpace(port), 10, 16)
+	if err != nil || value == 0 {
+		return 0, errors.New("invalid port " + port)
+	}
+	return uint16(value), nil
+}
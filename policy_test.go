@@ -0,0 +1,36 @@
+package plexus
+
+import (
+	"testing"
+
+	"github.com/Kairum-Labs/should"
+)
+
+func TestParsePorts(t *testing.T) {
+	ports, err := ParsePorts("")
+	should.NotBeError(t, err)
+	should.BeNil(t, ports)
+	ports, err = ParsePorts("22, 8000-8080")
+	should.NotBeError(t, err)
+	should.BeEqual(t, ports, []PortRange{{First: 22, Last: 22}, {First: 8000, Last: 8080}})
+	for _, invalid := range []string{"0", "65536", "ssh", "80-22", "22,"} {
+		_, err := ParsePorts(invalid)
+		should.BeError(t, err)
+	}
+}
+
+func TestSelects(t *testing.T) {
+	peer := NetworkPeer{WGPublicKey: "key", Tags: []string{"web"}, Groups: []string{"servers"}}
+	for selector, selected := range map[string]bool{
+		PolicyAny:       true,
+		"key":           true,
+		"other":         false,
+		"tag:web":       true,
+		"tag:db":        false,
+		"group:servers": true,
+		"group:laptops": false,
+		"web":           false,
+	} {
+		should.BeEqual(t, peer.Selects(selector), selected)
+	}
+}
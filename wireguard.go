@@ -3,6 +3,10 @@ package plexus
 import (
 	"fmt"
 	"log/slog"
+	"net"
+	"os"
+	"slices"
+	"syscall"
 
 	"github.com/vishvananda/netlink"
 	"github.com/vishvananda/netlink/nl"
@@ -10,12 +14,28 @@ import (
 	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
 )
 
+// Internet traffic routed through an exit node uses the ExitTable routing
+// table. The tunnel traffic of plexus interfaces carries FirewallMark so it is
+// not routed back into the tunnel.
+const (
+	ExitTable    = 51820
+	FirewallMark = 51820
+)
+
+// priorities of the exit routing rules; the suppress rule keeps the more
+// specific routes of the main table, such as the local lan, in use.
+const (
+	suppressRulePriority = 5209
+	exitRulePriority     = 5210
+)
+
 // Wireguard is a netlink compatible representation of Wireguard interface.
+// Addresses holds one address per family (IPv4 and/or IPv6).
 type Wireguard struct {
-	Name    string
-	MTU     int
-	Address netlink.Addr
-	Config  wgtypes.Config
+	Name      string
+	MTU       int
+	Addresses []netlink.Addr
+	Config    wgtypes.Config
 }
 
 // Attrs satisfies netlink Link interface.
@@ -42,6 +62,8 @@ func (wg *Wireguard) Apply() error {
 		return fmt.Errorf("wgtcl.New %w", err)
 	}
 	defer wgClient.Close()
+	mark := FirewallMark
+	wg.Config.FirewallMark = &mark
 	if err := wgClient.ConfigureDevice(wg.Name, wg.Config); err != nil {
 		return fmt.Errorf("wireguard configure device, %w", err)
 	}
@@ -49,20 +71,15 @@ func (wg *Wireguard) Apply() error {
 	if err != nil {
 		return fmt.Errorf("get link %w", err)
 	}
-	newRoute := netlink.Route{
-		LinkIndex: link.Attrs().Index,
-		Scope:     netlink.SCOPE_LINK,
-		Src:       wg.Address.IP,
-		Protocol:  2,
-	}
-	routes, err := netlink.RouteList(link, netlink.FAMILY_V4)
+	routes, err := netlink.RouteList(link, netlink.FAMILY_ALL)
 	if err != nil {
 		return fmt.Errorf("get routes %w", err)
 	}
 	for _, route := range routes {
-		slog.Debug("checking route", "route", route.Dst, "network address", wg.Address.IPNet)
-		if route.Dst.Contains(wg.Address.IP) {
-			// don't delete default route for the plexus network.
+		slog.Debug("checking route", "route", route.Dst, "addresses", wg.Addresses)
+		if route.Dst == nil || route.Dst.IP.IsLinkLocalUnicast() || route.Dst.IP.IsMulticast() ||
+			wg.interfaceRoute(route.Dst) {
+			// don't delete default routes for the plexus network.
 			slog.Debug("skipping")
 			continue
 		}
@@ -72,18 +89,163 @@ func (wg *Wireguard) Apply() error {
 			slog.Error("delete route", "destination", route.Dst, "error", err)
 		}
 	}
+	exitRoutes := []net.IPNet{}
 	for _, peer := range wg.Config.Peers {
 		for _, allowed := range peer.AllowedIPs {
-			if wg.Address.Contains(allowed.IP) {
+			if wg.onLink(allowed.IP) {
+				continue
+			}
+			if ones, _ := allowed.Mask.Size(); ones == 0 {
+				exitRoutes = append(exitRoutes, allowed)
 				continue
 			}
-			newRoute.Dst = &allowed
+			src := wg.source(allowed.IP)
+			if src == nil {
+				slog.Warn("no address for route family", "destination", allowed)
+				continue
+			}
+			newRoute := netlink.Route{
+				LinkIndex: link.Attrs().Index,
+				Scope:     netlink.SCOPE_LINK,
+				Src:       src,
+				Dst:       &allowed,
+				Protocol:  2,
+			}
 			slog.Info("adding route", "route", newRoute)
 			if err := netlink.RouteAdd(&newRoute); err != nil {
 				slog.Error("add route", "destination", newRoute.Dst, "error", err)
 			}
 		}
 	}
+	return wg.applyExitRoutes(link, exitRoutes)
+}
+
+// applyExitRoutes sets the default routes of the interface in the exit table
+// and updates the exit routing rules.
+func (wg *Wireguard) applyExitRoutes(link netlink.Link, exitRoutes []net.IPNet) error {
+	existing, err := netlink.RouteListFiltered(netlink.FAMILY_ALL,
+		&netlink.Route{LinkIndex: link.Attrs().Index, Table: ExitTable},
+		netlink.RT_FILTER_OIF|netlink.RT_FILTER_TABLE)
+	if err != nil {
+		return fmt.Errorf("get exit routes %w", err)
+	}
+	for _, route := range existing {
+		if slices.ContainsFunc(exitRoutes, func(dst net.IPNet) bool {
+			return (dst.IP.To4() != nil) == (route.Family == netlink.FAMILY_V4)
+		}) {
+			continue
+		}
+		slog.Info("deleting exit route", "interface", wg.Name, "destination", route.Dst)
+		if err := netlink.RouteDel(&route); err != nil {
+			slog.Error("delete exit route", "destination", route.Dst, "error", err)
+		}
+	}
+	for _, dst := range exitRoutes {
+		src := wg.source(dst.IP)
+		if src == nil {
+			slog.Warn("no address for exit route family", "destination", dst)
+			continue
+		}
+		route := netlink.Route{
+			LinkIndex: link.Attrs().Index,
+			Scope:     netlink.SCOPE_LINK,
+			Src:       src,
+			Dst:       &dst,
+			Table:     ExitTable,
+			Protocol:  2,
+		}
+		slog.Info("adding exit route", "route", route)
+		if err := netlink.RouteReplace(&route); err != nil {
+			return fmt.Errorf("add exit route %w", err)
+		}
+	}
+	return updateExitRules()
+}
+
+// exitRules returns the rules routing traffic without FirewallMark through the
+// exit table.
+func exitRules(family int) []*netlink.Rule {
+	suppress := netlink.NewRule()
+	suppress.Family = family
+	suppress.Table = syscall.RT_TABLE_MAIN
+	suppress.SuppressPrefixlen = 0
+	suppress.Priority = suppressRulePriority
+	exit := netlink.NewRule()
+	exit.Family = family
+	exit.Table = ExitTable
+	exit.Mark = FirewallMark
+	exit.Invert = true
+	exit.Priority = exitRulePriority
+	return []*netlink.Rule{suppress, exit}
+}
+
+// updateExitRules adds the exit rules of the address families with routes in
+// the exit table and removes those of the others.
+func updateExitRules() error {
+	for _, family := range []int{netlink.FAMILY_V4, netlink.FAMILY_V6} {
+		routes, err := netlink.RouteListFiltered(family, &netlink.Route{Table: ExitTable}, netlink.RT_FILTER_TABLE)
+		if err != nil {
+			return fmt.Errorf("get exit routes %w", err)
+		}
+		existing, err := netlink.RuleList(family)
+		if err != nil {
+			return fmt.Errorf("get rules %w", err)
+		}
+		for _, rule := range exitRules(family) {
+			found := slices.ContainsFunc(existing, func(r netlink.Rule) bool {
+				return r.Priority == rule.Priority && r.Table == rule.Table
+			})
+			switch {
+			case len(routes) > 0 && !found:
+				slog.Info("adding exit rule", "rule", rule)
+				if err := netlink.RuleAdd(rule); err != nil {
+					return fmt.Errorf("add exit rule %w", err)
+				}
+			case len(routes) == 0 && found:
+				slog.Info("deleting exit rule", "rule", rule)
+				if err := netlink.RuleDel(rule); err != nil {
+					return fmt.Errorf("delete exit rule %w", err)
+				}
+			}
+		}
+		if len(routes) > 0 && family == netlink.FAMILY_V4 {
+			// replies to marked traffic must pass reverse path filtering.
+			if err := os.WriteFile("/proc/sys/net/ipv4/conf/all/src_valid_mark", []byte("1"), 0o644); err != nil {
+				slog.Warn("set src_valid_mark", "error", err)
+			}
+		}
+	}
+	return nil
+}
+
+// interfaceRoute reports whether dst is the route to the network of an interface address.
+func (wg *Wireguard) interfaceRoute(dst *net.IPNet) bool {
+	for _, address := range wg.Addresses {
+		if address.IPNet != nil && dst.Contains(address.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// onLink reports whether ip is within the network of an interface address.
+func (wg *Wireguard) onLink(ip net.IP) bool {
+	for _, address := range wg.Addresses {
+		if address.IPNet != nil && address.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// source returns the interface address of the same family as ip.
+func (wg *Wireguard) source(ip net.IP) net.IP {
+	v4 := ip.To4() != nil
+	for _, address := range wg.Addresses {
+		if address.IPNet != nil && (address.IP.To4() != nil) == v4 {
+			return address.IP
+		}
+	}
 	return nil
 }
 
@@ -92,8 +254,10 @@ func (wg *Wireguard) Up() error {
 	if err := netlink.LinkAdd(wg); err != nil {
 		return fmt.Errorf("link add %w", err)
 	}
-	if err := netlink.AddrAdd(wg, &wg.Address); err != nil {
-		return fmt.Errorf("add address %w", err)
+	for _, address := range wg.Addresses {
+		if err := netlink.AddrAdd(wg, &address); err != nil {
+			return fmt.Errorf("add address %w", err)
+		}
 	}
 	if err := netlink.LinkSetUp(wg); err != nil {
 		return fmt.Errorf("link up %w", err)
@@ -107,16 +271,20 @@ func (wg *Wireguard) Down() error {
 	if err != nil {
 		return err
 	}
-	return netlink.LinkDel(link)
+	if err := netlink.LinkDel(link); err != nil {
+		return err
+	}
+	// the exit routes of the interface were removed with it.
+	return updateExitRules()
 }
 
 // New returns a new wireguard interface.
-func New(name string, mtu int, address netlink.Addr, config wgtypes.Config) *Wireguard {
+func New(name string, mtu int, addresses []netlink.Addr, config wgtypes.Config) *Wireguard {
 	wg := &Wireguard{
-		Name:    name,
-		MTU:     mtu,
-		Address: address,
-		Config:  config,
+		Name:      name,
+		MTU:       mtu,
+		Addresses: addresses,
+		Config:    config,
 	}
 	slog.Debug("new wireguard interface", "wg", wg)
 	return wg
@@ -141,14 +309,21 @@ func Get(name string) (*Wireguard, error) {
 	if err != nil {
 		return nil, err
 	}
-	addrs, err := netlink.AddrList(link, nl.FAMILY_V4)
+	addrs, err := netlink.AddrList(link, nl.FAMILY_ALL)
 	if err != nil {
 		return nil, err
 	}
+	addresses := []netlink.Addr{}
+	for _, addr := range addrs {
+		if addr.IP.IsLinkLocalUnicast() {
+			continue
+		}
+		addresses = append(addresses, addr)
+	}
 	wg := &Wireguard{
-		Name:    name,
-		MTU:     link.Attrs().MTU,
-		Address: addrs[0],
+		Name:      name,
+		MTU:       link.Attrs().MTU,
+		Addresses: addresses,
 		Config: wgtypes.Config{
 			PrivateKey: &device.PrivateKey,
 			ListenPort: &device.ListenPort,
@@ -163,6 +338,7 @@ func convertPeers(input []wgtypes.Peer) []wgtypes.PeerConfig {
 	for _, peer := range input {
 		newpeer := wgtypes.PeerConfig{
 			PublicKey:                   peer.PublicKey,
+			PresharedKey:                &peer.PresharedKey,
 			Endpoint:                    peer.Endpoint,
 			PersistentKeepaliveInterval: &peer.PersistentKeepaliveInterval,
 			ReplaceAllowedIPs:           true,
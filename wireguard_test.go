@@ -68,10 +68,18 @@ func TestNew(t *testing.T) {
 			},
 		},
 	}
-	address := netlink.Addr{
-		IPNet: &net.IPNet{
-			IP:   net.ParseIP("10.100.10.1"),
-			Mask: net.CIDRMask(24, 32),
+	addresses := []netlink.Addr{
+		{
+			IPNet: &net.IPNet{
+				IP:   net.ParseIP("10.100.10.1"),
+				Mask: net.CIDRMask(24, 32),
+			},
+		},
+		{
+			IPNet: &net.IPNet{
+				IP:   net.ParseIP("fd00:100:10::1"),
+				Mask: net.CIDRMask(64, 128),
+			},
 		},
 	}
 	newPeer := wgtypes.PeerConfig{
@@ -93,7 +101,7 @@ func TestNew(t *testing.T) {
 		},
 	}
 	t.Run("new", func(t *testing.T) {
-		wg := New("wgtest", 1420, address, config)
+		wg := New("wgtest", 1420, addresses, config)
 		should.BeEqual(t, wg.Attrs().Name, "wgtest")
 		should.BeEqual(t, wg.Attrs().MTU, 1420)
 		should.BeEqual(t, len(wg.Config.Peers), 2)